@@ -0,0 +1,407 @@
+// Package archivefs serves the contents of a tar or zip archive as a
+// read-only tree.
+//
+// Entries of uncompressed archives are read directly from the archive
+// file, the entries of compressed archives are decompressed on demand
+// and the chunks read are kept in a cache.
+package archivefs
+
+import (
+	"9fans.net/go/plan9"
+	"amoraes.info/ded/vfs"
+	"amoraes.info/ded/vfs/filetree"
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	Archivefs struct {
+		filetree.FS
+		file  *os.File
+		cache *chunkCache
+	}
+
+	// entry is a file or directory of the archive
+	entry struct {
+		name  string
+		isdir bool
+		mode  os.FileMode
+		mtime time.Time
+		size  int64
+
+		// section reads the contents from the archive file, it is
+		// nil when the contents are compressed
+		section *io.SectionReader
+		// open returns the contents from the start
+		open func() (io.ReadCloser, error)
+		// mu serializes the decompression of the contents
+		mu sync.Mutex
+	}
+
+	entryContent struct {
+		e     *entry
+		cache *chunkCache
+	}
+
+	entryFd struct {
+		c   *entryContent
+		cur int64
+	}
+
+	// counter counts the bytes read from r
+	counter struct {
+		r io.Reader
+		n int64
+	}
+)
+
+const (
+	// cacheChunks is the number of chunks kept by the cache
+	cacheChunks = 256
+)
+
+var (
+	ErrUnknownFormat = errors.New("unknown archive format")
+)
+
+// Open indexes the archive at name, the format is detected by the
+// extension: .zip, .tar, .tar.gz or .tgz.
+func Open(name string) (*Archivefs, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	var entries []*entry
+	lower := strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(lower, ".zip"):
+		entries, err = zipEntries(file)
+	case strings.HasSuffix(lower, ".tar"):
+		entries, err = tarEntries(file)
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		entries, err = tgzEntries(file)
+	default:
+		err = ErrUnknownFormat
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	fs := &Archivefs{
+		file:  file,
+		cache: newChunkCache(cacheChunks),
+	}
+	fs.Root = vfs.NewDir("")
+	fs.Root.SetMtime(uint32(info.ModTime().Unix()))
+	for _, e := range entries {
+		fs.add(e, info.ModTime())
+	}
+	return fs, nil
+}
+
+// Close closes the archive file
+func (fs *Archivefs) Close() error {
+	fs.cache.close()
+	return fs.file.Close()
+}
+
+// cleanName returns the path of an entry relative to the root,
+// or "" if the entry is outside of the root.
+func cleanName(name string) string {
+	name = path.Clean("/" + strings.TrimPrefix(name, "./"))
+	return strings.TrimPrefix(name, "/")
+}
+
+// add adds e to the tree, the parent directories missing in the
+// archive are created with mtime.
+func (fs *Archivefs) add(e *entry, mtime time.Time) {
+	name := cleanName(e.name)
+	if name == "" {
+		return
+	}
+	dir := fs.Root
+	parts := strings.Split(name, "/")
+	for _, p := range parts[:len(parts)-1] {
+		next := dir.Walk(p)
+		if next == nil {
+			next = vfs.NewDir(p)
+			next.SetMtime(uint32(mtime.Unix()))
+			dir.Add(next)
+		}
+		if !next.IsDir() {
+			// a file and a directory with the same name, keep the file
+			return
+		}
+		dir = next
+	}
+	base := parts[len(parts)-1]
+	f := dir.Walk(base)
+	switch {
+	case f != nil && f.IsDir() && e.isdir:
+		// the entry of a directory created by a previous entry
+	case f != nil:
+		// duplicated entries, the first one wins
+		return
+	case e.isdir:
+		f = vfs.NewDir(base)
+		dir.Add(f)
+	default:
+		f = vfs.NewFile(base, &entryContent{e: e, cache: fs.cache})
+		dir.Add(f)
+	}
+	f.Mode = plan9.Perm(e.mode.Perm() &^ 0222)
+	if e.isdir {
+		f.Mode |= plan9.DMDIR
+	}
+	f.SetMtime(uint32(e.mtime.Unix()))
+}
+
+func zipEntries(file *os.File) ([]*entry, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	r, err := zip.NewReader(file, info.Size())
+	if err != nil {
+		return nil, err
+	}
+	var entries []*entry
+	for _, zf := range r.File {
+		zf := zf
+		e := &entry{
+			name:  zf.Name,
+			isdir: zf.FileInfo().IsDir(),
+			mode:  zf.Mode(),
+			mtime: zf.Modified,
+			size:  int64(zf.UncompressedSize64),
+			open: func() (io.ReadCloser, error) {
+				return zf.Open()
+			},
+		}
+		if zf.Method == zip.Store {
+			off, err := zf.DataOffset()
+			if err != nil {
+				return nil, err
+			}
+			e.section = io.NewSectionReader(file, off, e.size)
+		}
+		if e.isdir || e.mode.IsRegular() {
+			entries = append(entries, e)
+		}
+	}
+	return entries, nil
+}
+
+func (c *counter) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.n += int64(n)
+	return n, err
+}
+
+// tarEntry returns the entry of hdr, it is nil for entries that
+// aren't files or directories
+func tarEntry(hdr *tar.Header) *entry {
+	switch hdr.Typeflag {
+	case tar.TypeReg, tar.TypeRegA, tar.TypeDir:
+	default:
+		return nil
+	}
+	return &entry{
+		name:  hdr.Name,
+		isdir: hdr.Typeflag == tar.TypeDir,
+		mode:  hdr.FileInfo().Mode(),
+		mtime: hdr.ModTime,
+		size:  hdr.Size,
+	}
+}
+
+func tarEntries(file *os.File) ([]*entry, error) {
+	c := &counter{r: file}
+	tr := tar.NewReader(c)
+	var entries []*entry
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if e := tarEntry(hdr); e != nil {
+			// the data of the entry starts after the header
+			e.section = io.NewSectionReader(file, c.n, e.size)
+			section := e.section
+			e.open = func() (io.ReadCloser, error) {
+				return readCloser{io.NewSectionReader(section, 0, section.Size())}, nil
+			}
+			entries = append(entries, e)
+		}
+	}
+	return entries, nil
+}
+
+func tgzEntries(file *os.File) ([]*entry, error) {
+	zr, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(zr)
+	var entries []*entry
+	for i := 0; ; i++ {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if e := tarEntry(hdr); e != nil {
+			index := i
+			e.open = func() (io.ReadCloser, error) {
+				return openTgzEntry(file, index)
+			}
+			entries = append(entries, e)
+		}
+	}
+	return entries, nil
+}
+
+// openTgzEntry decompresses file until the entry index
+func openTgzEntry(file *os.File, index int) (io.ReadCloser, error) {
+	zr, err := gzip.NewReader(io.NewSectionReader(file, 0, 1<<62))
+	if err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(zr)
+	for i := 0; i <= index; i++ {
+		if _, err := tr.Next(); err != nil {
+			zr.Close()
+			return nil, err
+		}
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{tr, zr}, nil
+}
+
+type readCloser struct {
+	io.Reader
+}
+
+func (readCloser) Close() error {
+	return nil
+}
+
+func (c *entryContent) Open(mode int, perm int) (vfs.FileContents, error) {
+	return &entryFd{c: c}, nil
+}
+
+func (c *entryContent) Size() (uint64, error) {
+	return uint64(c.e.size), nil
+}
+
+func (c *entryContent) Close() error {
+	return nil
+}
+
+// readAt copies the contents of the entry starting at off to b
+func (c *entryContent) readAt(b []byte, off int64) (int, error) {
+	if off >= c.e.size {
+		return 0, io.EOF
+	}
+	if max := c.e.size - off; int64(len(b)) > max {
+		b = b[:max]
+	}
+	if c.e.section != nil {
+		n, err := c.e.section.ReadAt(b, off)
+		if n > 0 && err == io.EOF {
+			err = nil
+		}
+		return n, err
+	}
+	n := 0
+	for n < len(b) {
+		data, err := c.cache.get(c.e, (off+int64(n))/chunkSize)
+		if err != nil {
+			if n > 0 && err == io.EOF {
+				break
+			}
+			return n, err
+		}
+		start := (off + int64(n)) % chunkSize
+		if start >= int64(len(data)) {
+			break
+		}
+		n += copy(b[n:], data[start:])
+	}
+	return n, nil
+}
+
+func (fd *entryFd) Read(b []byte) (int, error) {
+	n, err := fd.c.readAt(b, fd.cur)
+	fd.cur += int64(n)
+	return n, err
+}
+
+func (fd *entryFd) Write(b []byte) (int, error) {
+	return 0, vfs.ErrReadOnly
+}
+
+func (fd *entryFd) Seek(off int64, sp vfs.SeekPoint) (int64, error) {
+	cur := fd.cur
+	switch sp {
+	case vfs.SeekStart:
+		cur = off
+	case vfs.SeekCurrent:
+		cur += off
+	case vfs.SeekEnd:
+		cur = fd.c.e.size - off
+	}
+	if cur < 0 {
+		return fd.cur, vfs.ErrSeek
+	}
+	fd.cur = cur
+	return cur, nil
+}
+
+func (fd *entryFd) Sync() error {
+	return nil
+}
+
+func (fd *entryFd) Close() error {
+	return nil
+}
+
+func (fs *Archivefs) Create(fc *plan9.Fcall, ctx *vfs.Context) *plan9.Fcall {
+	ret := *fc
+	ret.Type++
+	return vfs.PackError(&ret, vfs.ErrReadOnly)
+}
+
+// Remove clunks the fid, archives can't be changed
+func (fs *Archivefs) Remove(fc *plan9.Fcall, ctx *vfs.Context) *plan9.Fcall {
+	ret := *fc
+	ret.Type++
+	fs.FS.Clunk(fc, ctx)
+	return vfs.PackError(&ret, vfs.ErrReadOnly)
+}
+
+func (fs *Archivefs) Wstat(fc *plan9.Fcall, ctx *vfs.Context) *plan9.Fcall {
+	ret := *fc
+	ret.Type++
+	return vfs.PackError(&ret, vfs.ErrReadOnly)
+}
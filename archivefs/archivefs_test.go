@@ -0,0 +1,242 @@
+package archivefs
+
+import (
+	"9fans.net/go/plan9"
+	"amoraes.info/ded/vfs"
+	"amoraes.info/ded/vfs/fstest"
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testEntry struct {
+	name string
+	mode os.FileMode
+	data []byte
+}
+
+var (
+	mtime = time.Date(2016, 3, 1, 12, 0, 0, 0, time.UTC)
+	hello = []byte("hello world\n")
+	// big spans a few chunks of the cache
+	big = make([]byte, 3*chunkSize+100)
+
+	testEntries = []testEntry{
+		{name: "dir/", mode: os.ModeDir | 0755},
+		{name: "dir/hello.txt", mode: 0644, data: hello},
+		{name: "./implicit/big.bin", mode: 0600, data: big},
+	}
+)
+
+func init() {
+	rand.New(rand.NewSource(1)).Read(big)
+}
+
+func writeZip(w io.Writer, method uint16) error {
+	zw := zip.NewWriter(w)
+	for _, e := range testEntries {
+		hdr := &zip.FileHeader{Name: e.name, Method: method, Modified: mtime}
+		hdr.SetMode(e.mode)
+		fw, err := zw.CreateHeader(hdr)
+		if err != nil {
+			return err
+		}
+		if _, err := fw.Write(e.data); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+func writeTar(w io.Writer) error {
+	tw := tar.NewWriter(w)
+	for _, e := range testEntries {
+		hdr := &tar.Header{
+			Name:     e.name,
+			Mode:     int64(e.mode.Perm()),
+			Size:     int64(len(e.data)),
+			ModTime:  mtime,
+			Typeflag: tar.TypeReg,
+		}
+		if e.mode.IsDir() {
+			hdr.Typeflag = tar.TypeDir
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := tw.Write(e.data); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+func writeTgz(w io.Writer) error {
+	zw := gzip.NewWriter(w)
+	if err := writeTar(zw); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// archives writes the test entries in every supported format
+func archives(t *testing.T) map[string]string {
+	dir, err := ioutil.TempDir("", "archivefs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	writers := map[string]func(io.Writer) error{
+		"stored.zip":    func(w io.Writer) error { return writeZip(w, zip.Store) },
+		"deflated.zip":  func(w io.Writer) error { return writeZip(w, zip.Deflate) },
+		"plain.tar":     writeTar,
+		"packed.tar.gz": writeTgz,
+	}
+	files := make(map[string]string)
+	for name, write := range writers {
+		var buf bytes.Buffer
+		if err := write(&buf); err != nil {
+			t.Fatal(err)
+		}
+		files[name] = filepath.Join(dir, name)
+		if err := ioutil.WriteFile(files[name], buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return files
+}
+
+func TestConformance(t *testing.T) {
+	for name, file := range archives(t) {
+		t.Run(name, func(t *testing.T) {
+			fs, err := Open(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer fs.Close()
+			fstest.Run(t, fs, fstest.Config{
+				File:     "dir/hello.txt",
+				Contents: hello,
+				Dir:      "dir",
+			})
+		})
+	}
+}
+
+func TestArchive(t *testing.T) {
+	for name, file := range archives(t) {
+		t.Run(name, func(t *testing.T) {
+			fs, err := Open(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer fs.Close()
+			srv := vfs.NewFileserver(fs)
+			ctx := vfs.NewContext()
+			call := func(fc plan9.Fcall) *plan9.Fcall {
+				t.Helper()
+				ret := srv.Call(&fc, ctx)
+				if ret.Type != fc.Type+1 {
+					t.Fatalf("Unexpected reply to %v: %v", &fc, ret)
+				}
+				return ret
+			}
+			call(plan9.Fcall{Type: plan9.Tversion, Msize: 8192, Version: "9P2000"})
+			call(plan9.Fcall{Type: plan9.Tattach, Fid: 1, Afid: plan9.NOFID})
+
+			// implicit directories are created for the entries
+			call(plan9.Fcall{Type: plan9.Twalk, Fid: 1, Newfid: 2, Wname: []string{"implicit"}})
+			st := call(plan9.Fcall{Type: plan9.Tstat, Fid: 2})
+			dir, err := plan9.UnmarshalDir(st.Stat)
+			if err != nil || dir.Mode&plan9.DMDIR == 0 {
+				t.Errorf("implicit should be a directory: %v / %v", dir, err)
+			}
+
+			call(plan9.Fcall{Type: plan9.Twalk, Fid: 2, Newfid: 3, Wname: []string{"big.bin"}})
+			st = call(plan9.Fcall{Type: plan9.Tstat, Fid: 3})
+			dir, err = plan9.UnmarshalDir(st.Stat)
+			switch {
+			case err != nil:
+				t.Fatal(err)
+			case dir.Mode != 0400:
+				t.Errorf("Files should be read-only: %v", dir.Mode)
+			case dir.Length != uint64(len(big)):
+				t.Errorf("Unexpected length %v", dir.Length)
+			case dir.Mtime != uint32(mtime.Unix()):
+				t.Errorf("Unexpected mtime %v", dir.Mtime)
+			}
+
+			// reads at any offset, backwards and across chunks
+			call(plan9.Fcall{Type: plan9.Topen, Fid: 3, Mode: plan9.OREAD})
+			for _, off := range []int{2*chunkSize + 10, 100, chunkSize - 50, len(big) - 10} {
+				rx := call(plan9.Fcall{Type: plan9.Tread, Fid: 3, Offset: uint64(off), Count: 100})
+				end := off + 100
+				if end > len(big) {
+					end = len(big)
+				}
+				if !bytes.Equal(rx.Data, big[off:end]) {
+					t.Errorf("Unexpected data at %v", off)
+				}
+			}
+
+			fc := plan9.Fcall{Type: plan9.Topen, Fid: 2, Mode: plan9.OWRITE}
+			if ret := srv.Call(&fc, ctx); ret.Type != plan9.Rerror {
+				t.Errorf("Open for writing should fail: %v", ret)
+			}
+			fc = plan9.Fcall{Type: plan9.Tcreate, Fid: 2, Name: "new", Perm: 0644}
+			if ret := srv.Call(&fc, ctx); ret.Type != plan9.Rerror || ret.Ename != vfs.ErrReadOnly.Error() {
+				t.Errorf("Create should fail: %v", ret)
+			}
+		})
+	}
+}
+
+func TestSequentialRead(t *testing.T) {
+	files := archives(t)
+	for _, name := range []string{"deflated.zip", "packed.tar.gz"} {
+		t.Run(name, func(t *testing.T) {
+			fs, err := Open(files[name])
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer fs.Close()
+			// the cache can't hold the whole file
+			fs.cache.max = 2
+			c := fs.Root.Walk("implicit").Walk("big.bin").Content().(*entryContent)
+			opens := 0
+			open := c.e.open
+			c.e.open = func() (io.ReadCloser, error) {
+				opens++
+				return open()
+			}
+
+			fd, err := c.Open(plan9.OREAD, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := ioutil.ReadAll(fd)
+			if err != nil || !bytes.Equal(data, big) {
+				t.Fatalf("Unexpected contents (%v bytes) / %v", len(data), err)
+			}
+			if opens != 1 {
+				t.Errorf("A sequential read should decompress the entry once, got %v", opens)
+			}
+
+			// a read before the last one starts again
+			if _, err := c.readAt(make([]byte, 10), 0); err != nil {
+				t.Fatal(err)
+			}
+			if opens != 2 {
+				t.Errorf("Expecting a new decompression, got %v", opens)
+			}
+		})
+	}
+}
@@ -0,0 +1,173 @@
+package archivefs
+
+import (
+	"container/list"
+	"io"
+	"sync"
+)
+
+type (
+	// chunkCache keeps the last chunks read from compressed entries,
+	// so reading an entry at an offset doesn't need to decompress it
+	// from the start every time.
+	chunkCache struct {
+		mu     sync.Mutex
+		max    int
+		lru    *list.List
+		chunks map[chunkKey]*list.Element
+
+		// streams keeps the last decompressors used, positioned
+		// after the last chunk they read, so a sequential read
+		// decompresses the entry once
+		streams    *list.List
+		maxStreams int
+	}
+
+	chunkKey struct {
+		entry *entry
+		index int64
+	}
+
+	chunk struct {
+		key  chunkKey
+		data []byte
+	}
+
+	// stream is an entry being decompressed, next is the index of
+	// the next chunk read from rc
+	stream struct {
+		e    *entry
+		rc   io.ReadCloser
+		next int64
+	}
+)
+
+const (
+	// chunkSize is the size of the chunks kept by the cache
+	chunkSize = 64 * 1024
+	// maxStreams is the number of decompressors kept by the cache
+	maxStreams = 8
+)
+
+func newChunkCache(max int) *chunkCache {
+	return &chunkCache{
+		max:        max,
+		lru:        list.New(),
+		chunks:     make(map[chunkKey]*list.Element),
+		streams:    list.New(),
+		maxStreams: maxStreams,
+	}
+}
+
+func (cc *chunkCache) lookup(key chunkKey) ([]byte, bool) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	el, ok := cc.chunks[key]
+	if !ok {
+		return nil, false
+	}
+	cc.lru.MoveToFront(el)
+	return el.Value.(*chunk).data, true
+}
+
+func (cc *chunkCache) put(key chunkKey, data []byte) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if el, ok := cc.chunks[key]; ok {
+		cc.lru.MoveToFront(el)
+		return
+	}
+	cc.chunks[key] = cc.lru.PushFront(&chunk{key: key, data: data})
+	for cc.lru.Len() > cc.max {
+		old := cc.lru.Remove(cc.lru.Back()).(*chunk)
+		delete(cc.chunks, old.key)
+	}
+}
+
+// take removes the stream of e from the cache, it is nil if the cache
+// has none or it is past the chunk index
+func (cc *chunkCache) take(e *entry, index int64) *stream {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	for el := cc.streams.Front(); el != nil; el = el.Next() {
+		if st := el.Value.(*stream); st.e == e {
+			cc.streams.Remove(el)
+			if st.next > index {
+				st.rc.Close()
+				return nil
+			}
+			return st
+		}
+	}
+	return nil
+}
+
+// keep adds st to the cache, the least recently used stream is closed
+// when there are too many
+func (cc *chunkCache) keep(st *stream) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	cc.streams.PushFront(st)
+	for cc.streams.Len() > cc.maxStreams {
+		cc.streams.Remove(cc.streams.Back()).(*stream).rc.Close()
+	}
+}
+
+// close closes the streams kept by the cache
+func (cc *chunkCache) close() {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	for cc.streams.Len() > 0 {
+		cc.streams.Remove(cc.streams.Front()).(*stream).rc.Close()
+	}
+}
+
+// get returns the chunk index of e. On a miss e is decompressed from
+// where the last read of e stopped, or from the start if it was after
+// index, and every chunk read is added to the cache.
+func (cc *chunkCache) get(e *entry, index int64) ([]byte, error) {
+	key := chunkKey{entry: e, index: index}
+	if data, ok := cc.lookup(key); ok {
+		return data, nil
+	}
+	// the reads of e wait for the one decompressing it, the chunk
+	// may be in the cache after it
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if data, ok := cc.lookup(key); ok {
+		return data, nil
+	}
+	st := cc.take(e, index)
+	if st == nil {
+		rc, err := e.open()
+		if err != nil {
+			return nil, err
+		}
+		st = &stream{e: e, rc: rc}
+	}
+	var data []byte
+	for st.next <= index {
+		data = make([]byte, chunkSize)
+		n, err := io.ReadFull(st.rc, data)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = nil
+		}
+		if err != nil {
+			st.rc.Close()
+			return nil, err
+		}
+		data = data[:n]
+		cc.put(chunkKey{entry: e, index: st.next}, data)
+		st.next++
+		if n < chunkSize {
+			// the end of the entry, the stream isn't needed
+			st.rc.Close()
+			if st.next <= index {
+				return nil, io.EOF
+			}
+			return data, nil
+		}
+	}
+	cc.keep(st)
+	return data, nil
+}
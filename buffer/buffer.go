@@ -25,6 +25,9 @@ func (b *B) Seek(offset int64, whence int) (n int64, err error) {
 	if whence != 0 {
 		return 0, errors.New("seek only from the beginning")
 	}
+	if offset < 0 {
+		return 0, errors.New("negative offset")
+	}
 	if offset > int64(b.sz) {
 		offset = int64(b.sz)
 	}
@@ -28,4 +28,8 @@ func TestBuffer(t *testing.T) {
 	if !bytes.Equal(b.Bytes(), []byte("olleh")) {
 		t.Errorf("wrong data returned")
 	}
+
+	if _, e := b.Seek(-1, 0); e == nil {
+		t.Errorf("negative offsets should fail")
+	}
 }
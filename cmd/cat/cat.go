@@ -9,16 +9,19 @@ import (
 
 	"9fans.net/go/plan9"
 	"9fans.net/go/plan9/client"
+	"amoraes.info/ded/vfs"
 )
 
 var (
 	addr  = flag.String("addr", "127.0.0.1:5640", "Address of the ded editor")
 	write = flag.Bool("w", false, "Write to the file instead of reading to it. Data is consumed from stdin")
+
+	tlsConfig = vfs.TLSFlags(flag.CommandLine)
 )
 
 func main() {
 	flag.Parse()
-	fsys, err := client.Mount("tcp", *addr)
+	fsys, err := mount()
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "error mounting: %v", err)
 		os.Exit(1)
@@ -65,6 +68,17 @@ func main() {
 	}
 }
 
+func mount() (*client.Fsys, error) {
+	if !tlsConfig.Enabled() {
+		return client.Mount("tcp", *addr)
+	}
+	cfg, err := tlsConfig.Client()
+	if err != nil {
+		return nil, err
+	}
+	return vfs.Mount(*addr, cfg)
+}
+
 func ensureFileExists(fsys *client.Fsys, name string) {
 	fid, err := fsys.Open(name, plan9.OWRITE)
 	if err == nil {
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"amoraes.info/ded/dumpfs"
+	"amoraes.info/ded/vfs"
+	"flag"
+	log "github.com/Sirupsen/logrus"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+var (
+	addr  = flag.String("addr", ":5640", "Address to bind")
+	debug = flag.Bool("debug", false, "Debug mode")
+	root  = flag.String("root", ".", "Directory to dump")
+	store = flag.String("store", ".dump", "Directory holding the snapshots")
+	every = flag.Duration("every", 24*time.Hour, "Interval between snapshots, 0 disables them")
+	now   = flag.Bool("now", false, "Take a snapshot on start")
+
+	tlsConfig = vfs.TLSFlags(flag.CommandLine)
+)
+
+type (
+	sysnameHook struct {
+		name string
+	}
+)
+
+func (s *sysnameHook) Levels() []log.Level {
+	return []log.Level{
+		log.PanicLevel,
+		log.FatalLevel,
+		log.ErrorLevel,
+		log.WarnLevel,
+		log.InfoLevel,
+		log.DebugLevel,
+	}
+}
+
+func (s *sysnameHook) Fire(e *log.Entry) error {
+	e.Data["system"] = s.name
+	return nil
+}
+
+func init() {
+	log.AddHook(&sysnameHook{
+		name: "dumpfsd",
+	})
+}
+
+func main() {
+	flag.Parse()
+	if *debug {
+		log.SetLevel(log.DebugLevel)
+	}
+	fs, err := dumpfs.New(*root, *store)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err":   err.Error(),
+			"store": *store,
+		}).Fatalf("Unable to open store")
+	}
+	if *now {
+		if _, err := fs.Snapshot(); err != nil {
+			log.WithFields(log.Fields{
+				"err": err.Error(),
+			}).Errorf("Snapshot failed")
+		}
+	}
+	if *every > 0 {
+		stop := fs.Schedule(*every)
+		defer stop()
+	}
+	log.WithFields(log.Fields{
+		"address": *addr,
+		"root":    *root,
+		"store":   *store,
+		"every":   *every,
+	}).Infof("Starting server...")
+
+	fileserver := vfs.NewFileserver(fs, vfs.Recover(), vfs.Logger())
+	var srv *vfs.Server
+	if tlsConfig.Enabled() {
+		cfg, cfgErr := tlsConfig.Server()
+		if cfgErr != nil {
+			log.WithFields(log.Fields{
+				"err": cfgErr.Error(),
+			}).Fatalf("Invalid TLS configuration")
+		}
+		srv, err = vfs.NewTLSServer(fileserver, *addr, cfg)
+	} else {
+		srv, err = vfs.NewTCPServer(fileserver, *addr)
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err.Error(),
+		}).Fatalf("Unable to start server")
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	<-sig
+	log.Infof("Shutting down...")
+	if err := srv.Close(); err != nil {
+		log.WithFields(log.Fields{
+			"err": err.Error(),
+		}).Errorf("Unable to close server")
+	}
+}
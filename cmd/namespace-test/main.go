@@ -35,8 +35,23 @@ var (
 	addr1      = flag.String("addr1", ":5640", "First address")
 	addr2      = flag.String("addr2", ":5641", "Second address")
 	listenAddr = flag.String("laddr", ":5642", "Address to listen for connections")
+	fork       = flag.Bool("fork", false, "Give each client its own copy of the namespace")
+
+	tlsConfig = vfs.TLSFlags(flag.CommandLine)
 )
 
+// mount connects to addr using TLS if it was configured
+func mount(addr string) (*client.Fsys, error) {
+	if !tlsConfig.Enabled() {
+		return client.Mount("tcp", addr)
+	}
+	cfg, err := tlsConfig.Client()
+	if err != nil {
+		return nil, err
+	}
+	return vfs.Mount(addr, cfg)
+}
+
 func main() {
 	flag.Parse()
 	log.SetLevel(log.DebugLevel)
@@ -44,11 +59,11 @@ func main() {
 		"address":  *addr1,
 		"address2": *addr2,
 	}).Infof("Connecting to server...")
-	fsys1, err := client.Mount("tcp", *addr1)
+	fsys1, err := mount(*addr1)
 	if err != nil {
 		log.Fatalf("Unable to connect to fsys1. %v", err)
 	}
-	fsys2, err := client.Mount("tcp", *addr2)
+	fsys2, err := mount(*addr2)
 	if err != nil {
 		log.Fatalf("Unable to connect to fsys2. %v", err)
 	}
@@ -81,7 +96,18 @@ func main() {
 	// now that we know we can connect, let's expose the namespace
 
 	export := namespace.NewExport(&ns)
-	srv, err := vfs.NewTCPServer(&vfs.Fileserver{export}, *listenAddr)
+	export.Fork = *fork
+	fileserver := vfs.NewFileserver(export, vfs.Recover(), vfs.Logger())
+	var srv *vfs.Server
+	if tlsConfig.Enabled() {
+		cfg, cfgErr := tlsConfig.Server()
+		if cfgErr != nil {
+			log.Fatalf("Invalid TLS configuration. %v", cfgErr)
+		}
+		srv, err = vfs.NewTLSServer(fileserver, *listenAddr, cfg)
+	} else {
+		srv, err = vfs.NewTCPServer(fileserver, *listenAddr)
+	}
 	if err != nil {
 		log.WithFields(log.Fields{
 			"err": err.Error(),
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"amoraes.info/ded/vfs"
+	"amoraes.info/ded/vfs/namespace"
+	"crypto/tls"
+	"flag"
+	log "github.com/Sirupsen/logrus"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+var (
+	addr   = flag.String("addr", "127.0.0.1:5640", "Address to bind")
+	debug  = flag.Bool("debug", false, "Debug mode")
+	nsFile = flag.String("ns", "", "Namespace file describing the exported namespace")
+	fork   = flag.Bool("fork", false, "Give each client its own copy of the namespace")
+
+	tlsConfig = vfs.TLSFlags(flag.CommandLine)
+)
+
+type (
+	sysnameHook struct {
+		name string
+	}
+)
+
+func (s *sysnameHook) Levels() []log.Level {
+	return []log.Level{
+		log.PanicLevel,
+		log.FatalLevel,
+		log.ErrorLevel,
+		log.WarnLevel,
+		log.InfoLevel,
+		log.DebugLevel,
+	}
+}
+
+func (s *sysnameHook) Fire(e *log.Entry) error {
+	e.Data["system"] = s.name
+	return nil
+}
+
+func init() {
+	log.AddHook(&sysnameHook{
+		name: "nsd",
+	})
+}
+
+func main() {
+	flag.Parse()
+	if *debug {
+		log.SetLevel(log.DebugLevel)
+	}
+	if *nsFile == "" {
+		log.Fatalf("Missing -ns file")
+	}
+
+	// the servers of the mount lines use the same TLS configuration
+	var clientCfg *tls.Config
+	if tlsConfig.Enabled() {
+		var err error
+		if clientCfg, err = tlsConfig.Client(); err != nil {
+			log.WithFields(log.Fields{
+				"err": err.Error(),
+			}).Fatalf("Invalid TLS configuration")
+		}
+	}
+	dial := namespace.NewDialer(clientCfg)
+
+	ns := &namespace.Namespace{}
+	if err := ns.ApplyFile(*nsFile, dial); err != nil {
+		log.WithFields(log.Fields{
+			"err": err.Error(),
+			"ns":  *nsFile,
+		}).Fatalf("Unable to build the namespace")
+	}
+	log.WithFields(log.Fields{
+		"address": *addr,
+		"ns":      *nsFile,
+		"fork":    *fork,
+	}).Infof("Starting server...")
+
+	export := namespace.NewExport(ns)
+	export.Fork = *fork
+	export.Dial = dial
+	fileserver := vfs.NewFileserver(export, vfs.Recover(), vfs.Logger())
+	if !tlsConfig.VerifyClients && !loopback(*addr) {
+		log.WithFields(log.Fields{
+			"address": *addr,
+		}).Warnf("Serving the namespace to other hosts without client certificates, anyone can change it")
+	}
+	var srv *vfs.Server
+	var err error
+	if tlsConfig.Enabled() {
+		cfg, cfgErr := tlsConfig.Server()
+		if cfgErr != nil {
+			log.WithFields(log.Fields{
+				"err": cfgErr.Error(),
+			}).Fatalf("Invalid TLS configuration")
+		}
+		srv, err = vfs.NewTLSServer(fileserver, *addr, cfg)
+	} else {
+		srv, err = vfs.NewTCPServer(fileserver, *addr)
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err.Error(),
+		}).Fatalf("Unable to start server")
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	<-sig
+	log.Infof("Shutting down...")
+	if err := srv.Close(); err != nil {
+		log.WithFields(log.Fields{
+			"err": err.Error(),
+		}).Errorf("Unable to close server")
+	}
+	ns.Close()
+}
+
+// loopback returns true if addr only accepts connections from this host
+func loopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
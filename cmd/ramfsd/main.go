@@ -0,0 +1,106 @@
+package main
+
+import (
+	"amoraes.info/ded/ramfs"
+	"amoraes.info/ded/vfs"
+	"flag"
+	log "github.com/Sirupsen/logrus"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+var (
+	addr     = flag.String("addr", ":5640", "Address to bind")
+	debug    = flag.Bool("debug", false, "Debug mode")
+	quota    = flag.Uint64("quota", 0, "Maximum number of bytes stored, 0 means no limit")
+	snapshot = flag.String("snapshot", "", "Directory loaded on start and replaced by the tree on shutdown")
+
+	tlsConfig = vfs.TLSFlags(flag.CommandLine)
+)
+
+type (
+	sysnameHook struct {
+		name string
+	}
+)
+
+func (s *sysnameHook) Levels() []log.Level {
+	return []log.Level{
+		log.PanicLevel,
+		log.FatalLevel,
+		log.ErrorLevel,
+		log.WarnLevel,
+		log.InfoLevel,
+		log.DebugLevel,
+	}
+}
+
+func (s *sysnameHook) Fire(e *log.Entry) error {
+	e.Data["system"] = s.name
+	return nil
+}
+
+func init() {
+	log.AddHook(&sysnameHook{
+		name: "ramfsd",
+	})
+}
+
+func main() {
+	flag.Parse()
+	if *debug {
+		log.SetLevel(log.DebugLevel)
+	}
+	fs := ramfs.New(*quota)
+	if *snapshot != "" {
+		if err := fs.Load(*snapshot); err != nil && !os.IsNotExist(err) {
+			log.WithFields(log.Fields{
+				"err":      err.Error(),
+				"snapshot": *snapshot,
+			}).Fatalf("Unable to load snapshot")
+		}
+	}
+	log.WithFields(log.Fields{
+		"address": *addr,
+		"quota":   *quota,
+	}).Infof("Starting server...")
+
+	fileserver := vfs.NewFileserver(fs, vfs.Recover(), vfs.Logger())
+	var srv *vfs.Server
+	var err error
+	if tlsConfig.Enabled() {
+		cfg, cfgErr := tlsConfig.Server()
+		if cfgErr != nil {
+			log.WithFields(log.Fields{
+				"err": cfgErr.Error(),
+			}).Fatalf("Invalid TLS configuration")
+		}
+		srv, err = vfs.NewTLSServer(fileserver, *addr, cfg)
+	} else {
+		srv, err = vfs.NewTCPServer(fileserver, *addr)
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err.Error(),
+		}).Fatalf("Unable to start server")
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	<-sig
+	log.Infof("Shutting down...")
+	if err := srv.Close(); err != nil {
+		log.WithFields(log.Fields{
+			"err": err.Error(),
+		}).Errorf("Unable to close server")
+	}
+	if *snapshot != "" {
+		if err := fs.Save(*snapshot); err != nil {
+			log.WithFields(log.Fields{
+				"err":      err.Error(),
+				"snapshot": *snapshot,
+			}).Fatalf("Unable to save snapshot")
+		}
+	}
+}
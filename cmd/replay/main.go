@@ -0,0 +1,63 @@
+package main
+
+import (
+	"amoraes.info/ded/ufs"
+	"amoraes.info/ded/vfs"
+	"flag"
+	"fmt"
+	"os"
+)
+
+var (
+	root  = flag.String("root", ".", "Root of the ufs tree used to answer the requests")
+	loose = flag.Bool("loose", false, "Ignore qid paths, versions and times when comparing replies")
+	ro    = flag.Bool("ro", false, "Answer the requests with a read-only tree")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %v [flags] transcript...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	failed := false
+	for _, name := range flag.Args() {
+		mismatches, err := replay(name)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v: %v\n", name, err)
+			os.Exit(1)
+		}
+		for _, m := range mismatches {
+			fmt.Printf("%v:%v\n", name, m)
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func replay(name string) ([]vfs.Mismatch, error) {
+	in, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+
+	var chain []vfs.Middleware
+	if *ro {
+		chain = append(chain, vfs.Access(vfs.ReadOnly))
+	}
+	r := &vfs.Replay{
+		FS: vfs.NewFileserver(&ufs.Ufs{Root: *root}, chain...),
+	}
+	if *loose {
+		r.Equal = vfs.LooseEqual
+	}
+	return r.Run(in)
+}
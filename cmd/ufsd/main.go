@@ -1,16 +1,25 @@
 package main
 
 import (
+	"amoraes.info/ded/archivefs"
 	"amoraes.info/ded/ufs"
 	"amoraes.info/ded/vfs"
+	"crypto/tls"
 	"flag"
 	log "github.com/Sirupsen/logrus"
+	"net"
+	"os"
 )
 
 var (
 	root  = flag.String("root", ".", "Default root to expose")
 	addr  = flag.String("addr", ":5640", "Address to bind")
 	debug = flag.Bool("debug", false, "Debug mode")
+	ro    = flag.Bool("ro", false, "Expose root as a read-only tree")
+	rec   = flag.String("record", "", "Write a transcript of every message to this file")
+	arch  = flag.String("archive", "", "Expose a .tar, .tar.gz or .zip file instead of root")
+
+	tlsConfig = vfs.TLSFlags(flag.CommandLine)
 )
 
 type (
@@ -43,23 +52,68 @@ func init() {
 
 func main() {
 	flag.Parse()
-	fs := ufs.Ufs{
-		Root: *root,
-	}
 	if *debug {
 		log.SetLevel(log.DebugLevel)
 	}
+	var fs vfs.ServerFS = &ufs.Ufs{
+		Root: *root,
+	}
+	if *arch != "" {
+		afs, err := archivefs.Open(*arch)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err":     err.Error(),
+				"archive": *arch,
+			}).Fatalf("Unable to open archive")
+		}
+		defer afs.Close()
+		fs = afs
+	}
 	log.WithFields(log.Fields{
 		"address": *addr,
 		"root":    *root,
+		"archive": *arch,
 	}).Infof("Starting server...")
 
-	srv, err := vfs.NewTCPServer(&vfs.Fileserver{&fs}, *addr)
+	chain := []vfs.Middleware{vfs.Recover(), vfs.Logger()}
+	if *ro {
+		chain = append(chain, vfs.Access(vfs.ReadOnly))
+	}
+	fileserver := vfs.NewFileserver(fs, chain...)
+
+	// the recorder is installed before the first connection
+	var recorder *vfs.Recorder
+	if *rec != "" {
+		out, err := os.OpenFile(*rec, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err":  err.Error(),
+				"file": *rec,
+			}).Fatalf("Unable to open transcript")
+		}
+		recorder = vfs.NewRecorder(out)
+	}
+
+	var lst net.Listener
+	var err error
+	if tlsConfig.Enabled() {
+		cfg, cfgErr := tlsConfig.Server()
+		if cfgErr != nil {
+			log.WithFields(log.Fields{
+				"err": cfgErr.Error(),
+			}).Fatalf("Invalid TLS configuration")
+		}
+		lst, err = tls.Listen("tcp", *addr, cfg)
+	} else {
+		lst, err = net.Listen("tcp", *addr)
+	}
+	if err == nil {
+		_, err = vfs.NewRecordedServer(fileserver, lst, recorder)
+	}
 	if err != nil {
 		log.WithFields(log.Fields{
 			"err": err.Error(),
 		}).Fatalf("Unable to start server")
 	}
-	_ = srv
 	select {}
 }
@@ -0,0 +1,307 @@
+// Package dumpfs keeps daily snapshots of a directory, like the dump
+// file system of Plan 9.
+//
+// The snapshots are served read-only as /YYYY/MMDD, the later
+// snapshots of the same day have a sequence number after the day:
+// /YYYY/MMDD1, /YYYY/MMDD2 and so on. The contents of the files are
+// kept once in the store, indexed by their sha256, so unchanged files
+// don't use more space. Writing "snapshot" to /ctl takes a snapshot.
+//
+// The store directory holds:
+//
+//	blobs/xx/<sha256>	the contents of the files
+//	dumps/YYYY/MMDD[s]	the list of files of each snapshot
+package dumpfs
+
+import (
+	"9fans.net/go/plan9"
+	"amoraes.info/ded/vfs"
+	"amoraes.info/ded/vfs/filetree"
+	"amoraes.info/ded/vfs/synth"
+	"errors"
+	log "github.com/Sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	Dump struct {
+		filetree.FS
+		// Source is the directory dumped
+		Source string
+		// Store is the directory holding the snapshots
+		Store string
+
+		// mu serializes the snapshots
+		mu sync.Mutex
+		// last has the entries of the last snapshot by path, its
+		// hashes are reused for the files that didn't change
+		last map[string]*entry
+		// scanned is when the files of the last snapshot were read
+		scanned uint32
+		now     func() time.Time
+	}
+)
+
+var (
+	ErrManifest = errors.New("invalid dump manifest")
+)
+
+// New serves the snapshots of source kept in store, store is created
+// if needed
+func New(source, store string) (*Dump, error) {
+	var err error
+	d := &Dump{
+		last: make(map[string]*entry),
+		now:  time.Now,
+	}
+	if d.Source, err = filepath.Abs(source); err != nil {
+		return nil, err
+	}
+	if d.Store, err = filepath.Abs(store); err != nil {
+		return nil, err
+	}
+	for _, dir := range []string{"blobs", "dumps"} {
+		if err := os.MkdirAll(filepath.Join(d.Store, dir), 0755); err != nil {
+			return nil, err
+		}
+	}
+	d.Root = vfs.NewDir("")
+	ctl := synth.NewCtl()
+	ctl.Handle("snapshot", func(args []string) error {
+		_, err := d.Snapshot()
+		return err
+	})
+	f := vfs.NewFile("ctl", ctl)
+	f.Mode = 0600
+	d.Root.Add(f)
+	if err := d.load(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// load adds the snapshots in the store to the tree
+func (d *Dump) load() error {
+	dumps := filepath.Join(d.Store, "dumps")
+	years, err := ioutil.ReadDir(dumps)
+	if err != nil {
+		return err
+	}
+	for _, y := range years {
+		if !y.IsDir() {
+			continue
+		}
+		days, err := ioutil.ReadDir(filepath.Join(dumps, y.Name()))
+		if err != nil {
+			return err
+		}
+		sort.Slice(days, func(i, j int) bool {
+			return dumpBefore(days[i].Name(), days[j].Name())
+		})
+		for _, day := range days {
+			if strings.HasSuffix(day.Name(), ".tmp") {
+				continue
+			}
+			entries, err := readManifest(filepath.Join(dumps, y.Name(), day.Name()))
+			if err != nil {
+				return err
+			}
+			d.add(y.Name(), day.Name(), uint32(day.ModTime().Unix()), entries)
+			d.last = index(entries)
+			d.scanned = uint32(day.ModTime().Unix())
+		}
+	}
+	return nil
+}
+
+func index(entries []*entry) map[string]*entry {
+	m := make(map[string]*entry, len(entries))
+	for _, e := range entries {
+		m[e.path] = e
+	}
+	return m
+}
+
+// add adds the snapshot year/day holding entries to the tree
+func (d *Dump) add(year, day string, mtime uint32, entries []*entry) {
+	ydir := d.Root.Walk(year)
+	if ydir == nil {
+		ydir = vfs.NewDir(year)
+		ydir.SetMtime(mtime)
+		d.Root.Add(ydir)
+	}
+	dump := vfs.NewDir(day)
+	dump.SetMtime(mtime)
+	for _, e := range entries {
+		parent := dump
+		elems := strings.Split(e.path, "/")
+		for _, name := range elems[:len(elems)-1] {
+			if parent = parent.Walk(name); parent == nil {
+				break
+			}
+		}
+		if parent == nil {
+			continue
+		}
+		var f *vfs.File
+		if e.mode&plan9.DMDIR != 0 {
+			f = vfs.NewDir(elems[len(elems)-1])
+		} else {
+			f = vfs.NewFile(elems[len(elems)-1], &blobContent{name: d.blobPath(e.hash), size: e.size})
+		}
+		// dumps are never changed
+		f.Mode = e.mode &^ 0222
+		f.SetMtime(e.mtime)
+		parent.Add(f)
+	}
+	// the day is added last, so clients never see a partial dump
+	ydir.Add(dump)
+}
+
+// dumpBefore returns true if the dump a was taken before b, in
+// the same year
+func dumpBefore(a, b string) bool {
+	if len(a) < 4 || len(b) < 4 || a[:4] != b[:4] {
+		return a < b
+	}
+	sa, _ := strconv.Atoi(a[4:])
+	sb, _ := strconv.Atoi(b[4:])
+	return sa < sb
+}
+
+// name returns the name of a snapshot taken at t
+func (d *Dump) name(t time.Time) (string, string) {
+	year, day := t.Format("2006"), t.Format("0102")
+	ydir := d.Root.Walk(year)
+	if ydir == nil || ydir.Walk(day) == nil {
+		return year, day
+	}
+	for s := 1; ; s++ {
+		if name := day + strconv.Itoa(s); ydir.Walk(name) == nil {
+			return year, name
+		}
+	}
+}
+
+// Snapshot dumps Source and returns the path of the new snapshot,
+// like "2016/0301"
+func (d *Dump) Snapshot() (string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	t := d.now()
+	scanned := uint32(time.Now().Unix())
+	var entries []*entry
+	err := filepath.Walk(d.Source, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			log.WithFields(log.Fields{
+				"Module": "dumpfs",
+				"File":   name,
+				"Err":    err,
+			}).Warnf("Skipping file")
+			return nil
+		}
+		rel, err := filepath.Rel(d.Source, name)
+		if err != nil || rel == "." {
+			return err
+		}
+		if name == d.Store {
+			return filepath.SkipDir
+		}
+		e := &entry{
+			path:  filepath.ToSlash(rel),
+			mode:  plan9.Perm(info.Mode().Perm()),
+			mtime: uint32(info.ModTime().Unix()),
+		}
+		switch {
+		case info.IsDir():
+			e.mode |= plan9.DMDIR
+		case info.Mode().IsRegular():
+			e.size = info.Size()
+			e.hash, err = d.hash(name, e)
+			if err != nil {
+				log.WithFields(log.Fields{
+					"Module": "dumpfs",
+					"File":   name,
+					"Err":    err,
+				}).Warnf("Skipping file")
+				return nil
+			}
+		default:
+			return nil
+		}
+		entries = append(entries, e)
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	year, day := d.name(t)
+	dir := filepath.Join(d.Store, "dumps", year)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	if err := writeManifest(filepath.Join(dir, day), entries); err != nil {
+		return "", err
+	}
+	d.add(year, day, uint32(t.Unix()), entries)
+	d.last = index(entries)
+	d.scanned = scanned
+	log.WithFields(log.Fields{
+		"Module": "dumpfs",
+		"Dump":   year + "/" + day,
+		"Files":  len(entries),
+	}).Infof("Snapshot done")
+	return year + "/" + day, nil
+}
+
+// hash returns the hash of the file name with the attributes of e,
+// the hash of the last dump is used if the file didn't change. Files
+// changed in the second the last dump was taken are read again, the
+// mtime can't tell if they changed after the dump.
+func (d *Dump) hash(name string, e *entry) (string, error) {
+	old, ok := d.last[e.path]
+	if ok && old.hash != "" && old.size == e.size && old.mtime == e.mtime && e.mtime < d.scanned {
+		if _, err := os.Stat(d.blobPath(old.hash)); err == nil {
+			return old.hash, nil
+		}
+	}
+	return d.putBlob(name)
+}
+
+// Schedule takes a snapshot every interval until stop is called
+func (d *Dump) Schedule(every time.Duration) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		t := time.NewTicker(every)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				if _, err := d.Snapshot(); err != nil {
+					log.WithFields(log.Fields{
+						"Module": "dumpfs",
+						"Err":    err,
+					}).Errorf("Snapshot failed")
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
+}
+
+func (d *Dump) Wstat(fc *plan9.Fcall, ctx *vfs.Context) *plan9.Fcall {
+	ret := *fc
+	ret.Type++
+	return vfs.PackError(&ret, vfs.ErrReadOnly)
+}
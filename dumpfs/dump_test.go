@@ -0,0 +1,140 @@
+package dumpfs
+
+import (
+	"9fans.net/go/plan9"
+	"amoraes.info/ded/vfs"
+	"amoraes.info/ded/vfs/namespace"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDump(t *testing.T) {
+	root, err := ioutil.TempDir("", "dumpfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	store := filepath.Join(root, ".dump")
+	write := func(name, data string) {
+		t.Helper()
+		name = filepath.Join(root, name)
+		os.MkdirAll(filepath.Dir(name), 0755)
+		if err := ioutil.WriteFile(name, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("a.txt", "v1")
+	write("dir/b.txt", "same")
+	write("dir/c.txt", "same")
+
+	d, err := New(root, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	day := time.Date(2016, 3, 1, 5, 0, 0, 0, time.Local)
+	d.now = func() time.Time { return day }
+	if name, err := d.Snapshot(); err != nil || name != "2016/0301" {
+		t.Fatalf("Unexpected snapshot %v / %v", name, err)
+	}
+	write("a.txt", "v2")
+
+	ns := &namespace.Namespace{}
+	if err := ns.MountServer("dump", ".", vfs.NewFileserver(d)); err != nil {
+		t.Fatal(err)
+	}
+	read := func(name string) string {
+		t.Helper()
+		fid, err := ns.Walk("/dump/" + name)
+		if err != nil {
+			return "missing"
+		}
+		defer fid.Close()
+		if err := fid.Open(plan9.OREAD); err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(fid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+
+	// the ctl file takes the second snapshot of the day
+	fid, err := ns.Walk("/dump/ctl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fid.Open(plan9.OWRITE); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fid.Write([]byte("snapshot\n")); err != nil {
+		t.Fatal(err)
+	}
+	fid.Close()
+
+	switch {
+	case read("2016/0301/a.txt") != "v1", read("2016/03011/a.txt") != "v2":
+		t.Errorf("Unexpected versions %q %q", read("2016/0301/a.txt"), read("2016/03011/a.txt"))
+	case read("2016/0301/dir/b.txt") != "same":
+		t.Errorf("Unexpected contents %q", read("2016/0301/dir/b.txt"))
+	case read("2016/0301/.dump/blobs") != "missing":
+		t.Errorf("The store shouldn't be dumped")
+	}
+
+	// the same contents are stored once: v1, v2 and same
+	var blobs int
+	filepath.Walk(filepath.Join(store, "blobs"), func(name string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			blobs++
+		}
+		return nil
+	})
+	if blobs != 3 {
+		t.Errorf("Expecting 3 blobs got %v", blobs)
+	}
+
+	fid, err = ns.Walk("/dump/2016/0301/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fid.Open(plan9.OWRITE); err == nil {
+		t.Errorf("Dumps should be read-only")
+	}
+	fid.Close()
+
+	// the snapshots are loaded from the store
+	d, err = New(root, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.now = func() time.Time { return day }
+	if name, err := d.Snapshot(); err != nil || name != "2016/03012" {
+		t.Errorf("Unexpected snapshot %v / %v", name, err)
+	}
+}
+
+func TestInvalidManifest(t *testing.T) {
+	root, err := ioutil.TempDir("", "dumpfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	store := filepath.Join(root, ".dump")
+	if err := os.MkdirAll(filepath.Join(store, "dumps", "2016"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, hash := range []string{"-", "x", "zz" + strings.Repeat("0", 62)} {
+		line := fmt.Sprintf("644 0 2 %s %q\n", hash, "a.txt")
+		if err := ioutil.WriteFile(filepath.Join(store, "dumps", "2016", "0301"), []byte(line), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := New(root, store); err == nil || !strings.Contains(err.Error(), ErrManifest.Error()) {
+			t.Errorf("%q: expecting %v got %v", hash, ErrManifest, err)
+		}
+	}
+}
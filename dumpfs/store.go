@@ -0,0 +1,173 @@
+package dumpfs
+
+import (
+	"9fans.net/go/plan9"
+	"amoraes.info/ded/vfs"
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+type (
+	// entry is a file or directory of a dump, the paths are relative
+	// to the dumped tree and use slashes
+	entry struct {
+		path  string
+		mode  plan9.Perm
+		mtime uint32
+		size  int64
+		// hash is the sha256 of the contents, empty for directories
+		hash string
+	}
+
+	// blobContent is the content of a dumped file, kept in the store
+	blobContent struct {
+		name string
+		size int64
+	}
+
+	blobFd struct {
+		*os.File
+	}
+)
+
+// blobPath returns where the contents with hash are kept
+func (d *Dump) blobPath(hash string) string {
+	return filepath.Join(d.Store, "blobs", hash[:2], hash)
+}
+
+// putBlob copies the file name to the store and returns its hash,
+// contents already in the store aren't copied again
+func (d *Dump) putBlob(name string) (string, error) {
+	in, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	tmp, err := ioutil.TempFile(filepath.Join(d.Store, "blobs"), "tmp")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmp, h), in)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", err
+	}
+	hash := hex.EncodeToString(h.Sum(nil))
+	blob := d.blobPath(hash)
+	if _, err := os.Stat(blob); err == nil {
+		return hash, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(blob), 0755); err != nil {
+		return "", err
+	}
+	if err := os.Chmod(tmp.Name(), 0444); err != nil {
+		return "", err
+	}
+	return hash, os.Rename(tmp.Name(), blob)
+}
+
+// writeManifest saves the entries of a dump to the file name, one
+// entry per line: mode, mtime, size, hash and the quoted path.
+func writeManifest(name string, entries []*entry) error {
+	tmp := name + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, e := range entries {
+		hash := e.hash
+		if hash == "" {
+			hash = "-"
+		}
+		fmt.Fprintf(w, "%o %d %d %s %s\n", uint32(e.mode), e.mtime, e.size, hash, strconv.Quote(e.path))
+	}
+	err = w.Flush()
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+func readManifest(name string) ([]*entry, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var entries []*entry
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.SplitN(s.Text(), " ", 5)
+		if len(fields) != 5 {
+			return nil, fmt.Errorf("%v: %v", ErrManifest, name)
+		}
+		mode, err1 := strconv.ParseUint(fields[0], 8, 32)
+		mtime, err2 := strconv.ParseUint(fields[1], 10, 32)
+		size, err3 := strconv.ParseInt(fields[2], 10, 64)
+		path, err4 := strconv.Unquote(fields[4])
+		for _, err := range []error{err1, err2, err3, err4} {
+			if err != nil {
+				return nil, fmt.Errorf("%v: %v: %v", ErrManifest, name, err)
+			}
+		}
+		e := &entry{path: path, mode: plan9.Perm(mode), mtime: uint32(mtime), size: size}
+		if fields[3] != "-" {
+			e.hash = fields[3]
+		}
+		if e.mode&plan9.DMDIR == 0 && !validHash(e.hash) {
+			return nil, fmt.Errorf("%v: %v: invalid hash of %v", ErrManifest, name, e.path)
+		}
+		entries = append(entries, e)
+	}
+	return entries, s.Err()
+}
+
+// validHash returns true if hash is a sha256 written by putBlob
+func validHash(hash string) bool {
+	if len(hash) != 2*sha256.Size {
+		return false
+	}
+	_, err := hex.DecodeString(hash)
+	return err == nil
+}
+
+func (c *blobContent) Open(mode int, perm int) (vfs.FileContents, error) {
+	f, err := os.Open(c.name)
+	if err != nil {
+		return nil, err
+	}
+	return &blobFd{f}, nil
+}
+
+func (c *blobContent) Size() (uint64, error) {
+	return uint64(c.size), nil
+}
+
+func (c *blobContent) Close() error {
+	return nil
+}
+
+func (fd *blobFd) Write(b []byte) (int, error) {
+	return 0, vfs.ErrReadOnly
+}
+
+func (fd *blobFd) Seek(off int64, sp vfs.SeekPoint) (int64, error) {
+	return fd.File.Seek(off, int(sp))
+}
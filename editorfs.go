@@ -2,30 +2,32 @@ package main
 
 import (
 	"9fans.net/go/plan9"
-	"9fans.net/go/plan9/client"
 	"amoraes.info/ded/buffer"
 	"amoraes.info/ded/vfs"
-	"amoraes.info/ded/vfs/memlistener"
 	"amoraes.info/ded/vfs/mixin"
 	"amoraes.info/ded/vfs/namespace"
 	"bytes"
 	"errors"
 	"fmt"
-	log "github.com/Sirupsen/logrus"
-	"io"
 )
 
 type (
+	// TextModel is the part of an editor exposed by EditorFS
+	TextModel interface {
+		Text() string
+		SetText(string)
+	}
+
 	EditorFS struct {
 		mixin.FS
-		editor *DedEditor
-		bar    *DedEditor
+		editor TextModel
+		bar    TextModel
 	}
 
 	editorFid struct {
 		name   string
 		mode   uint8
-		editor *DedEditor
+		editor TextModel
 
 		writer *buffer.B
 		reader *bytes.Reader
@@ -40,125 +42,100 @@ func (efid *editorFid) Close() error {
 	return nil
 }
 
-func (fs *EditorFS) ExportAt(ns *namespace.Namespace, name string) error {
-	var closelist []io.Closer
-	ls := memlistener.New("active")
-	closelist = append(closelist, ls)
-
-	defer func(cl *[]io.Closer) {
-		for _, c := range *cl {
-			if c != nil {
-				err := c.Close()
-				if err != nil {
-					log.WithFields(log.Fields{
-						"Module": "EditorFS",
-						"Err":    err,
-					}).Errorf("Error closing resource")
-				}
-			}
-		}
-	}(&closelist)
-
-	var err error
-	fileserver := &vfs.Fileserver{fs}
-	_, err = vfs.NewServer(fileserver, ls)
-	if err != nil {
-		println("exit 2")
-		ls.Close()
-		return err
-	}
-
-	nsclient, err := memlistener.Connect(ls, "nsclient")
-	closelist = append(closelist, nsclient)
-	if err != nil {
-		println("exit 1")
-		ls.Close()
-		return err
+var (
+	// qids of the files exposed by EditorFS
+	editorQids = map[string]plan9.Qid{
+		".":      {Type: plan9.QTDIR, Path: 0},
+		"body":   {Path: 1},
+		"header": {Path: 2},
 	}
+)
 
-	conn, err := client.NewConn(nsclient)
-	closelist = append(closelist, conn)
-	log.Debugf("client new conn %v/%v", conn, err)
-	if err != nil {
-		println("exit 3")
-		return err
+func NewEditorFS(editor, bar TextModel) *EditorFS {
+	return &EditorFS{
+		editor: editor,
+		bar:    bar,
 	}
+}
 
-	fsys, err := conn.Attach(nil, "nouser", "nogroup")
-	log.Debugf("attatch %v / %v", fsys, err)
-	if err != nil {
-		println("exit 4")
-		return err
-	}
+func (fs *EditorFS) ExportAt(ns *namespace.Namespace, name string) error {
+	return ns.MountServer(name, ".", vfs.NewFileserver(fs, vfs.Recover(), vfs.Logger()))
+}
 
-	rootfd, err := fsys.Open("/", plan9.OREAD)
-	closelist = append(closelist, rootfd)
-	log.Debugf("open %v / %v", rootfd, err)
-	if err != nil {
-		println("exit 5")
-		return err
+// fid returns the editorFid used by fc
+func (fs *EditorFS) fid(fc *plan9.Fcall, ctx *vfs.Context) (*editorFid, error) {
+	fd, ok := fs.GetFid(fc.Fid, ctx).(*editorFid)
+	if !ok {
+		return nil, vfs.ErrInvalidFid
 	}
+	return fd, nil
+}
 
-	err = ns.Mount(name, ".", rootfd)
-	if err != nil {
-		println("exit 6")
-		return err
-	}
-	// nothing to close
-	closelist = nil
-	return nil
+func (fs *EditorFS) Attach(fc *plan9.Fcall, ctx *vfs.Context) *plan9.Fcall {
+	ret := *fc
+	ret.Type++
+	fs.SetFid(ctx, fc.Fid, &editorFid{name: "."})
+	ret.Qid = editorQids["."]
+	return &ret
 }
 
 func (fs *EditorFS) Walk(fc *plan9.Fcall, ctx *vfs.Context) *plan9.Fcall {
-	println("editorfs walk: ", fc.String())
 	ret := *fc
 	ret.Type++
 
-	if len(fc.Wname) == 0 {
-		println("empty")
-		fs.SetFid(ctx, fc.Newfid, &editorFid{
-			name: ".",
-		})
-		return &ret
+	oldfd, err := fs.fid(fc, ctx)
+	if err != nil {
+		return vfs.PackError(&ret, err)
 	}
 
-	var efid *editorFid
-	oldfd := fs.GetFid(fc.Fid, ctx)
-	if oldfd != nil {
-		switch oldfd := oldfd.(type) {
-		case *editorFid:
-			efid = oldfd
+	// newfid is always a new editorFid, so walking doesn't change
+	// the fid used as the starting point
+	name := oldfd.name
+	for _, n := range fc.Wname {
+		if name != "." {
 			// the only way a walk from a previous fid is valid, is if
 			// the previous fid pointed to the editor itself, ie,
 			// the name was "."
-			if oldfd.name != "." {
-				return vfs.PackError(&ret, fmt.Errorf("editors don't have subdirs"))
-			}
+			err = fmt.Errorf("editors don't have subdirs")
+			break
 		}
-	} else {
-		efid = &editorFid{}
+		switch n {
+		case "body", "header":
+			name = n
+		case ".", "..":
+			name = "."
+		default:
+			err = fmt.Errorf("file not found: %v", n)
+		}
+		if err != nil {
+			break
+		}
+		ret.Wqid = append(ret.Wqid, editorQids[name])
 	}
-
-	switch fc.Wname[0] {
-	case "body", "header":
-		ret.Wqid = append(ret.Wqid, plan9.Qid{})
-		efid.name = fc.Wname[0]
-	case ".":
-		ret.Wqid = append(ret.Wqid, plan9.Qid{})
-		efid.name = "."
-	default:
-		return vfs.PackError(&ret, fmt.Errorf("file not found: %v", fc.Wname[0]))
+	switch {
+	case len(fc.Wname) > 0 && len(ret.Wqid) == 0:
+		return vfs.PackError(&ret, err)
+	case len(ret.Wqid) < len(fc.Wname):
+		// partial walks don't change newfid
+		return &ret
 	}
-	fs.SetFid(ctx, fc.Newfid, efid)
+	fs.SetFid(ctx, fc.Newfid, &editorFid{name: name})
 	return &ret
 }
 
 func (fs *EditorFS) Open(fc *plan9.Fcall, ctx *vfs.Context) *plan9.Fcall {
 	ret := *fc
 	ret.Type++
-	fd := fs.GetFid(fc.Fid, ctx).(*editorFid)
+	fd, err := fs.fid(fc, ctx)
+	if err != nil {
+		return vfs.PackError(&ret, err)
+	}
+	ret.Qid = editorQids[fd.name]
 	switch fd.name {
 	case ".":
+		if fc.Mode != plan9.OREAD {
+			return vfs.PackError(&ret, fmt.Errorf("invalid mode"))
+		}
 		return &ret
 	case "body", "header":
 		switch fc.Mode {
@@ -187,21 +164,30 @@ func (fs *EditorFS) Open(fc *plan9.Fcall, ctx *vfs.Context) *plan9.Fcall {
 			fd.writer = &buffer.B{}
 		}
 	}
+	ret.Iounit = fs.Iounit(ctx)
 	return &ret
 }
 
 func (fs *EditorFS) Read(fc *plan9.Fcall, ctx *vfs.Context) *plan9.Fcall {
 	ret := *fc
 	ret.Type++
-	fd := fs.GetFid(fc.Fid, ctx).(*editorFid)
-	switch fd.name {
-	case ".":
+	fd, err := fs.fid(fc, ctx)
+	if err != nil {
+		return vfs.PackError(&ret, err)
+	}
+	if fd.reader == nil {
 		// handle the directory listing later
 		return vfs.PackError(&ret, errors.New("cannot read root"))
 	}
 
-	fd.reader.Seek(int64(fc.Offset), 0)
-	ret.Data = make([]byte, int(fc.Count))
+	count := fc.Count
+	if iounit := fs.Iounit(ctx); count > iounit {
+		count = iounit
+	}
+	if _, err := fd.reader.Seek(int64(fc.Offset), 0); err != nil {
+		return vfs.PackError(&ret, err)
+	}
+	ret.Data = make([]byte, int(count))
 	n, _ := fd.reader.Read(ret.Data)
 	ret.Data = ret.Data[:n]
 	ret.Count = uint32(n)
@@ -211,9 +197,15 @@ func (fs *EditorFS) Read(fc *plan9.Fcall, ctx *vfs.Context) *plan9.Fcall {
 func (fs *EditorFS) Write(fc *plan9.Fcall, ctx *vfs.Context) *plan9.Fcall {
 	ret := *fc
 	ret.Type++
-	fd := fs.GetFid(fc.Fid, ctx).(*editorFid)
+	fd, err := fs.fid(fc, ctx)
+	if err != nil {
+		return vfs.PackError(&ret, err)
+	}
+	if fd.writer == nil {
+		return vfs.PackError(&ret, errors.New("file not open for writing"))
+	}
 
-	_, err := fd.writer.Seek(int64(fc.Offset), 0)
+	_, err = fd.writer.Seek(int64(fc.Offset), 0)
 	if err != nil {
 		return vfs.PackError(&ret, err)
 	}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"9fans.net/go/plan9"
+	"amoraes.info/ded/vfs/fstest"
+	"testing"
+)
+
+type (
+	// headlessModel is a TextModel without a window
+	headlessModel struct {
+		text string
+	}
+)
+
+var (
+	editorFuzzSeeds = [][]*plan9.Fcall{
+		{
+			{Type: plan9.Twalk, Fid: 0, Newfid: 1, Wname: []string{"body"}},
+			{Type: plan9.Topen, Fid: 1, Mode: plan9.OWRITE},
+			{Type: plan9.Twrite, Fid: 1, Offset: 2, Data: []byte("text")},
+			{Type: plan9.Tclunk, Fid: 1},
+		},
+		{
+			{Type: plan9.Twalk, Fid: 0, Newfid: 1, Wname: []string{"header"}},
+			{Type: plan9.Topen, Fid: 1, Mode: plan9.OREAD},
+			{Type: plan9.Tread, Fid: 1, Offset: 3, Count: 100},
+		},
+		{
+			{Type: plan9.Topen, Fid: 0, Mode: plan9.OREAD},
+			{Type: plan9.Tread, Fid: 0, Count: 100},
+		},
+	}
+)
+
+func (h *headlessModel) Text() string {
+	return h.text
+}
+
+func (h *headlessModel) SetText(text string) {
+	h.text = text
+}
+
+func newHeadlessEditorFS() *EditorFS {
+	return NewEditorFS(&headlessModel{text: "body text"}, &headlessModel{text: "Save | Quit"})
+}
+
+func FuzzEditorFSCalls(f *testing.F) {
+	for _, seed := range editorFuzzSeeds {
+		f.Add(fstest.EncodeCalls(seed...))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fstest.FuzzCalls(t, newHeadlessEditorFS(), data)
+	})
+}
+
+func FuzzEditorFSStream(f *testing.F) {
+	for _, seed := range editorFuzzSeeds {
+		fcs := []*plan9.Fcall{
+			{Type: plan9.Tversion, Tag: plan9.NOTAG, Msize: 8192, Version: "9P2000"},
+			{Type: plan9.Tattach, Fid: 0, Afid: plan9.NOFID, Uname: "fuzz"},
+		}
+		f.Add(fstest.EncodeStream(append(fcs, seed...)...))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fstest.FuzzStream(t, newHeadlessEditorFS(), data)
+	})
+}
@@ -1,9 +1,12 @@
 package main
 
 import (
+	"amoraes.info/ded/dumpfs"
+	"amoraes.info/ded/pipefs"
 	"amoraes.info/ded/vfs"
 	"amoraes.info/ded/vfs/namespace"
 	"bytes"
+	"crypto/tls"
 	"flag"
 	"fmt"
 	log "github.com/Sirupsen/logrus"
@@ -13,6 +16,7 @@ import (
 	"github.com/google/gxui/gxfont"
 	"github.com/google/gxui/math"
 	"github.com/google/gxui/themes/dark"
+	"net"
 	_ "time"
 )
 
@@ -89,22 +93,51 @@ func appMain(driver gxui.Driver) {
 	el.AddChild(dedEditor)
 	el.SetChildSize(dedEditorBar, math.Size{H: dedEditorBar.LineHeight()})
 
-	editorfs := &EditorFS{
-		editor: dedEditor,
-		bar:    dedEditorBar,
-	}
+	editorfs := NewEditorFS(dedEditor, dedEditorBar)
 	log.Infof("Exporting fs")
 	err := editorfs.ExportAt(&dedNamespace, "active")
 	log.Infof("EditorFS exported")
 	if err != nil {
 		log.Fatalf("Unable to export editor fs: %v", err)
 	}
+	if err := dedNamespace.MountServer("pipe", ".", vfs.NewFileserver(pipefs.New(), vfs.Recover())); err != nil {
+		log.Fatalf("Unable to mount pipefs: %v", err)
+	}
+	if *dumpStore != "" {
+		dump, err := dumpfs.New(".", *dumpStore)
+		if err != nil {
+			log.Fatalf("Unable to open the dump: %v", err)
+		}
+		if err := dedNamespace.MountServer("dump", ".", vfs.NewFileserver(dump, vfs.Recover())); err != nil {
+			log.Fatalf("Unable to mount the dump: %v", err)
+		}
+	}
+	// the servers of the mount commands use the TLS configuration
+	// of the export
+	var clientCfg *tls.Config
+	if tlsConfig.Enabled() {
+		var err error
+		if clientCfg, err = tlsConfig.Client(); err != nil {
+			log.Fatalf("Invalid TLS configuration: %v", err)
+		}
+	}
+	dial := namespace.NewDialer(clientCfg)
+	if *nsFile != "" {
+		if err := dedNamespace.ApplyFile(*nsFile, dial); err != nil {
+			log.Fatalf("Unable to apply the namespace file: %v", err)
+		}
+	}
+	nsctl := vfs.NewFile("ns", dedNamespace.CtlFile(dial))
+	nsctl.Mode = 0600
+	if err := dedNamespace.MountFile("ns", ".", nsctl); err != nil {
+		log.Fatalf("Unable to mount the ns file: %v", err)
+	}
 
 	/*
 		TODO(andre): this code requires the proper namespace implementation,
 		don't expose the FS.
 		editorfs := NewEditorFS(dedEditor, dedEditorBar)
-		srv, err := vfs.NewTCPServer(&vfs.Fileserver{editorfs}, "0.0.0.0:5640")
+		srv, err := vfs.NewTCPServer(vfs.NewFileserver(editorfs, vfs.Recover()), "0.0.0.0:5640")
 		if err != nil {
 			log.Printf("Error starting server: %v", err)
 			window.Close()
@@ -127,15 +160,34 @@ var (
 	rootCli *vfs.Client
 
 	dedNamespace namespace.Namespace
-	listenAddr   = flag.String("addr", ":5640", "Address to listen for incoming data")
+	listenAddr   = flag.String("addr", "127.0.0.1:5640", "Address to listen for incoming data, the ns file changes the namespace so other hosts should use -tlsverify")
+	dumpStore    = flag.String("dump", "", "Store of the snapshots of the current directory, mounted at dump")
+	nsFile       = flag.String("ns", "", "Namespace file applied to the ded namespace")
+
+	tlsConfig = vfs.TLSFlags(flag.CommandLine)
 )
 
 func main() {
+	flag.Parse()
 	log.SetLevel(log.DebugLevel)
 	fmt.Printf("")
 
 	export := namespace.NewExport(&dedNamespace)
-	srv, err := vfs.NewTCPServer(&vfs.Fileserver{export}, *listenAddr)
+	fileserver := vfs.NewFileserver(export, vfs.Recover(), vfs.Logger())
+	if !tlsConfig.VerifyClients && !loopback(*listenAddr) {
+		log.Warnf("Serving the namespace to other hosts without client certificates, anyone can change it")
+	}
+	var srv *vfs.Server
+	var err error
+	if tlsConfig.Enabled() {
+		cfg, cfgErr := tlsConfig.Server()
+		if cfgErr != nil {
+			log.Fatalf("Invalid TLS configuration: %v", cfgErr)
+		}
+		srv, err = vfs.NewTLSServer(fileserver, *listenAddr, cfg)
+	} else {
+		srv, err = vfs.NewTCPServer(fileserver, *listenAddr)
+	}
 	if err != nil {
 		log.Fatalf("Unable to start Ded tcp server. %v", err)
 	}
@@ -144,6 +196,19 @@ func main() {
 	srv.Close()
 }
 
+// loopback returns true if addr only accepts connections from this host
+func loopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
 func println(vals ...interface{}) {
 	buf := &bytes.Buffer{}
 	fmt.Fprintf(buf, "!PRINTLN!\t")
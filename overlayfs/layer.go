@@ -0,0 +1,183 @@
+package overlayfs
+
+import (
+	"9fans.net/go/plan9"
+	"9fans.net/go/plan9/client"
+	"amoraes.info/ded/vfs"
+	"amoraes.info/ded/vfs/memlistener"
+	"io"
+	"strings"
+)
+
+type (
+	// layer is a connection to one of the file servers of an overlay
+	layer struct {
+		srv  *vfs.Server
+		conn *client.Conn
+		fsys *client.Fsys
+	}
+)
+
+// dial serves fs over a memlistener and attaches to it
+func dial(name string, fs vfs.ServerFS) (*layer, error) {
+	ls := memlistener.New(name)
+	srv, err := vfs.NewServer(vfs.NewFileserver(fs, vfs.Recover()), ls)
+	if err != nil {
+		ls.Close()
+		return nil, err
+	}
+	conn, err := memlistener.Connect(ls, "overlay")
+	if err != nil {
+		srv.Close()
+		return nil, err
+	}
+	cli, err := client.NewConn(conn)
+	if err != nil {
+		conn.Close()
+		srv.Close()
+		return nil, err
+	}
+	fsys, err := cli.Attach(nil, "nouser", "")
+	if err != nil {
+		cli.Close()
+		srv.Close()
+		return nil, err
+	}
+	return &layer{srv: srv, conn: cli, fsys: fsys}, nil
+}
+
+func (l *layer) Close() error {
+	l.conn.Close()
+	return l.srv.Close()
+}
+
+func (l *layer) stat(p string) (*plan9.Dir, error) {
+	return l.fsys.Stat(p)
+}
+
+// exists returns true if p is in the layer
+func (l *layer) exists(p string) bool {
+	_, err := l.fsys.Stat(p)
+	return err == nil
+}
+
+// readDir returns every entry of the directory p
+func (l *layer) readDir(p string) ([]*plan9.Dir, error) {
+	fid, err := l.fsys.Open(p, plan9.OREAD)
+	if err != nil {
+		return nil, err
+	}
+	defer fid.Close()
+	return fid.Dirreadall()
+}
+
+// touch creates the empty file p
+func (l *layer) touch(p string) error {
+	fid, err := l.fsys.Create(p, plan9.OREAD, 0644)
+	if err != nil {
+		return err
+	}
+	return fid.Close()
+}
+
+// mkdir creates the directory p, the permissions are changed
+// by setAttr
+func (l *layer) mkdir(p string) error {
+	fid, err := l.fsys.Create(p, plan9.OREAD, plan9.DMDIR|0755)
+	if err != nil {
+		return err
+	}
+	return fid.Close()
+}
+
+// removeAll removes p and everything under it
+func (l *layer) removeAll(p string) error {
+	d, err := l.stat(p)
+	if err != nil {
+		return err
+	}
+	if d.Mode&plan9.DMDIR != 0 {
+		dirs, err := l.readDir(p)
+		if err != nil {
+			return err
+		}
+		for _, c := range dirs {
+			if err := l.removeAll(join(p, c.Name)); err != nil {
+				return err
+			}
+		}
+	}
+	return l.fsys.Remove(p)
+}
+
+// setAttr changes the mode and the mtime of p to the ones of d
+func (l *layer) setAttr(p string, d *plan9.Dir) error {
+	var nd plan9.Dir
+	nd.Null()
+	nd.Mode = d.Mode
+	nd.Mtime = d.Mtime
+	return l.fsys.Wstat(p, &nd)
+}
+
+// copyFile copies the file p with the attributes in d from src to l,
+// p is replaced if it already exists in l
+func (l *layer) copyFile(src *layer, p string, d *plan9.Dir) error {
+	in, err := src.fsys.Open(p, plan9.OREAD)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	var out *client.Fid
+	if old, err := l.stat(p); err == nil && old.Mode&plan9.DMDIR == 0 {
+		// the old file might be read-only
+		var nd plan9.Dir
+		nd.Null()
+		nd.Mode = old.Mode | 0200
+		if err := l.fsys.Wstat(p, &nd); err != nil {
+			return err
+		}
+		out, err = l.fsys.Open(p, plan9.OWRITE|plan9.OTRUNC)
+		if err != nil {
+			return err
+		}
+	} else {
+		if err == nil {
+			if err := l.removeAll(p); err != nil {
+				return err
+			}
+		}
+		out, err = l.fsys.Create(p, plan9.OWRITE, 0644)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return l.setAttr(p, d)
+}
+
+// join returns the path of name inside dir, the root is ""
+func join(dir, name string) string {
+	if dir == "" {
+		return name
+	}
+	return dir + "/" + name
+}
+
+// parent returns the directory holding p
+func parent(p string) string {
+	if i := strings.LastIndex(p, "/"); i >= 0 {
+		return p[:i]
+	}
+	return ""
+}
+
+// base returns the last element of p
+func base(p string) string {
+	return p[strings.LastIndex(p, "/")+1:]
+}
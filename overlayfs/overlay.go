@@ -0,0 +1,903 @@
+// Package overlayfs serves a writable view of a read-only tree.
+//
+// An Overlay is made of two file servers: the lower layer is never
+// changed by the clients, every change is kept by the upper layer.
+// Files are copied to the upper layer when they are opened for
+// writing or have their stat changed, removing a file of the lower
+// layer creates a whiteout in the upper layer: an empty file named
+// ".wh." followed by the name of the removed file. A directory
+// created over a whiteout holds a ".wh..opq" file, the entries of
+// the lower layer under it are hidden.
+//
+// The file ".ctl" at the root lists the changes when read, one per
+// line: "A path" for added files, "M path" for modified files and
+// "D path" for removed files. Writing "commit" applies the changes
+// to the lower layer, writing "discard" drops them.
+package overlayfs
+
+import (
+	"9fans.net/go/plan9"
+	"9fans.net/go/plan9/client"
+	"amoraes.info/ded/vfs"
+	"amoraes.info/ded/vfs/mixin"
+	"amoraes.info/ded/vfs/synth"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	Overlay struct {
+		mixin.FS
+		lower, upper *layer
+		ctl          *synth.Ctl
+		changes      *synth.Snapshot
+		started      uint32
+
+		// mu serializes the changes to the upper layer
+		mu sync.Mutex
+	}
+
+	// node is a file of the merged tree
+	node struct {
+		dir *plan9.Dir
+		// upper is true when the file is in the upper layer
+		upper bool
+		// lower is true when the file of the lower layer isn't
+		// hidden by a whiteout
+		lower bool
+	}
+
+	overlayFid struct {
+		sync.Mutex
+		o    *Overlay
+		path string
+		// ctl is true for the fids of the ctl file
+		ctl bool
+
+		// fid is the open file of a layer, fd the open ctl file
+		fid *client.Fid
+		fd  vfs.FileContents
+
+		// rclose is true when the file must be removed on clunk
+		rclose bool
+
+		// dirents holds the directory entries not read yet
+		dirents [][]byte
+		// diroffset is the offset of the next directory read
+		diroffset uint64
+	}
+
+	// ctlFd reads the changes and writes commands
+	ctlFd struct {
+		changes vfs.FileContents
+		ctl     vfs.FileContents
+	}
+)
+
+const (
+	// CtlName is the name of the ctl file, it hides any file with
+	// the same name at the root of the layers
+	CtlName = ".ctl"
+
+	whiteoutPrefix = ".wh."
+	opaqueName     = ".wh..opq"
+
+	// upperQid is set in the qid path of the files of the upper layer
+	upperQid = uint64(1) << 63
+	ctlQid   = uint64(1) << 62
+)
+
+var (
+	ErrBadName    = errors.New("invalid file name")
+	ErrNotFound   = errors.New("file not found")
+	ErrExists     = errors.New("file already exists")
+	ErrNotDir     = errors.New("not a directory")
+	ErrIsDir      = errors.New("is a directory")
+	ErrNotEmpty   = errors.New("directory not empty")
+	ErrPerm       = errors.New("permission denied")
+	ErrRemoveRoot = errors.New("cannot remove the root")
+	ErrDirOffset  = errors.New("invalid directory offset")
+	ErrRenameDir  = errors.New("cannot rename a directory of the lower layer")
+
+	errShortDirRead = errors.New("count too small for directory entry")
+)
+
+// New returns an overlay of upper on top of lower, both are served
+// until Close.
+func New(lower, upper vfs.ServerFS) (*Overlay, error) {
+	l, err := dial("lower", lower)
+	if err != nil {
+		return nil, err
+	}
+	u, err := dial("upper", upper)
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	o := &Overlay{
+		lower:   l,
+		upper:   u,
+		ctl:     synth.NewCtl(),
+		started: uint32(time.Now().Unix()),
+	}
+	o.ctl.Handle("commit", func(args []string) error {
+		return o.Commit()
+	})
+	o.ctl.Handle("discard", func(args []string) error {
+		return o.Discard()
+	})
+	o.changes = synth.NewSnapshot(func() ([]byte, error) {
+		lines, err := o.Changes()
+		if err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		for _, l := range lines {
+			fmt.Fprintln(&buf, l)
+		}
+		return buf.Bytes(), nil
+	})
+	return o, nil
+}
+
+// Close stops serving both layers
+func (o *Overlay) Close() error {
+	err := o.upper.Close()
+	if lerr := o.lower.Close(); err == nil {
+		err = lerr
+	}
+	return err
+}
+
+func whiteout(p string) string {
+	return join(parent(p), whiteoutPrefix+base(p))
+}
+
+func validName(name string) bool {
+	return name != "" && name != "." && name != ".." &&
+		!strings.Contains(name, "/") && !strings.HasPrefix(name, whiteoutPrefix)
+}
+
+// lookup finds p in the layers, every element of p is checked for
+// whiteouts and opaque directories
+func (o *Overlay) lookup(p string) (*node, error) {
+	var elems []string
+	if p != "" {
+		elems = strings.Split(p, "/")
+	}
+	var n *node
+	visible := true
+	for i := 0; i <= len(elems); i++ {
+		q := strings.Join(elems[:i], "/")
+		du, uerr := o.upper.stat(q)
+		var dl *plan9.Dir
+		if visible && i > 0 && o.upper.exists(whiteout(q)) {
+			visible = false
+		}
+		if visible {
+			var lerr error
+			if dl, lerr = o.lower.stat(q); lerr != nil {
+				visible = false
+			}
+		}
+		if uerr != nil && !visible {
+			return nil, ErrNotFound
+		}
+		n = &node{dir: dl, upper: uerr == nil, lower: visible}
+		if n.upper {
+			n.dir = du
+			n.dir.Qid.Path |= upperQid
+			// files and opaque directories hide the lower layer
+			if du.Mode&plan9.DMDIR == 0 || o.upper.exists(join(q, opaqueName)) {
+				visible = false
+			}
+		}
+	}
+	return n, nil
+}
+
+// entries returns the merged entries of the directory p
+func (o *Overlay) entries(p string, n *node) ([]*plan9.Dir, error) {
+	var dirs []*plan9.Dir
+	hidden := map[string]bool{}
+	merge := n.lower
+	if n.upper {
+		ds, err := o.upper.readDir(p)
+		if err != nil {
+			return nil, err
+		}
+		for _, d := range ds {
+			switch {
+			case d.Name == opaqueName:
+				merge = false
+			case strings.HasPrefix(d.Name, whiteoutPrefix):
+				hidden[d.Name[len(whiteoutPrefix):]] = true
+			case p == "" && d.Name == CtlName:
+			default:
+				d.Qid.Path |= upperQid
+				hidden[d.Name] = true
+				dirs = append(dirs, d)
+			}
+		}
+	}
+	if merge {
+		ds, err := o.lower.readDir(p)
+		if err != nil {
+			return nil, err
+		}
+		for _, d := range ds {
+			if !hidden[d.Name] && !(p == "" && d.Name == CtlName) {
+				dirs = append(dirs, d)
+			}
+		}
+	}
+	if p == "" {
+		dirs = append(dirs, o.ctlDir())
+	}
+	return dirs, nil
+}
+
+func (o *Overlay) ctlDir() *plan9.Dir {
+	return &plan9.Dir{
+		Qid:   plan9.Qid{Path: ctlQid},
+		Mode:  0600,
+		Atime: o.started,
+		Mtime: o.started,
+		Name:  CtlName,
+		Uid:   "none",
+		Gid:   "none",
+		Muid:  "none",
+	}
+}
+
+// copyUp copies p and its parents to the upper layer, o.mu must
+// be held
+func (o *Overlay) copyUp(p string) (*node, error) {
+	n, err := o.lookup(p)
+	if err != nil || n.upper {
+		return n, err
+	}
+	if _, err := o.copyUp(parent(p)); err != nil {
+		return nil, err
+	}
+	if n.dir.Mode&plan9.DMDIR != 0 {
+		if err := o.upper.mkdir(p); err != nil {
+			return nil, err
+		}
+		if err := o.upper.setAttr(p, n.dir); err != nil {
+			return nil, err
+		}
+	} else if err := o.upper.copyFile(o.lower, p, n.dir); err != nil {
+		return nil, err
+	}
+	return o.lookup(p)
+}
+
+// remove removes p from the merged tree, o.mu must be held
+func (o *Overlay) remove(p string) error {
+	if p == "" {
+		return ErrRemoveRoot
+	}
+	n, err := o.lookup(p)
+	if err != nil {
+		return err
+	}
+	if n.dir.Mode&plan9.DMDIR != 0 {
+		dirs, err := o.entries(p, n)
+		if err != nil {
+			return err
+		}
+		if len(dirs) > 0 {
+			return ErrNotEmpty
+		}
+	}
+	if n.upper {
+		// the directory can still hold whiteouts
+		if err := o.upper.removeAll(p); err != nil {
+			return err
+		}
+	}
+	if n.lower {
+		if _, err := o.copyUp(parent(p)); err != nil {
+			return err
+		}
+		return o.upper.touch(whiteout(p))
+	}
+	return nil
+}
+
+// Changes returns the changes kept by the upper layer, sorted by path
+func (o *Overlay) Changes() ([]string, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	var lines []string
+	if err := o.walkChanges("", &lines); err != nil {
+		return nil, err
+	}
+	sort.Slice(lines, func(i, j int) bool {
+		return lines[i][2:] < lines[j][2:]
+	})
+	return lines, nil
+}
+
+func (o *Overlay) walkChanges(p string, lines *[]string) error {
+	dirs, err := o.upper.readDir(p)
+	if err != nil {
+		return err
+	}
+	for _, d := range dirs {
+		q := join(p, d.Name)
+		switch {
+		case d.Name == opaqueName:
+		case strings.HasPrefix(d.Name, whiteoutPrefix):
+			*lines = append(*lines, "D "+join(p, d.Name[len(whiteoutPrefix):]))
+		case p == "" && d.Name == CtlName:
+		case d.Mode&plan9.DMDIR != 0:
+			if !o.lower.exists(q) {
+				*lines = append(*lines, "A "+q+"/")
+			}
+			if err := o.walkChanges(q, lines); err != nil {
+				return err
+			}
+		case o.lower.exists(q):
+			*lines = append(*lines, "M "+q)
+		default:
+			*lines = append(*lines, "A "+q)
+		}
+	}
+	return nil
+}
+
+// Commit applies the changes to the lower layer and drops them from
+// the upper layer
+func (o *Overlay) Commit() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if err := o.commit(""); err != nil {
+		return err
+	}
+	return o.discard()
+}
+
+func (o *Overlay) commit(p string) error {
+	dirs, err := o.upper.readDir(p)
+	if err != nil {
+		return err
+	}
+	// the removals go first, a directory created over a whiteout
+	// replaces the removed file
+	for _, d := range dirs {
+		q := join(p, strings.TrimPrefix(d.Name, whiteoutPrefix))
+		switch {
+		case d.Name == opaqueName:
+			old, err := o.lower.readDir(p)
+			if err != nil {
+				return err
+			}
+			for _, c := range old {
+				if err := o.lower.removeAll(join(p, c.Name)); err != nil {
+					return err
+				}
+			}
+		case strings.HasPrefix(d.Name, whiteoutPrefix) && o.lower.exists(q):
+			if err := o.lower.removeAll(q); err != nil {
+				return err
+			}
+		}
+	}
+	for _, d := range dirs {
+		q := join(p, d.Name)
+		switch {
+		case strings.HasPrefix(d.Name, whiteoutPrefix):
+		case p == "" && d.Name == CtlName:
+		case d.Mode&plan9.DMDIR != 0:
+			old, err := o.lower.stat(q)
+			if err == nil && old.Mode&plan9.DMDIR == 0 {
+				if err := o.lower.removeAll(q); err != nil {
+					return err
+				}
+			}
+			if err != nil || old.Mode&plan9.DMDIR == 0 {
+				if err := o.lower.mkdir(q); err != nil {
+					return err
+				}
+			}
+			if err := o.commit(q); err != nil {
+				return err
+			}
+			if err := o.lower.setAttr(q, d); err != nil {
+				return err
+			}
+		default:
+			if err := o.lower.copyFile(o.upper, q, d); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Discard drops the changes kept by the upper layer
+func (o *Overlay) Discard() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.discard()
+}
+
+func (o *Overlay) discard() error {
+	dirs, err := o.upper.readDir("")
+	if err != nil {
+		return err
+	}
+	for _, d := range dirs {
+		if err := o.upper.removeAll(d.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (fd *overlayFid) Close() error {
+	fd.Lock()
+	defer fd.Unlock()
+	var err error
+	if fd.fid != nil {
+		err = fd.fid.Close()
+		fd.fid = nil
+	}
+	if fd.fd != nil {
+		err = fd.fd.Close()
+		fd.fd = nil
+	}
+	if fd.rclose {
+		fd.rclose = false
+		fd.o.mu.Lock()
+		defer fd.o.mu.Unlock()
+		if rerr := fd.o.remove(fd.path); err == nil {
+			err = rerr
+		}
+	}
+	return err
+}
+
+func (fd *ctlFd) Read(b []byte) (int, error) {
+	return fd.changes.Read(b)
+}
+
+func (fd *ctlFd) Write(b []byte) (int, error) {
+	return fd.ctl.Write(b)
+}
+
+func (fd *ctlFd) Seek(off int64, sp vfs.SeekPoint) (int64, error) {
+	return fd.changes.Seek(off, sp)
+}
+
+func (fd *ctlFd) Sync() error {
+	return nil
+}
+
+func (fd *ctlFd) Close() error {
+	fd.ctl.Close()
+	return fd.changes.Close()
+}
+
+func (o *Overlay) fid(fc *plan9.Fcall, ctx *vfs.Context) (*overlayFid, error) {
+	fd, ok := o.GetFid(fc.Fid, ctx).(*overlayFid)
+	if !ok {
+		return nil, vfs.ErrInvalidFid
+	}
+	return fd, nil
+}
+
+func (o *Overlay) Attach(fc *plan9.Fcall, ctx *vfs.Context) *plan9.Fcall {
+	ret := *fc
+	ret.Type++
+
+	n, err := o.lookup("")
+	if err != nil {
+		return vfs.PackError(&ret, err)
+	}
+	o.SetFid(ctx, fc.Fid, &overlayFid{o: o})
+	ret.Qid = n.dir.Qid
+	return &ret
+}
+
+func (o *Overlay) Walk(fc *plan9.Fcall, ctx *vfs.Context) *plan9.Fcall {
+	ret := *fc
+	ret.Type++
+
+	fd, err := o.fid(fc, ctx)
+	if err != nil {
+		return vfs.PackError(&ret, err)
+	}
+	p, ctl := fd.path, fd.ctl
+	for i, name := range fc.Wname {
+		var qid plan9.Qid
+		switch {
+		case ctl:
+			err = ErrNotDir
+		case name == "..":
+			p = parent(p)
+		case p == "" && name == CtlName:
+			ctl = true
+			qid = o.ctlDir().Qid
+		case strings.HasPrefix(name, whiteoutPrefix):
+			err = ErrNotFound
+		default:
+			p = join(p, name)
+		}
+		if err == nil && !ctl {
+			var n *node
+			if n, err = o.lookup(p); err == nil {
+				qid = n.dir.Qid
+			}
+		}
+		if err != nil {
+			if i == 0 {
+				return vfs.PackError(&ret, err)
+			}
+			// a partial walk doesn't create newfid
+			return &ret
+		}
+		ret.Wqid = append(ret.Wqid, qid)
+	}
+	o.SetFid(ctx, fc.Newfid, &overlayFid{o: o, path: p, ctl: ctl})
+	return &ret
+}
+
+func (o *Overlay) Open(fc *plan9.Fcall, ctx *vfs.Context) *plan9.Fcall {
+	ret := *fc
+	ret.Type++
+
+	fd, err := o.fid(fc, ctx)
+	if err != nil {
+		return vfs.PackError(&ret, err)
+	}
+	rclose := fc.Mode&plan9.ORCLOSE != 0
+	if fd.ctl {
+		if rclose {
+			return vfs.PackError(&ret, ErrPerm)
+		}
+		changes, _ := o.changes.Open(int(fc.Mode), 0600)
+		ctl, _ := o.ctl.Open(int(fc.Mode), 0600)
+		fd.Lock()
+		fd.fd = &ctlFd{changes: changes, ctl: ctl}
+		fd.Unlock()
+		ret.Qid = o.ctlDir().Qid
+		ret.Iounit = o.Iounit(ctx)
+		return &ret
+	}
+	if rclose && fd.path == "" {
+		return vfs.PackError(&ret, ErrPerm)
+	}
+	n, err := o.lookup(fd.path)
+	if err != nil {
+		return vfs.PackError(&ret, err)
+	}
+	var fid *client.Fid
+	if n.dir.Mode&plan9.DMDIR != 0 {
+		if fc.Mode&3 != plan9.OREAD || fc.Mode&plan9.OTRUNC != 0 {
+			return vfs.PackError(&ret, ErrIsDir)
+		}
+	} else {
+		l := o.lower
+		write := fc.Mode&3 == plan9.OWRITE || fc.Mode&3 == plan9.ORDWR || fc.Mode&plan9.OTRUNC != 0
+		if write && !n.upper {
+			o.mu.Lock()
+			n, err = o.copyUp(fd.path)
+			o.mu.Unlock()
+			if err != nil {
+				return vfs.PackError(&ret, err)
+			}
+		}
+		if n.upper {
+			l = o.upper
+		}
+		fid, err = l.fsys.Open(fd.path, fc.Mode&^plan9.ORCLOSE)
+		if err != nil {
+			return vfs.PackError(&ret, err)
+		}
+	}
+	fd.Lock()
+	fd.fid = fid
+	fd.rclose = rclose
+	fd.Unlock()
+	ret.Qid = n.dir.Qid
+	ret.Iounit = o.Iounit(ctx)
+	return &ret
+}
+
+func (o *Overlay) Create(fc *plan9.Fcall, ctx *vfs.Context) *plan9.Fcall {
+	ret := *fc
+	ret.Type++
+
+	fd, err := o.fid(fc, ctx)
+	if err != nil {
+		return vfs.PackError(&ret, err)
+	}
+	if fd.ctl {
+		return vfs.PackError(&ret, ErrNotDir)
+	}
+	if !validName(fc.Name) || (fd.path == "" && fc.Name == CtlName) {
+		return vfs.PackError(&ret, ErrBadName)
+	}
+	p := join(fd.path, fc.Name)
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if _, err := o.lookup(p); err == nil {
+		return vfs.PackError(&ret, ErrExists)
+	}
+	dir, err := o.copyUp(fd.path)
+	if err != nil {
+		return vfs.PackError(&ret, err)
+	}
+	if dir.dir.Mode&plan9.DMDIR == 0 {
+		return vfs.PackError(&ret, ErrNotDir)
+	}
+	fid, err := o.upper.fsys.Create(p, fc.Mode&^plan9.ORCLOSE, fc.Perm)
+	if err != nil {
+		return vfs.PackError(&ret, err)
+	}
+	if wh := whiteout(p); o.upper.exists(wh) {
+		// the new file replaces the removed one
+		err = o.upper.fsys.Remove(wh)
+		if err == nil && fc.Perm&plan9.DMDIR != 0 {
+			err = o.upper.touch(join(p, opaqueName))
+		}
+		if err != nil {
+			fid.Close()
+			return vfs.PackError(&ret, err)
+		}
+	}
+	if fc.Perm&plan9.DMDIR != 0 {
+		// directories are read from the layers
+		fid.Close()
+		fid = nil
+	}
+	fd.Lock()
+	fd.path = p
+	fd.fid = fid
+	fd.rclose = fc.Mode&plan9.ORCLOSE != 0
+	fd.Unlock()
+	n, err := o.lookup(p)
+	if err != nil {
+		return vfs.PackError(&ret, err)
+	}
+	ret.Qid = n.dir.Qid
+	ret.Iounit = o.Iounit(ctx)
+	return &ret
+}
+
+func (o *Overlay) Read(fc *plan9.Fcall, ctx *vfs.Context) *plan9.Fcall {
+	ret := *fc
+	ret.Type++
+
+	fd, err := o.fid(fc, ctx)
+	if err != nil {
+		return vfs.PackError(&ret, err)
+	}
+	count := fc.Count
+	if iounit := o.Iounit(ctx); count > iounit {
+		count = iounit
+	}
+	buf := make([]byte, int(count))
+
+	fd.Lock()
+	defer fd.Unlock()
+	var sz int
+	switch {
+	case fd.fd != nil:
+		if _, err = fd.fd.Seek(int64(fc.Offset), vfs.SeekStart); err == nil {
+			sz, err = fd.fd.Read(buf)
+		}
+	case fd.fid != nil:
+		sz, err = fd.fid.ReadAt(buf, int64(fc.Offset))
+	default:
+		buf, err = o.readDir(fd, fc.Offset, count)
+		sz = len(buf)
+	}
+	if err != nil && err != io.EOF {
+		return vfs.PackError(&ret, err)
+	}
+	ret.Data = buf[:sz]
+	ret.Count = uint32(sz)
+	return &ret
+}
+
+// readDir returns the directory entries of fd that fit in count bytes,
+// reading from offset 0 starts again from the first entry.
+func (o *Overlay) readDir(fd *overlayFid, offset uint64, count uint32) ([]byte, error) {
+	if offset == 0 {
+		fd.dirents = nil
+		fd.diroffset = 0
+		n, err := o.lookup(fd.path)
+		if err != nil {
+			return nil, err
+		}
+		dirs, err := o.entries(fd.path, n)
+		if err != nil {
+			return nil, err
+		}
+		for _, d := range dirs {
+			buf, err := d.Bytes()
+			if err != nil {
+				return nil, err
+			}
+			fd.dirents = append(fd.dirents, buf)
+		}
+	} else if offset != fd.diroffset {
+		return nil, ErrDirOffset
+	}
+
+	var data []byte
+	for len(fd.dirents) > 0 && len(data)+len(fd.dirents[0]) <= int(count) {
+		data = append(data, fd.dirents[0]...)
+		fd.dirents = fd.dirents[1:]
+	}
+	if len(data) == 0 && len(fd.dirents) > 0 {
+		return nil, errShortDirRead
+	}
+	fd.diroffset += uint64(len(data))
+	return data, nil
+}
+
+func (o *Overlay) Write(fc *plan9.Fcall, ctx *vfs.Context) *plan9.Fcall {
+	ret := *fc
+	ret.Type++
+
+	fd, err := o.fid(fc, ctx)
+	if err != nil {
+		return vfs.PackError(&ret, err)
+	}
+	fd.Lock()
+	defer fd.Unlock()
+	var sz int
+	switch {
+	case fd.fd != nil:
+		sz, err = fd.fd.Write(fc.Data)
+	case fd.fid != nil:
+		sz, err = fd.fid.WriteAt(fc.Data, int64(fc.Offset))
+	default:
+		err = ErrIsDir
+	}
+	if err != nil {
+		return vfs.PackError(&ret, err)
+	}
+	ret.Count = uint32(sz)
+	return &ret
+}
+
+func (o *Overlay) Remove(fc *plan9.Fcall, ctx *vfs.Context) *plan9.Fcall {
+	ret := *fc
+	ret.Type++
+
+	fd, err := o.fid(fc, ctx)
+	if err != nil {
+		return vfs.PackError(&ret, err)
+	}
+	// the fid is clunked even if the remove fails
+	fd.Lock()
+	fd.rclose = false
+	fd.Unlock()
+	fd.Close()
+	if fd.ctl {
+		return vfs.PackError(&ret, ErrPerm)
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if err := o.remove(fd.path); err != nil {
+		return vfs.PackError(&ret, err)
+	}
+	return &ret
+}
+
+func (o *Overlay) Stat(fc *plan9.Fcall, ctx *vfs.Context) *plan9.Fcall {
+	ret := *fc
+	ret.Type++
+
+	fd, err := o.fid(fc, ctx)
+	if err != nil {
+		return vfs.PackError(&ret, err)
+	}
+	var dir *plan9.Dir
+	if fd.ctl {
+		dir = o.ctlDir()
+	} else {
+		n, err := o.lookup(fd.path)
+		if err != nil {
+			return vfs.PackError(&ret, err)
+		}
+		dir = n.dir
+		if fd.path == "" {
+			dir.Name = "/"
+		}
+	}
+	ret.Stat, err = dir.Bytes()
+	if err != nil {
+		return vfs.PackError(&ret, err)
+	}
+	return &ret
+}
+
+// Wstat copies the file to the upper layer and changes it there,
+// renaming a file of the lower layer leaves a whiteout behind.
+func (o *Overlay) Wstat(fc *plan9.Fcall, ctx *vfs.Context) *plan9.Fcall {
+	ret := *fc
+	ret.Type++
+
+	fd, err := o.fid(fc, ctx)
+	if err != nil {
+		return vfs.PackError(&ret, err)
+	}
+	if fd.ctl {
+		return vfs.PackError(&ret, ErrPerm)
+	}
+	dir, err := plan9.UnmarshalDir(fc.Stat)
+	if err != nil {
+		return vfs.PackError(&ret, err)
+	}
+	var null plan9.Dir
+	null.Null()
+	if *dir == null {
+		// a wstat that changes nothing asks for a sync
+		return &ret
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	p := fd.path
+	n, err := o.lookup(p)
+	if err != nil {
+		return vfs.PackError(&ret, err)
+	}
+	np := p
+	rename := dir.Name != "" && dir.Name != n.dir.Name
+	if rename {
+		np = join(parent(p), dir.Name)
+		switch {
+		case p == "":
+			return vfs.PackError(&ret, ErrPerm)
+		case !validName(dir.Name) || (parent(p) == "" && dir.Name == CtlName):
+			return vfs.PackError(&ret, ErrBadName)
+		case n.lower && n.dir.Mode&plan9.DMDIR != 0:
+			return vfs.PackError(&ret, ErrRenameDir)
+		}
+		if _, err := o.lookup(np); err == nil {
+			return vfs.PackError(&ret, ErrExists)
+		}
+	}
+	if _, err := o.copyUp(p); err != nil {
+		return vfs.PackError(&ret, err)
+	}
+	if err := o.upper.fsys.Wstat(p, dir); err != nil {
+		return vfs.PackError(&ret, err)
+	}
+	if rename {
+		if wh := whiteout(np); o.upper.exists(wh) {
+			// the renamed file replaces the removed one
+			err := o.upper.fsys.Remove(wh)
+			if err == nil && n.dir.Mode&plan9.DMDIR != 0 {
+				err = o.upper.touch(join(np, opaqueName))
+			}
+			if err != nil {
+				return vfs.PackError(&ret, err)
+			}
+		}
+		if n.lower {
+			if err := o.upper.touch(whiteout(p)); err != nil {
+				return vfs.PackError(&ret, err)
+			}
+		}
+		fd.Lock()
+		fd.path = np
+		fd.Unlock()
+	}
+	return &ret
+}
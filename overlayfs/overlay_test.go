@@ -0,0 +1,198 @@
+package overlayfs
+
+import (
+	"9fans.net/go/plan9"
+	"amoraes.info/ded/ramfs"
+	"amoraes.info/ded/ufs"
+	"amoraes.info/ded/vfs/fstest"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// lowerDir creates the directory used as the lower layer
+func lowerDir(t *testing.T) string {
+	root, err := ioutil.TempDir("", "overlayfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(root) })
+	files := map[string]string{
+		"a.txt":         "lower\n",
+		"dir/b.txt":     "b\n",
+		"dir/sub/c.txt": "c\n",
+	}
+	for name, data := range files {
+		name = filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+func newOverlay(t *testing.T, root string) *Overlay {
+	o, err := New(&ufs.Ufs{Root: root}, ramfs.New(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { o.Close() })
+	return o
+}
+
+func TestConformance(t *testing.T) {
+	fstest.Run(t, newOverlay(t, lowerDir(t)), fstest.Config{
+		File:     "dir/b.txt",
+		Contents: []byte("b\n"),
+		Dir:      "dir",
+		Writable: true,
+	})
+}
+
+func TestOverlay(t *testing.T) {
+	root := lowerDir(t)
+	o := newOverlay(t, root)
+	c, err := dial("overlay", o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	read := func(name string) string {
+		t.Helper()
+		fid, err := c.fsys.Open(name, plan9.OREAD)
+		if err != nil {
+			return err.Error()
+		}
+		defer fid.Close()
+		data, _ := ioutil.ReadAll(fid)
+		return string(data)
+	}
+	write := func(name, data string) {
+		t.Helper()
+		fid, err := c.fsys.Open(name, plan9.OWRITE|plan9.OTRUNC)
+		if err != nil {
+			fid, err = c.fsys.Create(name, plan9.OWRITE, 0644)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer fid.Close()
+		if _, err := fid.Write([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	list := func(name string) string {
+		t.Helper()
+		dirs, err := c.readDir(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, d := range dirs {
+			names = append(names, d.Name)
+		}
+		sort.Strings(names)
+		return strings.Join(names, " ")
+	}
+	disk := func(name string) string {
+		data, err := ioutil.ReadFile(filepath.Join(root, name))
+		if err != nil {
+			return "missing"
+		}
+		return string(data)
+	}
+	change := func() {
+		t.Helper()
+		write("a.txt", "upper\n")
+		write("new.txt", "new\n")
+		if err := c.fsys.Remove("dir/b.txt"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	change()
+	if s := read("a.txt"); s != "upper\n" || disk("a.txt") != "lower\n" {
+		t.Errorf("Writes should be copied up: %q / %q", s, disk("a.txt"))
+	}
+	if c.exists("dir/b.txt") || disk("dir/b.txt") != "b\n" {
+		t.Errorf("Removed files should be hidden and kept in the lower layer")
+	}
+	if s := list(""); s != ".ctl a.txt dir new.txt" {
+		t.Errorf("Unexpected root %q", s)
+	}
+	if s := read(CtlName); s != "M a.txt\nD dir/b.txt\nA new.txt\n" {
+		t.Errorf("Unexpected changes %q", s)
+	}
+
+	if err := c.fsys.Remove("dir/sub/c.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.fsys.Remove("dir/sub"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.mkdir("dir/sub"); err != nil {
+		t.Fatal(err)
+	}
+	if s := list("dir/sub"); s != "" {
+		t.Errorf("A directory created over a whiteout should be empty: %q", s)
+	}
+
+	// discard restores the lower layer
+	write(CtlName, "discard\n")
+	if s := read("a.txt"); s != "lower\n" {
+		t.Errorf("Unexpected contents after discard %q", s)
+	}
+	if s := list("dir"); s != "b.txt sub" {
+		t.Errorf("Unexpected dir after discard %q", s)
+	}
+	if s := read(CtlName); s != "" {
+		t.Errorf("Unexpected changes after discard %q", s)
+	}
+
+	// a directory renamed over a whiteout hides the removed one
+	if err := c.fsys.Remove("dir/sub/c.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.fsys.Remove("dir/sub"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.mkdir("dir/new"); err != nil {
+		t.Fatal(err)
+	}
+	fid, err := c.fsys.Open("dir/new", plan9.OREAD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var d plan9.Dir
+	d.Null()
+	d.Name = "sub"
+	err = fid.Wstat(&d)
+	fid.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := list("dir/sub"); s != "" {
+		t.Errorf("A directory renamed over a whiteout should be empty: %q", s)
+	}
+
+	// commit writes the changes to the lower layer
+	change()
+	write(CtlName, "commit\n")
+	switch {
+	case disk("a.txt") != "upper\n", disk("new.txt") != "new\n", disk("dir/b.txt") != "missing":
+		t.Errorf("Changes weren't committed")
+	case disk("dir/sub/c.txt") != "missing":
+		t.Errorf("The renamed directory should replace the removed one")
+	case read(CtlName) != "":
+		t.Errorf("Commit should drop the changes")
+	case read("a.txt") != "upper\n":
+		t.Errorf("Unexpected contents after commit")
+	}
+}
@@ -0,0 +1,253 @@
+// Package pipefs is a file server of pipes, like the #| device of
+// Plan 9.
+//
+// Creating a directory creates a pipe, the directory holds the two
+// ends of the pipe: data0 and data1. The data written to one end is
+// read from the other, reads wait until the other end writes.
+//
+// An end hangs up when every open of it is closed, after that the
+// reads on the other end return EOF once the buffer is empty and
+// the writes fail. When both ends are closed the pipe starts again.
+package pipefs
+
+import (
+	"9fans.net/go/plan9"
+	"amoraes.info/ded/vfs"
+	"amoraes.info/ded/vfs/filetree"
+	"context"
+	"errors"
+	"io"
+	"sync"
+)
+
+type (
+	Pipefs struct {
+		filetree.FS
+	}
+
+	// pipe holds the data written to both ends, buf[i] is written
+	// to end i and read from the other end
+	pipe struct {
+		mu     sync.Mutex
+		buf    [2][]byte
+		opens  [2]int
+		hungup [2]bool
+		closed bool
+		// wake is closed when the state of the pipe changes
+		wake chan struct{}
+	}
+
+	// pipeEnd is the content of data0 and data1
+	pipeEnd struct {
+		p   *pipe
+		end int
+	}
+
+	pipeFd struct {
+		p      *pipe
+		end    int
+		closed bool
+	}
+)
+
+const (
+	// Bufsize is the number of bytes kept by each direction of a pipe,
+	// writes wait when the buffer is full.
+	Bufsize = 64 * 1024
+)
+
+var (
+	ErrHungup  = errors.New("write on closed pipe")
+	ErrNotPipe = errors.New("only directories can be created")
+)
+
+func New() *Pipefs {
+	fs := &Pipefs{}
+	fs.Root = vfs.NewDir("")
+	fs.Root.Mode |= 0200
+	return fs
+}
+
+func newPipe() *pipe {
+	return &pipe{wake: make(chan struct{})}
+}
+
+// broadcast wakes every pending request, p.mu must be held
+func (p *pipe) broadcast() {
+	close(p.wake)
+	p.wake = make(chan struct{})
+}
+
+// wait releases p.mu until the state of p changes or ctx is done,
+// p.mu must be held
+func (p *pipe) wait(ctx context.Context) error {
+	wake := p.wake
+	p.mu.Unlock()
+	defer p.mu.Lock()
+	select {
+	case <-wake:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// close hangs up both ends, it is called when the pipe is removed
+func (p *pipe) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	p.buf = [2][]byte{}
+	p.broadcast()
+}
+
+func (e *pipeEnd) Open(mode int, perm int) (vfs.FileContents, error) {
+	p := e.p
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return nil, ErrHungup
+	}
+	p.opens[e.end]++
+	p.hungup[e.end] = false
+	p.broadcast()
+	return &pipeFd{p: p, end: e.end}, nil
+}
+
+// Size returns the number of bytes waiting to be read from e
+func (e *pipeEnd) Size() (uint64, error) {
+	e.p.mu.Lock()
+	defer e.p.mu.Unlock()
+	return uint64(len(e.p.buf[1-e.end])), nil
+}
+
+func (e *pipeEnd) Close() error {
+	return nil
+}
+
+func (fd *pipeFd) Read(b []byte) (int, error) {
+	return fd.ReadContext(context.Background(), b)
+}
+
+func (fd *pipeFd) ReadContext(ctx context.Context, b []byte) (int, error) {
+	p := fd.p
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	other := 1 - fd.end
+	for len(p.buf[other]) == 0 {
+		if fd.closed || p.closed || p.hungup[other] {
+			return 0, io.EOF
+		}
+		if err := p.wait(ctx); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, p.buf[other])
+	p.buf[other] = p.buf[other][n:]
+	p.broadcast()
+	return n, nil
+}
+
+func (fd *pipeFd) Write(b []byte) (int, error) {
+	return fd.WriteContext(context.Background(), b)
+}
+
+// WriteContext adds b to the buffer of the other end, it waits
+// while the buffer is full.
+func (fd *pipeFd) WriteContext(ctx context.Context, b []byte) (int, error) {
+	p := fd.p
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n := 0
+	for n < len(b) {
+		if fd.closed || p.closed || p.hungup[1-fd.end] {
+			return n, ErrHungup
+		}
+		free := Bufsize - len(p.buf[fd.end])
+		if free <= 0 {
+			if err := p.wait(ctx); err != nil {
+				return n, err
+			}
+			continue
+		}
+		if free > len(b)-n {
+			free = len(b) - n
+		}
+		p.buf[fd.end] = append(p.buf[fd.end], b[n:n+free]...)
+		n += free
+		p.broadcast()
+	}
+	return n, nil
+}
+
+// Seek is a no-op, pipes are streams
+func (fd *pipeFd) Seek(off int64, sp vfs.SeekPoint) (int64, error) {
+	return 0, nil
+}
+
+func (fd *pipeFd) Sync() error {
+	return nil
+}
+
+// Close hangs up the end of fd if it was its last open
+func (fd *pipeFd) Close() error {
+	p := fd.p
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if fd.closed {
+		return nil
+	}
+	fd.closed = true
+	p.opens[fd.end]--
+	if p.opens[fd.end] == 0 {
+		p.hungup[fd.end] = true
+	}
+	if p.opens[0] == 0 && p.opens[1] == 0 {
+		// nobody is using the pipe, start again
+		p.buf = [2][]byte{}
+		p.hungup = [2]bool{}
+	}
+	p.broadcast()
+	return nil
+}
+
+// Create creates a pipe, only directories can be created
+func (fs *Pipefs) Create(fc *plan9.Fcall, ctx *vfs.Context) *plan9.Fcall {
+	if fc.Perm&plan9.DMDIR == 0 {
+		ret := *fc
+		ret.Type++
+		return vfs.PackError(&ret, ErrNotPipe)
+	}
+	ret := fs.FS.Create(fc, ctx)
+	if ret.Type == plan9.Rerror {
+		return ret
+	}
+	dir, _ := fs.File(fc.Fid, ctx)
+	p := newPipe()
+	for i, name := range []string{"data0", "data1"} {
+		f := vfs.NewFile(name, &pipeEnd{p: p, end: i})
+		f.Mode = 0666
+		dir.Add(f)
+	}
+	// the ends can't be removed and nothing else can be created
+	dir.SetMode(dir.Perm() &^ 0222)
+	return ret
+}
+
+// Remove removes a pipe, the ends can't be removed
+func (fs *Pipefs) Remove(fc *plan9.Fcall, ctx *vfs.Context) *plan9.Fcall {
+	dir, ok := fs.File(fc.Fid, ctx)
+	if !ok || !dir.IsDir() || dir == fs.Root {
+		return fs.FS.Remove(fc, ctx)
+	}
+	if p := dir.Parent(); p != nil && p.Perm()&0200 == 0 {
+		return fs.FS.Remove(fc, ctx)
+	}
+	for _, c := range dir.Childs() {
+		if end, ok := c.Content().(*pipeEnd); ok {
+			end.p.close()
+		}
+		dir.Remove(c)
+	}
+	return fs.FS.Remove(fc, ctx)
+}
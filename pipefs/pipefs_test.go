@@ -0,0 +1,104 @@
+package pipefs
+
+import (
+	"9fans.net/go/plan9"
+	"amoraes.info/ded/vfs"
+	"amoraes.info/ded/vfs/filetree"
+	"amoraes.info/ded/vfs/namespace"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestPipe(t *testing.T) {
+	ns := &namespace.Namespace{}
+	if err := ns.MountServer("pipe", ".", vfs.NewFileserver(New())); err != nil {
+		t.Fatal(err)
+	}
+	root, err := ns.Walk("/pipe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := root.Create("p", plan9.OREAD, plan9.DMDIR|0755); err != nil {
+		t.Fatal(err)
+	}
+	root.Close()
+
+	open := func(name string, mode uint8) io.ReadWriteCloser {
+		fid, err := ns.Walk("/pipe/p/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := fid.Open(mode); err != nil {
+			t.Fatal(err)
+		}
+		return fid
+	}
+	end0 := open("data0", plan9.ORDWR)
+	end1 := open("data1", plan9.ORDWR)
+
+	read := make(chan string)
+	go func() {
+		buf := make([]byte, 10)
+		n, _ := end1.Read(buf)
+		read <- string(buf[:n])
+	}()
+	select {
+	case s := <-read:
+		t.Fatalf("Read should wait for the other end: %q", s)
+	case <-time.After(10 * time.Millisecond):
+	}
+	if _, err := end0.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if s := <-read; s != "hello" {
+		t.Errorf("Unexpected read %q", s)
+	}
+
+	// data written before the hang up is still read, then EOF
+	if _, err := end1.Write([]byte("bye")); err != nil {
+		t.Fatal(err)
+	}
+	end1.Close()
+	if data, err := ioutil.ReadAll(end0); err != nil || string(data) != "bye" {
+		t.Errorf("Unexpected read %q / %v", data, err)
+	}
+	if _, err := end0.Write([]byte("x")); err == nil {
+		t.Errorf("Write after the hang up should fail")
+	}
+	end0.Close()
+
+	if _, err := ns.Walk("/pipe/p/data2"); err == nil {
+		t.Errorf("Pipes have only two ends")
+	}
+}
+
+func TestCreate(t *testing.T) {
+	srv := vfs.NewFileserver(New())
+	ctx := vfs.NewContext()
+	steps := []struct {
+		fc  plan9.Fcall
+		err error
+	}{
+		{fc: plan9.Fcall{Type: plan9.Tversion, Msize: 8192, Version: "9P2000"}},
+		{fc: plan9.Fcall{Type: plan9.Tattach, Fid: 1, Afid: plan9.NOFID}},
+		{fc: plan9.Fcall{Type: plan9.Twalk, Fid: 1, Newfid: 2}},
+		{fc: plan9.Fcall{Type: plan9.Tcreate, Fid: 2, Name: "file", Perm: 0644, Mode: plan9.OWRITE}, err: ErrNotPipe},
+		{fc: plan9.Fcall{Type: plan9.Tcreate, Fid: 2, Name: "p", Perm: plan9.DMDIR | 0755}},
+		{fc: plan9.Fcall{Type: plan9.Twalk, Fid: 1, Newfid: 3, Wname: []string{"p", "data1"}}},
+		{fc: plan9.Fcall{Type: plan9.Tremove, Fid: 3}, err: filetree.ErrPerm},
+		{fc: plan9.Fcall{Type: plan9.Tremove, Fid: 2}},
+		{fc: plan9.Fcall{Type: plan9.Twalk, Fid: 1, Newfid: 4, Wname: []string{"p"}}, err: filetree.ErrNotFound},
+	}
+	for i, s := range steps {
+		fc := s.fc
+		ret := srv.Call(&fc, ctx)
+		switch {
+		case s.err == nil && ret.Type != fc.Type+1:
+			t.Errorf("step %v: expecting success got %v", i, ret)
+		case s.err != nil && (ret.Type != plan9.Rerror || ret.Ename != s.err.Error()):
+			t.Errorf("step %v: expecting %v got %v", i, s.err, ret)
+		}
+	}
+}
@@ -0,0 +1,331 @@
+// Package ramfs is a file server that keeps every file in memory.
+package ramfs
+
+import (
+	"9fans.net/go/plan9"
+	"amoraes.info/ded/vfs"
+	"amoraes.info/ded/vfs/filetree"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+type (
+	Ramfs struct {
+		filetree.FS
+		// Quota is the maximum number of bytes used by all files,
+		// 0 means no limit.
+		Quota uint64
+
+		mu   sync.Mutex
+		used uint64
+	}
+
+	// ramContent is the content of a file, every change in its
+	// size is accounted in the quota of fs
+	ramContent struct {
+		*vfs.InMemory
+		fs *Ramfs
+		// mu serializes the changes to the size
+		mu sync.Mutex
+		// removed is set when the file is removed, its size was
+		// released and it can't grow again
+		removed bool
+	}
+
+	ramFd struct {
+		vfs.FileContents
+		c   *ramContent
+		cur int64
+	}
+)
+
+var (
+	ErrQuota   = errors.New("quota exceeded")
+	ErrRemoved = errors.New("file removed")
+	// ErrUnsupported is returned by Save when the directory replaced
+	// holds files that Load skips, like links and devices
+	ErrUnsupported = errors.New("snapshot holds files that can't be loaded")
+)
+
+// New returns an empty Ramfs that can hold quota bytes
+func New(quota uint64) *Ramfs {
+	fs := &Ramfs{Quota: quota}
+	fs.Root = vfs.NewDir("")
+	fs.Root.Mode |= 0200
+	fs.NewContent = func(name string, perm plan9.Perm) (vfs.HasContent, error) {
+		return fs.newContent(nil), nil
+	}
+	return fs
+}
+
+func (fs *Ramfs) newContent(data []byte) *ramContent {
+	return &ramContent{InMemory: vfs.NewInMemory(data), fs: fs}
+}
+
+// Used returns the number of bytes used by all files
+func (fs *Ramfs) Used() uint64 {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.used
+}
+
+// reserve accounts n more bytes, it fails if the quota is exceeded
+func (fs *Ramfs) reserve(n uint64) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.Quota > 0 && fs.used+n > fs.Quota {
+		return ErrQuota
+	}
+	fs.used += n
+	return nil
+}
+
+func (fs *Ramfs) release(n uint64) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.used -= n
+}
+
+// resize changes the size of c from old to sz, c.mu must be held
+func (c *ramContent) resize(old, sz uint64) error {
+	if c.removed {
+		return ErrRemoved
+	}
+	if sz > old {
+		if err := c.fs.reserve(sz - old); err != nil {
+			return err
+		}
+	}
+	if err := c.InMemory.Truncate(sz); err != nil {
+		if sz > old {
+			c.fs.release(sz - old)
+		}
+		return err
+	}
+	if sz < old {
+		c.fs.release(old - sz)
+	}
+	return nil
+}
+
+func (c *ramContent) Open(mode int, perm int) (vfs.FileContents, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if mode&plan9.OTRUNC != 0 {
+		old, _ := c.InMemory.Size()
+		if err := c.resize(old, 0); err != nil {
+			return nil, err
+		}
+	}
+	fd, err := c.InMemory.Open(mode&^plan9.OTRUNC, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &ramFd{FileContents: fd, c: c}, nil
+}
+
+func (c *ramContent) Truncate(sz uint64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	old, _ := c.InMemory.Size()
+	return c.resize(old, sz)
+}
+
+// Close releases the contents, it is called when the file is removed
+func (c *ramContent) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.removed {
+		return nil
+	}
+	old, _ := c.InMemory.Size()
+	c.fs.release(old)
+	c.removed = true
+	return c.InMemory.Close()
+}
+
+// bytes returns a copy of the contents
+func (c *ramContent) bytes() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]byte(nil), c.InMemory.Bytes()...)
+}
+
+func (fd *ramFd) Read(b []byte) (int, error) {
+	n, err := fd.FileContents.Read(b)
+	fd.cur += int64(n)
+	return n, err
+}
+
+func (fd *ramFd) Write(b []byte) (int, error) {
+	fd.c.mu.Lock()
+	defer fd.c.mu.Unlock()
+	if fd.c.removed {
+		// the size of a removed file was given back to the quota
+		return 0, ErrRemoved
+	}
+	old, _ := fd.c.InMemory.Size()
+	var reserved uint64
+	if end := uint64(fd.cur) + uint64(len(b)); end > old {
+		if err := fd.c.fs.reserve(end - old); err != nil {
+			return 0, err
+		}
+		reserved = end - old
+	}
+	n, err := fd.FileContents.Write(b)
+	if err != nil {
+		fd.c.fs.release(reserved)
+	}
+	fd.cur += int64(n)
+	return n, err
+}
+
+func (fd *ramFd) Seek(off int64, sp vfs.SeekPoint) (int64, error) {
+	cur, err := fd.FileContents.Seek(off, sp)
+	if err != nil {
+		return cur, err
+	}
+	fd.cur = cur
+	return cur, nil
+}
+
+// Save writes the tree to the directory dir, replacing it.
+//
+// Directories are saved with owner permissions, so the copy
+// on disk can be changed and removed. The tree is written to
+// dir.tmp and the old copy is kept as dir.old until dir is
+// replaced, so one of them is complete if Save is interrupted.
+func (fs *Ramfs) Save(dir string) error {
+	tmp, old := dir+".tmp", dir+".old"
+	if err := restore(dir); err != nil {
+		return err
+	}
+	if err := loadable(dir); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.RemoveAll(tmp); err != nil {
+		return err
+	}
+	if err := save(fs.Root, tmp); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	if err := os.RemoveAll(old); err != nil {
+		return err
+	}
+	if err := os.Rename(dir, old); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Rename(tmp, dir); err != nil {
+		return err
+	}
+	return os.RemoveAll(old)
+}
+
+// latest returns the most recent complete copy of the snapshot dir:
+// dir itself, or the copies left by an interrupted Save
+func latest(dir string) string {
+	for _, p := range []string{dir, dir + ".old", dir + ".tmp"} {
+		if _, err := os.Stat(p); err == nil {
+			return p
+		}
+	}
+	return dir
+}
+
+// restore moves the copy left by an interrupted Save back to dir
+func restore(dir string) error {
+	if p := latest(dir); p != dir {
+		return os.Rename(p, dir)
+	}
+	return nil
+}
+
+// loadable returns an error if path holds files that Load skips
+func loadable(path string) error {
+	infos, err := ioutil.ReadDir(path)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		full := filepath.Join(path, info.Name())
+		switch {
+		case info.IsDir():
+			if err := loadable(full); err != nil {
+				return err
+			}
+		case !info.Mode().IsRegular():
+			return fmt.Errorf("%v: %v", full, ErrUnsupported)
+		}
+	}
+	return nil
+}
+
+func save(f *vfs.File, path string) error {
+	perm := os.FileMode(f.Perm() & 0777)
+	if !f.IsDir() {
+		var data []byte
+		if c, ok := f.Content().(*ramContent); ok {
+			data = c.bytes()
+		}
+		return ioutil.WriteFile(path, data, perm)
+	}
+	if err := os.Mkdir(path, perm|0700); err != nil {
+		return err
+	}
+	for _, c := range f.Childs() {
+		d, err := c.Dir()
+		if err != nil {
+			return err
+		}
+		if err := save(c, filepath.Join(path, d.Name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Load adds the files under the directory dir to the root of fs,
+// when dir is missing the copy left by an interrupted Save is used
+func (fs *Ramfs) Load(dir string) error {
+	return fs.load(fs.Root, latest(dir))
+}
+
+func (fs *Ramfs) load(parent *vfs.File, path string) error {
+	infos, err := ioutil.ReadDir(path)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		full := filepath.Join(path, info.Name())
+		var f *vfs.File
+		switch {
+		case info.IsDir():
+			f = vfs.NewDir(info.Name())
+			f.Mode = plan9.DMDIR | plan9.Perm(info.Mode().Perm())
+			if err := fs.load(f, full); err != nil {
+				return err
+			}
+		case info.Mode().IsRegular():
+			data, err := ioutil.ReadFile(full)
+			if err != nil {
+				return err
+			}
+			if err := fs.reserve(uint64(len(data))); err != nil {
+				return err
+			}
+			f = vfs.NewFile(info.Name(), fs.newContent(data))
+			f.Mode = plan9.Perm(info.Mode().Perm())
+		default:
+			// links and devices can't be kept in memory
+			continue
+		}
+		f.SetMtime(uint32(info.ModTime().Unix()))
+		parent.Add(f)
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package ramfs
+
+import (
+	"9fans.net/go/plan9"
+	"amoraes.info/ded/vfs"
+	"amoraes.info/ded/vfs/filetree"
+	"amoraes.info/ded/vfs/fstest"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestConformance(t *testing.T) {
+	fs := New(0)
+	fs.Root.Add(vfs.NewFile("hello.txt", fs.newContent([]byte("hello"))))
+	fstest.Run(t, fs, fstest.Config{
+		File:     "hello.txt",
+		Contents: []byte("hello"),
+		Writable: true,
+	})
+}
+
+func TestQuotaAndWstat(t *testing.T) {
+	fs := New(10)
+	srv := vfs.NewFileserver(fs)
+	ctx := vfs.NewContext()
+	wstat := func(d plan9.Dir) []byte {
+		buf, _ := d.Bytes()
+		return buf
+	}
+	var nochange plan9.Dir
+	nochange.Null()
+	rename, truncate, grow := nochange, nochange, nochange
+	rename.Name = "b"
+	truncate.Length = 2
+	grow.Length = 11
+
+	steps := []struct {
+		fc  plan9.Fcall
+		err error
+	}{
+		{fc: plan9.Fcall{Type: plan9.Tversion, Msize: 8192, Version: "9P2000"}},
+		{fc: plan9.Fcall{Type: plan9.Tattach, Fid: 1, Afid: plan9.NOFID}},
+		{fc: plan9.Fcall{Type: plan9.Twalk, Fid: 1, Newfid: 2}},
+		{fc: plan9.Fcall{Type: plan9.Tcreate, Fid: 2, Name: "a", Perm: 0644, Mode: plan9.OWRITE}},
+		{fc: plan9.Fcall{Type: plan9.Twrite, Fid: 2, Data: []byte("12345678")}},
+		{fc: plan9.Fcall{Type: plan9.Twrite, Fid: 2, Offset: 8, Data: []byte("abc")}, err: ErrQuota},
+		{fc: plan9.Fcall{Type: plan9.Twrite, Fid: 2, Offset: 4, Data: []byte("abcdef")}},
+		{fc: plan9.Fcall{Type: plan9.Twstat, Fid: 2, Stat: wstat(grow)}, err: ErrQuota},
+		{fc: plan9.Fcall{Type: plan9.Twstat, Fid: 2, Stat: wstat(truncate)}},
+		{fc: plan9.Fcall{Type: plan9.Twstat, Fid: 2, Stat: wstat(rename)}},
+		{fc: plan9.Fcall{Type: plan9.Twalk, Fid: 1, Newfid: 3, Wname: []string{"a"}}, err: filetree.ErrNotFound},
+		{fc: plan9.Fcall{Type: plan9.Twalk, Fid: 1, Newfid: 3, Wname: []string{"b"}}},
+		{fc: plan9.Fcall{Type: plan9.Tremove, Fid: 3}},
+		{fc: plan9.Fcall{Type: plan9.Twrite, Fid: 2, Data: []byte("abc")}, err: ErrRemoved},
+	}
+	for i, s := range steps {
+		fc := s.fc
+		ret := srv.Call(&fc, ctx)
+		switch {
+		case s.err == nil && ret.Type != fc.Type+1:
+			t.Errorf("step %v: expecting success got %v", i, ret)
+		case s.err != nil && (ret.Type != plan9.Rerror || ret.Ename != s.err.Error()):
+			t.Errorf("step %v: expecting %v got %v", i, s.err, ret)
+		}
+		if i == 8 && fs.Used() != 2 {
+			t.Errorf("Truncate should release the quota: %v", fs.Used())
+		}
+	}
+	if fs.Used() != 0 {
+		t.Errorf("Remove should release the quota: %v", fs.Used())
+	}
+}
+
+func TestSaveLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ramfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	snapshot := filepath.Join(dir, "snapshot")
+
+	fs := New(0)
+	sub := vfs.NewDir("sub", vfs.NewFile("b.txt", fs.newContent([]byte("bbb"))))
+	fs.Root.Add(vfs.NewFile("a.txt", fs.newContent([]byte("a"))))
+	fs.Root.Add(sub)
+	for i := 0; i < 2; i++ {
+		// the second save replaces the first
+		if err := fs.Save(snapshot); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	loaded := New(0)
+	if err := loaded.Load(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	b := loaded.Root.Walk("sub").Walk("b.txt")
+	if b == nil || string(b.Content().(*ramContent).Bytes()) != "bbb" {
+		t.Fatalf("Unexpected file %v", b)
+	}
+	if loaded.Used() != 4 {
+		t.Errorf("Loaded files should use the quota: %v", loaded.Used())
+	}
+	if New(3).Load(snapshot) != ErrQuota {
+		t.Errorf("Load should respect the quota")
+	}
+
+	// a Save interrupted after moving the old copy aside
+	if err := os.Rename(snapshot, snapshot+".old"); err != nil {
+		t.Fatal(err)
+	}
+	if err := New(0).Load(snapshot); err != nil {
+		t.Errorf("Load should use the old copy: %v", err)
+	}
+	if err := fs.Save(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(snapshot + ".old"); !os.IsNotExist(err) {
+		t.Errorf("Save should remove the old copy: %v", err)
+	}
+
+	if err := os.Symlink("a.txt", filepath.Join(snapshot, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Save(snapshot); err == nil {
+		t.Errorf("Save should not replace files it can't load")
+	}
+	if _, err := os.Lstat(filepath.Join(snapshot, "link")); err != nil {
+		t.Errorf("Save removed the link: %v", err)
+	}
+}
@@ -5,9 +5,14 @@ import (
 	"amoraes.info/ded/vfs"
 	"amoraes.info/ded/vfs/mixin"
 	"errors"
+	"hash/fnv"
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 )
 
 type (
@@ -17,42 +22,151 @@ type (
 	}
 
 	ufsFid struct {
+		sync.Mutex
 		fullpath string
 		file     *os.File
+
+		// isdir is true when file is a directory
+		isdir bool
+		// rclose is true when the file must be removed on clunk
+		rclose bool
+
+		// dirents holds the directory entries not read yet
+		dirents [][]byte
+		// diroffset is the offset of the next directory read
+		diroffset uint64
 	}
 )
 
+var (
+	ErrBadName      = errors.New("invalid file name")
+	ErrNotDir       = errors.New("not a directory")
+	ErrIsDir        = errors.New("is a directory")
+	ErrRemoveRoot   = errors.New("cannot remove the root")
+	ErrDirOffset    = errors.New("invalid directory offset")
+	ErrShortDirRead = errors.New("count too small for directory entry")
+	ErrWstat        = errors.New("wstat not allowed")
+)
+
 func (fd *ufsFid) Close() error {
+	fd.Lock()
+	defer fd.Unlock()
+	var err error
 	if fd.file != nil {
-		return fd.file.Close()
+		err = fd.file.Close()
+		fd.file = nil
+	}
+	if fd.rclose {
+		fd.rclose = false
+		if rerr := os.Remove(fd.fullpath); err == nil {
+			err = rerr
+		}
+	}
+	return err
+}
+
+func (ufs *Ufs) root() string {
+	return filepath.Clean(ufs.Root)
+}
+
+// stat returns the plan9.Dir of fullpath, the qid path is derived
+// from fullpath.
+func (ufs *Ufs) stat(fullpath string) (plan9.Dir, error) {
+	info, err := os.Stat(fullpath)
+	if err != nil {
+		return plan9.Dir{}, err
+	}
+	dir := FileInfoToDir(info)
+	h := fnv.New64a()
+	io.WriteString(h, fullpath)
+	dir.Qid.Path = h.Sum64()
+	if fullpath == ufs.root() {
+		dir.Name = "/"
+	}
+	return dir, nil
+}
+
+func (ufs *Ufs) fid(fc *plan9.Fcall, ctx *vfs.Context) (*ufsFid, error) {
+	fd, ok := ufs.GetFid(fc.Fid, ctx).(*ufsFid)
+	if !ok {
+		return nil, vfs.ErrInvalidFid
+	}
+	return fd, nil
+}
+
+func validName(name string) bool {
+	return name != "" && name != "." && !strings.Contains(name, "/")
+}
+
+func (ufs *Ufs) Attach(fc *plan9.Fcall, ctx *vfs.Context) *plan9.Fcall {
+	ret := *fc
+	ret.Type++
+
+	root := ufs.root()
+	dir, err := ufs.stat(root)
+	if err != nil {
+		return vfs.PackError(&ret, err)
 	}
-	return nil
+	if dir.Mode&plan9.DMDIR == 0 {
+		return vfs.PackError(&ret, ErrNotDir)
+	}
+	ufs.SetFid(ctx, fc.Fid, &ufsFid{fullpath: root})
+	ret.Qid = dir.Qid
+	return &ret
 }
 
 func (ufs *Ufs) Walk(fc *plan9.Fcall, ctx *vfs.Context) *plan9.Fcall {
 	ret := *fc
 	ret.Type++
 
-	parent := ufs.Root
-	// check if we have a fid from a previous walk
-	if fd := ufs.GetFid(fc.Fid, ctx); fd != nil {
-		switch fd := fd.(type) {
-		case *ufsFid:
-			parent = fd.fullpath
+	fd, err := ufs.fid(fc, ctx)
+	if err != nil {
+		return vfs.PackError(&ret, err)
+	}
+	if len(fc.Wname) == 0 {
+		if fc.Newfid != fc.Fid {
+			ufs.SetFid(ctx, fc.Newfid, &ufsFid{fullpath: fd.fullpath})
 		}
+		return &ret
+	}
+
+	root := ufs.root()
+	current, err := ufs.stat(fd.fullpath)
+	if err != nil {
+		return vfs.PackError(&ret, err)
 	}
+	fullpath := fd.fullpath
 	for _, name := range fc.Wname {
-		file, err := os.Stat(filepath.Join(parent, name))
+		if current.Mode&plan9.DMDIR == 0 {
+			err = ErrNotDir
+			break
+		}
+		if !validName(name) {
+			err = ErrBadName
+			break
+		}
+		next := filepath.Join(fullpath, name)
+		if name == ".." && fullpath == root {
+			// .. of the root is the root
+			next = root
+		}
+		current, err = ufs.stat(next)
 		if err != nil {
-			return vfs.PackError(&ret, err)
+			break
 		}
-		dir := FileInfoToDir(file)
-		ret.Wqid = append(ret.Wqid, DirToQid(dir))
-		parent = filepath.Join(parent, name)
+		ret.Wqid = append(ret.Wqid, current.Qid)
+		fullpath = next
+	}
+	switch {
+	case len(ret.Wqid) == 0:
+		return vfs.PackError(&ret, err)
+	case len(ret.Wqid) < len(fc.Wname):
+		// partial walks don't change newfid
+		return &ret
 	}
 
 	ufs.SetFid(ctx, fc.Newfid, &ufsFid{
-		fullpath: parent,
+		fullpath: fullpath,
 	})
 
 	return &ret
@@ -62,14 +176,30 @@ func (ufs *Ufs) Open(fc *plan9.Fcall, ctx *vfs.Context) *plan9.Fcall {
 	ret := *fc
 	ret.Type++
 
-	data := ufs.GetFid(fc.Fid, ctx).(*ufsFid)
+	data, err := ufs.fid(fc, ctx)
+	if err != nil {
+		return vfs.PackError(&ret, err)
+	}
+	dir, err := ufs.stat(data.fullpath)
+	if err != nil {
+		return vfs.PackError(&ret, err)
+	}
+	isdir := dir.Mode&plan9.DMDIR != 0
+	if isdir && (fc.Mode&3 == plan9.OWRITE || fc.Mode&3 == plan9.ORDWR || fc.Mode&plan9.OTRUNC != 0) {
+		return vfs.PackError(&ret, ErrIsDir)
+	}
 	openmode := DirModeToOSMode(uint32(fc.Mode))
 	file, err := os.OpenFile(data.fullpath, openmode, 0666)
 	if err != nil {
 		return vfs.PackError(&ret, err)
 	}
+	data.Lock()
 	data.file = file
-	ret.Iounit = 8 * 1024
+	data.isdir = isdir
+	data.rclose = fc.Mode&plan9.ORCLOSE != 0
+	data.Unlock()
+	ret.Qid = dir.Qid
+	ret.Iounit = ufs.Iounit(ctx)
 
 	return &ret
 }
@@ -78,32 +208,59 @@ func (ufs *Ufs) Create(fc *plan9.Fcall, ctx *vfs.Context) *plan9.Fcall {
 	ret := *fc
 	ret.Type++
 
-	data := ufs.GetFid(fc.Fid, ctx).(*ufsFid)
-	println("data.fullpath", data.fullpath)
+	data, err := ufs.fid(fc, ctx)
+	if err != nil {
+		return vfs.PackError(&ret, err)
+	}
+	if !validName(fc.Name) || fc.Name == ".." {
+		return vfs.PackError(&ret, ErrBadName)
+	}
 	openmode := DirModeToOSMode(uint32(fc.Mode))
 
 	perm := fc.Perm
 
 	unixPerm := vfs.Plan9PermToUnix(uint32(fc.Perm))
-	if (perm & plan9.DMDIR) == plan9.DMDIR {
+	isdir := (perm & plan9.DMDIR) == plan9.DMDIR
+	if isdir {
 		// we are creating a directory
 		// the only valid permission will be 0755
 		if unixPerm != 0755 {
 			return vfs.PackError(&ret, errors.New("Only 0644 (file) and 0755 (dir) permissions are allowed"))
 		}
+		if fc.Mode&3 != plan9.OREAD {
+			return vfs.PackError(&ret, ErrIsDir)
+		}
 	} else {
 		if unixPerm != 0644 {
 			return vfs.PackError(&ret, errors.New("Only 0644 (file) and 0755 (dir) permissions are allowed"))
 		}
 	}
 
-	data.fullpath = filepath.Join(data.fullpath, fc.Name)
-	file, err := os.OpenFile(data.fullpath, openmode|os.O_CREATE, unixPerm)
+	fullpath := filepath.Join(data.fullpath, fc.Name)
+	var file *os.File
+	if isdir {
+		if err = os.Mkdir(fullpath, unixPerm); err == nil {
+			file, err = os.Open(fullpath)
+		}
+	} else {
+		file, err = os.OpenFile(fullpath, openmode|os.O_CREATE|os.O_EXCL, unixPerm)
+	}
 	if err != nil {
 		return vfs.PackError(&ret, err)
 	}
+	dir, err := ufs.stat(fullpath)
+	if err != nil {
+		file.Close()
+		return vfs.PackError(&ret, err)
+	}
+	data.Lock()
+	data.fullpath = fullpath
 	data.file = file
-	ret.Iounit = 8 * 1024
+	data.isdir = isdir
+	data.rclose = fc.Mode&plan9.ORCLOSE != 0
+	data.Unlock()
+	ret.Qid = dir.Qid
+	ret.Iounit = ufs.Iounit(ctx)
 
 	return &ret
 }
@@ -112,24 +269,30 @@ func (ufs *Ufs) Read(fc *plan9.Fcall, ctx *vfs.Context) *plan9.Fcall {
 	ret := *fc
 	ret.Type++
 
-	buf := make([]byte, int(fc.Count))
+	fd, err := ufs.fid(fc, ctx)
+	if err != nil {
+		return vfs.PackError(&ret, err)
+	}
+	count := fc.Count
+	if iounit := ufs.Iounit(ctx); count > iounit {
+		count = iounit
+	}
 
-	file := ufs.GetFid(fc.Fid, ctx).(*ufsFid).file
-	if fc.Offset != 0 {
-		_, err := file.Seek(int64(fc.Offset), 0)
+	fd.Lock()
+	defer fd.Unlock()
+	if fd.isdir {
+		data, err := ufs.readDir(fd, fc.Offset, count)
 		if err != nil {
 			return vfs.PackError(&ret, err)
 		}
+		ret.Data = data
+		ret.Count = uint32(len(data))
+		return &ret
 	}
 
-	sz, err := file.Read(buf)
-
-	switch {
-	case err == io.EOF:
-		ret.Data = nil
-		ret.Count = 0
-		return &ret
-	case err != nil:
+	buf := make([]byte, int(count))
+	sz, err := fd.file.ReadAt(buf, int64(fc.Offset))
+	if err != nil && err != io.EOF {
 		return vfs.PackError(&ret, err)
 	}
 
@@ -138,19 +301,59 @@ func (ufs *Ufs) Read(fc *plan9.Fcall, ctx *vfs.Context) *plan9.Fcall {
 	return &ret
 }
 
+// readDir returns the directory entries of fd that fit in count bytes,
+// reading from offset 0 starts again from the first entry.
+func (ufs *Ufs) readDir(fd *ufsFid, offset uint64, count uint32) ([]byte, error) {
+	if offset == 0 {
+		if _, err := fd.file.Seek(0, 0); err != nil {
+			return nil, err
+		}
+		names, err := fd.file.Readdirnames(-1)
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(names)
+		fd.dirents = nil
+		fd.diroffset = 0
+		for _, name := range names {
+			dir, err := ufs.stat(filepath.Join(fd.fullpath, name))
+			if err != nil {
+				// broken links and files removed after Readdirnames
+				continue
+			}
+			buf, err := dir.Bytes()
+			if err != nil {
+				return nil, err
+			}
+			fd.dirents = append(fd.dirents, buf)
+		}
+	} else if offset != fd.diroffset {
+		return nil, ErrDirOffset
+	}
+
+	var data []byte
+	for len(fd.dirents) > 0 && len(data)+len(fd.dirents[0]) <= int(count) {
+		data = append(data, fd.dirents[0]...)
+		fd.dirents = fd.dirents[1:]
+	}
+	if len(data) == 0 && len(fd.dirents) > 0 {
+		return nil, ErrShortDirRead
+	}
+	fd.diroffset += uint64(len(data))
+	return data, nil
+}
+
 func (ufs *Ufs) Write(fc *plan9.Fcall, ctx *vfs.Context) *plan9.Fcall {
 	ret := *fc
 	ret.Type++
 
-	file := ufs.GetFid(fc.Fid, ctx).(*ufsFid).file
-	if fc.Offset != 0 {
-		_, err := file.Seek(int64(fc.Offset), 0)
-		if err != nil {
-			return vfs.PackError(&ret, err)
-		}
+	fd, err := ufs.fid(fc, ctx)
+	if err != nil {
+		return vfs.PackError(&ret, err)
 	}
-
-	sz, err := file.Write(fc.Data)
+	fd.Lock()
+	defer fd.Unlock()
+	sz, err := fd.file.WriteAt(fc.Data, int64(fc.Offset))
 	if err != nil {
 		return vfs.PackError(&ret, err)
 	}
@@ -158,16 +361,129 @@ func (ufs *Ufs) Write(fc *plan9.Fcall, ctx *vfs.Context) *plan9.Fcall {
 	return &ret
 }
 
-func (ufs *Ufs) Flush(fc *plan9.Fcall, ctx *vfs.Context) *plan9.Fcall {
+func (ufs *Ufs) Remove(fc *plan9.Fcall, ctx *vfs.Context) *plan9.Fcall {
 	ret := *fc
 	ret.Type++
 
-	file := ufs.GetFid(fc.Fid, ctx).(*ufsFid).file
+	fd, err := ufs.fid(fc, ctx)
+	if err != nil {
+		return vfs.PackError(&ret, err)
+	}
+	if fd.fullpath == ufs.root() {
+		return vfs.PackError(&ret, ErrRemoveRoot)
+	}
+	// the fid is clunked even if the remove fails
+	fd.Lock()
+	fd.rclose = false
+	fd.Unlock()
+	fd.Close()
+	if err := os.Remove(fd.fullpath); err != nil {
+		return vfs.PackError(&ret, err)
+	}
+	return &ret
+}
 
-	err := file.Sync()
+func (ufs *Ufs) Stat(fc *plan9.Fcall, ctx *vfs.Context) *plan9.Fcall {
+	ret := *fc
+	ret.Type++
+
+	fd, err := ufs.fid(fc, ctx)
+	if err != nil {
+		return vfs.PackError(&ret, err)
+	}
+	dir, err := ufs.stat(fd.fullpath)
 	if err != nil {
 		return vfs.PackError(&ret, err)
 	}
+	ret.Stat, err = dir.Bytes()
+	if err != nil {
+		return vfs.PackError(&ret, err)
+	}
+	return &ret
+}
+
+// Wstat changes the name, permissions, length and modification time
+// of a file, renames are limited to the same directory.
+func (ufs *Ufs) Wstat(fc *plan9.Fcall, ctx *vfs.Context) *plan9.Fcall {
+	ret := *fc
+	ret.Type++
+
+	fd, err := ufs.fid(fc, ctx)
+	if err != nil {
+		return vfs.PackError(&ret, err)
+	}
+	dir, err := plan9.UnmarshalDir(fc.Stat)
+	if err != nil {
+		return vfs.PackError(&ret, err)
+	}
+	fd.Lock()
+	defer fd.Unlock()
+	old, err := ufs.stat(fd.fullpath)
+	if err != nil {
+		return vfs.PackError(&ret, err)
+	}
+	rename := dir.Name != "" && dir.Name != old.Name
+	switch {
+	case rename && fd.fullpath == ufs.root():
+		return vfs.PackError(&ret, ErrWstat)
+	case rename && (!validName(dir.Name) || dir.Name == ".."):
+		return vfs.PackError(&ret, ErrBadName)
+	case dir.Mode != ^plan9.Perm(0) && (dir.Mode^old.Mode)&plan9.DMDIR != 0:
+		return vfs.PackError(&ret, ErrWstat)
+	case dir.Length != ^uint64(0) && dir.Length != old.Length && old.Mode&plan9.DMDIR != 0:
+		return vfs.PackError(&ret, ErrIsDir)
+	}
+	newpath := fd.fullpath
+	if rename {
+		newpath = filepath.Join(filepath.Dir(fd.fullpath), dir.Name)
+		if _, err := os.Lstat(newpath); err == nil {
+			return vfs.PackError(&ret, os.ErrExist)
+		}
+	}
+
+	// the changes done are undone when one fails, so the file changes
+	// as a whole or not at all. The truncate can't be undone, it is
+	// the last one.
+	var undo []func()
+	fail := func(err error) *plan9.Fcall {
+		for i := len(undo) - 1; i >= 0; i-- {
+			undo[i]()
+		}
+		return vfs.PackError(&ret, err)
+	}
+	if rename {
+		oldpath := fd.fullpath
+		if err := os.Rename(oldpath, newpath); err != nil {
+			return fail(err)
+		}
+		undo = append(undo, func() { os.Rename(newpath, oldpath) })
+	}
+	if dir.Mode != ^plan9.Perm(0) {
+		if err := os.Chmod(newpath, vfs.Plan9PermToUnix(uint32(dir.Mode))); err != nil {
+			return fail(err)
+		}
+		undo = append(undo, func() { os.Chmod(newpath, vfs.Plan9PermToUnix(uint32(old.Mode))) })
+	}
+	if dir.Mtime != ^uint32(0) {
+		mtime := time.Unix(int64(dir.Mtime), 0)
+		if err := os.Chtimes(newpath, mtime, mtime); err != nil {
+			return fail(err)
+		}
+		undo = append(undo, func() {
+			os.Chtimes(newpath, time.Unix(int64(old.Atime), 0), time.Unix(int64(old.Mtime), 0))
+		})
+	}
+	if dir.Length != ^uint64(0) && dir.Length != old.Length {
+		if err := os.Truncate(newpath, int64(dir.Length)); err != nil {
+			return fail(err)
+		}
+		if dir.Mtime != ^uint32(0) {
+			// the truncate changed the mtime
+			mtime := time.Unix(int64(dir.Mtime), 0)
+			os.Chtimes(newpath, mtime, mtime)
+		}
+	}
+	fd.fullpath = newpath
 	return &ret
 }
 
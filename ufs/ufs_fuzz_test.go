@@ -0,0 +1,75 @@
+package ufs
+
+import (
+	"9fans.net/go/plan9"
+	"amoraes.info/ded/vfs/fstest"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var (
+	fuzzSeeds = [][]*plan9.Fcall{
+		{
+			{Type: plan9.Twalk, Fid: 0, Newfid: 1, Wname: []string{"dir", "a.txt"}},
+			{Type: plan9.Topen, Fid: 1, Mode: plan9.ORDWR},
+			{Type: plan9.Twrite, Fid: 1, Offset: 3, Data: []byte("data")},
+			{Type: plan9.Tread, Fid: 1, Count: 100},
+			{Type: plan9.Tclunk, Fid: 1},
+		},
+		{
+			{Type: plan9.Twalk, Fid: 0, Newfid: 1, Wname: []string{"dir"}},
+			{Type: plan9.Tcreate, Fid: 1, Name: "new", Perm: plan9.DMDIR | 0755, Mode: plan9.OREAD},
+			{Type: plan9.Tread, Fid: 1, Count: 100},
+			{Type: plan9.Tremove, Fid: 1},
+		},
+		{
+			{Type: plan9.Twalk, Fid: 0, Newfid: 1},
+			{Type: plan9.Topen, Fid: 1, Mode: plan9.OREAD},
+			{Type: plan9.Tread, Fid: 1, Count: 8192},
+			{Type: plan9.Tread, Fid: 1, Offset: 10, Count: 8192},
+			{Type: plan9.Tstat, Fid: 1},
+		},
+	}
+)
+
+// fuzzTree returns the root of a small tree that is removed after t
+func fuzzTree(t *testing.T) string {
+	root, err := ioutil.TempDir("", "ufsfuzz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(root) })
+	if err := os.Mkdir(filepath.Join(root, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"dir/a.txt", "b.txt"} {
+		if err := ioutil.WriteFile(filepath.Join(root, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+func FuzzCalls(f *testing.F) {
+	for _, seed := range fuzzSeeds {
+		f.Add(fstest.EncodeCalls(seed...))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fstest.FuzzCalls(t, &Ufs{Root: fuzzTree(t)}, data)
+	})
+}
+
+func FuzzStream(f *testing.F) {
+	for _, seed := range fuzzSeeds {
+		fcs := []*plan9.Fcall{
+			{Type: plan9.Tversion, Tag: plan9.NOTAG, Msize: 8192, Version: "9P2000"},
+			{Type: plan9.Tattach, Fid: 0, Afid: plan9.NOFID, Uname: "fuzz"},
+		}
+		f.Add(fstest.EncodeStream(append(fcs, seed...)...))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fstest.FuzzStream(t, &Ufs{Root: fuzzTree(t)}, data)
+	})
+}
@@ -0,0 +1,115 @@
+package ufs
+
+import (
+	"9fans.net/go/plan9"
+	"amoraes.info/ded/vfs"
+	"amoraes.info/ded/vfs/fstest"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestConformance(t *testing.T) {
+	root, err := ioutil.TempDir("", "ufs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	contents := []byte("hello world\n")
+	if err := os.Mkdir(filepath.Join(root, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "dir", "hello.txt"), contents, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fstest.Run(t, &Ufs{Root: root}, fstest.Config{
+		File:     "dir/hello.txt",
+		Contents: contents,
+		Dir:      "dir",
+		Writable: true,
+	})
+}
+
+func TestWstat(t *testing.T) {
+	root, err := ioutil.TempDir("", "ufs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	if err := ioutil.WriteFile(filepath.Join(root, "a"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := vfs.NewFileserver(&Ufs{Root: root})
+	ctx := vfs.NewContext()
+	var d plan9.Dir
+	d.Null()
+	d.Name = "b"
+	d.Mode = 0600
+	d.Length = 2
+	d.Mtime = 1000
+	stat, _ := d.Bytes()
+	for _, fc := range []plan9.Fcall{
+		{Type: plan9.Tversion, Msize: 8192, Version: "9P2000"},
+		{Type: plan9.Tattach, Fid: 1, Afid: plan9.NOFID},
+		{Type: plan9.Twalk, Fid: 1, Newfid: 2, Wname: []string{"a"}},
+		{Type: plan9.Twstat, Fid: 2, Stat: stat},
+	} {
+		if ret := srv.Call(&fc, ctx); ret.Type != fc.Type+1 {
+			t.Fatalf("Unexpected reply to %v: %v", &fc, ret)
+		}
+	}
+	info, err := os.Stat(filepath.Join(root, "b"))
+	switch {
+	case err != nil:
+		t.Fatal(err)
+	case info.Mode().Perm() != 0600, info.Size() != 2, info.ModTime().Unix() != 1000:
+		t.Errorf("Unexpected stat %v %v %v", info.Mode(), info.Size(), info.ModTime())
+	}
+}
+
+func TestWstatAllOrNothing(t *testing.T) {
+	root, err := ioutil.TempDir("", "ufs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	for _, name := range []string{"a", "b"} {
+		if err := ioutil.WriteFile(filepath.Join(root, name), []byte("hello"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	srv := vfs.NewFileserver(&Ufs{Root: root})
+	ctx := vfs.NewContext()
+	var d plan9.Dir
+	d.Null()
+	d.Name = "b"
+	d.Mode = 0600
+	d.Length = 2
+	stat, _ := d.Bytes()
+	for _, fc := range []plan9.Fcall{
+		{Type: plan9.Tversion, Msize: 8192, Version: "9P2000"},
+		{Type: plan9.Tattach, Fid: 1, Afid: plan9.NOFID},
+		{Type: plan9.Twalk, Fid: 1, Newfid: 2, Wname: []string{"a"}},
+	} {
+		if ret := srv.Call(&fc, ctx); ret.Type != fc.Type+1 {
+			t.Fatalf("Unexpected reply to %v: %v", &fc, ret)
+		}
+	}
+	// b exists, so the length and the mode don't change either
+	fc := plan9.Fcall{Type: plan9.Twstat, Fid: 2, Stat: stat}
+	if ret := srv.Call(&fc, ctx); ret.Type != plan9.Rerror {
+		t.Errorf("The rename should fail: %v", ret)
+	}
+	info, err := os.Stat(filepath.Join(root, "a"))
+	switch {
+	case err != nil:
+		t.Fatal(err)
+	case info.Mode().Perm() != 0644, info.Size() != 5:
+		t.Errorf("a shouldn't change: %v %v", info.Mode(), info.Size())
+	}
+}
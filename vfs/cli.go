@@ -1,13 +1,30 @@
 package vfs
 
 import (
+	"9fans.net/go/plan9"
 	"9fans.net/go/plan9/client"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
 	"log"
+	"net"
+	"os"
 )
 
 type (
 	Client struct {
 		*client.Conn
+		// Msize is the message size negotiated with the server
+		Msize uint32
+	}
+
+	// versionReader records the msize of the Rversion read by the
+	// client, the client doesn't tell it
+	versionReader struct {
+		io.ReadWriteCloser
+		buf   []byte
+		msize uint32
+		done  bool
 	}
 )
 
@@ -18,11 +35,70 @@ const (
 // Connect to a local 9p server running on port 5640
 func ConnectLocal() (*Client, error) {
 	log.Printf("Dial to %v", defaultServer)
-	conn, err := client.Dial("tcp", defaultServer)
+	return Connect(defaultServer, nil)
+}
+
+// Connect to the 9p server at addr, if cfg isn't nil the connection
+// is protected by TLS.
+func Connect(addr string, cfg *tls.Config) (*Client, error) {
+	var conn net.Conn
+	var err error
+	if cfg != nil {
+		conn, err = tls.Dial("tcp", addr, cfg)
+	} else {
+		conn, err = net.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	cli, err := NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return cli, nil
+}
+
+// NewClient starts a 9p session over rwc
+func NewClient(rwc io.ReadWriteCloser) (*Client, error) {
+	r := &versionReader{ReadWriteCloser: rwc}
+	cli, err := client.NewConn(r)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{cli, r.msize}, nil
+}
+
+func (r *versionReader) Read(p []byte) (int, error) {
+	n, err := r.ReadWriteCloser.Read(p)
+	if r.done {
+		return n, err
+	}
+	// the first message is the Rversion
+	r.buf = append(r.buf, p[:n]...)
+	if len(r.buf) < 4 {
+		return n, err
+	}
+	if size := binary.LittleEndian.Uint32(r.buf); uint32(len(r.buf)) >= size {
+		if fc, ferr := plan9.UnmarshalFcall(r.buf[:size]); ferr == nil && fc.Type == plan9.Rversion {
+			r.msize = fc.Msize
+		}
+		r.done, r.buf = true, nil
+	}
+	return n, err
+}
+
+// Mount connects to addr and attach to the default tree of the server
+// using the current user name.
+func Mount(addr string, cfg *tls.Config) (*client.Fsys, error) {
+	cli, err := Connect(addr, cfg)
+	if err != nil {
+		return nil, err
+	}
+	fsys, err := cli.Attach(nil, os.Getenv("USER"), "")
 	if err != nil {
+		cli.Close()
 		return nil, err
 	}
-	return &Client{
-		conn,
-	}, nil
+	return fsys, nil
 }
@@ -0,0 +1,27 @@
+package vfs
+
+import (
+	"9fans.net/go/plan9"
+	"net"
+	"testing"
+)
+
+func TestNewClientMsize(t *testing.T) {
+	c, s := net.Pipe()
+	defer s.Close()
+	go func() {
+		tx, err := plan9.ReadFcall(s)
+		if err != nil {
+			return
+		}
+		plan9.WriteFcall(s, &plan9.Fcall{Type: plan9.Rversion, Tag: tx.Tag, Msize: 4096, Version: "9P2000"})
+	}()
+	cli, err := NewClient(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if cli.Msize != 4096 {
+		t.Errorf("Expecting msize 4096 got %v", cli.Msize)
+	}
+}
@@ -1,18 +1,90 @@
 package vfs
 
 import (
+	"context"
 	"fmt"
+	"net"
+	"sync"
 )
 
+type (
+	Context struct {
+		*session
+
+		// ctx is cancelled when the connection is closed or
+		// when the request is flushed by the client.
+		ctx context.Context
+	}
+
+	// session holds the state shared by every request of a connection
+	session struct {
+		mu   sync.Mutex
+		data map[interface{}]interface{}
+
+		// uname is the name of the user attached to the connection,
+		// when the client presented a certificate it is fixed to its CommonName.
+		uname     string
+		aname     string
+		certUname bool
+		remote    net.Addr
+
+		ctx    context.Context
+		cancel context.CancelFunc
+
+		inflight map[uint16]*inflight
+	}
+
+	// inflight is a request that wasn't answered yet
+	inflight struct {
+		cancel context.CancelFunc
+		done   chan struct{}
+	}
+)
+
+func NewContext() *Context {
+	return newContext(nil)
+}
+
+func newContext(remote net.Addr) *Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Context{
+		session: &session{
+			data:     make(map[interface{}]interface{}),
+			remote:   remote,
+			ctx:      ctx,
+			cancel:   cancel,
+			inflight: make(map[uint16]*inflight),
+		},
+		ctx: ctx,
+	}
+}
+
 func (c *Context) Put(k, v interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	c.data[k] = v
 }
 
 func (c *Context) Get(k interface{}) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	val, ok := c.data[k]
 	return val, ok
 }
 
+// GetOrPut returns the value stored at k, if k isn't present the
+// value returned by fn is stored and returned.
+func (c *Context) GetOrPut(k interface{}, fn func() interface{}) interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	val, ok := c.data[k]
+	if !ok {
+		val = fn()
+		c.data[k] = val
+	}
+	return val
+}
+
 func (c *Context) MustGet(k interface{}) interface{} {
 	val, ok := c.Get(k)
 	if !ok {
@@ -22,13 +94,129 @@ func (c *Context) MustGet(k interface{}) interface{} {
 }
 
 func (c *Context) Delete(k interface{}) (interface{}, bool) {
-	val, ok := c.Get(k)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	val, ok := c.data[k]
 	if ok {
 		delete(c.data, k)
 	}
 	return val, ok
 }
 
+// Uname returns the name of the user attached to the connection.
+//
+// If the client presented a certificate, this is the CommonName
+// of the certificate.
+func (c *Context) Uname() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.uname
+}
+
+// Aname returns the name of the tree attached by the client
+func (c *Context) Aname() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.aname
+}
+
+// RemoteAddr returns the address of the client, it might be nil
+// if the context isn't bound to a connection.
+func (c *Context) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// Context returns a context.Context that is cancelled when the client
+// disconnects or flushes the request being handled.
+func (c *Context) Context() context.Context {
+	return c.ctx
+}
+
+// Done is a shortcut for c.Context().Done()
+func (c *Context) Done() <-chan struct{} {
+	return c.ctx.Done()
+}
+
+// Err is a shortcut for c.Context().Err()
+func (c *Context) Err() error {
+	return c.ctx.Err()
+}
+
 func (c *Context) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	c.data = make(map[interface{}]interface{})
 }
+
+// setAttach records the user and tree names used in a successful attach.
+func (c *Context) setAttach(uname, aname string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.certUname {
+		c.uname = uname
+	}
+	c.aname = aname
+}
+
+// setCertUname fixes the user name of the connection
+func (c *Context) setCertUname(uname string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.uname = uname
+	c.certUname = uname != ""
+}
+
+// request returns a new Context for the request identified by tag,
+// the returned context shares all data with c.
+//
+// done must be called after the request is answered.
+func (c *Context) request(tag uint16) (req *Context, done func()) {
+	ctx, cancel := context.WithCancel(c.session.ctx)
+	inf := &inflight{
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	c.mu.Lock()
+	c.inflight[tag] = inf
+	c.mu.Unlock()
+	return &Context{session: c.session, ctx: ctx}, func() {
+		c.mu.Lock()
+		if c.inflight[tag] == inf {
+			delete(c.inflight, tag)
+		}
+		c.mu.Unlock()
+		cancel()
+		close(inf.done)
+	}
+}
+
+// flush cancels the request identified by tag and returns a channel
+// that is closed after the request is answered.
+//
+// If no request is using tag, the returned channel is already closed.
+func (c *Context) flush(tag uint16) <-chan struct{} {
+	c.mu.Lock()
+	inf, ok := c.inflight[tag]
+	c.mu.Unlock()
+	if !ok {
+		done := make(chan struct{})
+		close(done)
+		return done
+	}
+	inf.cancel()
+	return inf.done
+}
+
+// flushAll cancels every request that wasn't answered yet
+func (c *Context) flushAll() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, inf := range c.inflight {
+		inf.cancel()
+	}
+}
+
+// close cancels all requests of the connection
+func (c *Context) close() {
+	c.session.cancel()
+}
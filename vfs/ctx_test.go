@@ -0,0 +1,118 @@
+package vfs
+
+import (
+	"9fans.net/go/plan9"
+	"amoraes.info/ded/vfs/memlistener"
+	"testing"
+	"time"
+)
+
+type (
+	blockingRead struct {
+		attached chan *Context
+		released chan error
+	}
+)
+
+func (br *blockingRead) Call(fc *plan9.Fcall, ctx *Context) *plan9.Fcall {
+	ret := *fc
+	ret.Type++
+	switch fc.Type {
+	case plan9.Tversion:
+		ret.Msize = 8 * 1024
+		ret.Version = "9P2000"
+	case plan9.Tattach:
+		ctx.setAttach(fc.Uname, fc.Aname)
+		br.attached <- ctx
+	case plan9.Tread:
+		// only returns when the request is flushed
+		<-ctx.Done()
+		br.released <- ctx.Err()
+		return PackError(&ret, ctx.Err())
+	}
+	return &ret
+}
+
+func (br *blockingRead) ReleaseContext(ctx *Context) error {
+	return nil
+}
+
+func TestContextFlush(t *testing.T) {
+	rpc := &blockingRead{
+		attached: make(chan *Context, 1),
+		released: make(chan error, 1),
+	}
+	l := memlistener.New("server")
+	srv, err := NewServer(rpc, l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	conn, err := memlistener.Connect(l, "client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	rpcs := []*plan9.Fcall{
+		{Type: plan9.Tversion, Tag: plan9.NOTAG, Msize: 8 * 1024, Version: "9P2000"},
+		{Type: plan9.Tattach, Tag: 1, Fid: 1, Afid: plan9.NOFID, Uname: "glenda", Aname: "main"},
+	}
+	for _, tx := range rpcs {
+		if err := plan9.WriteFcall(conn, tx); err != nil {
+			t.Fatal(err)
+		}
+		if rx, err := plan9.ReadFcall(conn); err != nil {
+			t.Fatal(err)
+		} else if rx.Type != tx.Type+1 {
+			t.Fatalf("Unexpected reply %v", rx)
+		}
+	}
+
+	ctx := <-rpc.attached
+	if ctx.Uname() != "glenda" || ctx.Aname() != "main" {
+		t.Errorf("Invalid attach data: %v / %v", ctx.Uname(), ctx.Aname())
+	}
+	if ctx.RemoteAddr().String() != "client" {
+		t.Errorf("Invalid remote address: %v", ctx.RemoteAddr())
+	}
+
+	plan9.WriteFcall(conn, &plan9.Fcall{Type: plan9.Tread, Tag: 2, Fid: 1, Count: 10})
+	select {
+	case <-rpc.released:
+		t.Fatalf("Read should block until flushed")
+	case <-time.After(10 * time.Millisecond):
+	}
+	plan9.WriteFcall(conn, &plan9.Fcall{Type: plan9.Tflush, Tag: 3, Oldtag: 2})
+
+	if err := <-rpc.released; err == nil {
+		t.Errorf("Read should see the cancellation error")
+	}
+
+	// the flushed request must be answered before the Rflush
+	if rx, err := plan9.ReadFcall(conn); err != nil {
+		t.Fatal(err)
+	} else if rx.Tag != 2 {
+		t.Errorf("Expecting reply to the flushed request, got %v", rx)
+	}
+	if rx, err := plan9.ReadFcall(conn); err != nil {
+		t.Fatal(err)
+	} else if rx.Type != plan9.Rflush || rx.Tag != 3 {
+		t.Errorf("Expecting Rflush, got %v", rx)
+	}
+
+	// a new read only finishes when the client disconnects
+	plan9.WriteFcall(conn, &plan9.Fcall{Type: plan9.Tread, Tag: 4, Fid: 1, Count: 10})
+	select {
+	case <-rpc.released:
+		t.Fatalf("Flush should cancel only the flushed request")
+	case <-time.After(10 * time.Millisecond):
+	}
+	conn.Close()
+	select {
+	case <-rpc.released:
+	case <-time.After(time.Second):
+		t.Errorf("Requests should be cancelled after disconnect")
+	}
+}
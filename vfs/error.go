@@ -7,6 +7,11 @@ import (
 
 var (
 	ErrInvalidFid = errors.New("invalid fid")
+	ErrReadOnly   = errors.New("read-only file system")
+	ErrSeek       = errors.New("invalid seek offset")
+	ErrTooLarge   = errors.New("file too large")
+
+	ErrInvalidMessage = errors.New("invalid message type")
 )
 
 func PackError(fc *plan9.Fcall, err error) *plan9.Fcall {
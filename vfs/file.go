@@ -2,16 +2,31 @@ package vfs
 
 import (
 	"9fans.net/go/plan9"
+	"context"
 	"errors"
 	"io"
+	"math"
 	"os"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type (
 	File struct {
-		Name    string
+		Name string
+		// Mode holds the permissions and the DMDIR bit of the file,
+		// once the file is served it is changed with SetMode
+		Mode plan9.Perm
+
 		content HasContent
 		childs  []*File
+		parent  *File
+
+		// mu protects childs, parent, Mode and the qid version
+		mu    sync.Mutex
+		qid   plan9.Qid
+		mtime uint32
 
 		curfd FileContents
 	}
@@ -30,11 +45,32 @@ type (
 		Close() error
 	}
 
+	// ContextReader is implemented by FileContents whose reads wait
+	// for data, like event files. The read must return when ctx is
+	// done, for example when the client flushes the request.
+	ContextReader interface {
+		ReadContext(ctx context.Context, b []byte) (int, error)
+	}
+
+	// ContextWriter is implemented by FileContents whose writes wait,
+	// like pipes with a full buffer. The write must return when ctx
+	// is done.
+	ContextWriter interface {
+		WriteContext(ctx context.Context, b []byte) (int, error)
+	}
+
 	InMemory struct {
+		mu  sync.Mutex
 		buf []byte
 		cur int
 	}
 
+	// inMemoryFd is an open InMemory, every open has its own cursor
+	inMemoryFd struct {
+		in  *InMemory
+		cur int
+	}
+
 	SeekPoint int
 )
 
@@ -44,12 +80,34 @@ const (
 	SeekEnd     = SeekPoint(2)
 )
 
+var (
+	// lastQidPath is the qid path of the last File created
+	lastQidPath uint64
+
+	// MaxInMemory is the largest size of an InMemory, the writes
+	// and truncates past it fail with ErrTooLarge
+	MaxInMemory = 256 << 20
+)
+
 func NewFile(name string, content HasContent) *File {
 	return &File{
 		Name:    name,
+		Mode:    0644,
 		childs:  make([]*File, 0),
 		content: content,
+		qid:     plan9.Qid{Path: atomic.AddUint64(&lastQidPath, 1)},
+		mtime:   uint32(time.Now().Unix()),
+	}
+}
+
+// NewDir returns a read-only directory holding childs
+func NewDir(name string, childs ...*File) *File {
+	dir := NewFile(name, nil)
+	dir.Mode = plan9.DMDIR | 0555
+	for _, c := range childs {
+		dir.Add(c)
 	}
+	return dir
 }
 
 func (f *File) Size() (uint64, error) {
@@ -59,7 +117,32 @@ func (f *File) Size() (uint64, error) {
 	return f.content.Size()
 }
 
+func (f *File) IsDir() bool {
+	return f.Perm()&plan9.DMDIR != 0
+}
+
+// Perm returns the Mode of f
+func (f *File) Perm() plan9.Perm {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.Mode
+}
+
+// SetMode changes the Mode of f
+func (f *File) SetMode(mode plan9.Perm) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Mode = mode
+}
+
+// Content returns the content of f, it is nil for directories
+func (f *File) Content() HasContent {
+	return f.content
+}
+
 func (f *File) Walk(name string) *File {
+	f.mu.Lock()
+	defer f.mu.Unlock()
 	for _, c := range f.childs {
 		if c.Name == name {
 			return c
@@ -68,6 +151,62 @@ func (f *File) Walk(name string) *File {
 	return nil
 }
 
+// Childs returns a copy of the list of childs of f
+func (f *File) Childs() []*File {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]*File(nil), f.childs...)
+}
+
+// Parent returns the directory that holds f, or nil if f
+// wasn't added to a directory.
+func (f *File) Parent() *File {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.parent
+}
+
+// Qid returns the qid of f, the path is unique for each File
+// and the version changes after every call to Touch.
+func (f *File) Qid() plan9.Qid {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	qid := f.qid
+	qid.Type = uint8(f.Mode >> 24)
+	return qid
+}
+
+// Touch records a change to the contents of f
+func (f *File) Touch() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.qid.Vers++
+	f.mtime = uint32(time.Now().Unix())
+}
+
+// Dir returns the plan9.Dir describing f
+func (f *File) Dir() (plan9.Dir, error) {
+	var dir plan9.Dir
+	if !f.IsDir() {
+		size, err := f.Size()
+		if err != nil {
+			return dir, err
+		}
+		dir.Length = size
+	}
+	dir.Qid = f.Qid()
+	f.mu.Lock()
+	dir.Mode = f.Mode
+	dir.Name = f.Name
+	dir.Atime = f.mtime
+	dir.Mtime = f.mtime
+	f.mu.Unlock()
+	dir.Uid = "none"
+	dir.Gid = "none"
+	dir.Muid = "none"
+	return dir, nil
+}
+
 func (f *File) Contents() (FileContents, error) {
 	if f.curfd != nil {
 		return f.curfd, nil
@@ -105,54 +244,160 @@ func (f *File) Sync() error {
 }
 
 func (f *File) Add(c *File) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c.mu.Lock()
+	c.parent = f
+	c.mu.Unlock()
 	f.childs = append(f.childs, c)
 }
 
+// SetMtime changes the modification time of f
+func (f *File) SetMtime(mtime uint32) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.mtime = mtime
+}
+
+// Rename changes the name of c, a child of f, it returns false if
+// c isn't a child of f or if f already has a child called name.
+func (f *File) Rename(c *File, name string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	found := false
+	for _, v := range f.childs {
+		if v.Name == name && v != c {
+			return false
+		}
+		found = found || v == c
+	}
+	if found {
+		c.mu.Lock()
+		c.Name = name
+		c.mu.Unlock()
+	}
+	return found
+}
+
+// Remove removes c from the childs of f, it returns false
+// if c isn't a child of f.
+func (f *File) Remove(c *File) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, v := range f.childs {
+		if v == c {
+			f.childs = append(f.childs[:i], f.childs[i+1:]...)
+			c.mu.Lock()
+			c.parent = nil
+			c.mu.Unlock()
+			return true
+		}
+	}
+	return false
+}
+
+// NewInMemory returns an InMemory holding a copy of data
+func NewInMemory(data []byte) *InMemory {
+	return &InMemory{buf: append([]byte(nil), data...)}
+}
+
+// Open returns the contents of in with a cursor at the start,
+// OTRUNC in mode truncates in.
 func (in *InMemory) Open(mode int, perm int) (FileContents, error) {
-	return in, nil
+	if mode&plan9.OTRUNC != 0 {
+		in.Truncate(0)
+	}
+	return &inMemoryFd{in: in}, nil
 }
 
 func (in *InMemory) Read(b []byte) (int, error) {
-	if in.cur >= len(in.buf) {
-		return 0, io.EOF
-	}
-	slice := in.buf[in.cur:]
-	n := copy(b, slice)
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	n, err := in.readAt(b, in.cur)
 	in.cur += n
-	return n, nil
+	return n, err
 }
 
 func (in *InMemory) Write(b []byte) (int, error) {
-	in.Expand(len(b))
-
-	// if we got here, then expand ensures
-	// that b can be copied directly after in.cur
-	buf := in.buf[in.cur : in.cur+len(b)]
-	n := copy(buf, b)
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if len(b) > MaxInMemory-in.cur {
+		return 0, ErrTooLarge
+	}
+	n := in.writeAt(b, in.cur)
 	// move the cursor
 	in.cur += n
-	// expand the length to include the cursor
-	in.buf = in.buf[0:in.cur]
+	return n, nil
+}
+
+// readAt copies the contents starting at off to b
+func (in *InMemory) readAt(b []byte, off int) (int, error) {
+	if off >= len(in.buf) {
+		return 0, io.EOF
+	}
+	return copy(b, in.buf[off:]), nil
+}
 
+// writeAt copies b to the contents starting at off, the gap
+// between the end of the contents and off is filled with zeros.
+func (in *InMemory) writeAt(b []byte, off int) int {
+	end := off + len(b)
+	if end > len(in.buf) {
+		// expand the length to include the new data
+		in.resize(end)
+	}
+	n := copy(in.buf[off:end], b)
 	if n != len(b) {
 		panic("len != n")
 	}
-	return n, nil
+	return n
 }
 
 func (in *InMemory) Expand(sz int) {
-	empty := cap(in.buf) - (in.cur + 1)
-	if empty > sz {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.expand(in.cur + sz)
+}
+
+// expand ensures the capacity of the buffer is at least end
+func (in *InMemory) expand(end int) {
+	if cap(in.buf) >= end {
 		return
 	}
 	//TODO(andre): use a buffer cache
-	nb := make([]byte, len(in.buf), len(in.buf)+sz)
+	nb := make([]byte, len(in.buf), end+len(in.buf))
 	copy(nb, in.buf)
 	in.buf = nb
-	return
+}
+
+// resize changes the length of the buffer to sz, new bytes are zero
+func (in *InMemory) resize(sz int) {
+	old := len(in.buf)
+	in.expand(sz)
+	in.buf = in.buf[:sz]
+	for i := old; i < sz; i++ {
+		in.buf[i] = 0
+	}
+}
+
+// Truncate changes the size of in to sz, the cursor is moved
+// to the end if it was after sz.
+func (in *InMemory) Truncate(sz uint64) error {
+	if sz > uint64(MaxInMemory) {
+		return ErrTooLarge
+	}
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.resize(int(sz))
+	if in.cur > int(sz) {
+		in.cur = int(sz)
+	}
+	return nil
 }
 
 func (in *InMemory) Seek(sz int64, sp SeekPoint) (int64, error) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
 	switch sp {
 	case SeekStart:
 		in.cur = int(sz)
@@ -179,49 +424,110 @@ func (in *InMemory) Sync() error {
 
 func (in *InMemory) Close() error {
 	//TODO(andre): recycle the buffer, but for now let the GC do the work
+	in.mu.Lock()
+	defer in.mu.Unlock()
 	in.buf = nil
 	return nil
 }
 
 func (in *InMemory) Bytes() []byte {
+	in.mu.Lock()
+	defer in.mu.Unlock()
 	return in.buf
 }
 
 func (in *InMemory) Size() (uint64, error) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
 	return uint64(len(in.buf)), nil
 }
 
+func (fd *inMemoryFd) Read(b []byte) (int, error) {
+	fd.in.mu.Lock()
+	defer fd.in.mu.Unlock()
+	n, err := fd.in.readAt(b, fd.cur)
+	fd.cur += n
+	return n, err
+}
+
+func (fd *inMemoryFd) Write(b []byte) (int, error) {
+	fd.in.mu.Lock()
+	defer fd.in.mu.Unlock()
+	if len(b) > MaxInMemory-fd.cur {
+		// the gap before cur would be allocated too
+		return 0, ErrTooLarge
+	}
+	n := fd.in.writeAt(b, fd.cur)
+	fd.cur += n
+	return n, nil
+}
+
+// Seek moves the cursor of fd, unlike InMemory.Seek the cursor can
+// be moved past the end, so a write can leave a gap.
+func (fd *inMemoryFd) Seek(sz int64, sp SeekPoint) (int64, error) {
+	fd.in.mu.Lock()
+	defer fd.in.mu.Unlock()
+	cur := int64(fd.cur)
+	switch sp {
+	case SeekStart:
+		cur = sz
+	case SeekEnd:
+		cur = int64(len(fd.in.buf)) - sz
+	case SeekCurrent:
+		cur += sz
+	}
+	if cur < 0 || cur > math.MaxInt32 {
+		return int64(fd.cur), ErrSeek
+	}
+	fd.cur = int(cur)
+	return cur, nil
+}
+
+func (fd *inMemoryFd) Sync() error {
+	return nil
+}
+
+// Close releases fd, the contents are kept in the InMemory
+func (fd *inMemoryFd) Close() error {
+	return nil
+}
+
 func FileInfoToDir(stat os.FileInfo) (dir plan9.Dir) {
+	dir.Mode = plan9.Perm(stat.Mode().Perm())
 	if stat.IsDir() {
-		dir.Type |= plan9.QTDIR
+		dir.Mode |= plan9.DMDIR
+		dir.Qid.Type = plan9.QTDIR
 	}
+	dir.Qid.Vers = uint32(stat.ModTime().Unix())
 	dir.Atime = uint32(stat.ModTime().Unix())
 	dir.Mtime = uint32(stat.ModTime().Unix())
 	dir.Name = stat.Name()
-	dir.Length = uint64(stat.Size())
+	if !stat.IsDir() {
+		dir.Length = uint64(stat.Size())
+	}
 	dir.Uid = "none"
 	dir.Gid = "none"
 	dir.Muid = "none"
 	return
 }
 
+// DirToQid returns the qid of dir with the type bits taken from its mode
 func DirToQid(dir plan9.Dir) plan9.Qid {
-	return plan9.Qid{
-		Path: 0,
-		Vers: 1,
-		Type: uint8(dir.Type),
-	}
+	qid := dir.Qid
+	qid.Type = uint8(dir.Mode >> 24)
+	return qid
 }
 
+// DirModeToOSMode converts the mode of a Topen or Tcreate to the
+// flags used by os.OpenFile
 func DirModeToOSMode(dm uint32) (osmode int) {
-	if (dm & plan9.OREAD) == plan9.OREAD {
-		osmode |= os.O_RDONLY
-	}
-	if (dm & plan9.OWRITE) == plan9.OWRITE {
-		osmode |= os.O_WRONLY
-	}
-	if (dm & plan9.ORDWR) == plan9.ORDWR {
-		osmode |= os.O_RDWR
+	switch dm & 3 {
+	case plan9.OREAD, plan9.OEXEC:
+		osmode = os.O_RDONLY
+	case plan9.OWRITE:
+		osmode = os.O_WRONLY
+	case plan9.ORDWR:
+		osmode = os.O_RDWR
 	}
 	if (dm & plan9.OAPPEND) == plan9.OAPPEND {
 		osmode |= os.O_APPEND
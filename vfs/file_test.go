@@ -1,6 +1,7 @@
 package vfs
 
 import (
+	"9fans.net/go/plan9"
 	"bytes"
 	"testing"
 )
@@ -74,3 +75,57 @@ func TestInMemory(t *testing.T) {
 		t.Fatalf("Wrong contents: %v", string(aux))
 	}
 }
+
+func TestInMemoryOpen(t *testing.T) {
+	in := NewInMemory([]byte(`hello`))
+	a, _ := in.Open(0, 0644)
+	b, _ := in.Open(0, 0644)
+
+	aux := make([]byte, 3)
+	if n, err := a.Read(aux); err != nil || n != 3 {
+		t.Fatalf("Invalid read %v / %v", n, err)
+	}
+	// each open has its own cursor
+	if n, err := b.Read(aux); err != nil || n != 3 || string(aux) != "hel" {
+		t.Fatalf("Invalid read %q / %v", aux[:n], err)
+	}
+
+	// writing past the end leaves a gap filled with zeros
+	if _, err := b.Seek(7, SeekStart); err != nil {
+		t.Fatalf("Error on seek: %v", err)
+	}
+	if _, err := b.Write([]byte(`!`)); err != nil {
+		t.Fatalf("Error writing: %v", err)
+	}
+	if !bytes.Equal(in.Bytes(), []byte("hello\x00\x00!")) {
+		t.Fatalf("Wrong contents: %q", in.Bytes())
+	}
+	if err := b.Close(); err != nil || len(in.Bytes()) == 0 {
+		t.Fatalf("Closing an open shouldn't release the contents: %v", err)
+	}
+
+	if _, err := in.Open(plan9.OTRUNC, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if sz, _ := in.Size(); sz != 0 {
+		t.Fatalf("OTRUNC should truncate the contents: %v", sz)
+	}
+}
+
+func TestInMemoryLimit(t *testing.T) {
+	in := NewInMemory([]byte(`hello`))
+	fd, _ := in.Open(0, 0644)
+	// a write far past the end doesn't allocate the gap
+	if _, err := fd.Seek(int64(MaxInMemory), SeekStart); err != nil {
+		t.Fatalf("Error on seek: %v", err)
+	}
+	if _, err := fd.Write([]byte(`!`)); err != ErrTooLarge {
+		t.Errorf("Expecting %v got %v", ErrTooLarge, err)
+	}
+	if err := in.Truncate(uint64(MaxInMemory) + 1); err != ErrTooLarge {
+		t.Errorf("Expecting %v got %v", ErrTooLarge, err)
+	}
+	if sz, _ := in.Size(); sz != 5 {
+		t.Errorf("The contents shouldn't change: %v", sz)
+	}
+}
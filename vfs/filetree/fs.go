@@ -0,0 +1,566 @@
+// Package filetree serves a tree of vfs.File over 9P.
+//
+// Synthetic file servers only need to describe their files, the
+// walk, open, read, write, create, remove and stat requests are
+// handled by FS:
+//
+//	root := vfs.NewDir("",
+//		vfs.NewFile("body", vfs.NewInMemory(nil)),
+//		vfs.NewDir("log"),
+//	)
+//	srv := vfs.NewFileserver(filetree.New(root))
+//
+// Every open has its own vfs.FileContents, returned by the
+// HasContent of the file. Contents that implement vfs.ContextReader
+// or vfs.ContextWriter are streams, the offset of the request is
+// ignored.
+package filetree
+
+import (
+	"9fans.net/go/plan9"
+	"amoraes.info/ded/vfs"
+	"amoraes.info/ded/vfs/mixin"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+)
+
+type (
+	FS struct {
+		mixin.FS
+		Root *vfs.File
+
+		// NewContent returns the content of the files created by
+		// clients, when nil the files are kept in a vfs.InMemory.
+		NewContent func(name string, perm plan9.Perm) (vfs.HasContent, error)
+
+		// mu serializes the changes to the tree
+		mu sync.Mutex
+	}
+
+	// Truncater is implemented by contents that can change their
+	// size with a Twstat
+	Truncater interface {
+		Truncate(size uint64) error
+	}
+
+	treeFid struct {
+		sync.Mutex
+		file *vfs.File
+		fd   vfs.FileContents
+
+		// rclose is true when the file must be removed on clunk
+		rclose bool
+
+		// dirents holds the directory entries not read yet
+		dirents [][]byte
+		// diroffset is the offset of the next directory read
+		diroffset uint64
+	}
+)
+
+var (
+	ErrBadName      = errors.New("invalid file name")
+	ErrNotFound     = errors.New("file not found")
+	ErrExists       = errors.New("file already exists")
+	ErrNotDir       = errors.New("not a directory")
+	ErrIsDir        = errors.New("is a directory")
+	ErrNotEmpty     = errors.New("directory not empty")
+	ErrPerm         = errors.New("permission denied")
+	ErrNoContent    = errors.New("file has no contents")
+	ErrRemoveRoot   = errors.New("cannot remove the root")
+	ErrDirOffset    = errors.New("invalid directory offset")
+	ErrShortDirRead = errors.New("count too small for directory entry")
+	ErrWstat        = errors.New("wstat not allowed")
+)
+
+// New returns a FS serving the files under root
+func New(root *vfs.File) *FS {
+	return &FS{Root: root}
+}
+
+func (fd *treeFid) Close() error {
+	fd.Lock()
+	defer fd.Unlock()
+	var err error
+	if fd.fd != nil {
+		err = fd.fd.Close()
+		fd.fd = nil
+	}
+	if fd.rclose {
+		fd.rclose = false
+		if rerr := remove(fd.file); err == nil {
+			err = rerr
+		}
+	}
+	return err
+}
+
+// remove takes f out of the tree and releases its content
+func remove(f *vfs.File) error {
+	parent := f.Parent()
+	if parent == nil {
+		return ErrRemoveRoot
+	}
+	if len(f.Childs()) > 0 {
+		return ErrNotEmpty
+	}
+	if !parent.Remove(f) {
+		return ErrNotFound
+	}
+	parent.Touch()
+	if c := f.Content(); c != nil {
+		return c.Close()
+	}
+	return nil
+}
+
+// allowed checks if the permissions of f allow an open with mode
+func allowed(f *vfs.File, mode uint8) bool {
+	var need plan9.Perm
+	switch mode & 3 {
+	case plan9.OREAD:
+		need = 0400
+	case plan9.OWRITE:
+		need = 0200
+	case plan9.ORDWR:
+		need = 0600
+	case plan9.OEXEC:
+		need = 0100
+	}
+	if mode&plan9.OTRUNC != 0 {
+		need |= 0200
+	}
+	return f.Perm()&need == need
+}
+
+func validName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.Contains(name, "/")
+}
+
+func (fs *FS) fid(fc *plan9.Fcall, ctx *vfs.Context) (*treeFid, error) {
+	fd, ok := fs.GetFid(fc.Fid, ctx).(*treeFid)
+	if !ok {
+		return nil, vfs.ErrInvalidFid
+	}
+	return fd, nil
+}
+
+func (fs *FS) Attach(fc *plan9.Fcall, ctx *vfs.Context) *plan9.Fcall {
+	ret := *fc
+	ret.Type++
+
+	if fs.Root == nil || !fs.Root.IsDir() {
+		return vfs.PackError(&ret, ErrNotDir)
+	}
+	fs.SetFid(ctx, fc.Fid, &treeFid{file: fs.Root})
+	ret.Qid = fs.Root.Qid()
+	return &ret
+}
+
+func (fs *FS) Walk(fc *plan9.Fcall, ctx *vfs.Context) *plan9.Fcall {
+	ret := *fc
+	ret.Type++
+
+	fd, err := fs.fid(fc, ctx)
+	if err != nil {
+		return vfs.PackError(&ret, err)
+	}
+	f := fd.file
+	for _, name := range fc.Wname {
+		if !f.IsDir() {
+			err = ErrNotDir
+			break
+		}
+		var next *vfs.File
+		switch {
+		case name == "..":
+			// .. of the root is the root
+			next = f
+			if p := f.Parent(); f != fs.Root && p != nil {
+				next = p
+			}
+		case validName(name):
+			if next = f.Walk(name); next == nil {
+				err = ErrNotFound
+			}
+		default:
+			err = ErrBadName
+		}
+		if err != nil {
+			break
+		}
+		f = next
+		ret.Wqid = append(ret.Wqid, f.Qid())
+	}
+	switch {
+	case len(fc.Wname) > 0 && len(ret.Wqid) == 0:
+		return vfs.PackError(&ret, err)
+	case len(ret.Wqid) < len(fc.Wname):
+		// partial walks don't change newfid
+		return &ret
+	}
+	if len(fc.Wname) == 0 && fc.Newfid == fc.Fid {
+		return &ret
+	}
+	fs.SetFid(ctx, fc.Newfid, &treeFid{file: f})
+	return &ret
+}
+
+func (fs *FS) Open(fc *plan9.Fcall, ctx *vfs.Context) *plan9.Fcall {
+	ret := *fc
+	ret.Type++
+
+	fd, err := fs.fid(fc, ctx)
+	if err != nil {
+		return vfs.PackError(&ret, err)
+	}
+	f := fd.file
+	if f.IsDir() && (fc.Mode&3 != plan9.OREAD || fc.Mode&plan9.OTRUNC != 0) {
+		return vfs.PackError(&ret, ErrIsDir)
+	}
+	if !allowed(f, fc.Mode) {
+		return vfs.PackError(&ret, ErrPerm)
+	}
+	rclose := fc.Mode&plan9.ORCLOSE != 0
+	if p := f.Parent(); rclose && (f == fs.Root || p == nil || p.Perm()&0200 == 0) {
+		return vfs.PackError(&ret, ErrPerm)
+	}
+
+	var contents vfs.FileContents
+	if !f.IsDir() {
+		c := f.Content()
+		if c == nil {
+			return vfs.PackError(&ret, ErrNoContent)
+		}
+		contents, err = c.Open(int(fc.Mode), int(f.Perm()))
+		if err != nil {
+			return vfs.PackError(&ret, err)
+		}
+		if fc.Mode&plan9.OTRUNC != 0 {
+			f.Touch()
+		}
+	}
+	fd.Lock()
+	fd.fd = contents
+	fd.rclose = rclose
+	fd.Unlock()
+	ret.Qid = f.Qid()
+	ret.Iounit = fs.Iounit(ctx)
+	return &ret
+}
+
+func (fs *FS) Create(fc *plan9.Fcall, ctx *vfs.Context) *plan9.Fcall {
+	ret := *fc
+	ret.Type++
+
+	fd, err := fs.fid(fc, ctx)
+	if err != nil {
+		return vfs.PackError(&ret, err)
+	}
+	parent := fd.file
+	switch {
+	case !parent.IsDir():
+		return vfs.PackError(&ret, ErrNotDir)
+	case !validName(fc.Name):
+		return vfs.PackError(&ret, ErrBadName)
+	case parent.Perm()&0200 == 0:
+		return vfs.PackError(&ret, ErrPerm)
+	}
+	isdir := fc.Perm&plan9.DMDIR != 0
+	if isdir && fc.Mode&3 != plan9.OREAD {
+		return vfs.PackError(&ret, ErrIsDir)
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if parent.Walk(fc.Name) != nil {
+		return vfs.PackError(&ret, ErrExists)
+	}
+	var f *vfs.File
+	var contents vfs.FileContents
+	if isdir {
+		f = vfs.NewDir(fc.Name)
+	} else {
+		content, err := fs.newContent(fc.Name, fc.Perm)
+		if err != nil {
+			return vfs.PackError(&ret, err)
+		}
+		if contents, err = content.Open(int(fc.Mode), int(fc.Perm)); err != nil {
+			content.Close()
+			return vfs.PackError(&ret, err)
+		}
+		f = vfs.NewFile(fc.Name, content)
+	}
+	f.Mode = fc.Perm
+	parent.Add(f)
+	parent.Touch()
+
+	fd.Lock()
+	fd.file = f
+	fd.fd = contents
+	fd.rclose = fc.Mode&plan9.ORCLOSE != 0
+	fd.Unlock()
+	ret.Qid = f.Qid()
+	ret.Iounit = fs.Iounit(ctx)
+	return &ret
+}
+
+func (fs *FS) newContent(name string, perm plan9.Perm) (vfs.HasContent, error) {
+	if fs.NewContent == nil {
+		return vfs.NewInMemory(nil), nil
+	}
+	return fs.NewContent(name, perm)
+}
+
+func (fs *FS) Read(fc *plan9.Fcall, ctx *vfs.Context) *plan9.Fcall {
+	ret := *fc
+	ret.Type++
+
+	fd, err := fs.fid(fc, ctx)
+	if err != nil {
+		return vfs.PackError(&ret, err)
+	}
+	count := fc.Count
+	if iounit := fs.Iounit(ctx); count > iounit {
+		count = iounit
+	}
+
+	fd.Lock()
+	if cr, ok := fd.fd.(vfs.ContextReader); ok {
+		// the read might block, the fid can't be locked while
+		// waiting, or the clunk of the fid would block too
+		fd.Unlock()
+		buf := make([]byte, int(count))
+		sz, err := cr.ReadContext(ctx.Context(), buf)
+		if err != nil && err != io.EOF {
+			return vfs.PackError(&ret, err)
+		}
+		ret.Data = buf[:sz]
+		ret.Count = uint32(sz)
+		return &ret
+	}
+	defer fd.Unlock()
+	if fd.file.IsDir() {
+		data, err := fs.readDir(fd, fc.Offset, count)
+		if err != nil {
+			return vfs.PackError(&ret, err)
+		}
+		ret.Data = data
+		ret.Count = uint32(len(data))
+		return &ret
+	}
+	if fd.fd == nil {
+		return vfs.PackError(&ret, mixin.ErrFidNotOpen)
+	}
+
+	if _, err := fd.fd.Seek(int64(fc.Offset), vfs.SeekStart); err != nil {
+		return vfs.PackError(&ret, err)
+	}
+	buf := make([]byte, int(count))
+	sz, err := fd.fd.Read(buf)
+	if err != nil && err != io.EOF {
+		return vfs.PackError(&ret, err)
+	}
+	ret.Data = buf[:sz]
+	ret.Count = uint32(sz)
+	return &ret
+}
+
+// readDir returns the directory entries of fd that fit in count bytes,
+// reading from offset 0 starts again from the first entry.
+func (fs *FS) readDir(fd *treeFid, offset uint64, count uint32) ([]byte, error) {
+	if offset == 0 {
+		fd.dirents = nil
+		fd.diroffset = 0
+		for _, c := range fd.file.Childs() {
+			dir, err := c.Dir()
+			if err != nil {
+				return nil, err
+			}
+			buf, err := dir.Bytes()
+			if err != nil {
+				return nil, err
+			}
+			fd.dirents = append(fd.dirents, buf)
+		}
+	} else if offset != fd.diroffset {
+		return nil, ErrDirOffset
+	}
+
+	var data []byte
+	for len(fd.dirents) > 0 && len(data)+len(fd.dirents[0]) <= int(count) {
+		data = append(data, fd.dirents[0]...)
+		fd.dirents = fd.dirents[1:]
+	}
+	if len(data) == 0 && len(fd.dirents) > 0 {
+		return nil, ErrShortDirRead
+	}
+	fd.diroffset += uint64(len(data))
+	return data, nil
+}
+
+func (fs *FS) Write(fc *plan9.Fcall, ctx *vfs.Context) *plan9.Fcall {
+	ret := *fc
+	ret.Type++
+
+	fd, err := fs.fid(fc, ctx)
+	if err != nil {
+		return vfs.PackError(&ret, err)
+	}
+	fd.Lock()
+	if cw, ok := fd.fd.(vfs.ContextWriter); ok {
+		// like ContextReader, the write might block
+		fd.Unlock()
+		sz, err := cw.WriteContext(ctx.Context(), fc.Data)
+		if err != nil {
+			return vfs.PackError(&ret, err)
+		}
+		fd.file.Touch()
+		ret.Count = uint32(sz)
+		return &ret
+	}
+	defer fd.Unlock()
+	if fd.fd == nil {
+		return vfs.PackError(&ret, ErrIsDir)
+	}
+	if fd.file.Perm()&plan9.DMAPPEND != 0 {
+		_, err = fd.fd.Seek(0, vfs.SeekEnd)
+	} else {
+		_, err = fd.fd.Seek(int64(fc.Offset), vfs.SeekStart)
+	}
+	if err != nil {
+		return vfs.PackError(&ret, err)
+	}
+	sz, err := fd.fd.Write(fc.Data)
+	if err != nil {
+		return vfs.PackError(&ret, err)
+	}
+	fd.file.Touch()
+	ret.Count = uint32(sz)
+	return &ret
+}
+
+func (fs *FS) Remove(fc *plan9.Fcall, ctx *vfs.Context) *plan9.Fcall {
+	ret := *fc
+	ret.Type++
+
+	fd, err := fs.fid(fc, ctx)
+	if err != nil {
+		return vfs.PackError(&ret, err)
+	}
+	f := fd.file
+	if f == fs.Root {
+		return vfs.PackError(&ret, ErrRemoveRoot)
+	}
+	// the fid is clunked even if the remove fails
+	fd.Lock()
+	fd.rclose = false
+	fd.Unlock()
+	fd.Close()
+	if p := f.Parent(); p != nil && p.Perm()&0200 == 0 {
+		return vfs.PackError(&ret, ErrPerm)
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := remove(f); err != nil {
+		return vfs.PackError(&ret, err)
+	}
+	return &ret
+}
+
+func (fs *FS) Stat(fc *plan9.Fcall, ctx *vfs.Context) *plan9.Fcall {
+	ret := *fc
+	ret.Type++
+
+	fd, err := fs.fid(fc, ctx)
+	if err != nil {
+		return vfs.PackError(&ret, err)
+	}
+	dir, err := fd.file.Dir()
+	if err != nil {
+		return vfs.PackError(&ret, err)
+	}
+	if fd.file == fs.Root && dir.Name == "" {
+		dir.Name = "/"
+	}
+	ret.Stat, err = dir.Bytes()
+	if err != nil {
+		return vfs.PackError(&ret, err)
+	}
+	return &ret
+}
+
+// Wstat changes the name, permissions, length and modification time
+// of a file. Nothing is changed if any of the changes isn't allowed.
+func (fs *FS) Wstat(fc *plan9.Fcall, ctx *vfs.Context) *plan9.Fcall {
+	ret := *fc
+	ret.Type++
+
+	fd, err := fs.fid(fc, ctx)
+	if err != nil {
+		return vfs.PackError(&ret, err)
+	}
+	dir, err := plan9.UnmarshalDir(fc.Stat)
+	if err != nil {
+		return vfs.PackError(&ret, err)
+	}
+	f := fd.file
+	old, err := f.Dir()
+	if err != nil {
+		return vfs.PackError(&ret, err)
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	parent := f.Parent()
+	rename := dir.Name != "" && dir.Name != old.Name
+	switch {
+	case rename && (f == fs.Root || parent == nil || parent.Perm()&0200 == 0):
+		return vfs.PackError(&ret, ErrPerm)
+	case rename && !validName(dir.Name):
+		return vfs.PackError(&ret, ErrBadName)
+	case rename && parent.Walk(dir.Name) != nil:
+		return vfs.PackError(&ret, ErrExists)
+	case dir.Mode != ^plan9.Perm(0) && (dir.Mode^f.Perm())&plan9.DMDIR != 0:
+		return vfs.PackError(&ret, ErrWstat)
+	case dir.Uid != "" && dir.Uid != old.Uid, dir.Gid != "" && dir.Gid != old.Gid:
+		return vfs.PackError(&ret, ErrWstat)
+	}
+	if dir.Length != ^uint64(0) && dir.Length != old.Length {
+		t, ok := f.Content().(Truncater)
+		switch {
+		case f.IsDir():
+			return vfs.PackError(&ret, ErrIsDir)
+		case f.Perm()&0200 == 0:
+			return vfs.PackError(&ret, ErrPerm)
+		case !ok:
+			return vfs.PackError(&ret, ErrWstat)
+		}
+		if err := t.Truncate(dir.Length); err != nil {
+			return vfs.PackError(&ret, err)
+		}
+		f.Touch()
+	}
+	if rename {
+		parent.Rename(f, dir.Name)
+		parent.Touch()
+	}
+	if dir.Mode != ^plan9.Perm(0) {
+		f.SetMode(dir.Mode)
+	}
+	if dir.Mtime != ^uint32(0) {
+		f.SetMtime(dir.Mtime)
+	}
+	return &ret
+}
+
+// File returns the file used by fid
+func (fs *FS) File(fid uint32, ctx *vfs.Context) (*vfs.File, bool) {
+	fd, ok := fs.GetFid(fid, ctx).(*treeFid)
+	if !ok {
+		return nil, false
+	}
+	return fd.file, true
+}
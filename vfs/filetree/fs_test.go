@@ -0,0 +1,67 @@
+package filetree
+
+import (
+	"9fans.net/go/plan9"
+	"amoraes.info/ded/vfs"
+	"amoraes.info/ded/vfs/fstest"
+	"testing"
+)
+
+func TestConformance(t *testing.T) {
+	root := vfs.NewDir("",
+		vfs.NewFile("hello.txt", vfs.NewInMemory([]byte("hello"))),
+		vfs.NewDir("dir"),
+	)
+	root.Mode |= 0200
+	root.Walk("dir").Mode |= 0200
+	fstest.Run(t, New(root), fstest.Config{
+		File:     "hello.txt",
+		Contents: []byte("hello"),
+		Dir:      "dir",
+		Writable: true,
+	})
+}
+
+func TestPermissions(t *testing.T) {
+	ro := vfs.NewFile("ro", vfs.NewInMemory([]byte("data")))
+	ro.Mode = 0444
+	log := vfs.NewFile("log", vfs.NewInMemory([]byte("a")))
+	log.Mode = plan9.DMAPPEND | 0644
+	srv := vfs.NewFileserver(New(vfs.NewDir("", ro, log)))
+	ctx := vfs.NewContext()
+
+	steps := []struct {
+		fc  plan9.Fcall
+		err error
+	}{
+		{fc: plan9.Fcall{Type: plan9.Tversion, Msize: 8192, Version: "9P2000"}},
+		{fc: plan9.Fcall{Type: plan9.Tattach, Fid: 1, Afid: plan9.NOFID}},
+		{fc: plan9.Fcall{Type: plan9.Tcreate, Fid: 1, Name: "new", Perm: 0644, Mode: plan9.OWRITE}, err: ErrPerm},
+		{fc: plan9.Fcall{Type: plan9.Twalk, Fid: 1, Newfid: 2, Wname: []string{"ro"}}},
+		{fc: plan9.Fcall{Type: plan9.Topen, Fid: 2, Mode: plan9.OWRITE}, err: ErrPerm},
+		{fc: plan9.Fcall{Type: plan9.Topen, Fid: 2, Mode: plan9.OREAD | plan9.ORCLOSE}, err: ErrPerm},
+		{fc: plan9.Fcall{Type: plan9.Tremove, Fid: 2}, err: ErrPerm},
+		{fc: plan9.Fcall{Type: plan9.Twalk, Fid: 1, Newfid: 3, Wname: []string{"log"}}},
+		{fc: plan9.Fcall{Type: plan9.Topen, Fid: 3, Mode: plan9.ORDWR}},
+		{fc: plan9.Fcall{Type: plan9.Twrite, Fid: 3, Offset: 0, Data: []byte("b")}},
+		{fc: plan9.Fcall{Type: plan9.Twalk, Fid: 1, Newfid: 4, Wname: []string{"nothere"}}, err: ErrNotFound},
+		{fc: plan9.Fcall{Type: plan9.Twalk, Fid: 1, Newfid: 4, Wname: []string{"log"}}},
+		{fc: plan9.Fcall{Type: plan9.Twalk, Fid: 4, Newfid: 5, Wname: []string{".."}}, err: ErrNotDir},
+	}
+	for i, s := range steps {
+		fc := s.fc
+		ret := srv.Call(&fc, ctx)
+		switch {
+		case s.err == nil && ret.Type != fc.Type+1:
+			t.Errorf("step %v: expecting success got %v", i, ret)
+		case s.err != nil && (ret.Type != plan9.Rerror || ret.Ename != s.err.Error()):
+			t.Errorf("step %v: expecting %v got %v", i, s.err, ret)
+		}
+	}
+
+	// writes to a DMAPPEND file ignore the offset
+	ret := srv.Call(&plan9.Fcall{Type: plan9.Tread, Fid: 3, Count: 10}, ctx)
+	if ret.Type != plan9.Rread || string(ret.Data) != "ab" {
+		t.Errorf("Unexpected read of an append only file: %v", ret)
+	}
+}
@@ -0,0 +1,443 @@
+package fstest
+
+import (
+	"9fans.net/go/plan9"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"path"
+	"sort"
+	"time"
+)
+
+func checkVersion(s *session) {
+	rx := s.ok(&plan9.Fcall{Type: plan9.Tversion, Tag: plan9.NOTAG, Msize: msize, Version: "9P2000"})
+	if rx.Version != "9P2000" {
+		s.Errorf("Rversion: expecting version 9P2000 got %q", rx.Version)
+	}
+	if rx.Msize > msize || rx.Msize <= plan9.IOHDRSZ {
+		s.Errorf("Rversion: invalid msize %v for a request of %v", rx.Msize, msize)
+	}
+
+	rx = s.ok(&plan9.Fcall{Type: plan9.Tversion, Tag: plan9.NOTAG, Msize: msize / 2, Version: "9P2000"})
+	if rx.Msize > msize/2 {
+		s.Errorf("Rversion: msize %v is bigger than the requested %v", rx.Msize, msize/2)
+	}
+
+	rx = s.ok(&plan9.Fcall{Type: plan9.Tversion, Tag: plan9.NOTAG, Msize: msize, Version: "XP1"})
+	if rx.Version != "unknown" {
+		s.Errorf("Rversion: expecting version unknown for XP1 got %q", rx.Version)
+	}
+
+	// a new version aborts the previous session
+	s.attach()
+	s.ok(&plan9.Fcall{Type: plan9.Tversion, Tag: plan9.NOTAG, Msize: msize, Version: "9P2000"})
+	s.fail(&plan9.Fcall{Type: plan9.Tclunk, Fid: rootFid}, "fids are released by Tversion")
+}
+
+func checkAttach(s *session) {
+	root := s.attach()
+	if !isDir(root) {
+		s.Errorf("Rattach: root qid %v isn't a directory", root)
+	}
+	s.fail(&plan9.Fcall{Type: plan9.Tattach, Fid: rootFid, Afid: plan9.NOFID, Uname: s.cfg.Uname, Aname: s.cfg.Aname}, "fid in use")
+
+	clone := s.newfid()
+	if qids := s.walk(clone); len(qids) != 0 {
+		s.Errorf("Rwalk: clone returned %v qids", len(qids))
+	}
+	s.ok(&plan9.Fcall{Type: plan9.Tclunk, Fid: clone})
+}
+
+func checkWalk(s *session) {
+	root := s.attach()
+	names := split(s.cfg.File)
+
+	fid := s.newfid()
+	qids := s.walk(fid, names...)
+	for i, q := range qids[:len(qids)-1] {
+		if !isDir(q) {
+			s.Errorf("walk %v: %v isn't a directory: %v", s.cfg.File, names[i], q)
+		}
+	}
+	file := qids[len(qids)-1]
+	if isDir(file) {
+		s.Errorf("walk %v: qid of a regular file is a directory: %v", s.cfg.File, file)
+	}
+	s.ok(&plan9.Fcall{Type: plan9.Tclunk, Fid: fid})
+
+	missing := s.newfid()
+	s.fail(&plan9.Fcall{Type: plan9.Twalk, Fid: rootFid, Newfid: missing, Wname: []string{unique("missing")}}, "file doesn't exist")
+	s.fail(&plan9.Fcall{Type: plan9.Tclunk, Fid: missing}, "failed walks don't create newfid")
+
+	// walking past a regular file returns the qids walked so far
+	partial := s.newfid()
+	rx := s.ok(&plan9.Fcall{Type: plan9.Twalk, Fid: rootFid, Newfid: partial, Wname: append(names, "x")})
+	if len(rx.Wqid) != len(names) {
+		s.Errorf("partial walk: expecting %v qids got %v", len(names), len(rx.Wqid))
+	}
+	s.fail(&plan9.Fcall{Type: plan9.Tclunk, Fid: partial}, "partial walks don't create newfid")
+
+	// .. of the root is the root
+	up := s.newfid()
+	qids = s.walk(up, "..")
+	if qids[0].Path != root.Path || !isDir(qids[0]) {
+		s.Errorf("walk ..: expecting the root %v got %v", root, qids[0])
+	}
+	s.ok(&plan9.Fcall{Type: plan9.Tclunk, Fid: up})
+	if len(names) > 1 {
+		up = s.newfid()
+		qids = s.walk(up, names[0], "..")
+		if qids[1].Path != root.Path {
+			s.Errorf("walk %v/..: expecting the root %v got %v", names[0], root, qids[1])
+		}
+		s.ok(&plan9.Fcall{Type: plan9.Tclunk, Fid: up})
+	}
+
+	// the wire format doesn't allow more than MAXWELEM names,
+	// but every walk up to that must be accepted
+	long := make([]string, plan9.MAXWELEM)
+	for i := range long {
+		long[i] = ".."
+	}
+	up = s.newfid()
+	qids = s.walk(up, long...)
+	if qids[len(qids)-1].Path != root.Path {
+		s.Errorf("walk %v: expecting the root %v got %v", long, root, qids[len(qids)-1])
+	}
+	s.ok(&plan9.Fcall{Type: plan9.Tclunk, Fid: up})
+
+	inuse := s.newfid()
+	s.walk(inuse)
+	s.fail(&plan9.Fcall{Type: plan9.Twalk, Fid: rootFid, Newfid: inuse}, "newfid in use")
+
+	// walking to the same fid moves it
+	rx = s.ok(&plan9.Fcall{Type: plan9.Twalk, Fid: inuse, Newfid: inuse, Wname: names})
+	if len(rx.Wqid) != len(names) || rx.Wqid[len(names)-1].Path != file.Path {
+		s.Errorf("walk %v with newfid = fid: expecting %v got %v", s.cfg.File, file, rx.Wqid)
+	}
+	s.fail(&plan9.Fcall{Type: plan9.Twalk, Fid: inuse, Newfid: s.newfid(), Wname: []string{"x"}}, "walk from a regular file")
+	s.ok(&plan9.Fcall{Type: plan9.Tclunk, Fid: inuse})
+
+	s.fail(&plan9.Fcall{Type: plan9.Twalk, Fid: s.newfid(), Newfid: s.newfid()}, "unknown fid")
+}
+
+func checkOpen(s *session) {
+	s.attach()
+	dir := s.newfid()
+	s.walk(dir)
+	rx := s.ok(&plan9.Fcall{Type: plan9.Topen, Fid: dir, Mode: plan9.OREAD})
+	if !isDir(rx.Qid) {
+		s.Errorf("Ropen: the root qid %v isn't a directory", rx.Qid)
+	}
+	if rx.Iounit > s.msize-plan9.IOHDRSZ {
+		s.Errorf("Ropen: iounit %v doesn't fit in msize %v", rx.Iounit, s.msize)
+	}
+	s.fail(&plan9.Fcall{Type: plan9.Topen, Fid: dir, Mode: plan9.OREAD}, "fid already open")
+	s.fail(&plan9.Fcall{Type: plan9.Twalk, Fid: dir, Newfid: s.newfid(), Wname: []string{".."}}, "walk from an open fid")
+	s.ok(&plan9.Fcall{Type: plan9.Tclunk, Fid: dir})
+
+	dir = s.newfid()
+	s.walk(dir)
+	s.fail(&plan9.Fcall{Type: plan9.Topen, Fid: dir, Mode: plan9.OWRITE}, "directories can't be written")
+	s.fail(&plan9.Fcall{Type: plan9.Topen, Fid: dir, Mode: plan9.ORDWR}, "directories can't be written")
+	s.ok(&plan9.Fcall{Type: plan9.Tclunk, Fid: dir})
+
+	file := s.newfid()
+	s.walk(file, split(s.cfg.File)...)
+	s.fail(&plan9.Fcall{Type: plan9.Tread, Fid: file, Count: 10}, "read before open")
+	s.fail(&plan9.Fcall{Type: plan9.Twrite, Fid: file, Data: []byte("x")}, "write before open")
+	rx = s.ok(&plan9.Fcall{Type: plan9.Topen, Fid: file, Mode: plan9.OREAD})
+	if isDir(rx.Qid) {
+		s.Errorf("Ropen: the qid %v of a regular file is a directory", rx.Qid)
+	}
+	s.fail(&plan9.Fcall{Type: plan9.Twrite, Fid: file, Data: []byte("x")}, "fid open for reading")
+	s.ok(&plan9.Fcall{Type: plan9.Tclunk, Fid: file})
+}
+
+func checkRead(s *session) {
+	fsys := s.mount()
+	fid, err := fsys.Open(s.cfg.File, plan9.OREAD)
+	if err != nil {
+		s.Fatalf("open %v: %v", s.cfg.File, err)
+	}
+	defer fid.Close()
+
+	all, err := ioutil.ReadAll(fid)
+	if err != nil {
+		s.Fatalf("read %v: %v", s.cfg.File, err)
+	}
+	if s.cfg.Contents == nil {
+		return
+	}
+	if !bytes.Equal(all, s.cfg.Contents) {
+		s.Fatalf("read %v: expecting %q got %q", s.cfg.File, s.cfg.Contents, all)
+	}
+
+	size := int64(len(all))
+	for _, off := range []int64{0, size / 2, size - 1, size, size + 10} {
+		if off < 0 {
+			continue
+		}
+		buf := make([]byte, 4)
+		n, err := fid.ReadAt(buf, off)
+		var expect []byte
+		if off < size {
+			expect = all[off:]
+			if len(expect) > len(buf) {
+				expect = expect[:len(buf)]
+			}
+		}
+		switch {
+		case len(expect) == 0 && err != io.EOF:
+			s.Errorf("read %v at %v: expecting EOF got %v bytes (err: %v)", s.cfg.File, off, n, err)
+		case len(expect) > 0 && err != nil:
+			s.Errorf("read %v at %v: %v", s.cfg.File, off, err)
+		case !bytes.Equal(buf[:n], expect):
+			s.Errorf("read %v at %v: expecting %q got %q", s.cfg.File, off, expect, buf[:n])
+		}
+	}
+}
+
+func checkDirRead(s *session) {
+	fsys := s.mount()
+	names := split(s.cfg.File)
+	dirpath := path.Dir(s.cfg.File)
+	fid, err := fsys.Open(dirpath, plan9.OREAD)
+	if err != nil {
+		s.Fatalf("open %v: %v", dirpath, err)
+	}
+	defer fid.Close()
+
+	dirs, err := fid.Dirreadall()
+	if err != nil {
+		s.Fatalf("read %v: %v", dirpath, err)
+	}
+	seen := make(map[string]bool)
+	var found *plan9.Dir
+	for _, d := range dirs {
+		switch {
+		case d.Name == "" || d.Name == "." || d.Name == "..":
+			s.Errorf("read %v: invalid entry name %q", dirpath, d.Name)
+		case seen[d.Name]:
+			s.Errorf("read %v: entry %q returned twice", dirpath, d.Name)
+		case d.Qid.Type != uint8(d.Mode>>24):
+			s.Errorf("read %v: qid type %v doesn't match mode %v of %q", dirpath, d.Qid.Type, d.Mode, d.Name)
+		}
+		seen[d.Name] = true
+		if d.Name == names[len(names)-1] {
+			found = d
+		}
+	}
+	if found == nil {
+		s.Fatalf("read %v: %v not found in %v", dirpath, names[len(names)-1], dirs)
+	}
+	if found.Mode&plan9.DMDIR != 0 {
+		s.Errorf("read %v: %v is a directory", dirpath, found)
+	}
+	if s.cfg.Contents != nil && found.Length != uint64(len(s.cfg.Contents)) {
+		s.Errorf("read %v: expecting length %v got %v", dirpath, len(s.cfg.Contents), found.Length)
+	}
+
+	// reading from the start returns the same entries
+	if _, err := fid.Seek(0, 0); err != nil {
+		s.Fatalf("seek %v: %v", dirpath, err)
+	}
+	again, err := fid.Dirreadall()
+	if err != nil {
+		s.Fatalf("read %v again: %v", dirpath, err)
+	}
+	if !sameNames(dirs, again) {
+		s.Errorf("read %v: entries changed from %v to %v", dirpath, dirs, again)
+	}
+}
+
+func checkStat(s *session) {
+	fsys := s.mount()
+	d, err := fsys.Stat(".")
+	if err != nil {
+		s.Fatalf("stat of the root: %v", err)
+	}
+	if d.Mode&plan9.DMDIR == 0 || !isDir(d.Qid) {
+		s.Errorf("stat of the root: not a directory %v", d)
+	}
+
+	fid, err := fsys.Open(s.cfg.File, plan9.OREAD)
+	if err != nil {
+		s.Fatalf("open %v: %v", s.cfg.File, err)
+	}
+	defer fid.Close()
+	d, err = fid.Stat()
+	if err != nil {
+		s.Fatalf("stat %v: %v", s.cfg.File, err)
+	}
+	if d.Name != path.Base(s.cfg.File) {
+		s.Errorf("stat %v: expecting name %v got %v", s.cfg.File, path.Base(s.cfg.File), d.Name)
+	}
+	if d.Mode&plan9.DMDIR != 0 || isDir(d.Qid) {
+		s.Errorf("stat %v: regular file is a directory: %v", s.cfg.File, d)
+	}
+	if d.Qid.Path != fid.Qid().Path {
+		s.Errorf("stat %v: qid %v doesn't match the walk qid %v", s.cfg.File, d.Qid, fid.Qid())
+	}
+	if s.cfg.Contents != nil && d.Length != uint64(len(s.cfg.Contents)) {
+		s.Errorf("stat %v: expecting length %v got %v", s.cfg.File, len(s.cfg.Contents), d.Length)
+	}
+}
+
+func checkClunk(s *session) {
+	s.attach()
+	fid := s.newfid()
+	s.walk(fid)
+	s.ok(&plan9.Fcall{Type: plan9.Tclunk, Fid: fid})
+	s.fail(&plan9.Fcall{Type: plan9.Tclunk, Fid: fid}, "fid already clunked")
+	s.fail(&plan9.Fcall{Type: plan9.Twalk, Fid: fid, Newfid: s.newfid()}, "fid already clunked")
+
+	s.ok(&plan9.Fcall{Type: plan9.Tclunk, Fid: rootFid})
+	s.fail(&plan9.Fcall{Type: plan9.Twalk, Fid: rootFid, Newfid: s.newfid()}, "root fid clunked")
+}
+
+func checkFlush(s *session) {
+	s.attach()
+	// flushing a request that was already answered is a no-op
+	s.ok(&plan9.Fcall{Type: plan9.Tflush, Oldtag: s.tag})
+	s.ok(&plan9.Fcall{Type: plan9.Tflush, Oldtag: s.tag + 100})
+	fid := s.newfid()
+	s.walk(fid)
+	s.ok(&plan9.Fcall{Type: plan9.Tclunk, Fid: fid})
+
+	if s.cfg.Blocking == "" {
+		return
+	}
+	// the request in flight is answered before the Rflush, or
+	// not at all
+	fid = s.newfid()
+	s.walk(fid, split(s.cfg.Blocking)...)
+	s.ok(&plan9.Fcall{Type: plan9.Topen, Fid: fid, Mode: plan9.OREAD})
+	read := &plan9.Fcall{Type: plan9.Tread, Fid: fid, Count: s.msize - plan9.IOHDRSZ}
+	s.send(read)
+	// give the server time to start the read
+	time.Sleep(10 * time.Millisecond)
+	flush := &plan9.Fcall{Type: plan9.Tflush, Oldtag: read.Tag}
+	s.send(flush)
+	for {
+		rx := s.recv(flush)
+		if rx.Tag == read.Tag {
+			if err := CheckReply(read, rx); err != nil {
+				s.Errorf("%v: %v", read, err)
+			}
+			continue
+		}
+		if err := CheckReply(flush, rx); err != nil {
+			s.Errorf("%v: %v", flush, err)
+		}
+		break
+	}
+	// a reply to the flushed request after the Rflush fails the
+	// tag check of the clunk
+	s.ok(&plan9.Fcall{Type: plan9.Tclunk, Fid: fid})
+}
+
+func checkCreate(s *session) {
+	if !s.cfg.Writable {
+		s.Skip("read-only tree")
+	}
+	fsys := s.mount()
+	name := join(s.cfg.Dir, unique("file"))
+	fid, err := fsys.Create(name, plan9.ORDWR, 0644)
+	if err != nil {
+		s.Fatalf("create %v: %v", name, err)
+	}
+	defer fid.Close()
+	if isDir(fid.Qid()) {
+		s.Errorf("create %v: qid of a regular file is a directory: %v", name, fid.Qid())
+	}
+	if _, err := fsys.Create(name, plan9.ORDWR, 0644); err == nil {
+		s.Errorf("create %v: should fail when the file exists", name)
+	}
+
+	writes := []struct {
+		off  int64
+		data string
+	}{{0, "hello"}, {5, "world"}, {0, "HE"}}
+	for _, w := range writes {
+		if n, err := fid.WriteAt([]byte(w.data), w.off); err != nil || n != len(w.data) {
+			s.Fatalf("write %q at %v: wrote %v (err: %v)", w.data, w.off, n, err)
+		}
+	}
+	expect := "HElloworld"
+	buf := make([]byte, 20)
+	n, err := fid.ReadAt(buf, 0)
+	if err != nil || string(buf[:n]) != expect {
+		s.Errorf("read %v: expecting %q got %q (err: %v)", name, expect, buf[:n], err)
+	}
+	if d, err := fid.Stat(); err != nil {
+		s.Errorf("stat %v: %v", name, err)
+	} else if d.Length != uint64(len(expect)) {
+		s.Errorf("stat %v: expecting length %v got %v", name, len(expect), d.Length)
+	}
+
+	rfid, err := fsys.Open(name, plan9.OREAD)
+	if err != nil {
+		s.Fatalf("open %v: %v", name, err)
+	}
+	if err := rfid.Remove(); err != nil {
+		s.Fatalf("remove %v: %v", name, err)
+	}
+	if _, err := fsys.Stat(name); err == nil {
+		s.Errorf("stat %v: file should be removed", name)
+	}
+}
+
+func checkMkdir(s *session) {
+	if !s.cfg.Writable {
+		s.Skip("read-only tree")
+	}
+	fsys := s.mount()
+	name := join(s.cfg.Dir, unique("dir"))
+	fid, err := fsys.Create(name, plan9.OREAD, plan9.DMDIR|0755)
+	if err != nil {
+		s.Fatalf("create %v: %v", name, err)
+	}
+	if !isDir(fid.Qid()) {
+		s.Errorf("create %v: qid of a directory isn't a directory: %v", name, fid.Qid())
+	}
+	if dirs, err := fid.Dirreadall(); err != nil || len(dirs) != 0 {
+		s.Errorf("read %v: expecting an empty directory got %v (err: %v)", name, dirs, err)
+	}
+	fid.Close()
+
+	child := join(name, "child")
+	cfid, err := fsys.Create(child, plan9.OWRITE, 0644)
+	if err != nil {
+		s.Fatalf("create %v: %v", child, err)
+	}
+	cfid.Close()
+	if err := fsys.Remove(child); err != nil {
+		s.Errorf("remove %v: %v", child, err)
+	}
+	if err := fsys.Remove(name); err != nil {
+		s.Errorf("remove %v: %v", name, err)
+	}
+}
+
+func sameNames(a, b []*plan9.Dir) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	names := func(dirs []*plan9.Dir) []string {
+		var ret []string
+		for _, d := range dirs {
+			ret = append(ret, d.Name)
+		}
+		sort.Strings(ret)
+		return ret
+	}
+	na, nb := names(a), names(b)
+	for i := range na {
+		if na[i] != nb[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,264 @@
+// Package fstest checks if a vfs.ServerFS behaves like a 9P server.
+//
+// The file server is exported over a memlistener and every check
+// uses a new connection, either speaking raw 9P or using the
+// 9fans.net/go/plan9/client package.
+//
+// FuzzCalls and FuzzStream are the bodies of fuzz targets, a crash
+// found by go test -fuzz is written to testdata/fuzz and is replayed
+// by every go test run after that.
+package fstest
+
+import (
+	"9fans.net/go/plan9"
+	"9fans.net/go/plan9/client"
+	"amoraes.info/ded/vfs"
+	"amoraes.info/ded/vfs/memlistener"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+type (
+	// Config describes the tree exported by the file server
+	Config struct {
+		// File is the path, relative to the root, of an existing regular file
+		File string
+		// Contents of File, when nil the contents aren't compared
+		Contents []byte
+		// Dir is the path of a directory used by the checks that change
+		// the tree, empty means the root.
+		Dir string
+		// Writable enables the checks that create, write and remove files
+		Writable bool
+		// Blocking is the path of a file whose reads wait for data,
+		// like a queue of events, used to flush a request in flight.
+		// Empty skips that check.
+		Blocking string
+		// Uname and Aname are used to attach to the server
+		Uname string
+		Aname string
+	}
+
+	check struct {
+		name string
+		fn   func(*session)
+	}
+
+	// session is a connection to the server under test
+	session struct {
+		*testing.T
+		cfg  Config
+		conn net.Conn
+
+		msize   uint32
+		tag     uint16
+		nextFid uint32
+	}
+)
+
+const (
+	// rootFid is the fid used by attach in raw sessions
+	rootFid = 1
+	msize   = 8 * 1024
+)
+
+var (
+	checks = []check{
+		{"Version", checkVersion},
+		{"Attach", checkAttach},
+		{"Walk", checkWalk},
+		{"Open", checkOpen},
+		{"Read", checkRead},
+		{"DirRead", checkDirRead},
+		{"Stat", checkStat},
+		{"Clunk", checkClunk},
+		{"Flush", checkFlush},
+		{"Create", checkCreate},
+		{"Mkdir", checkMkdir},
+	}
+)
+
+// Run executes every protocol check against fs, failures are reported
+// as errors of subtests of t.
+func Run(t *testing.T, fs vfs.ServerFS, cfg Config) {
+	if cfg.File == "" {
+		t.Fatalf("fstest: Config.File is required")
+	}
+	if cfg.Uname == "" {
+		cfg.Uname = "fstest"
+	}
+	l := memlistener.New("fstest")
+	srv, err := vfs.NewServer(vfs.NewFileserver(fs, vfs.Recover()), l)
+	if err != nil {
+		t.Fatalf("fstest: unable to start server: %v", err)
+	}
+	defer srv.Close()
+
+	for _, c := range checks {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			conn, err := memlistener.Connect(l, "fstest-"+c.name)
+			if err != nil {
+				t.Fatalf("unable to connect: %v", err)
+			}
+			defer conn.Close()
+			c.fn(&session{T: t, cfg: cfg, conn: conn, nextFid: rootFid + 1})
+		})
+	}
+}
+
+// rpc sends tx and waits for the reply, replies that break the protocol
+// are reported as errors.
+func (s *session) rpc(tx *plan9.Fcall) *plan9.Fcall {
+	s.Helper()
+	s.send(tx)
+	rx := s.recv(tx)
+	if err := CheckReply(tx, rx); err != nil {
+		s.Errorf("%v: %v", tx, err)
+	}
+	return rx
+}
+
+// send sends tx with a new tag without waiting for the reply
+func (s *session) send(tx *plan9.Fcall) {
+	s.Helper()
+	if tx.Type != plan9.Tversion {
+		s.tag++
+		if s.tag == plan9.NOTAG {
+			s.tag = 0
+		}
+		tx.Tag = s.tag
+	}
+	if err := plan9.WriteFcall(s.conn, tx); err != nil {
+		s.Fatalf("%v: unable to send: %v", tx, err)
+	}
+}
+
+// recv reads the next reply, tx is the request it is expected for
+func (s *session) recv(tx *plan9.Fcall) *plan9.Fcall {
+	s.Helper()
+	rx, err := plan9.ReadFcall(s.conn)
+	if err != nil {
+		s.Fatalf("%v: unable to read reply: %v", tx, err)
+	}
+	return rx
+}
+
+// CheckReply returns an error if rx isn't a valid reply to tx
+func CheckReply(tx, rx *plan9.Fcall) error {
+	if rx == nil {
+		return errors.New("no reply")
+	}
+	switch {
+	case rx.Tag != tx.Tag:
+		return fmt.Errorf("reply with tag %v", rx.Tag)
+	case rx.Type == plan9.Rerror && rx.Ename == "":
+		return errors.New("Rerror without message")
+	case rx.Type != plan9.Rerror && (tx.Type%2 != 0 || rx.Type != tx.Type+1):
+		return fmt.Errorf("unexpected reply %v", rx)
+	}
+	if _, err := rx.Bytes(); err != nil {
+		return fmt.Errorf("reply %v can't be encoded: %v", rx, err)
+	}
+	switch rx.Type {
+	case plan9.Rversion:
+		if rx.Msize > tx.Msize {
+			return fmt.Errorf("msize %v is bigger than the requested %v", rx.Msize, tx.Msize)
+		}
+	case plan9.Rwalk:
+		if len(rx.Wqid) > len(tx.Wname) || (len(tx.Wname) > 0 && len(rx.Wqid) == 0) {
+			return fmt.Errorf("%v qids for a walk of %v names", len(rx.Wqid), len(tx.Wname))
+		}
+	case plan9.Rread:
+		if len(rx.Data) > int(tx.Count) {
+			return fmt.Errorf("%v bytes for a read of %v", len(rx.Data), tx.Count)
+		}
+	}
+	return nil
+}
+
+// ok sends tx and stops the check if the server answers with an error
+func (s *session) ok(tx *plan9.Fcall) *plan9.Fcall {
+	s.Helper()
+	rx := s.rpc(tx)
+	if rx.Type == plan9.Rerror {
+		s.Fatalf("%v: unexpected error %q", tx, rx.Ename)
+	}
+	return rx
+}
+
+// fail sends tx and reports an error if the server accepts it
+func (s *session) fail(tx *plan9.Fcall, why string) {
+	s.Helper()
+	if rx := s.rpc(tx); rx.Type != plan9.Rerror {
+		s.Errorf("%v: should fail (%v), got %v", tx, why, rx)
+	}
+}
+
+func (s *session) newfid() uint32 {
+	fid := s.nextFid
+	s.nextFid++
+	return fid
+}
+
+// attach starts a session and attaches rootFid, it returns the root qid
+func (s *session) attach() plan9.Qid {
+	s.Helper()
+	rx := s.ok(&plan9.Fcall{Type: plan9.Tversion, Tag: plan9.NOTAG, Msize: msize, Version: "9P2000"})
+	s.msize = rx.Msize
+	rx = s.ok(&plan9.Fcall{Type: plan9.Tattach, Fid: rootFid, Afid: plan9.NOFID, Uname: s.cfg.Uname, Aname: s.cfg.Aname})
+	return rx.Qid
+}
+
+// walk walks from rootFid to newfid
+func (s *session) walk(newfid uint32, names ...string) []plan9.Qid {
+	s.Helper()
+	rx := s.ok(&plan9.Fcall{Type: plan9.Twalk, Fid: rootFid, Newfid: newfid, Wname: names})
+	if len(rx.Wqid) != len(names) {
+		s.Fatalf("walk %v: only %v of %v names walked", names, len(rx.Wqid), len(names))
+	}
+	return rx.Wqid
+}
+
+// mount starts a session using the 9fans client
+func (s *session) mount() *client.Fsys {
+	s.Helper()
+	conn, err := client.NewConn(s.conn)
+	if err != nil {
+		s.Fatalf("version: %v", err)
+	}
+	fsys, err := conn.Attach(nil, s.cfg.Uname, s.cfg.Aname)
+	if err != nil {
+		s.Fatalf("attach: %v", err)
+	}
+	return fsys
+}
+
+// split returns the elements of p
+func split(p string) []string {
+	var names []string
+	for _, n := range strings.Split(p, "/") {
+		if n != "" && n != "." {
+			names = append(names, n)
+		}
+	}
+	return names
+}
+
+// join returns the path of name inside the directory d
+func join(d, name string) string {
+	return strings.Join(append(split(d), name), "/")
+}
+
+// unique returns a name that isn't used by the tree under test
+func unique(what string) string {
+	return fmt.Sprintf("fstest-%v-%v", what, time.Now().UnixNano())
+}
+
+func isDir(q plan9.Qid) bool {
+	return q.Type&plan9.QTDIR == plan9.QTDIR
+}
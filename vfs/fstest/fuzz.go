@@ -0,0 +1,250 @@
+package fstest
+
+import (
+	"9fans.net/go/plan9"
+	"amoraes.info/ded/vfs"
+	"testing"
+)
+
+type (
+	// decoder turns fuzzer input into request fields, reading past the
+	// end of the input returns zeros.
+	decoder struct {
+		data []byte
+	}
+
+	// encoder is the inverse of decoder
+	encoder []byte
+)
+
+var (
+	// fuzzNames are the names used by generated walks and creates
+	fuzzNames = []string{"dir", "a.txt", "b.txt", "body", "header", "mnt", "new", "..", ".", "", "x/y"}
+
+	fuzzVersions = []string{"9P2000", "9P2000.u", "XP1", ""}
+
+	fuzzPerms = []plan9.Perm{0644, plan9.DMDIR | 0755, 0600, plan9.DMDIR | plan9.DMAPPEND | 0777}
+
+	fuzzTypes = []uint8{
+		plan9.Tversion, plan9.Tauth, plan9.Tattach, plan9.Tflush,
+		plan9.Twalk, plan9.Topen, plan9.Tcreate, plan9.Tread,
+		plan9.Twrite, plan9.Tclunk, plan9.Tremove, plan9.Tstat,
+		plan9.Twstat,
+	}
+)
+
+func (d *decoder) empty() bool {
+	return len(d.data) == 0
+}
+
+func (d *decoder) byte() byte {
+	if len(d.data) == 0 {
+		return 0
+	}
+	b := d.data[0]
+	d.data = d.data[1:]
+	return b
+}
+
+func (d *decoder) uint16() uint16 {
+	return uint16(d.byte()) | uint16(d.byte())<<8
+}
+
+func (d *decoder) uint32() uint32 {
+	return uint32(d.uint16()) | uint32(d.uint16())<<16
+}
+
+func (d *decoder) bytes(n int) []byte {
+	if n > len(d.data) {
+		n = len(d.data)
+	}
+	b := d.data[:n]
+	d.data = d.data[n:]
+	return b
+}
+
+// fcall builds the next request, fids are kept small so requests
+// refer to each other.
+func (d *decoder) fcall() *plan9.Fcall {
+	fc := &plan9.Fcall{
+		Type: fuzzTypes[int(d.byte())%len(fuzzTypes)],
+		Tag:  uint16(d.byte()),
+		Fid:  uint32(d.byte() % 8),
+	}
+	switch fc.Type {
+	case plan9.Tversion:
+		fc.Tag = plan9.NOTAG
+		fc.Msize = d.uint32()
+		fc.Version = fuzzVersions[int(d.byte())%len(fuzzVersions)]
+	case plan9.Tauth, plan9.Tattach:
+		fc.Afid = plan9.NOFID
+		fc.Uname = "fuzz"
+	case plan9.Tflush:
+		fc.Oldtag = uint16(d.byte())
+	case plan9.Twalk:
+		fc.Newfid = uint32(d.byte() % 8)
+		n := int(d.byte())
+		if n == 0xff {
+			n = plan9.MAXWELEM + 1
+		} else {
+			n %= 4
+		}
+		for i := 0; i < n; i++ {
+			fc.Wname = append(fc.Wname, fuzzNames[int(d.byte())%len(fuzzNames)])
+		}
+	case plan9.Topen:
+		fc.Mode = d.byte()
+	case plan9.Tcreate:
+		fc.Name = fuzzNames[int(d.byte())%len(fuzzNames)]
+		fc.Perm = fuzzPerms[int(d.byte())%len(fuzzPerms)]
+		fc.Mode = d.byte()
+	case plan9.Tread:
+		fc.Offset = uint64(d.uint16())
+		fc.Count = d.uint32()
+		if d.byte() == 0xff {
+			fc.Offset = ^uint64(0) - uint64(d.byte())
+		}
+	case plan9.Twrite:
+		fc.Offset = uint64(d.uint16())
+		fc.Data = d.bytes(int(d.byte()))
+		fc.Count = uint32(len(fc.Data))
+	case plan9.Twstat:
+		dir := plan9.Dir{Name: fuzzNames[int(d.byte())%len(fuzzNames)], Mode: fuzzPerms[int(d.byte())%len(fuzzPerms)]}
+		fc.Stat, _ = dir.Bytes()
+	}
+	return fc
+}
+
+// FuzzCalls decodes data as a sequence of requests and sends them to
+// fs one at a time, after a version and an attach of fid 0.
+//
+// Requests are sent to the Fileserver without vfs.Recover, a panic
+// is a crash of the fuzz target.
+func FuzzCalls(t *testing.T, fs vfs.ServerFS, data []byte) {
+	srv := vfs.NewFileserver(fs)
+	ctx := vfs.NewContext()
+	defer fs.ReleaseContext(ctx)
+
+	call(t, srv, ctx, &plan9.Fcall{Type: plan9.Tversion, Tag: plan9.NOTAG, Msize: msize, Version: "9P2000"})
+	call(t, srv, ctx, &plan9.Fcall{Type: plan9.Tattach, Fid: 0, Afid: plan9.NOFID, Uname: "fuzz"})
+
+	d := &decoder{data: data}
+	for !d.empty() {
+		call(t, srv, ctx, d.fcall())
+	}
+}
+
+// FuzzStream decodes data as the bytes sent by a client and sends
+// every well formed message to fs, malformed messages are skipped.
+func FuzzStream(t *testing.T, fs vfs.ServerFS, data []byte) {
+	srv := vfs.NewFileserver(fs)
+	ctx := vfs.NewContext()
+	defer fs.ReleaseContext(ctx)
+
+	for len(data) >= 4 {
+		n := int(data[0]) | int(data[1])<<8 | int(data[2])<<16 | int(data[3])<<24
+		if n < 4 || n > len(data) {
+			return
+		}
+		fc, err := plan9.UnmarshalFcall(data[:n])
+		data = data[n:]
+		if err != nil {
+			continue
+		}
+		call(t, srv, ctx, fc)
+	}
+}
+
+// call sends tx to srv and checks if the reply is valid
+func call(t *testing.T, srv *vfs.Fileserver, ctx *vfs.Context, tx *plan9.Fcall) {
+	t.Helper()
+	req := *tx
+	rx := srv.Call(&req, ctx)
+	if err := CheckReply(tx, rx); err != nil {
+		t.Fatalf("%v: %v", tx, err)
+	}
+}
+
+// EncodeCalls returns the input that FuzzCalls decodes as fcs, it
+// is used to build seed corpora. Fields that can't be generated by
+// FuzzCalls are replaced by the closest value it can generate.
+func EncodeCalls(fcs ...*plan9.Fcall) []byte {
+	var e encoder
+	for _, fc := range fcs {
+		e.byte(byte(indexOf(len(fuzzTypes), func(i int) bool { return fuzzTypes[i] == fc.Type })))
+		e.byte(byte(fc.Tag))
+		e.byte(byte(fc.Fid))
+		switch fc.Type {
+		case plan9.Tversion:
+			e.uint32(fc.Msize)
+			e.byte(byte(indexOf(len(fuzzVersions), func(i int) bool { return fuzzVersions[i] == fc.Version })))
+		case plan9.Tflush:
+			e.byte(byte(fc.Oldtag))
+		case plan9.Twalk:
+			e.byte(byte(fc.Newfid))
+			e.byte(byte(len(fc.Wname)))
+			for _, n := range fc.Wname {
+				e.name(n)
+			}
+		case plan9.Topen:
+			e.byte(fc.Mode)
+		case plan9.Tcreate:
+			e.name(fc.Name)
+			e.byte(byte(indexOf(len(fuzzPerms), func(i int) bool { return fuzzPerms[i] == fc.Perm })))
+			e.byte(fc.Mode)
+		case plan9.Tread:
+			e.uint16(uint16(fc.Offset))
+			e.uint32(fc.Count)
+			e.byte(0)
+		case plan9.Twrite:
+			e.uint16(uint16(fc.Offset))
+			e.byte(byte(len(fc.Data)))
+			e = append(e, fc.Data[:int(byte(len(fc.Data)))]...)
+		case plan9.Twstat:
+			e.byte(0)
+			e.byte(0)
+		}
+	}
+	return e
+}
+
+// EncodeStream returns the bytes sent by a client that sends fcs
+func EncodeStream(fcs ...*plan9.Fcall) []byte {
+	var buf []byte
+	for _, fc := range fcs {
+		b, err := fc.Bytes()
+		if err != nil {
+			panic(err)
+		}
+		buf = append(buf, b...)
+	}
+	return buf
+}
+
+func (e *encoder) byte(b byte) {
+	*e = append(*e, b)
+}
+
+func (e *encoder) uint16(v uint16) {
+	e.byte(byte(v))
+	e.byte(byte(v >> 8))
+}
+
+func (e *encoder) uint32(v uint32) {
+	e.uint16(uint16(v))
+	e.uint16(uint16(v >> 16))
+}
+
+func (e *encoder) name(n string) {
+	e.byte(byte(indexOf(len(fuzzNames), func(i int) bool { return fuzzNames[i] == n })))
+}
+
+// indexOf returns the first i in [0, n) where match is true, or 0
+func indexOf(n int, match func(int) bool) int {
+	for i := 0; i < n; i++ {
+		if match(i) {
+			return i
+		}
+	}
+	return 0
+}
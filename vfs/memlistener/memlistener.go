@@ -129,17 +129,10 @@ func (l *L) Addr() net.Addr {
 }
 
 func (l *L) Accept() (net.Conn, error) {
-	var iAmClosed bool
-	l.Lock()
-	iAmClosed = l.alreadyClosed
-	l.Unlock()
-
-	if iAmClosed {
+	ch := make(chan signal)
+	if !l.addCloseNotify(ch) {
 		return nil, io.EOF
 	}
-
-	ch := make(chan signal)
-	l.addCloseNotify(ch)
 	defer l.removeCloseNotify(ch)
 
 	select {
@@ -150,10 +143,16 @@ func (l *L) Accept() (net.Conn, error) {
 	}
 }
 
-func (l *L) addCloseNotify(ch chan signal) {
+// addCloseNotify registers ch to be closed with l, it returns false
+// if l is already closed
+func (l *L) addCloseNotify(ch chan signal) bool {
 	l.Lock()
 	defer l.Unlock()
+	if l.alreadyClosed {
+		return false
+	}
 	l.closenotify = append(l.closenotify, ch)
+	return true
 }
 
 func (l *L) removeCloseNotify(ch chan signal) {
@@ -173,14 +172,16 @@ func (l *L) removeCloseNotify(ch chan signal) {
 
 func (l *L) Close() error {
 	l.Lock()
+	defer l.Unlock()
+	if l.alreadyClosed {
+		return nil
+	}
 	l.alreadyClosed = true
-	l.Unlock()
-
-	l.Lock()
+	// closing instead of sending, an Accept that already got a
+	// connection won't read from its channel
 	for _, v := range l.closenotify {
-		v <- signal{}
+		close(v)
 	}
-	l.Unlock()
 	return nil
 }
 
@@ -0,0 +1,227 @@
+package vfs
+
+import (
+	"9fans.net/go/plan9"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"runtime"
+	"sync"
+	"time"
+)
+
+type (
+	// Handler answers one request
+	Handler func(*plan9.Fcall, *Context) *plan9.Fcall
+
+	// Middleware wraps a Handler with extra behaviour, it might
+	// answer the request without calling next.
+	Middleware func(next Handler) Handler
+
+	// Metrics records how many requests of each type were
+	// answered and how long they took.
+	Metrics struct {
+		sync.Mutex
+		stats map[uint8]*MessageStats
+	}
+
+	// MessageStats holds the latency of a message type
+	MessageStats struct {
+		Count  uint64
+		Errors uint64
+		Total  time.Duration
+		Max    time.Duration
+	}
+)
+
+var (
+	msgNames = map[uint8]string{
+		plan9.Tversion: "Tversion",
+		plan9.Tauth:    "Tauth",
+		plan9.Tattach:  "Tattach",
+		plan9.Tflush:   "Tflush",
+		plan9.Twalk:    "Twalk",
+		plan9.Topen:    "Topen",
+		plan9.Tcreate:  "Tcreate",
+		plan9.Tread:    "Tread",
+		plan9.Twrite:   "Twrite",
+		plan9.Tclunk:   "Tclunk",
+		plan9.Tremove:  "Tremove",
+		plan9.Tstat:    "Tstat",
+		plan9.Twstat:   "Twstat",
+	}
+)
+
+// MessageName returns the name of the message type t (ie, Twalk)
+func MessageName(t uint8) string {
+	if name, ok := msgNames[t]; ok {
+		return name
+	}
+	if name, ok := msgNames[t-1]; ok && t%2 == 1 {
+		return "R" + name[1:]
+	}
+	if t == plan9.Rerror {
+		return "Rerror"
+	}
+	return fmt.Sprintf("unknown(%v)", t)
+}
+
+// NewFileserver returns a Fileserver that dispatch requests to fs
+// after passing them through the middleware chain.
+//
+// The first middleware is the first one to see the request.
+func NewFileserver(fs ServerFS, chain ...Middleware) *Fileserver {
+	srv := &Fileserver{ServerFS: fs}
+	h := Handler(srv.dispatch)
+	for i := len(chain) - 1; i >= 0; i-- {
+		h = chain[i](h)
+	}
+	srv.handler = h
+	return srv
+}
+
+// Recover converts a panic in the next handlers into a Rerror
+func Recover() Middleware {
+	return func(next Handler) Handler {
+		return func(fc *plan9.Fcall, ctx *Context) (ret *plan9.Fcall) {
+			defer func() {
+				r := recover()
+				if r == nil {
+					return
+				}
+				stack := make([]byte, 4096)
+				stack = stack[:runtime.Stack(stack, false)]
+				log.WithFields(log.Fields{
+					"module": "vfs.Recover",
+					"panic":  r,
+					"fcall":  fc.String(),
+					"stack":  string(stack),
+				}).Errorf("Panic while handling request")
+				rerr := *fc
+				ret = PackError(&rerr, fmt.Errorf("internal server error: %v", r))
+			}()
+			return next(fc, ctx)
+		}
+	}
+}
+
+// Logger logs every request and response pair
+func Logger() Middleware {
+	return func(next Handler) Handler {
+		return func(fc *plan9.Fcall, ctx *Context) *plan9.Fcall {
+			start := time.Now()
+			req := fc.String()
+			ret := next(fc, ctx)
+			entry := log.WithFields(log.Fields{
+				"module":   "vfs.Logger",
+				"remote":   ctx.RemoteAddr(),
+				"uname":    ctx.Uname(),
+				"type":     MessageName(fc.Type),
+				"tag":      fc.Tag,
+				"request":  req,
+				"duration": time.Since(start),
+			})
+			if ret == nil {
+				entry.Debugf("No response")
+				return ret
+			}
+			entry = entry.WithField("response", ret.String())
+			if ret.Type == plan9.Rerror {
+				entry.Debugf("Request failed")
+			} else {
+				entry.Debugf("Request answered")
+			}
+			return ret
+		}
+	}
+}
+
+// Access calls check before passing the request to the next handler,
+// if check returns an error the request is answered with it. Tclunk
+// isn't checked and a rejected Tremove still clunks its fid, like 9P
+// requires.
+func Access(check func(*plan9.Fcall, *Context) error) Middleware {
+	return func(next Handler) Handler {
+		return func(fc *plan9.Fcall, ctx *Context) *plan9.Fcall {
+			if fc.Type == plan9.Tclunk {
+				return next(fc, ctx)
+			}
+			if err := check(fc, ctx); err != nil {
+				if fc.Type == plan9.Tremove {
+					next(&plan9.Fcall{Type: plan9.Tclunk, Tag: fc.Tag, Fid: fc.Fid}, ctx)
+				}
+				ret := *fc
+				return PackError(&ret, err)
+			}
+			return next(fc, ctx)
+		}
+	}
+}
+
+// ReadOnly is an access check that rejects every request that
+// could change the file system, use it with Access.
+func ReadOnly(fc *plan9.Fcall, ctx *Context) error {
+	switch fc.Type {
+	case plan9.Tcreate, plan9.Tremove, plan9.Twrite, plan9.Twstat:
+		return ErrReadOnly
+	case plan9.Topen:
+		if (fc.Mode&3 != plan9.OREAD && fc.Mode&3 != plan9.OEXEC) || fc.Mode&(plan9.OTRUNC|plan9.ORCLOSE) != 0 {
+			return ErrReadOnly
+		}
+	}
+	return nil
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		stats: make(map[uint8]*MessageStats),
+	}
+}
+
+// Middleware returns the middleware that feeds m
+func (m *Metrics) Middleware() Middleware {
+	return func(next Handler) Handler {
+		return func(fc *plan9.Fcall, ctx *Context) *plan9.Fcall {
+			start := time.Now()
+			ret := next(fc, ctx)
+			m.record(fc.Type, time.Since(start), ret == nil || ret.Type == plan9.Rerror)
+			return ret
+		}
+	}
+}
+
+func (m *Metrics) record(t uint8, d time.Duration, failed bool) {
+	m.Lock()
+	defer m.Unlock()
+	st := m.stats[t]
+	if st == nil {
+		st = &MessageStats{}
+		m.stats[t] = st
+	}
+	st.Count++
+	if failed {
+		st.Errors++
+	}
+	st.Total += d
+	if d > st.Max {
+		st.Max = d
+	}
+}
+
+// Snapshot returns a copy of the current stats indexed by message name
+func (m *Metrics) Snapshot() map[string]MessageStats {
+	m.Lock()
+	defer m.Unlock()
+	ret := make(map[string]MessageStats, len(m.stats))
+	for t, st := range m.stats {
+		ret[MessageName(t)] = *st
+	}
+	return ret
+}
+
+// Mean returns the average latency of the requests
+func (ms MessageStats) Mean() time.Duration {
+	if ms.Count == 0 {
+		return 0
+	}
+	return ms.Total / time.Duration(ms.Count)
+}
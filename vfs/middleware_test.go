@@ -0,0 +1,130 @@
+package vfs_test
+
+import (
+	"9fans.net/go/plan9"
+	"amoraes.info/ded/ufs"
+	"amoraes.info/ded/vfs"
+	"amoraes.info/ded/vfs/mixin"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+type (
+	panicFS struct {
+		mixin.FS
+	}
+)
+
+func (fs *panicFS) Walk(fc *plan9.Fcall, ctx *vfs.Context) *plan9.Fcall {
+	// the fid was never set, so this panics
+	_ = fs.GetFid(fc.Fid, ctx).(*panicFS)
+	return nil
+}
+
+func (fs *panicFS) Open(fc *plan9.Fcall, ctx *vfs.Context) *plan9.Fcall {
+	panic("open failed")
+}
+
+func TestMiddlewareChain(t *testing.T) {
+	metrics := vfs.NewMetrics()
+	var order []string
+	trace := func(name string) vfs.Middleware {
+		return func(next vfs.Handler) vfs.Handler {
+			return func(fc *plan9.Fcall, ctx *vfs.Context) *plan9.Fcall {
+				order = append(order, name)
+				return next(fc, ctx)
+			}
+		}
+	}
+	denyUname := func(fc *plan9.Fcall, ctx *vfs.Context) error {
+		if fc.Type == plan9.Tattach && fc.Uname == "evil" {
+			return errors.New("permission denied")
+		}
+		return nil
+	}
+	srv := vfs.NewFileserver(&panicFS{}, trace("first"), metrics.Middleware(), vfs.Recover(),
+		vfs.Logger(), vfs.Access(denyUname), trace("last"))
+	ctx := vfs.NewContext()
+
+	if ret := srv.Call(&plan9.Fcall{Type: plan9.Tversion, Msize: 8192, Version: "9P2000"}, ctx); ret.Type != plan9.Rversion {
+		t.Fatalf("Unexpected reply: %v", ret)
+	}
+	if order[0] != "first" || order[1] != "last" {
+		t.Errorf("Invalid middleware order: %v", order)
+	}
+
+	if ret := srv.Call(&plan9.Fcall{Type: plan9.Tattach, Fid: 1, Afid: plan9.NOFID, Uname: "evil"}, ctx); ret.Type != plan9.Rerror {
+		t.Errorf("Access check should reject the attach: %v", ret)
+	}
+	if ret := srv.Call(&plan9.Fcall{Type: plan9.Tattach, Fid: 1, Afid: plan9.NOFID, Uname: "glenda"}, ctx); ret.Type != plan9.Rattach {
+		t.Errorf("Access check should allow the attach: %v", ret)
+	}
+
+	ret := srv.Call(&plan9.Fcall{Type: plan9.Twalk, Fid: 1, Newfid: 2, Wname: []string{"a"}}, ctx)
+	if ret.Type != plan9.Rerror {
+		t.Errorf("Panic should be converted to Rerror: %v", ret)
+	}
+	for i := 0; i < 2; i++ {
+		// the panicking open must not mark the fid open
+		ret := srv.Call(&plan9.Fcall{Type: plan9.Topen, Fid: 1, Mode: plan9.OREAD}, ctx)
+		if ret.Type != plan9.Rerror || ret.Ename == mixin.ErrFidOpen.Error() {
+			t.Errorf("Unexpected open reply: %v", ret)
+		}
+	}
+
+	stats := metrics.Snapshot()
+	if stats["Tattach"].Count != 2 || stats["Tattach"].Errors != 1 {
+		t.Errorf("Invalid attach stats: %+v", stats["Tattach"])
+	}
+	if stats["Twalk"].Errors != 1 {
+		t.Errorf("Invalid walk stats: %+v", stats["Twalk"])
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	ctx := vfs.NewContext()
+	for _, fc := range []*plan9.Fcall{
+		{Type: plan9.Twrite},
+		{Type: plan9.Tcreate},
+		{Type: plan9.Tremove},
+		{Type: plan9.Twstat},
+		{Type: plan9.Topen, Mode: plan9.OWRITE},
+		{Type: plan9.Topen, Mode: plan9.OREAD | plan9.OTRUNC},
+	} {
+		if vfs.ReadOnly(fc, ctx) == nil {
+			t.Errorf("%v should be rejected", vfs.MessageName(fc.Type))
+		}
+	}
+	if err := vfs.ReadOnly(&plan9.Fcall{Type: plan9.Topen, Mode: plan9.OREAD}, ctx); err != nil {
+		t.Errorf("Reading should be allowed: %v", err)
+	}
+}
+
+func TestReadOnlyRemove(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vfs-readonly")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	srv := vfs.NewFileserver(&ufs.Ufs{Root: dir}, vfs.Access(vfs.ReadOnly))
+	ctx := vfs.NewContext()
+	for _, step := range []struct {
+		fc     plan9.Fcall
+		expect uint8
+	}{
+		{plan9.Fcall{Type: plan9.Tversion, Msize: 8192, Version: "9P2000"}, plan9.Rversion},
+		{plan9.Fcall{Type: plan9.Tattach, Fid: 1, Afid: plan9.NOFID, Uname: "glenda"}, plan9.Rattach},
+		{plan9.Fcall{Type: plan9.Twalk, Fid: 1, Newfid: 2}, plan9.Rwalk},
+		{plan9.Fcall{Type: plan9.Tremove, Fid: 2}, plan9.Rerror},
+		// the rejected remove clunked fid 2
+		{plan9.Fcall{Type: plan9.Twalk, Fid: 1, Newfid: 2}, plan9.Rwalk},
+		{plan9.Fcall{Type: plan9.Tclunk, Fid: 2}, plan9.Rclunk},
+	} {
+		fc := step.fc
+		if ret := srv.Call(&fc, ctx); ret.Type != step.expect {
+			t.Errorf("%v: expecting %v got %v", &step.fc, vfs.MessageName(step.expect), ret)
+		}
+	}
+}
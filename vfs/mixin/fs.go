@@ -3,8 +3,11 @@ package mixin
 import (
 	"9fans.net/go/plan9"
 	"amoraes.info/ded/vfs"
+	"errors"
 	log "github.com/Sirupsen/logrus"
 	"io"
+	"strings"
+	"sync"
 )
 
 type (
@@ -12,37 +15,236 @@ type (
 
 	keys uint
 
-	fidMap map[uint32]interface{}
+	fidMap struct {
+		sync.Mutex
+		fids map[uint32]*fidEntry
+	}
+
+	fidEntry struct {
+		val   interface{}
+		state FidState
+	}
+
+	// FidState is the protocol state of a fid, it is kept by FS
+	// so servers don't need to validate the sequence of requests.
+	FidState struct {
+		// Open is true after a successful Topen or Tcreate
+		Open bool
+		// Mode used to open the fid
+		Mode uint8
+		// Qid returned by the request that created or opened the fid
+		Qid plan9.Qid
+	}
 )
 
 const (
 	fids = keys(iota)
+	msize
+
+	// maxMsize is the biggest message accepted by FS
+	maxMsize = 8 * 1024
 )
 
+var (
+	ErrUnknownFid   = errors.New("unknown fid")
+	ErrFidInUse     = errors.New("fid already in use")
+	ErrFidOpen      = errors.New("fid already open")
+	ErrFidNotOpen   = errors.New("fid not open")
+	ErrNotReadable  = errors.New("fid not open for reading")
+	ErrNotWritable  = errors.New("fid not open for writing")
+	ErrWalkOpenFid  = errors.New("cannot walk from an open fid")
+	ErrTooManyNames = errors.New("too many names in walk")
+	ErrMsize        = errors.New("msize too small")
+
+	errMissing = errors.New("filesystem missing implementation")
+)
+
+func newFidMap() interface{} {
+	return &fidMap{fids: make(map[uint32]*fidEntry)}
+}
+
+// fidsOf returns the fids of the connection that owns ctx
+func fidsOf(ctx *vfs.Context) *fidMap {
+	return ctx.GetOrPut(fids, newFidMap).(*fidMap)
+}
+
 func (fs *FS) GetFid(fid uint32, ctx *vfs.Context) interface{} {
-	return (ctx.MustGet(fids).(fidMap))[fid]
+	fm := fidsOf(ctx)
+	fm.Lock()
+	defer fm.Unlock()
+	if e, ok := fm.fids[fid]; ok {
+		return e.val
+	}
+	return nil
 }
 
+// SetFid changes the value associated with fid, if fid
+// is a new fid it starts as a walked (not open) fid.
 func (fs *FS) SetFid(ctx *vfs.Context, fid uint32, val interface{}) {
-	ctx.MustGet(fids).(fidMap)[fid] = val
+	fm := fidsOf(ctx)
+	fm.Lock()
+	defer fm.Unlock()
+	if e, ok := fm.fids[fid]; ok {
+		e.val = val
+		return
+	}
+	fm.fids[fid] = &fidEntry{val: val}
 }
 
-func (fs *FS) ValidFid(fc *plan9.Fcall, ctx *vfs.Context) bool {
-	return fs.GetFid(fc.Fid, ctx) != nil
+// FidState returns the protocol state of fid
+func (fs *FS) FidState(fid uint32, ctx *vfs.Context) (FidState, bool) {
+	fm := fidsOf(ctx)
+	fm.Lock()
+	defer fm.Unlock()
+	if e, ok := fm.fids[fid]; ok {
+		return e.state, true
+	}
+	return FidState{}, false
+}
+
+// ValidFid checks if the fids used by fc follow the 9P rules
+// considering the requests already answered.
+//
+// Cloning an open fid (a walk without names) is accepted, the
+// new fid starts closed. Clients that can't walk from the
+// attach fid (like 9fans.net/go/plan9/client) rely on that.
+func (fs *FS) ValidFid(fc *plan9.Fcall, ctx *vfs.Context) error {
+	fm := fidsOf(ctx)
+	fm.Lock()
+	defer fm.Unlock()
+
+	switch fc.Type {
+	case plan9.Tversion, plan9.Tflush:
+		return nil
+	case plan9.Tauth:
+		if _, inuse := fm.fids[fc.Afid]; inuse {
+			return ErrFidInUse
+		}
+		return nil
+	case plan9.Tattach:
+		if _, inuse := fm.fids[fc.Fid]; inuse {
+			return ErrFidInUse
+		}
+		return nil
+	}
+
+	e, ok := fm.fids[fc.Fid]
+	if !ok {
+		return ErrUnknownFid
+	}
+	switch fc.Type {
+	case plan9.Twalk:
+		if len(fc.Wname) > plan9.MAXWELEM {
+			return ErrTooManyNames
+		}
+		if e.state.Open && len(fc.Wname) > 0 {
+			return ErrWalkOpenFid
+		}
+		if _, inuse := fm.fids[fc.Newfid]; inuse && fc.Newfid != fc.Fid {
+			return ErrFidInUse
+		}
+	case plan9.Topen, plan9.Tcreate:
+		if e.state.Open {
+			return ErrFidOpen
+		}
+	case plan9.Tread:
+		if !e.state.Open {
+			return ErrFidNotOpen
+		}
+		if e.state.Mode&3 == plan9.OWRITE {
+			return ErrNotReadable
+		}
+	case plan9.Twrite:
+		if !e.state.Open {
+			return ErrFidNotOpen
+		}
+		if e.state.Mode&3 == plan9.OREAD || e.state.Mode&3 == plan9.OEXEC {
+			return ErrNotWritable
+		}
+	}
+	return nil
+}
+
+// UpdateFid records the effects of the reply rx to tx on the
+// fid state.
+func (fs *FS) UpdateFid(tx, rx *plan9.Fcall, ctx *vfs.Context) {
+	failed := rx == nil || rx.Type == plan9.Rerror
+	switch tx.Type {
+	case plan9.Tclunk, plan9.Tremove:
+		// the fid is gone even if the request failed
+		if _, ok := fs.FidState(tx.Fid, ctx); ok {
+			fs.ReleaseFid(tx.Fid, ctx)
+		}
+		return
+	}
+	if failed {
+		return
+	}
+
+	fm := fidsOf(ctx)
+	fm.Lock()
+	var stale *uint32
+	switch tx.Type {
+	case plan9.Tattach:
+		if e, ok := fm.fids[tx.Fid]; ok {
+			e.state = FidState{Qid: rx.Qid}
+		}
+	case plan9.Twalk:
+		if tx.Newfid == tx.Fid && len(tx.Wname) == 0 {
+			// walking a fid to itself doesn't change it
+			break
+		}
+		if len(rx.Wqid) != len(tx.Wname) {
+			// partial walks don't create newfid
+			if tx.Newfid != tx.Fid {
+				stale = &tx.Newfid
+			}
+			break
+		}
+		var qid plan9.Qid
+		if old, ok := fm.fids[tx.Fid]; ok {
+			qid = old.state.Qid
+		}
+		if len(rx.Wqid) > 0 {
+			qid = rx.Wqid[len(rx.Wqid)-1]
+		}
+		if e, ok := fm.fids[tx.Newfid]; ok {
+			e.state = FidState{Qid: qid}
+		}
+	case plan9.Topen, plan9.Tcreate:
+		if e, ok := fm.fids[tx.Fid]; ok {
+			e.state = FidState{Open: true, Mode: tx.Mode, Qid: rx.Qid}
+		}
+	}
+	fm.Unlock()
+
+	if stale != nil {
+		if _, ok := fs.FidState(*stale, ctx); ok {
+			fs.ReleaseFid(*stale, ctx)
+		}
+	}
 }
 
 func (fs *FS) ReleaseFid(fid uint32, ctx *vfs.Context) error {
 	log.WithFields(log.Fields{
 		"Fid":    fid,
+		"Uname":  ctx.Uname(),
 		"Module": "mixin.FS",
 	}).Debugf("Releasing fid")
-	defer func(ctx *vfs.Context, fid uint32) { delete((ctx.MustGet(fids).(fidMap)), fid) }(ctx, fid)
-	fd := fs.GetFid(fid, ctx)
+	fm := fidsOf(ctx)
+	fm.Lock()
+	var fd interface{}
+	if e, ok := fm.fids[fid]; ok {
+		fd = e.val
+	}
+	delete(fm.fids, fid)
+	fm.Unlock()
 	if fd != nil {
 		switch fd := fd.(type) {
 		case io.Closer:
 			log.WithFields(log.Fields{
 				"Fid":    fid,
+				"Uname":  ctx.Uname(),
 				"Module": "mixin.FS",
 			}).Debugf("Fid is a Closer")
 			err := fd.Close()
@@ -54,15 +256,39 @@ func (fs *FS) ReleaseFid(fid uint32, ctx *vfs.Context) error {
 	return nil
 }
 
+// Version negotiates the msize and the protocol, only 9P2000 is
+// supported, other versions are answered with "unknown".
 func (fs *FS) Version(fc *plan9.Fcall, ctx *vfs.Context) *plan9.Fcall {
-	ctx.Put(fids, make(fidMap))
+	// a new session clunks every fid of the previous one
+	fs.ReleaseContext(ctx)
+	ctx.Put(fids, newFidMap())
 	ret := *fc
 	ret.Type++
-	ret.Msize = 1024 * 8
+	ret.Msize = fc.Msize
+	if ret.Msize > maxMsize {
+		ret.Msize = maxMsize
+	}
+	if ret.Msize <= plan9.IOHDRSZ {
+		return vfs.PackError(&ret, ErrMsize)
+	}
+	if fc.Version != "9P2000" && !strings.HasPrefix(fc.Version, "9P2000.") {
+		ret.Version = "unknown"
+		return &ret
+	}
 	ret.Version = "9P2000"
+	ctx.Put(msize, ret.Msize)
 	return &ret
 }
 
+// Iounit returns the biggest read or write that fits in the msize
+// negotiated by the connection of ctx.
+func (fs *FS) Iounit(ctx *vfs.Context) uint32 {
+	if v, ok := ctx.Get(msize); ok {
+		return v.(uint32) - plan9.IOHDRSZ
+	}
+	return maxMsize - plan9.IOHDRSZ
+}
+
 func (fs *FS) Attach(fc *plan9.Fcall, ctx *vfs.Context) *plan9.Fcall {
 	ret := *fc
 	ret.Type++
@@ -72,87 +298,77 @@ func (fs *FS) Attach(fc *plan9.Fcall, ctx *vfs.Context) *plan9.Fcall {
 
 func (fs *FS) Auth(fc *plan9.Fcall, ctx *vfs.Context) *plan9.Fcall {
 	ret := *fc
-	ret.Type++
-	return &ret
+	return vfs.PackError(&ret, errors.New("authentication not required"))
 }
 
 func (fs *FS) Clunk(fc *plan9.Fcall, ctx *vfs.Context) *plan9.Fcall {
-	println("cluking fid", fc.Fid)
 	ret := *fc
 	ret.Type++
 	if err := fs.ReleaseFid(fc.Fid, ctx); err != nil {
-		println("error on release", err.Error())
+		log.WithFields(log.Fields{
+			"Fid":    fc.Fid,
+			"Uname":  ctx.Uname(),
+			"Module": "mixin.FS",
+			"Err":    err,
+		}).Errorf("Clunk error")
 		return vfs.PackError(&ret, err)
 	}
 	return &ret
 }
 
+// Flush answers a Tflush, the request being flushed is cancelled
+// by vfs.Server (see vfs.Context.Done) before Flush is called.
 func (fs *FS) Flush(fc *plan9.Fcall, ctx *vfs.Context) *plan9.Fcall {
 	ret := *fc
-	ret.Type = plan9.Rerror
-	ret.Ename = "filesystem missing implementation"
+	ret.Type++
 	return &ret
 }
 
 func (fs *FS) Open(fc *plan9.Fcall, ctx *vfs.Context) *plan9.Fcall {
 	ret := *fc
-	ret.Type = plan9.Rerror
-	ret.Ename = "filesystem missing implementation"
-	return &ret
+	return vfs.PackError(&ret, errMissing)
 }
 
 func (fs *FS) Create(fc *plan9.Fcall, ctx *vfs.Context) *plan9.Fcall {
 	ret := *fc
-	ret.Type = plan9.Rerror
-	ret.Ename = "filesystem missing implementation"
-	return &ret
+	return vfs.PackError(&ret, errMissing)
 }
 
 func (fs *FS) Read(fc *plan9.Fcall, ctx *vfs.Context) *plan9.Fcall {
 	ret := *fc
-	ret.Type = plan9.Rerror
-	ret.Ename = "filesystem missing implementation"
-	return &ret
+	return vfs.PackError(&ret, errMissing)
 }
 
 func (fs *FS) Write(fc *plan9.Fcall, ctx *vfs.Context) *plan9.Fcall {
 	ret := *fc
-	ret.Type = plan9.Rerror
-	ret.Ename = "filesystem missing implementation"
-	return &ret
+	return vfs.PackError(&ret, errMissing)
 }
 
 func (fs *FS) Remove(fc *plan9.Fcall, ctx *vfs.Context) *plan9.Fcall {
 	ret := *fc
-	ret.Type = plan9.Rerror
-	ret.Ename = "filesystem missing implementation"
-	return &ret
+	return vfs.PackError(&ret, errMissing)
 }
 
 func (fs *FS) Stat(fc *plan9.Fcall, ctx *vfs.Context) *plan9.Fcall {
 	ret := *fc
-	ret.Type = plan9.Rerror
-	ret.Ename = "filesystem missing implementation"
-	return &ret
+	return vfs.PackError(&ret, errMissing)
 }
 
 func (fs *FS) Wstat(fc *plan9.Fcall, ctx *vfs.Context) *plan9.Fcall {
 	ret := *fc
-	ret.Type = plan9.Rerror
-	ret.Ename = "filesystem missing implementation"
-	return &ret
+	return vfs.PackError(&ret, errMissing)
 }
 
 func (fs *FS) Walk(fc *plan9.Fcall, ctx *vfs.Context) *plan9.Fcall {
 	ret := *fc
-	ret.Type = plan9.Rerror
-	ret.Ename = "filesystem missing implementation"
-	return &ret
+	return vfs.PackError(&ret, errMissing)
 }
 
 func (fs *FS) ReleaseContext(ctx *vfs.Context) error {
 	log.WithFields(log.Fields{
 		"Module": "mixin.FS",
+		"Uname":  ctx.Uname(),
+		"Remote": ctx.RemoteAddr(),
 	}).Debugf("Releasing context data")
 	if _, ok := ctx.Get(fids); !ok {
 		log.WithFields(log.Fields{
@@ -160,9 +376,15 @@ func (fs *FS) ReleaseContext(ctx *vfs.Context) error {
 		}).Debugf("No fid to release")
 		return nil
 	}
-	fids := ctx.MustGet(fids).(fidMap)
+	fm := fidsOf(ctx)
+	fm.Lock()
+	var all []uint32
+	for k, _ := range fm.fids {
+		all = append(all, k)
+	}
+	fm.Unlock()
 	var firstErr error
-	for k, _ := range fids {
+	for _, k := range all {
 		err := fs.ReleaseFid(k, ctx)
 		if err != nil {
 			log.WithFields(log.Fields{
@@ -0,0 +1,84 @@
+package mixin
+
+import (
+	"9fans.net/go/plan9"
+	"amoraes.info/ded/vfs"
+	"testing"
+)
+
+type (
+	// flatFS accepts any walk and open
+	flatFS struct {
+		FS
+	}
+)
+
+func (fs *flatFS) Walk(fc *plan9.Fcall, ctx *vfs.Context) *plan9.Fcall {
+	ret := *fc
+	ret.Type++
+	for _, _ = range fc.Wname {
+		ret.Wqid = append(ret.Wqid, plan9.Qid{})
+	}
+	fs.SetFid(ctx, fc.Newfid, struct{}{})
+	return &ret
+}
+
+func (fs *flatFS) Open(fc *plan9.Fcall, ctx *vfs.Context) *plan9.Fcall {
+	ret := *fc
+	ret.Type++
+	return &ret
+}
+
+func (fs *flatFS) Read(fc *plan9.Fcall, ctx *vfs.Context) *plan9.Fcall {
+	ret := *fc
+	ret.Type++
+	return &ret
+}
+
+func TestFidLifecycle(t *testing.T) {
+	fs := &flatFS{}
+	srv := vfs.NewFileserver(fs)
+	ctx := vfs.NewContext()
+
+	steps := []struct {
+		fc  plan9.Fcall
+		err error
+	}{
+		{fc: plan9.Fcall{Type: plan9.Tversion, Msize: 8192, Version: "9P2000"}},
+		{fc: plan9.Fcall{Type: plan9.Tread, Fid: 1}, err: ErrUnknownFid},
+		{fc: plan9.Fcall{Type: plan9.Tattach, Fid: 1, Afid: plan9.NOFID}},
+		{fc: plan9.Fcall{Type: plan9.Tattach, Fid: 1, Afid: plan9.NOFID}, err: ErrFidInUse},
+		{fc: plan9.Fcall{Type: plan9.Twalk, Fid: 1, Newfid: 2, Wname: []string{"a"}}},
+		{fc: plan9.Fcall{Type: plan9.Twalk, Fid: 1, Newfid: 2, Wname: []string{"b"}}, err: ErrFidInUse},
+		{fc: plan9.Fcall{Type: plan9.Tread, Fid: 2}, err: ErrFidNotOpen},
+		{fc: plan9.Fcall{Type: plan9.Topen, Fid: 2, Mode: plan9.OWRITE}},
+		{fc: plan9.Fcall{Type: plan9.Topen, Fid: 2, Mode: plan9.OREAD}, err: ErrFidOpen},
+		{fc: plan9.Fcall{Type: plan9.Tread, Fid: 2}, err: ErrNotReadable},
+		{fc: plan9.Fcall{Type: plan9.Twalk, Fid: 2, Newfid: 3, Wname: []string{"c"}}, err: ErrWalkOpenFid},
+		// cloning is accepted and the clone isn't open
+		{fc: plan9.Fcall{Type: plan9.Twalk, Fid: 2, Newfid: 3}},
+		{fc: plan9.Fcall{Type: plan9.Tread, Fid: 3}, err: ErrFidNotOpen},
+		{fc: plan9.Fcall{Type: plan9.Topen, Fid: 3, Mode: plan9.OREAD}},
+		{fc: plan9.Fcall{Type: plan9.Tread, Fid: 3}},
+		{fc: plan9.Fcall{Type: plan9.Tclunk, Fid: 3}},
+		{fc: plan9.Fcall{Type: plan9.Tclunk, Fid: 3}, err: ErrUnknownFid},
+		// remove clunks the fid even when it fails
+		{fc: plan9.Fcall{Type: plan9.Tremove, Fid: 2}, err: errMissing},
+		{fc: plan9.Fcall{Type: plan9.Tstat, Fid: 2}, err: ErrUnknownFid},
+	}
+
+	for i, s := range steps {
+		fc := s.fc
+		ret := srv.Call(&fc, ctx)
+		switch {
+		case s.err == nil && ret.Type != fc.Type+1:
+			t.Errorf("step %v: expecting success got %v", i, ret)
+		case s.err != nil && (ret.Type != plan9.Rerror || ret.Ename != s.err.Error()):
+			t.Errorf("step %v: expecting %v got %v", i, s.err, ret)
+		}
+	}
+
+	if st, ok := fs.FidState(1, ctx); !ok || st.Open {
+		t.Errorf("Attach fid should be valid and closed: %v / %v", st, ok)
+	}
+}
@@ -0,0 +1,79 @@
+package namespace
+
+import (
+	"amoraes.info/ded/vfs"
+	"amoraes.info/ded/vfs/synth"
+	"bytes"
+)
+
+type (
+	// ctlFile lists the mounts of a namespace and runs the commands
+	// of the namespace files written to it
+	ctlFile struct {
+		ns  *Namespace
+		ctl *synth.Ctl
+	}
+
+	ctlFd struct {
+		ctl  *synth.Ctl
+		list *bytes.Reader
+	}
+)
+
+// CtlFile returns a file listing the mounts of ns, like String, the
+// commands written to it change ns. dial is used by mount, if it is
+// nil mount fails.
+func (ns *Namespace) CtlFile(dial Dialer) vfs.HasContent {
+	ctl := synth.NewCtl()
+	for _, name := range []string{"mount", "bind", "unmount"} {
+		name := name
+		ctl.Handle(name, func(args []string) error {
+			cmd, err := parseCommand(name, args)
+			if err != nil {
+				return err
+			}
+			return ns.Run(cmd, dial)
+		})
+	}
+	return &ctlFile{ns: ns, ctl: ctl}
+}
+
+// Open takes a snapshot of the mounts, it is read until the file is
+// closed
+func (c *ctlFile) Open(mode int, perm int) (vfs.FileContents, error) {
+	return &ctlFd{ctl: c.ctl, list: bytes.NewReader([]byte(c.ns.String()))}, nil
+}
+
+func (c *ctlFile) Size() (uint64, error) {
+	return 0, nil
+}
+
+func (c *ctlFile) Close() error {
+	return nil
+}
+
+func (fd *ctlFd) Read(b []byte) (int, error) {
+	return fd.list.Read(b)
+}
+
+// Write runs the commands of b, one per line, like synth.Ctl
+func (fd *ctlFd) Write(b []byte) (int, error) {
+	for _, line := range bytes.Split(b, []byte("\n")) {
+		if err := fd.ctl.Run(string(line)); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+func (fd *ctlFd) Seek(off int64, sp vfs.SeekPoint) (int64, error) {
+	return fd.list.Seek(off, int(sp))
+}
+
+func (fd *ctlFd) Sync() error {
+	return nil
+}
+
+func (fd *ctlFd) Close() error {
+	return nil
+}
@@ -0,0 +1,106 @@
+package namespace
+
+import (
+	"9fans.net/go/plan9"
+	"9fans.net/go/plan9/client"
+	"amoraes.info/ded/ufs"
+	"amoraes.info/ded/vfs"
+	"amoraes.info/ded/vfs/fstest"
+	"amoraes.info/ded/vfs/memlistener"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var (
+	exportFuzzSeeds = [][]*plan9.Fcall{
+		{
+			{Type: plan9.Twalk, Fid: 0, Newfid: 1, Wname: []string{"mnt"}},
+			{Type: plan9.Twalk, Fid: 1, Newfid: 2, Wname: []string{"dir", "a.txt"}},
+			{Type: plan9.Topen, Fid: 2, Mode: plan9.OREAD},
+			{Type: plan9.Tread, Fid: 2, Count: 100},
+			{Type: plan9.Tclunk, Fid: 2},
+		},
+		{
+			{Type: plan9.Twalk, Fid: 0, Newfid: 1, Wname: []string{"mnt", "b.txt"}},
+			{Type: plan9.Topen, Fid: 1, Mode: plan9.ORDWR},
+			{Type: plan9.Twrite, Fid: 1, Offset: 1, Data: []byte("data")},
+			{Type: plan9.Tread, Fid: 1, Count: 100},
+		},
+		{
+			{Type: plan9.Topen, Fid: 0, Mode: plan9.OREAD},
+			{Type: plan9.Tread, Fid: 0, Count: 100},
+		},
+	}
+)
+
+// fuzzExport returns an Export of a namespace with a small ufs tree
+// mounted at "mnt", everything is released after t
+func fuzzExport(t *testing.T) *Export {
+	root, err := ioutil.TempDir("", "exportfuzz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(root) })
+	if err := os.Mkdir(filepath.Join(root, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"dir/a.txt", "b.txt"} {
+		if err := ioutil.WriteFile(filepath.Join(root, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	l := memlistener.New("ufs")
+	srv, err := vfs.NewServer(vfs.NewFileserver(&ufs.Ufs{Root: root}, vfs.Recover()), l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { srv.Close() })
+	conn, err := memlistener.Connect(l, "export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli, err := client.NewConn(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cli.Close() })
+	fsys, err := cli.Attach(nil, "fuzz", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootfid, err := fsys.Open("/", plan9.OREAD)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ns := &Namespace{}
+	if err := ns.Mount("mnt", ".", rootfid); err != nil {
+		t.Fatal(err)
+	}
+	return NewExport(ns)
+}
+
+func FuzzExportCalls(f *testing.F) {
+	for _, seed := range exportFuzzSeeds {
+		f.Add(fstest.EncodeCalls(seed...))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fstest.FuzzCalls(t, fuzzExport(t), data)
+	})
+}
+
+func FuzzExportStream(f *testing.F) {
+	for _, seed := range exportFuzzSeeds {
+		fcs := []*plan9.Fcall{
+			{Type: plan9.Tversion, Tag: plan9.NOTAG, Msize: 8192, Version: "9P2000"},
+			{Type: plan9.Tattach, Fid: 0, Afid: plan9.NOFID, Uname: "fuzz"},
+		}
+		f.Add(fstest.EncodeStream(append(fcs, seed...)...))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fstest.FuzzStream(t, fuzzExport(t), data)
+	})
+}
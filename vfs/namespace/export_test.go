@@ -0,0 +1,98 @@
+package namespace
+
+import (
+	"9fans.net/go/plan9"
+	"9fans.net/go/plan9/client"
+	"amoraes.info/ded/vfs/fstest"
+	"io"
+	"testing"
+)
+
+func TestExportConformance(t *testing.T) {
+	ns := &Namespace{}
+	if err := ns.Mount("mnt", "", newTree(t, "hello", "dir/", "dir/hello.txt")); err != nil {
+		t.Fatal(err)
+	}
+	fstest.Run(t, NewExport(ns), fstest.Config{
+		File:     "mnt/dir/hello.txt",
+		Contents: []byte("hello"),
+		Dir:      "mnt/dir",
+		Writable: true,
+	})
+}
+
+func TestExportPassThrough(t *testing.T) {
+	tree := newTree(t, "data", "dir/", "dir/x")
+	dial := func(addr, spec string) (*client.Fid, io.Closer, uint32, error) {
+		fid, err := tree.Walk("")
+		return fid, nil, 512, err
+	}
+	ns := &Namespace{}
+	if err := ns.Run(&Command{Name: "mount", Flag: MCREATE, Args: []string{"tcp!src!5640", "/src"}}, dial); err != nil {
+		t.Fatal(err)
+	}
+	c := rawAttach(t, NewExport(ns))
+
+	// the qids come from the server
+	rx := c.rpc(&plan9.Fcall{Type: plan9.Twalk, Fid: 0, Newfid: 1, Wname: []string{"src", "dir", "x"}})
+	dir, err := tree.Walk("dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dir.Close()
+	if len(rx.Wqid) != 3 || rx.Wqid[1].Path != dir.Qid().Path || rx.Wqid[0].Path != tree.Qid().Path {
+		t.Errorf("Unexpected qids %v", rx)
+	}
+
+	// the iounit is the one of the mounted tree
+	if rx := c.rpc(&plan9.Fcall{Type: plan9.Topen, Fid: 1, Mode: plan9.OREAD}); rx.Type != plan9.Ropen || rx.Iounit != 512 {
+		t.Errorf("Unexpected open %v", rx)
+	}
+
+	// stat names the mount points after their path
+	stat := func(fid uint32) *plan9.Dir {
+		t.Helper()
+		rx := c.rpc(&plan9.Fcall{Type: plan9.Tstat, Fid: fid})
+		if rx.Type != plan9.Rstat {
+			t.Fatalf("Unexpected stat %v", rx)
+		}
+		d, err := plan9.UnmarshalDir(rx.Stat)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	c.rpc(&plan9.Fcall{Type: plan9.Twalk, Fid: 0, Newfid: 2, Wname: []string{"src"}})
+	if d := stat(2); d.Name != "src" || d.Qid.Path != tree.Qid().Path {
+		t.Errorf("Unexpected stat of the mount point %v", d)
+	}
+	if d := stat(0); d.Name != "/" || d.Qid != synthQid("/") {
+		t.Errorf("Unexpected stat of the root %v", d)
+	}
+
+	// wstat and remove go to the server
+	var d plan9.Dir
+	d.Null()
+	d.Name = "y"
+	buf, _ := d.Bytes()
+	if rx := c.rpc(&plan9.Fcall{Type: plan9.Twstat, Fid: 1, Stat: buf}); rx.Type != plan9.Rwstat {
+		t.Errorf("Unexpected wstat %v", rx)
+	}
+	fid, err := tree.Walk("dir/y")
+	if err != nil {
+		t.Fatalf("The file should be renamed: %v", err)
+	}
+	fid.Close()
+	if rx := c.rpc(&plan9.Fcall{Type: plan9.Tremove, Fid: 1}); rx.Type != plan9.Rremove {
+		t.Errorf("Unexpected remove %v", rx)
+	}
+	if _, err := tree.Walk("dir/y"); err == nil {
+		t.Errorf("The file should be removed")
+	}
+	if rx := c.rpc(&plan9.Fcall{Type: plan9.Tremove, Fid: 2}); rx.Type != plan9.Rerror {
+		t.Errorf("Mount points can't be removed: %v", rx)
+	}
+	if rx := c.rpc(&plan9.Fcall{Type: plan9.Twstat, Fid: 0, Stat: buf}); rx.Type != plan9.Rerror {
+		t.Errorf("Synthetic directories can't be changed: %v", rx)
+	}
+}
@@ -2,42 +2,335 @@ package namespace
 
 import (
 	"9fans.net/go/plan9"
-	"9fans.net/go/plan9/client"
 	"amoraes.info/ded/vfs"
+	"amoraes.info/ded/vfs/filetree"
 	"amoraes.info/ded/vfs/mixin"
+	"errors"
+	"fmt"
 	"io"
 	"path"
+	"sync"
+	"sync/atomic"
 )
 
+var (
+	errNotMounted   = errors.New("fid isn't part of a mounted tree")
+	errNoCreate     = errors.New("mounted directory forbids creation")
+	errUnknownAname = errors.New("unknown namespace")
+	errWalkCtl      = errors.New("can't walk from the ctl file")
+	errRemoveMount  = errors.New("can't remove a mount point")
+)
+
+// CtlName is the file at the root of the forked namespaces, reading
+// it lists the mounts of the client and the commands written to it
+// change them (see Namespace.CtlFile).
+const CtlName = "nsctl"
+
+// ctlQid is the Qid path of the ctl files
+const ctlQid = 1 << 62
+
 type (
 	Export struct {
 		mixin.FS
 		ns *Namespace
+
+		// Fork makes every attach use its own copy of the
+		// namespace, the clients change it writing to CtlName
+		Fork bool
+		// Dial is used by the mount commands of the ctl file
+		Dial Dialer
+
+		mu sync.Mutex
+		// named has the namespaces selected by the aname of an attach
+		named map[string]*Namespace
+	}
+
+	// view is the namespace used by the fids of an attach
+	view struct {
+		ns *Namespace
+		// ctl and refs are only used by forked namespaces, the
+		// namespace is closed when its last fid is clunked
+		ctl  vfs.HasContent
+		refs int32
+	}
+
+	// exportFid is a file of the namespace
+	exportFid struct {
+		sync.Mutex
+		view *view
+		// path is the path of the file in the namespace
+		path string
+		// members has the fids of the file, more than one if the
+		// file is a union directory
+		members []*Member
+		// node is true if the file is a directory of the mount tree,
+		// without members it is a synthetic directory
+		node bool
+		// open and mode are kept to open the file again when the
+		// connection of a remote tree is lost
+		open bool
+		mode uint8
+		// dirents holds the entries of a union directory not read yet
+		dirents   [][]byte
+		diroffset uint64
+
+		// ctl is true for the ctl file of a forked namespace,
+		// ctlfd is set when it is open
+		ctl   bool
+		ctlfd vfs.FileContents
 	}
 )
 
 func NewExport(ns *Namespace) *Export {
 	return &Export{
-		ns: ns,
+		ns:    ns,
+		named: make(map[string]*Namespace),
+	}
+}
+
+// AddNamespace makes the attaches with aname use ns
+func (fs *Export) AddNamespace(aname string, ns *Namespace) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.named[aname] = ns
+}
+
+// namespace returns the namespace selected by aname
+func (fs *Export) namespace(aname string) (*Namespace, error) {
+	if aname == "" {
+		return fs.ns, nil
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	ns, ok := fs.named[aname]
+	if !ok {
+		return nil, errUnknownAname
+	}
+	return ns, nil
+}
+
+// newFid returns the file of v resolved to t, counting it as a user
+// of v
+func (v *view) newFid(t *target) *exportFid {
+	if v.ctl != nil {
+		atomic.AddInt32(&v.refs, 1)
+	}
+	return &exportFid{
+		view:    v,
+		path:    t.path,
+		members: t.members,
+		node:    t.node,
+		ctl:     t.ctl,
+	}
+}
+
+// target returns the file of fd, its fids are still owned by fd
+func (fd *exportFid) target() *target {
+	return &target{path: fd.path, members: fd.members, node: fd.node, ctl: fd.ctl}
+}
+
+// union returns true if fd is a directory with more than one member
+func (fd *exportFid) union() bool {
+	return len(fd.members) > 1
+}
+
+// synthetic returns true if fd is a directory of the mount tree
+// without a tree mounted there
+func (fd *exportFid) synthetic() bool {
+	return fd.node && len(fd.members) == 0
+}
+
+func (fd *exportFid) isDir() bool {
+	return fd.qid().Type&plan9.QTDIR != 0
+}
+
+func (fd *exportFid) qid() plan9.Qid {
+	switch {
+	case fd.ctl:
+		return plan9.Qid{Path: ctlQid}
+	case len(fd.members) == 0:
+		return synthQid(fd.path)
+	}
+	return fd.members[0].Fid.Qid()
+}
+
+// iounit returns the largest read or write of fd, the one of the
+// connection of ctx limited by the one of the tree of fd
+func (fs *Export) iounit(fd *exportFid, ctx *vfs.Context) uint32 {
+	iounit := fs.Iounit(ctx)
+	if len(fd.members) == 1 && !fd.node {
+		if m := fd.members[0]; m.iounit != 0 && m.iounit < iounit {
+			iounit = m.iounit
+		}
 	}
+	return iounit
 }
 
-func (fs *Export) isClientFid(f interface{}) bool {
-	_, ok := f.(*client.Fid)
-	return ok
+// stat returns the entry of fd, named after its path in the namespace
+func (fd *exportFid) stat() (*plan9.Dir, error) {
+	switch {
+	case fd.ctl:
+		return ctlDir(), nil
+	case len(fd.members) == 0:
+		return synthDir(fd.path), nil
+	}
+	d, err := fd.members[0].Fid.Stat()
+	if err != nil {
+		return nil, err
+	}
+	d.Name = path.Base(fd.path)
+	return d, nil
+}
+
+// ctlDir returns the entry of the ctl file
+func ctlDir() *plan9.Dir {
+	return &plan9.Dir{
+		Qid:  plan9.Qid{Path: ctlQid},
+		Mode: 0600,
+		Name: CtlName,
+		Uid:  "none",
+		Gid:  "none",
+		Muid: "none",
+	}
+}
+
+func (fd *exportFid) Close() error {
+	fd.Lock()
+	defer fd.Unlock()
+	for _, m := range fd.members {
+		m.Fid.Close()
+	}
+	fd.members = nil
+	if fd.ctlfd != nil {
+		fd.ctlfd.Close()
+		fd.ctlfd = nil
+	}
+	if v := fd.view; v.ctl != nil && atomic.AddInt32(&v.refs, -1) == 0 {
+		v.ns.Close()
+	}
+	return nil
+}
+
+// exportFid returns the file used by fc
+func (fs *Export) exportFid(fc *plan9.Fcall, ctx *vfs.Context) *exportFid {
+	fd, ok := fs.GetFid(fc.Fid, ctx).(*exportFid)
+	if !ok {
+		return &exportFid{view: &view{ns: fs.ns}, path: "/"}
+	}
+	return fd
+}
+
+// Attach starts at the root of the namespace selected by the aname,
+// a copy of it if fs.Fork is set
+func (fs *Export) Attach(fc *plan9.Fcall, ctx *vfs.Context) *plan9.Fcall {
+	ret := *fc
+	ret.Type++
+
+	ns, err := fs.namespace(fc.Aname)
+	if err != nil {
+		return vfs.PackError(&ret, err)
+	}
+	v := &view{ns: ns}
+	if fs.Fork {
+		v.ns = ns.Fork()
+		v.ctl = v.ns.CtlFile(fs.Dial)
+	}
+	t, err := v.ns.resolve("/")
+	if err != nil {
+		if fs.Fork {
+			v.ns.Close()
+		}
+		return vfs.PackError(&ret, err)
+	}
+	fd := v.newFid(t)
+	fs.SetFid(ctx, fc.Fid, fd)
+	ret.Qid = fd.qid()
+	return &ret
+}
+
+// retry runs op, when op fails because the connection of fd was lost
+// fd is walked and opened again and op runs once more
+func (fd *exportFid) retry(op func() error) error {
+	err := op()
+	if !connLost(err) {
+		return err
+	}
+	if rerr := fd.recover(); rerr != nil {
+		return fmt.Errorf("%v: %v: %v", errLost, fd.path, rerr)
+	}
+	return op()
+}
+
+// recover replaces the fids of fd by new ones, open with the same
+// mode without truncating the file again
+func (fd *exportFid) recover() error {
+	t, err := fd.view.ns.resolve(fd.path)
+	if err != nil {
+		return err
+	}
+	if len(t.members) == 0 {
+		return errSynthetic
+	}
+	if fd.open {
+		for _, m := range t.members {
+			if err := m.Fid.Open(fd.mode &^ plan9.OTRUNC); err != nil {
+				for _, m := range t.members {
+					m.Fid.Close()
+				}
+				return err
+			}
+		}
+	}
+	for _, m := range fd.members {
+		m.Fid.Close()
+	}
+	fd.members = t.members
+	return nil
 }
 
 func (fs *Export) Open(fc *plan9.Fcall, ctx *vfs.Context) *plan9.Fcall {
 	ret := *fc
 	ret.Type++
 
-	fid := fs.GetFid(fc.Fid, ctx).(*client.Fid)
+	fd := fs.exportFid(fc, ctx)
+	fd.Lock()
+	defer fd.Unlock()
+	if fd.ctl {
+		var err error
+		if fd.ctlfd, err = fd.view.ctl.Open(int(fc.Mode), 0); err != nil {
+			return vfs.PackError(&ret, err)
+		}
+		ret.Qid = fd.qid()
+		ret.Iounit = fs.Iounit(ctx)
+		return &ret
+	}
+	if fd.synthetic() {
+		if fc.Mode&3 != plan9.OREAD || fc.Mode&plan9.OTRUNC != 0 {
+			return vfs.PackError(&ret, vfs.ErrReadOnly)
+		}
+		ret.Qid = fd.qid()
+		ret.Iounit = fs.Iounit(ctx)
+		return &ret
+	}
+	if len(fd.members) == 0 {
+		return vfs.PackError(&ret, errNotMounted)
+	}
 
-	err := fid.Open(fc.Mode)
+	// every member of a union directory is read
+	err := fd.retry(func() error {
+		for _, m := range fd.members {
+			if err := m.Fid.Open(fc.Mode); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 	if err != nil {
 		return vfs.PackError(&ret, err)
 	}
-	ret.Iounit = 8168
+	fd.open, fd.mode = true, fc.Mode
+	ret.Qid = fd.qid()
+	ret.Iounit = fs.iounit(fd, ctx)
 
 	return &ret
 }
@@ -46,13 +339,42 @@ func (fs *Export) Create(fc *plan9.Fcall, ctx *vfs.Context) *plan9.Fcall {
 	ret := *fc
 	ret.Type++
 
-	fid := fs.GetFid(fc.Fid, ctx).(*client.Fid)
+	fd := fs.exportFid(fc, ctx)
+	fd.Lock()
+	defer fd.Unlock()
 
-	err := fid.Create(fc.Name, fc.Mode, fc.Perm)
+	// the file is created in the first member that allows it
+	var member *Member
+	err := fd.retry(func() error {
+		member = nil
+		for _, m := range fd.members {
+			if m.Flag&MCREATE != 0 {
+				member = m
+				break
+			}
+		}
+		if member == nil {
+			if len(fd.members) == 0 && !fd.node {
+				return errNotMounted
+			}
+			return errNoCreate
+		}
+		return member.Fid.Create(fc.Name, fc.Mode, fc.Perm)
+	})
 	if err != nil {
 		return vfs.PackError(&ret, err)
 	}
-	ret.Iounit = 8168
+	// the fid is now the new file
+	for _, m := range fd.members {
+		if m != member {
+			m.Fid.Close()
+		}
+	}
+	fd.members = []*Member{member}
+	fd.path = path.Join(fd.path, fc.Name)
+	fd.open, fd.mode = true, fc.Mode
+	ret.Qid = member.Fid.Qid()
+	ret.Iounit = fs.iounit(fd, ctx)
 
 	return &ret
 }
@@ -61,9 +383,25 @@ func (fs *Export) Write(fc *plan9.Fcall, ctx *vfs.Context) *plan9.Fcall {
 	ret := *fc
 	ret.Type++
 
-	fid := fs.GetFid(fc.Fid, ctx).(*client.Fid)
+	fd := fs.exportFid(fc, ctx)
+	fd.Lock()
+	defer fd.Unlock()
+	if fd.ctlfd != nil {
+		if _, err := fd.ctlfd.Write(fc.Data); err != nil {
+			return vfs.PackError(&ret, err)
+		}
+		ret.Count = uint32(len(fc.Data))
+		return &ret
+	}
+	if len(fd.members) == 0 {
+		return vfs.PackError(&ret, errNotMounted)
+	}
 
-	sz, err := fid.WriteAt(fc.Data, int64(fc.Offset))
+	var sz int
+	err := fd.retry(func() (err error) {
+		sz, err = fd.members[0].Fid.WriteAt(fc.Data, int64(fc.Offset))
+		return err
+	})
 	if err != nil {
 		return vfs.PackError(&ret, err)
 	}
@@ -76,10 +414,43 @@ func (fs *Export) Read(fc *plan9.Fcall, ctx *vfs.Context) *plan9.Fcall {
 	ret := *fc
 	ret.Type++
 
-	fid := fs.GetFid(fc.Fid, ctx).(*client.Fid)
-	buf := make([]byte, fc.Count)
+	fd := fs.exportFid(fc, ctx)
+	fd.Lock()
+	defer fd.Unlock()
+	count := fc.Count
+	if iounit := fs.iounit(fd, ctx); count > iounit {
+		count = iounit
+	}
+	if fd.ctlfd != nil {
+		return fs.readCtl(&ret, fd, count)
+	}
+	if len(fd.members) == 0 && !fd.node {
+		return vfs.PackError(&ret, errNotMounted)
+	}
 
-	sz, err := fid.ReadAt(buf, int64(fc.Offset))
+	if fd.isDir() && (fd.node || fd.union()) {
+		err := fd.retry(func() (err error) {
+			ret.Data, err = fs.readUnion(fd, fc.Offset, count)
+			return err
+		})
+		if err != nil {
+			return vfs.PackError(&ret, err)
+		}
+		ret.Count = uint32(len(ret.Data))
+		return &ret
+	}
+
+	buf := make([]byte, count)
+	var sz int
+	err := fd.retry(func() (err error) {
+		sz, err = fd.members[0].Fid.ReadAt(buf, int64(fc.Offset))
+		if err == io.EOF {
+			if perr := probe(fd.members[0].Fid); perr != nil {
+				return perr
+			}
+		}
+		return err
+	})
 	if err != nil {
 		if err == io.EOF {
 			ret.Count = 0
@@ -89,40 +460,193 @@ func (fs *Export) Read(fc *plan9.Fcall, ctx *vfs.Context) *plan9.Fcall {
 		return vfs.PackError(&ret, err)
 	}
 	ret.Count = uint32(sz)
-	ret.Data = buf
+	ret.Data = buf[:sz]
 
 	return &ret
 }
 
+// readCtl answers a read of the ctl file with the commands it runs
+func (fs *Export) readCtl(ret *plan9.Fcall, fd *exportFid, count uint32) *plan9.Fcall {
+	if _, err := fd.ctlfd.Seek(int64(ret.Offset), vfs.SeekStart); err != nil {
+		return vfs.PackError(ret, err)
+	}
+	buf := make([]byte, count)
+	sz, err := fd.ctlfd.Read(buf)
+	if err != nil && err != io.EOF {
+		return vfs.PackError(ret, err)
+	}
+	ret.Count = uint32(sz)
+	ret.Data = buf[:sz]
+	return ret
+}
+
+// readUnion returns the entries of the union directory fd that fit in
+// count bytes. The entries of all members are merged, when a name is
+// in more than one member the first one is used. The mount points in
+// fd come first, they hide the files with the same name.
+func (fs *Export) readUnion(fd *exportFid, offset uint64, count uint32) ([]byte, error) {
+	if offset == 0 {
+		fd.dirents = nil
+		fd.diroffset = 0
+		seen := make(map[string]bool)
+		dirs := fd.view.ns.mountPoints(fd.path)
+		if fd.view.ctl != nil && fd.path == "/" {
+			dirs = append(dirs, *ctlDir())
+		}
+		for _, d := range dirs {
+			seen[d.Name] = true
+			buf, err := d.Bytes()
+			if err != nil {
+				return nil, err
+			}
+			fd.dirents = append(fd.dirents, buf)
+		}
+		for _, m := range fd.members {
+			// the members are read again from the start
+			if _, err := m.Fid.Seek(0, 0); err != nil {
+				return nil, err
+			}
+			dirs, err := m.Fid.Dirreadall()
+			if err == nil && len(dirs) == 0 {
+				// a closed connection reads like an empty directory
+				err = probe(m.Fid)
+			}
+			if err != nil {
+				return nil, err
+			}
+			for _, d := range dirs {
+				if seen[d.Name] {
+					continue
+				}
+				seen[d.Name] = true
+				buf, err := d.Bytes()
+				if err != nil {
+					return nil, err
+				}
+				fd.dirents = append(fd.dirents, buf)
+			}
+		}
+	} else if offset != fd.diroffset {
+		return nil, filetree.ErrDirOffset
+	}
+
+	var data []byte
+	for len(fd.dirents) > 0 && len(data)+len(fd.dirents[0]) <= int(count) {
+		data = append(data, fd.dirents[0]...)
+		fd.dirents = fd.dirents[1:]
+	}
+	if len(data) == 0 && len(fd.dirents) > 0 {
+		return nil, filetree.ErrShortDirRead
+	}
+	fd.diroffset += uint64(len(data))
+	return data, nil
+}
+
 func (fs *Export) Walk(fc *plan9.Fcall, ctx *vfs.Context) *plan9.Fcall {
 	ret := *fc
 	ret.Type++
 
-	oldfid := fs.GetFid(fc.Fid, ctx)
-	if fs.isClientFid(oldfid) {
-		println("valid fid, walk from this fid")
-		// continue from the old fid found
-		fid, err := oldfid.(*client.Fid).Walk(path.Join(fc.Wname...))
-		if err != nil {
-			return vfs.PackError(&ret, err)
-		}
-		oldfid.(*client.Fid).Close()
-		fs.SetFid(ctx, fc.Newfid, fid)
+	if len(fc.Wname) == 0 && fc.Newfid == fc.Fid {
+		// nothing changes, not even an open fid
+		return &ret
+	}
+	fd := fs.exportFid(fc, ctx)
+	if fd.ctl && len(fc.Wname) > 0 {
+		return vfs.PackError(&ret, errWalkCtl)
+	}
 
-		// should populate the Wqid here
+	// the names are walked from the namespace, so the mount points
+	// below fd are crossed and .. goes back through them
+	var t *target
+	fd.Lock()
+	err := fd.retry(func() (err error) {
+		ret.Wqid, t, err = fd.view.ns.walk(fd.target(), fc.Wname, fd.view.ctl != nil)
+		return err
+	})
+	fd.Unlock()
+	switch {
+	case err != nil && len(ret.Wqid) == 0:
+		return vfs.PackError(&ret, err)
+	case err != nil:
+		// partial walks don't change newfid
 		return &ret
 	}
+	nfd := fd.view.newFid(t)
+	if fc.Newfid == fc.Fid {
+		// the old fid is replaced by the walked one
+		fd.Close()
+	}
+	fs.SetFid(ctx, fc.Newfid, nfd)
+	return &ret
+}
+
+func (fs *Export) Stat(fc *plan9.Fcall, ctx *vfs.Context) *plan9.Fcall {
+	ret := *fc
+	ret.Type++
 
-	println("namespace walk")
-	fid, err := fs.ns.Walk(path.Join(fc.Wname...))
+	fd := fs.exportFid(fc, ctx)
+	fd.Lock()
+	defer fd.Unlock()
+	var d *plan9.Dir
+	err := fd.retry(func() (err error) {
+		d, err = fd.stat()
+		return err
+	})
 	if err != nil {
-		println("got error")
 		return vfs.PackError(&ret, err)
 	}
-	println("setting fid", fid)
-	for _, _ = range fc.Wname {
-		ret.Wqid = append(ret.Wqid, plan9.Qid{})
+	if ret.Stat, err = d.Bytes(); err != nil {
+		return vfs.PackError(&ret, err)
+	}
+	return &ret
+}
+
+func (fs *Export) Wstat(fc *plan9.Fcall, ctx *vfs.Context) *plan9.Fcall {
+	ret := *fc
+	ret.Type++
+
+	fd := fs.exportFid(fc, ctx)
+	fd.Lock()
+	defer fd.Unlock()
+	if fd.ctl || len(fd.members) == 0 {
+		return vfs.PackError(&ret, vfs.ErrReadOnly)
+	}
+	d, err := plan9.UnmarshalDir(fc.Stat)
+	if err != nil {
+		return vfs.PackError(&ret, err)
+	}
+	err = fd.retry(func() error {
+		return fd.members[0].Fid.Wstat(d)
+	})
+	if err != nil {
+		return vfs.PackError(&ret, err)
+	}
+	return &ret
+}
+
+func (fs *Export) Remove(fc *plan9.Fcall, ctx *vfs.Context) *plan9.Fcall {
+	ret := *fc
+	ret.Type++
+
+	fd := fs.exportFid(fc, ctx)
+	fd.Lock()
+	defer fd.Unlock()
+	switch {
+	case fd.ctl:
+		return vfs.PackError(&ret, vfs.ErrReadOnly)
+	case fd.node:
+		return vfs.PackError(&ret, errRemoveMount)
+	case len(fd.members) == 0:
+		return vfs.PackError(&ret, errNotMounted)
+	}
+	err := fd.retry(func() error {
+		// the fid is clunked even if the remove fails
+		m := fd.members[0]
+		fd.members = fd.members[1:]
+		return m.Fid.Remove()
+	})
+	if err != nil {
+		return vfs.PackError(&ret, err)
 	}
-	fs.SetFid(ctx, fc.Newfid, fid)
 	return &ret
 }
@@ -0,0 +1,22 @@
+package namespace
+
+// Fork returns a copy of ns, the mounts of the copy and of ns change
+// without affecting each other. The mounted fids are shared until the
+// last namespace using them releases them.
+func (ns *Namespace) Fork() *Namespace {
+	s := ns.acquire()
+	defer ns.done(s)
+	fork := &Namespace{cur: &snapshot{mounts: s.mounts.fork()}}
+	fork.oldest = fork.cur
+	return fork
+}
+
+// Close releases every mount of ns, they are closed when the walks
+// in progress end
+func (ns *Namespace) Close() error {
+	return ns.change(func(mounts *Tree) ([]*Member, error) {
+		members := mounts.members()
+		mounts.Members, mounts.Childs = nil, nil
+		return members, nil
+	})
+}
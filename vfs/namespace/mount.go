@@ -2,20 +2,65 @@ package namespace
 
 import (
 	"9fans.net/go/plan9/client"
+	"sync/atomic"
 )
 
 type (
 	Tree struct {
 		Name   string
 		Childs []*Tree
-		Fid    *client.Fid
+		// Members are the trees mounted at this node, in the order
+		// used by walks. More than one member makes a union directory.
+		Members []*Member
+	}
+
+	// Member is a tree mounted in a union directory
+	Member struct {
+		Fid  *client.Fid
+		Flag int
+		// refs counts the namespaces sharing the member, it is set
+		// when the member is added to a tree
+		refs *int32
+		// src tells how the member was mounted, the members added by
+		// the same bind share it
+		src *source
+		// remote is set for the trees mounted from a dial string,
+		// Fid is nil for them
+		remote *remote
+		// iounit is the largest read or write of Fid, 0 if it isn't
+		// known
+		iounit uint32
+		// conn is the remote tree Fid was walked from, a bind of it
+		// keeps its connection open
+		conn *remote
+	}
+
+	// source is the command that mounted a member, without the flags
+	// and the new path. The members mounted with a fid have no cmd,
+	// args describes the fid.
+	source struct {
+		cmd  string
+		args []string
 	}
 )
 
+// Flags of MountFlag, they have the same meaning as in Plan 9
+const (
+	// MREPL replaces the members of the union
+	MREPL = 0x0000
+	// MBEFORE adds the member before the others
+	MBEFORE = 0x0001
+	// MAFTER adds the member after the others
+	MAFTER = 0x0002
+	// MCREATE allows files to be created in the member, the first
+	// member with MCREATE receives the files created in the union
+	MCREATE = 0x0004
+
+	// morder masks the flags that choose the position of a member
+	morder = 0x0003
+)
+
 func (t *Tree) FindChild(n string) *Tree {
-	if len(n) == 0 || n == "." {
-		return t
-	}
 	for _, c := range t.Childs {
 		if c.Name == n {
 			return c
@@ -32,42 +77,105 @@ func (t *Tree) AddChild(n string) *Tree {
 	return nt
 }
 
-// findLongestMatch returns the deepest root in the tree that have
-// a valid Fid and a tail (which could be empty) with the rest of the steps
-// that should be walked using the Fid.
-func (t *Tree) findLongestMatch(steps []string) (*client.Fid, []string) {
-	if len(steps) == 1 {
-		return t.Fid, nil
-	}
-	first := steps[0]
-	tail := steps[1:]
-
-	var validChild *Tree
-	if len(first) == 0 || first == "." || first == t.Name {
-		// well, I am part of the step, so search the tail in my children
-
-		for _, c := range t.Childs {
-			if c.Name == tail[0] {
-				// this child might be part of the path, use it
-				validChild = c
-				break
-			}
+// add adds m to the members of t following the order in flag,
+// it returns the members that were replaced
+func (t *Tree) add(m *Member, flag int) []*Member {
+	if m.refs == nil {
+		m.refs = new(int32)
+		*m.refs = 1
+	}
+	var old []*Member
+	switch flag & morder {
+	case MBEFORE:
+		t.Members = append([]*Member{m}, t.Members...)
+	case MAFTER:
+		t.Members = append(t.Members, m)
+	default:
+		old = t.Members
+		t.Members = []*Member{m}
+	}
+	return old
+}
+
+// find returns the node at elems, nil if there isn't one
+func (t *Tree) find(elems []string) *Tree {
+	node := t
+	for _, e := range elems {
+		if node = node.FindChild(e); node == nil {
+			return nil
+		}
+	}
+	return node
+}
+
+// prune removes the nodes without mounts along elems, it returns
+// true if t has no mounts left
+func (t *Tree) prune(elems []string) bool {
+	if len(elems) > 0 {
+		if c := t.FindChild(elems[0]); c != nil && c.prune(elems[1:]) {
+			t.removeChild(c)
 		}
 	}
-	if validChild == nil {
-		// no child is capable of handling the tail
-		// so I MUST BE the longest match, return my data
-		return t.Fid, tail
-	}
-	fid, ctail := validChild.findLongestMatch(tail)
-	if fid == nil {
-		// I might have a valid child, but the child don't have a valid fid
-		// this meas that we are just steps in a subpath that holds a valid mount
-		// so return my data which is probably enough to walk to the desired
-		// path
-		return t.Fid, tail
-	}
-	// my child is at least one step deeper in the tree
-	// so use its data
-	return fid, ctail
+	return len(t.Members) == 0 && len(t.Childs) == 0
+}
+
+func (t *Tree) removeChild(c *Tree) {
+	for i := range t.Childs {
+		if t.Childs[i] == c {
+			t.Childs = append(t.Childs[:i], t.Childs[i+1:]...)
+			return
+		}
+	}
+}
+
+// share returns a copy of m for a fork, Fid is closed when m and all
+// of its copies are released
+func (m *Member) share() *Member {
+	atomic.AddInt32(m.refs, 1)
+	return &Member{Fid: m.Fid, Flag: m.Flag, refs: m.refs, src: m.src, remote: m.remote, iounit: m.iounit, conn: m.conn}
+}
+
+// release closes Fid if m is the last member using it
+func (m *Member) release() {
+	if m.refs != nil && atomic.AddInt32(m.refs, -1) != 0 {
+		return
+	}
+	if m.remote != nil {
+		m.remote.close()
+		return
+	}
+	m.Fid.Close()
+	if m.conn != nil {
+		m.conn.close()
+	}
+}
+
+// fork returns a copy of t sharing the fids of the members
+func (t *Tree) fork() *Tree {
+	nt := &Tree{Name: t.Name}
+	for _, m := range t.Members {
+		nt.Members = append(nt.Members, m.share())
+	}
+	for _, c := range t.Childs {
+		nt.Childs = append(nt.Childs, c.fork())
+	}
+	return nt
+}
+
+// copy returns a copy of the nodes of t, the members are the same
+func (t *Tree) copy() *Tree {
+	nt := &Tree{Name: t.Name, Members: append([]*Member(nil), t.Members...)}
+	for _, c := range t.Childs {
+		nt.Childs = append(nt.Childs, c.copy())
+	}
+	return nt
+}
+
+// members returns the members of t and of its children
+func (t *Tree) members() []*Member {
+	members := append([]*Member(nil), t.Members...)
+	for _, c := range t.Childs {
+		members = append(members, c.members()...)
+	}
+	return members
 }
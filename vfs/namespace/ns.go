@@ -1,80 +1,290 @@
 package namespace
 
 import (
+	"9fans.net/go/plan9"
 	"9fans.net/go/plan9/client"
+	"amoraes.info/ded/vfs"
+	"amoraes.info/ded/vfs/filetree"
+	"amoraes.info/ded/vfs/memlistener"
 	"errors"
 	"path"
 	"strings"
+	"sync"
 )
 
 type (
+	// Namespace is safe for concurrent use. The walks use a snapshot
+	// of the mounts and never wait for the mounts to change.
 	Namespace struct {
-		mounts Tree
+		// wmu serializes the changes of the mounts
+		wmu sync.Mutex
+		// mu protects the list of snapshots, from the oldest one
+		// still walked to the current one
+		mu          sync.Mutex
+		cur, oldest *snapshot
 	}
 )
 
+var (
+	errNotMountPoint = errors.New("not a mount point")
+	errNotMember     = errors.New("fid isn't mounted there")
+)
+
 // Mount changes this namespace to expose fid (and it's tree) under parent/name.
+//
+// Mount refuses names already mounted, MountFlag adds fid to a union
+// instead.
 func (ns *Namespace) Mount(name string, parent string, fid *client.Fid) error {
-	root := &ns.mounts
-	for _, p := range strings.Split(parent, "/") {
-		child := root.FindChild(p)
-		if child == nil {
-			child = root.AddChild(p)
-		}
-		root = child
-	}
-	if root.FindChild(name) != nil {
-		return errors.New("name is duplicated")
+	return ns.mountNew(path.Join(parent, name), &Member{Fid: fid, src: &source{args: []string{"fid"}}})
+}
+
+// mountNew mounts m at p if nothing is mounted there
+func (ns *Namespace) mountNew(p string, m *Member) error {
+	if m.Fid == nil {
+		return errors.New("invalid fid")
 	}
-	root = root.AddChild(name)
-	root.Fid = fid
-	return nil
+	m.Flag = MCREATE
+	return ns.change(func(mounts *Tree) ([]*Member, error) {
+		node := mounts.node(p)
+		if len(node.Members) > 0 {
+			return nil, errors.New("name is duplicated")
+		}
+		node.add(m, MREPL)
+		return nil, nil
+	})
 }
 
-// Walk scans the mount tree for the path p and perform a walk on the correct fid.
-//
-// When walk reaches a node without a valid child, then it will start to perform
-// walk operations on the last valid fid.
-func (ns *Namespace) Walk(p string) (*client.Fid, error) {
-	var searchFid *client.Fid
-	root := &ns.mounts
-	p = path.Join("/", p)
-	parts := strings.Split(p, "/")
-	fid, parts := root.findLongestMatch(parts)
+// MountFlag mounts fid under parent/name, flag tells where fid goes
+// in the union of trees mounted there: MREPL replaces the union,
+// MBEFORE and MAFTER add fid before or after the other members.
+// MCREATE allows files to be created in fid when they are created
+// in the union.
+func (ns *Namespace) MountFlag(name string, parent string, fid *client.Fid, flag int) error {
+	return ns.mountFlag(path.Join(parent, name), fid, flag, &source{args: []string{"fid"}})
+}
 
+func (ns *Namespace) mountFlag(p string, fid *client.Fid, flag int, src *source) error {
 	if fid == nil {
-		return nil, errors.New("path not found")
+		return errors.New("invalid fid")
+	}
+	return ns.mountMember(p, &Member{Fid: fid, src: src}, flag)
+}
+
+// mountMember mounts m at p, the flag of m is set from flag
+func (ns *Namespace) mountMember(p string, m *Member, flag int) error {
+	m.Flag = flag &^ morder
+	return ns.change(func(mounts *Tree) ([]*Member, error) {
+		return mounts.mount(p, []*Member{m}, flag), nil
+	})
+}
+
+// mount adds members to the union at p, keeping their order, and
+// returns the members replaced
+func (t *Tree) mount(p string, members []*Member, flag int) []*Member {
+	node := t.node(p)
+	if flag&morder == MBEFORE {
+		for i := len(members) - 1; i >= 0; i-- {
+			node.add(members[i], flag)
+		}
+		return nil
 	}
-	if len(parts) > 0 {
-		// need to do fid walking
-		var err error
-		// clone the fid from the mount point
-		searchFid, err = fid.Walk(".")
+	var replaced []*Member
+	for i, m := range members {
+		if i > 0 {
+			flag = MAFTER
+		}
+		replaced = append(replaced, node.add(m, flag)...)
+	}
+	return replaced
+}
+
+// Bind makes the tree at old visible at new too, flag works like in
+// MountFlag. The fids of old are cloned, so old can be unmounted later
+// without changing new.
+func (ns *Namespace) Bind(old, new string, flag int) error {
+	return ns.change(func(mounts *Tree) ([]*Member, error) {
+		members, err := mounts.walkUnion(old)
 		if err != nil {
 			return nil, err
 		}
-		defer searchFid.Close()
-		for i, s := range parts {
-			searchFid, err = searchFid.Walk(s)
-			if err != nil {
-				return nil, err
+		src := &source{cmd: "bind", args: []string{old}}
+		for _, m := range members {
+			m.Flag = flag &^ morder
+			m.src = src
+			if m.conn != nil {
+				m.conn.hold()
 			}
-			// if this isn't the last fid to be scanned
-			// close it to release the resources.
-			//
-			// The last one shouldn't be closed, since it will
-			// be used by the caller of Walk
-			if i != len(parts)-1 {
-				defer searchFid.Close()
+		}
+		return mounts.mount(new, members, flag), nil
+	})
+}
+
+// Unmount releases the trees mounted at p, if fid isn't nil only that
+// member of the union is released. Nodes left without mounts are
+// removed.
+func (ns *Namespace) Unmount(p string, fid *client.Fid) error {
+	return ns.change(func(mounts *Tree) ([]*Member, error) {
+		elems := split(p)
+		node := mounts.find(elems)
+		if node == nil || len(node.Members) == 0 {
+			return nil, errNotMountPoint
+		}
+		var kept, removed []*Member
+		for _, m := range node.Members {
+			if fid == nil || m.Fid == fid {
+				removed = append(removed, m)
+			} else {
+				kept = append(kept, m)
 			}
 		}
-	} else {
-		// no more walking, just clone the fid
-		var err error
-		searchFid, err = fid.Walk(".")
-		if err != nil {
-			return nil, err
+		if len(removed) == 0 {
+			return nil, errNotMember
+		}
+		node.Members = kept
+		mounts.prune(elems)
+		return removed, nil
+	})
+}
+
+// split returns the names in the path p
+func split(p string) []string {
+	if p = path.Join("/", p); p == "/" {
+		return nil
+	}
+	return strings.Split(p[1:], "/")
+}
+
+// node returns the node of t at p, the nodes missing are created
+func (t *Tree) node(p string) *Tree {
+	root := t
+	for _, name := range split(p) {
+		child := root.FindChild(name)
+		if child == nil {
+			child = root.AddChild(name)
 		}
+		root = child
+	}
+	return root
+}
+
+// MountServer serves fs over a memlistener and mounts its root
+// under parent/name.
+func (ns *Namespace) MountServer(name string, parent string, fs vfs.RPC) error {
+	fsys, iounit, closeAll, err := dialServer(name, fs)
+	if err != nil {
+		return err
+	}
+	var root *client.Fid
+	if root, err = fsys.Open("/", plan9.OREAD); err == nil {
+		m := &Member{Fid: root, src: &source{args: []string{name}}, iounit: iounit}
+		if err = ns.mountNew(path.Join(parent, name), m); err == nil {
+			return nil
+		}
+		root.Close()
+	}
+	closeAll()
+	return err
+}
+
+// MountFile serves f and mounts it under parent/name
+func (ns *Namespace) MountFile(name string, parent string, f *vfs.File) error {
+	fsys, iounit, closeAll, err := dialServer(name, vfs.NewFileserver(filetree.New(vfs.NewDir("", f)), vfs.Recover()))
+	if err != nil {
+		return err
+	}
+	var root, fid *client.Fid
+	if root, err = fsys.Open("/", plan9.OREAD); err == nil {
+		fid, err = walkFrom(root, []string{f.Name})
+		root.Close()
+		if err == nil {
+			m := &Member{Fid: fid, src: &source{args: []string{name}}, iounit: iounit}
+			if err = ns.mountNew(path.Join(parent, name), m); err == nil {
+				return nil
+			}
+			fid.Close()
+		}
+	}
+	closeAll()
+	return err
+}
+
+// dialServer serves fs over a memlistener and attaches to it, iounit
+// is the largest read or write of the connection and closeAll stops
+// the server and the client
+func dialServer(name string, fs vfs.RPC) (fsys *client.Fsys, iounit uint32, closeAll func(), err error) {
+	ls := memlistener.New(name)
+	srv, err := vfs.NewServer(fs, ls)
+	if err != nil {
+		ls.Close()
+		return nil, 0, nil, err
+	}
+	conn, err := memlistener.Connect(ls, "namespace")
+	if err != nil {
+		srv.Close()
+		return nil, 0, nil, err
+	}
+	cli, err := vfs.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		srv.Close()
+		return nil, 0, nil, err
+	}
+	closeAll = func() {
+		cli.Close()
+		srv.Close()
+	}
+	if fsys, err = cli.Attach(nil, "nouser", ""); err != nil {
+		closeAll()
+		return nil, 0, nil, err
+	}
+	return fsys, cli.Msize - plan9.IOHDRSZ, closeAll, nil
+}
+
+// Walk scans the mount tree for the path p and perform a walk on the correct fid.
+//
+// When walk reaches a node without a valid child, then it will start to perform
+// walk operations on the fids of the last mount point, in the union order.
+func (ns *Namespace) Walk(p string) (*client.Fid, error) {
+	members, err := ns.WalkUnion(p)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range members[1:] {
+		m.Fid.Close()
+	}
+	return members[0].Fid, nil
+}
+
+// WalkUnion is like Walk but when p is a union directory it returns a
+// clone of every member, in order. Below a union p is found in the
+// first member that has it.
+func (ns *Namespace) WalkUnion(p string) ([]*Member, error) {
+	s := ns.acquire()
+	defer ns.done(s)
+	return s.mounts.walkUnion(p)
+}
+
+func (t *Tree) walkUnion(p string) ([]*Member, error) {
+	nt, err := t.resolve(p)
+	if err != nil {
+		return nil, err
+	}
+	if len(nt.members) == 0 {
+		return nil, errSynthetic
+	}
+	return nt.members, nil
+}
+
+// walkFrom walks elems from a clone of fid, the mounted fids may be
+// open and names can't be walked from an open fid
+func walkFrom(fid *client.Fid, elems []string) (*client.Fid, error) {
+	if len(elems) == 0 {
+		return fid.Walk("")
+	}
+	clone, err := fid.Walk("")
+	if err != nil {
+		return nil, err
 	}
-	return searchFid, nil
+	defer clone.Close()
+	return clone.Walk(strings.Join(elems, "/"))
 }
@@ -0,0 +1,451 @@
+package namespace
+
+import (
+	"9fans.net/go/plan9"
+	"9fans.net/go/plan9/client"
+	"amoraes.info/ded/ramfs"
+	"amoraes.info/ded/vfs"
+	"amoraes.info/ded/vfs/memlistener"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// dial serves fs over a memlistener and attaches to it, everything
+// is released after t
+func dial(t *testing.T, fs vfs.RPC) *client.Fsys {
+	return attach(t, fs, "")
+}
+
+// attach is like dial but attaches to aname
+func attach(t *testing.T, fs vfs.RPC, aname string) *client.Fsys {
+	l := memlistener.New("namespace")
+	srv, err := vfs.NewServer(fs, l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { srv.Close() })
+	conn, err := memlistener.Connect(l, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli, err := client.NewConn(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cli.Close() })
+	fsys, err := cli.Attach(nil, "glenda", aname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fsys
+}
+
+// newTree returns the root of a ramfs holding the files names, the
+// contents of every file are data. The names ending in / are
+// directories.
+func newTree(t *testing.T, data string, names ...string) *client.Fid {
+	fsys := dial(t, vfs.NewFileserver(ramfs.New(0)))
+	for _, name := range names {
+		if strings.HasSuffix(name, "/") {
+			fid, err := fsys.Create(strings.TrimSuffix(name, "/"), plan9.OREAD, plan9.DMDIR|0755)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fid.Close()
+			continue
+		}
+		fid, err := fsys.Create(name, plan9.OWRITE, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := fid.Write([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+		fid.Close()
+	}
+	root, err := fsys.Open("/", plan9.OREAD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer root.Close()
+	// names can't be walked from an open fid
+	fid, err := root.Walk("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fid
+}
+
+func TestUnion(t *testing.T) {
+	ns := &Namespace{}
+	if err := ns.MountFlag("bin", "", newTree(t, "project", "build", "cat"), MREPL); err != nil {
+		t.Fatal(err)
+	}
+	tools := newTree(t, "tools", "cat", "rc")
+	if err := ns.MountFlag("bin", "", tools, MAFTER|MCREATE); err != nil {
+		t.Fatal(err)
+	}
+	if err := ns.Mount("bin", "", tools); err == nil {
+		t.Errorf("Mount should refuse a mounted name")
+	}
+
+	read := func(name string) string {
+		t.Helper()
+		fid, err := ns.Walk(name)
+		if err != nil {
+			return "missing"
+		}
+		defer fid.Close()
+		if err := fid.Open(plan9.OREAD); err != nil {
+			t.Fatal(err)
+		}
+		data, _ := ioutil.ReadAll(fid)
+		return string(data)
+	}
+	switch {
+	case read("bin/cat") != "project":
+		t.Errorf("The first member should be used: %q", read("bin/cat"))
+	case read("bin/rc") != "tools":
+		t.Errorf("The later members should be used: %q", read("bin/rc"))
+	case read("bin/ls") != "missing":
+		t.Errorf("Unexpected file bin/ls")
+	}
+
+	if err := ns.MountFlag("bin", "", newTree(t, "local", "cat"), MBEFORE); err != nil {
+		t.Fatal(err)
+	}
+	if s := read("bin/cat"); s != "local" {
+		t.Errorf("MBEFORE should come first: %q", s)
+	}
+
+	// the export merges the union
+	fsys := dial(t, vfs.NewFileserver(NewExport(ns)))
+	list := func() string {
+		t.Helper()
+		fid, err := fsys.Open("bin", plan9.OREAD)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer fid.Close()
+		dirs, err := fid.Dirreadall()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, d := range dirs {
+			names = append(names, d.Name)
+		}
+		sort.Strings(names)
+		return strings.Join(names, " ")
+	}
+	if s := list(); s != "build cat rc" {
+		t.Errorf("Unexpected union %q", s)
+	}
+
+	// files are created in the MCREATE member
+	fid, err := fsys.Create("bin/new", plan9.OWRITE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fid.Close()
+	if _, err := tools.Walk("new"); err != nil {
+		t.Errorf("The file should be created in the MCREATE member: %v", err)
+	}
+	if s := list(); s != "build cat new rc" {
+		t.Errorf("Unexpected union after create %q", s)
+	}
+
+	if err := ns.MountFlag("bin", "", newTree(t, "only", "sh"), MREPL); err != nil {
+		t.Fatal(err)
+	}
+	if s := list(); s != "sh" {
+		t.Errorf("MREPL should replace the union: %q", s)
+	}
+	if _, err := fsys.Create("bin/new", plan9.OWRITE, 0644); err == nil {
+		t.Errorf("Create should fail without MCREATE")
+	}
+}
+
+func TestUnmountBind(t *testing.T) {
+	ns := &Namespace{}
+	tree := newTree(t, "a", "x")
+	if err := ns.Mount("a", "", tree); err != nil {
+		t.Fatal(err)
+	}
+	if err := ns.Bind("a", "b/c", MREPL); err != nil {
+		t.Fatal(err)
+	}
+	if err := ns.Bind("a", "a", MAFTER); err != nil {
+		t.Fatal(err)
+	}
+	exists := func(name string) bool {
+		fid, err := ns.Walk(name)
+		if err != nil {
+			return false
+		}
+		fid.Close()
+		return true
+	}
+	if !exists("b/c/x") {
+		t.Errorf("The bound tree should be visible")
+	}
+
+	if err := ns.Unmount("a", newTree(t, "other")); err != errNotMember {
+		t.Errorf("Expecting %v got %v", errNotMember, err)
+	}
+	if err := ns.Unmount("a", tree); err != nil {
+		t.Fatal(err)
+	}
+	if !exists("a/x") {
+		t.Errorf("The other member of the union should be kept")
+	}
+	if err := ns.Unmount("a", nil); err != nil {
+		t.Fatal(err)
+	}
+	switch {
+	case exists("a/x"):
+		t.Errorf("a should be unmounted")
+	case !exists("b/c/x"):
+		t.Errorf("The binds should be kept after the unmount")
+	}
+
+	if err := ns.Unmount("b", nil); err != errNotMountPoint {
+		t.Errorf("Expecting %v got %v", errNotMountPoint, err)
+	}
+	if err := ns.Unmount("/b/c", nil); err != nil {
+		t.Fatal(err)
+	}
+	s := ns.acquire()
+	defer ns.done(s)
+	if len(s.mounts.Childs) != 0 {
+		t.Errorf("The empty nodes should be removed")
+	}
+}
+
+func TestBindWhileServing(t *testing.T) {
+	ns := &Namespace{}
+	if err := ns.Mount("a", "", newTree(t, "a", "x")); err != nil {
+		t.Fatal(err)
+	}
+	fsys := dial(t, vfs.NewFileserver(NewExport(ns)))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			if fid, err := fsys.Open("a/x", plan9.OREAD); err == nil {
+				ioutil.ReadAll(fid)
+				fid.Close()
+			}
+		}
+	}()
+	for i := 0; i < 50; i++ {
+		if err := ns.Bind("a", "b", MREPL); err != nil {
+			t.Fatal(err)
+		}
+		if err := ns.Unmount("b", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-done
+}
+
+func TestFork(t *testing.T) {
+	ns := &Namespace{}
+	if err := ns.Mount("a", "", newTree(t, "a", "x")); err != nil {
+		t.Fatal(err)
+	}
+	other := &Namespace{}
+	if err := other.Mount("o", "", newTree(t, "o", "y")); err != nil {
+		t.Fatal(err)
+	}
+	export := NewExport(ns)
+	export.Fork = true
+	export.AddNamespace("other", other)
+	c1 := attach(t, vfs.NewFileserver(export), "")
+	c2 := attach(t, vfs.NewFileserver(export), "")
+
+	exists := func(fsys *client.Fsys, name string) bool {
+		fid, err := fsys.Open(name, plan9.OREAD)
+		if err != nil {
+			return false
+		}
+		fid.Close()
+		return true
+	}
+	ctl := func(fsys *client.Fsys, cmd string) error {
+		fid, err := fsys.Open(CtlName, plan9.OWRITE)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer fid.Close()
+		_, err = fid.Write([]byte(cmd))
+		return err
+	}
+
+	if err := ctl(c1, "bind -a a b\nunmount a\n"); err != nil {
+		t.Fatal(err)
+	}
+	switch {
+	case !exists(c1, "b/x") || exists(c1, "a/x"):
+		t.Errorf("The ctl file should change the namespace of the client")
+	case exists(c2, "b/x") || !exists(c2, "a/x"):
+		t.Errorf("The other clients shouldn't see the changes")
+	}
+	if fid, err := ns.Walk("a/x"); err != nil {
+		t.Errorf("The base namespace shouldn't change: %v", err)
+	} else {
+		fid.Close()
+	}
+	if err := ctl(c1, "bind -ab a b\n"); err == nil {
+		t.Errorf("Expecting an error for -ab")
+	}
+
+	if fid, err := c2.Open("/", plan9.OREAD); err != nil {
+		t.Fatal(err)
+	} else {
+		dirs, _ := fid.Dirreadall()
+		fid.Close()
+		if len(dirs) != 2 || dirs[0].Name != "a" || dirs[1].Name != CtlName {
+			t.Errorf("Unexpected root %v", dirs)
+		}
+	}
+
+	c3 := attach(t, vfs.NewFileserver(export), "other")
+	if !exists(c3, "o/y") || exists(c3, "a/x") {
+		t.Errorf("The aname should select the namespace")
+	}
+}
+
+func TestSyntheticDirs(t *testing.T) {
+	ns := &Namespace{}
+	if err := ns.Mount("c", "a/b", newTree(t, "c", "x")); err != nil {
+		t.Fatal(err)
+	}
+	fsys := dial(t, vfs.NewFileserver(NewExport(ns)))
+	list := func(name string) string {
+		t.Helper()
+		fid, err := fsys.Open(name, plan9.OREAD)
+		if err != nil {
+			return err.Error()
+		}
+		defer fid.Close()
+		dirs, err := fid.Dirreadall()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, d := range dirs {
+			names = append(names, d.Name)
+		}
+		sort.Strings(names)
+		return strings.Join(names, " ")
+	}
+
+	switch {
+	case list("/") != "a":
+		t.Errorf("Unexpected root %q", list("/"))
+	case list("a") != "b", list("a/b") != "c", list("a/b/c") != "x":
+		t.Errorf("Unexpected directories %q %q %q", list("a"), list("a/b"), list("a/b/c"))
+	}
+	fid, err := fsys.Open("a/b", plan9.OREAD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q := fid.Qid(); q.Type&plan9.QTDIR == 0 || q != synthQid("/a/b") || q == synthQid("/a") {
+		t.Errorf("Unexpected qid %v", q)
+	}
+	fid.Close()
+	if _, err := fsys.Open("a", plan9.OWRITE); err == nil {
+		t.Errorf("Synthetic directories should be read-only")
+	}
+	if _, err := fsys.Create("a/new", plan9.OWRITE, 0644); err == nil {
+		t.Errorf("Files can't be created in synthetic directories")
+	}
+
+	// a directory mounted above is merged with the mount points
+	if err := ns.Mount("", "", newTree(t, "root", "a/", "a/real", "top")); err != nil {
+		t.Fatal(err)
+	}
+	switch {
+	case list("/") != "a top":
+		t.Errorf("Unexpected root %q", list("/"))
+	case list("a") != "b real":
+		t.Errorf("Unexpected directory %q", list("a"))
+	}
+	fid, err = fsys.Create("a/new", plan9.OWRITE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fid.Close()
+	if s := list("a"); s != "b new real" {
+		t.Errorf("Unexpected directory after create %q", s)
+	}
+}
+
+func TestExportPipelinedReads(t *testing.T) {
+	ns := &Namespace{}
+	if err := ns.Mount("u", "", newTree(t, "a", "x")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ns.MountFlag("u", "", newTree(t, "b", "y"), MAFTER); err != nil {
+		t.Fatal(err)
+	}
+	l := memlistener.New("export")
+	srv, err := vfs.NewServer(vfs.NewFileserver(NewExport(ns)), l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	conn, err := memlistener.Connect(l, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for _, tx := range []*plan9.Fcall{
+		{Type: plan9.Tversion, Tag: plan9.NOTAG, Msize: 8192, Version: "9P2000"},
+		{Type: plan9.Tattach, Tag: 1, Fid: 0, Afid: plan9.NOFID, Uname: "glenda"},
+		{Type: plan9.Twalk, Tag: 1, Fid: 0, Newfid: 1, Wname: []string{"u"}},
+		{Type: plan9.Topen, Tag: 1, Fid: 1, Mode: plan9.OREAD},
+	} {
+		if err := plan9.WriteFcall(conn, tx); err != nil {
+			t.Fatal(err)
+		}
+		if rx, err := plan9.ReadFcall(conn); err != nil || rx.Type != tx.Type+1 {
+			t.Fatalf("Unexpected reply to %v: %v / %v", tx, rx, err)
+		}
+	}
+
+	// the reads of the union directory are sent before any reply
+	const reads = 8
+	for i := 0; i < reads; i++ {
+		tx := &plan9.Fcall{Type: plan9.Tread, Tag: uint16(100 + i), Fid: 1, Count: 8000}
+		if err := plan9.WriteFcall(conn, tx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < reads; i++ {
+		rx, err := plan9.ReadFcall(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rx.Type != plan9.Rread {
+			t.Errorf("Unexpected read %v", rx)
+			continue
+		}
+		var names []string
+		for data := rx.Data; len(data) > 2; {
+			n := int(data[0]) | int(data[1])<<8 + 2
+			d, err := plan9.UnmarshalDir(data[:n])
+			if err != nil {
+				t.Fatal(err)
+			}
+			names = append(names, d.Name)
+			data = data[n:]
+		}
+		if len(names) != 2 {
+			t.Errorf("Expecting x and y got %v", names)
+		}
+	}
+}
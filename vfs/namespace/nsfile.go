@@ -0,0 +1,293 @@
+package namespace
+
+import (
+	"9fans.net/go/plan9"
+	"9fans.net/go/plan9/client"
+	"amoraes.info/ded/vfs"
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/flynn/go-shlex"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+type (
+	// Command is a line of a namespace file, like Plan 9's
+	// /lib/namespace:
+	//
+	//	mount [-abc] addr new [spec]
+	//	bind [-abc] old new
+	//	unmount new
+	//
+	// addr is a dial string, like tcp!host!5640.
+	Command struct {
+		Name string
+		Flag int
+		Args []string
+		// Line is the line of the command in the file, 0 if it
+		// didn't come from a file
+		Line int
+	}
+
+	// Dialer connects to the server at addr and returns the root of
+	// the tree spec, the connection, closed when the tree is no
+	// longer used, and the largest read or write of the connection,
+	// 0 if it isn't known. conn can be nil.
+	Dialer func(addr, spec string) (root *client.Fid, conn io.Closer, iounit uint32, err error)
+)
+
+const (
+	// defaultPort is the 9fs port, used when a dial string has none
+	defaultPort = "564"
+)
+
+var (
+	errNoDialer = errors.New("mount isn't available")
+	errUsage    = errors.New("usage")
+)
+
+// NewDialer returns a Dialer that connects using TLS if cfg isn't nil
+func NewDialer(cfg *tls.Config) Dialer {
+	return func(addr, spec string) (*client.Fid, io.Closer, uint32, error) {
+		network, hostport := ParseDial(addr)
+		if network != "tcp" {
+			return nil, nil, 0, fmt.Errorf("unsupported network %q", network)
+		}
+		cli, err := vfs.Connect(hostport, cfg)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		fsys, err := cli.Attach(nil, os.Getenv("USER"), spec)
+		if err != nil {
+			cli.Close()
+			return nil, nil, 0, err
+		}
+		root, err := fsys.Open("/", plan9.OREAD)
+		if err != nil {
+			cli.Close()
+			return nil, nil, 0, err
+		}
+		return root, cli, cli.Msize - plan9.IOHDRSZ, nil
+	}
+}
+
+// ParseDial splits a dial string like tcp!host!port in the network
+// and the address. The network is tcp when it is missing or net, the
+// port is the 9fs port when it is missing, and host:port is accepted
+// too.
+func ParseDial(addr string) (network, hostport string) {
+	parts := strings.SplitN(addr, "!", 3)
+	switch {
+	case len(parts) == 1:
+		return "tcp", addr
+	case len(parts) == 2 && parts[0] == "unix":
+		return "unix", parts[1]
+	case len(parts) == 2 && (parts[0] == "tcp" || parts[0] == "net"):
+		return "tcp", parts[1] + ":" + defaultPort
+	case len(parts) == 2:
+		return "tcp", parts[0] + ":" + parts[1]
+	case parts[0] == "net":
+		return "tcp", parts[1] + ":" + parts[2]
+	}
+	return parts[0], parts[1] + ":" + parts[2]
+}
+
+// Parse reads the commands of a namespace file. $name and ${name} are
+// replaced by getenv(name), os.Getenv if getenv is nil. Empty lines
+// and lines starting with # are ignored.
+func Parse(r io.Reader, getenv func(string) string) ([]*Command, error) {
+	if getenv == nil {
+		getenv = os.Getenv
+	}
+	var cmds []*Command
+	s := bufio.NewScanner(r)
+	for line := 1; s.Scan(); line++ {
+		text := strings.TrimSpace(s.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		args, err := shlex.Split(os.Expand(text, getenv))
+		if err != nil {
+			return nil, fmt.Errorf("line %v: %v", line, err)
+		}
+		if len(args) == 0 {
+			continue
+		}
+		cmd, err := parseCommand(args[0], args[1:])
+		if err != nil {
+			return nil, fmt.Errorf("line %v: %v", line, err)
+		}
+		cmd.Line = line
+		cmds = append(cmds, cmd)
+	}
+	return cmds, s.Err()
+}
+
+// parseCommand checks the arguments of the command name
+func parseCommand(name string, args []string) (*Command, error) {
+	cmd := &Command{Name: name, Flag: MREPL}
+	if len(args) > 0 && strings.HasPrefix(args[0], "-") && name != "unmount" {
+		var err error
+		if cmd.Flag, err = parseFlag(args[0]); err != nil {
+			return nil, err
+		}
+		args = args[1:]
+	}
+	cmd.Args = args
+	switch {
+	case name == "mount" && (len(args) == 2 || len(args) == 3):
+	case name == "bind" && len(args) == 2:
+	case name == "unmount" && len(args) == 1:
+	case name == "mount":
+		return nil, fmt.Errorf("%v: mount [-abc] addr new [spec]", errUsage)
+	case name == "bind":
+		return nil, fmt.Errorf("%v: bind [-abc] old new", errUsage)
+	case name == "unmount":
+		return nil, fmt.Errorf("%v: unmount new", errUsage)
+	default:
+		return nil, fmt.Errorf("unknown command %q", name)
+	}
+	return cmd, nil
+}
+
+// parseFlag returns the mount flag of the options of bind and mount:
+// -a (MAFTER), -b (MBEFORE) and -c (MCREATE), like "-ac"
+func parseFlag(opt string) (int, error) {
+	flag := MREPL
+	for _, c := range strings.TrimPrefix(opt, "-") {
+		switch c {
+		case 'a':
+			flag |= MAFTER
+		case 'b':
+			flag |= MBEFORE
+		case 'c':
+			flag |= MCREATE
+		default:
+			return 0, fmt.Errorf("unknown option %q", c)
+		}
+	}
+	if flag&morder == morder {
+		return 0, errors.New("-a and -b can't be used together")
+	}
+	return flag, nil
+}
+
+// Run changes ns with cmd, dial connects to the servers of the mount
+// commands when they are first walked
+func (ns *Namespace) Run(cmd *Command, dial Dialer) error {
+	switch cmd.Name {
+	case "mount":
+		if dial == nil {
+			return errNoDialer
+		}
+		var spec string
+		if len(cmd.Args) == 3 {
+			spec = cmd.Args[2]
+		}
+		// the server is dialed on the first walk
+		src := &source{cmd: "mount", args: []string{cmd.Args[0]}}
+		if spec != "" {
+			src.args = append(src.args, spec)
+		}
+		m := &Member{src: src, remote: newRemote(cmd.Args[0], spec, dial)}
+		return ns.mountMember(cmd.Args[1], m, cmd.Flag)
+	case "bind":
+		return ns.Bind(cmd.Args[0], cmd.Args[1], cmd.Flag)
+	case "unmount":
+		return ns.Unmount(cmd.Args[0], nil)
+	}
+	return fmt.Errorf("unknown command %q", cmd.Name)
+}
+
+// Apply runs cmds in order, it stops at the first error
+func (ns *Namespace) Apply(cmds []*Command, dial Dialer) error {
+	for _, cmd := range cmds {
+		if err := ns.Run(cmd, dial); err != nil {
+			if cmd.Line > 0 {
+				return fmt.Errorf("line %v: %v", cmd.Line, err)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// ApplyFile parses the namespace file name and applies it to ns
+func (ns *Namespace) ApplyFile(name string, dial Dialer) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	cmds, err := Parse(f, nil)
+	if err != nil {
+		return fmt.Errorf("%v: %v", name, err)
+	}
+	if err := ns.Apply(cmds, dial); err != nil {
+		return fmt.Errorf("%v: %v", name, err)
+	}
+	return nil
+}
+
+// String returns the mounts of ns in the syntax of the namespace
+// files. The trees mounted with a fid can't be mounted again, they
+// are listed as comments.
+func (ns *Namespace) String() string {
+	s := ns.acquire()
+	defer ns.done(s)
+	var buf bytes.Buffer
+	s.mounts.list(&buf, "/")
+	return buf.String()
+}
+
+// list writes the mounts of t, at p, and of its children to w
+func (t *Tree) list(w io.Writer, p string) {
+	var last *source
+	for i, m := range t.Members {
+		if m.src == last {
+			// one bind of a union
+			continue
+		}
+		last = m.src
+		var opt string
+		if i > 0 {
+			opt = "a"
+		}
+		if m.Flag&MCREATE != 0 {
+			opt += "c"
+		}
+		args := []string{m.src.cmd}
+		if opt != "" {
+			args = append(args, "-"+opt)
+		}
+		switch m.src.cmd {
+		case "mount":
+			args = append(append(args, m.src.args[0], p), m.src.args[1:]...)
+		case "bind":
+			args = append(args, m.src.args[0], p)
+		default:
+			args = append([]string{"#", "mount"}, append(args[1:], m.src.args[0], p)...)
+		}
+		for i, a := range args {
+			args[i] = quote(a)
+		}
+		fmt.Fprintln(w, strings.Join(args, " "))
+	}
+	for _, c := range t.Childs {
+		c.list(w, path.Join(p, c.Name))
+	}
+}
+
+// quote quotes s if it can't be a single argument of a command
+func quote(s string) string {
+	if s != "" && !strings.ContainsAny(s, " \t\n'\"\\") {
+		return s
+	}
+	return strconv.Quote(s)
+}
@@ -0,0 +1,166 @@
+package namespace
+
+import (
+	"9fans.net/go/plan9"
+	"9fans.net/go/plan9/client"
+	"amoraes.info/ded/vfs"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	vars := map[string]string{"host": "src.local", "tools": "/usr/tools"}
+	getenv := func(name string) string { return vars[name] }
+
+	cmds, err := Parse(strings.NewReader(`# shared layout
+mount tcp!$host!5640 /src
+mount -ac tcp!${host}!5641 /bin "build tree"
+
+bind -b $tools /bin
+unmount /tmp
+`), getenv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Command{
+		{Name: "mount", Flag: MREPL, Args: []string{"tcp!src.local!5640", "/src"}, Line: 2},
+		{Name: "mount", Flag: MAFTER | MCREATE, Args: []string{"tcp!src.local!5641", "/bin", "build tree"}, Line: 3},
+		{Name: "bind", Flag: MBEFORE, Args: []string{"/usr/tools", "/bin"}, Line: 5},
+		{Name: "unmount", Flag: MREPL, Args: []string{"/tmp"}, Line: 6},
+	}
+	if len(cmds) != len(expected) {
+		t.Fatalf("Expecting %v commands got %v", len(expected), len(cmds))
+	}
+	for i, c := range cmds {
+		e := expected[i]
+		if c.Name != e.Name || c.Flag != e.Flag || c.Line != e.Line || strings.Join(c.Args, "|") != strings.Join(e.Args, "|") {
+			t.Errorf("Expecting %+v got %+v", e, *c)
+		}
+	}
+
+	for _, bad := range []string{"mount /src", "bind -x a b", "bind -ab a b", "cd /tmp", "bind 'a b"} {
+		if _, err := Parse(strings.NewReader("\n"+bad), getenv); err == nil || !strings.HasPrefix(err.Error(), "line 2:") {
+			t.Errorf("Expecting an error at line 2 for %q got %v", bad, err)
+		}
+	}
+}
+
+func TestParseDial(t *testing.T) {
+	for addr, expected := range map[string]string{
+		"tcp!host!5640":  "tcp host:5640",
+		"host!5640":      "tcp host:5640",
+		"localhost:5640": "tcp localhost:5640",
+		"net!host!5640":  "tcp host:5640",
+		"tcp!host":       "tcp host:564",
+		"net!host":       "tcp host:564",
+		"unix!/tmp/sock": "unix /tmp/sock",
+	} {
+		network, hostport := ParseDial(addr)
+		if s := network + " " + hostport; s != expected {
+			t.Errorf("%v: expecting %q got %q", addr, expected, s)
+		}
+	}
+}
+
+func TestApply(t *testing.T) {
+	trees := map[string]*client.Fid{
+		"tcp!src!5640": newTree(t, "src", "main.go"),
+		"tcp!bin!5640": newTree(t, "bin", "rc"),
+	}
+	dial := func(addr, spec string) (*client.Fid, io.Closer, uint32, error) {
+		fid, err := trees[addr].Walk("")
+		return fid, nil, 0, err
+	}
+	cmds, err := Parse(strings.NewReader(`mount tcp!src!5640 /src
+mount -a tcp!bin!5640 /src
+bind /src /lib/src
+unmount /src
+`), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ns := &Namespace{}
+	if err := ns.Apply(cmds, dial); err != nil {
+		t.Fatal(err)
+	}
+	for name, exists := range map[string]bool{"lib/src/main.go": true, "lib/src/rc": true, "src/main.go": false} {
+		fid, err := ns.Walk(name)
+		if (err == nil) != exists {
+			t.Errorf("%v: expecting %v got %v", name, exists, err)
+		}
+		if err == nil {
+			fid.Close()
+		}
+	}
+
+	cmds, _ = Parse(strings.NewReader("bind /src /x\n"), nil)
+	if err := ns.Apply(cmds, dial); err == nil || !strings.HasPrefix(err.Error(), "line 1:") {
+		t.Errorf("Expecting an error at line 1 got %v", err)
+	}
+	if err := ns.Apply([]*Command{{Name: "mount", Args: []string{"tcp!src!5640", "/x"}}}, nil); err != errNoDialer {
+		t.Errorf("Expecting %v got %v", errNoDialer, err)
+	}
+}
+
+func TestCtlFile(t *testing.T) {
+	trees := map[string]*client.Fid{
+		"tcp!src!5640": newTree(t, "src", "main.go"),
+		"tcp!bin!5640": newTree(t, "bin", "rc"),
+	}
+	dial := func(addr, spec string) (*client.Fid, io.Closer, uint32, error) {
+		fid, err := trees[addr].Walk("")
+		return fid, nil, 0, err
+	}
+	ns := &Namespace{}
+	f := vfs.NewFile("ns", ns.CtlFile(dial))
+	if err := ns.MountFile("ns", "", f); err != nil {
+		t.Fatal(err)
+	}
+	ctl := func(data string) (string, error) {
+		t.Helper()
+		fid, err := ns.Walk("ns")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer fid.Close()
+		if err := fid.Open(plan9.ORDWR); err != nil {
+			t.Fatal(err)
+		}
+		if data != "" {
+			if _, err := fid.Write([]byte(data)); err != nil {
+				return "", err
+			}
+		}
+		list, err := ioutil.ReadAll(fid)
+		return string(list), err
+	}
+
+	if _, err := ctl("mount tcp!src!5640 /src\nmount -ac tcp!bin!5640 /src \"a spec\"\nbind /src /lib/src\n"); err != nil {
+		t.Fatal(err)
+	}
+	if fid, err := ns.Walk("lib/src/rc"); err != nil {
+		t.Errorf("The commands should change the namespace: %v", err)
+	} else {
+		fid.Close()
+	}
+	list, err := ctl("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `# mount -c ns /ns
+mount tcp!src!5640 /src
+mount -ac tcp!bin!5640 /src "a spec"
+bind /src /lib/src
+`
+	if list != expected {
+		t.Errorf("Expecting %q got %q", expected, list)
+	}
+	if _, err := ctl("unmount /src\n"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ctl("unmount /src\n"); err == nil || err.Error() != errNotMountPoint.Error() {
+		t.Errorf("Expecting %v got %v", errNotMountPoint, err)
+	}
+}
@@ -0,0 +1,276 @@
+package namespace
+
+import (
+	"9fans.net/go/plan9"
+	"9fans.net/go/plan9/client"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"io"
+	"sync"
+	"time"
+)
+
+type (
+	// remote is a tree mounted from a dial string. It is dialed on
+	// the first walk and dialed again when the connection is lost,
+	// waiting more after every failed dial. The dial is made without
+	// holding mu, the concurrent walks wait for it on dialing.
+	//
+	// The binds of a remote tree keep the fids of the connection
+	// they were made with, they aren't recovered when it is lost.
+	// The files open below the tree are closed with it.
+	remote struct {
+		addr string
+		spec string
+		dial Dialer
+
+		mu      sync.Mutex
+		root    *client.Fid
+		conn    io.Closer
+		iounit  uint32
+		dialing chan struct{}
+		// users counts the mount and the binds of the tree, the
+		// connection is closed when they are all released
+		users int
+		// failures counts the dials that failed in a row, err is the
+		// last one, no dial is tried before retry
+		failures int
+		err      error
+		retry    time.Time
+	}
+)
+
+const (
+	minBackoff = 100 * time.Millisecond
+	maxBackoff = 30 * time.Second
+)
+
+var (
+	errLost     = errors.New("connection lost, the file can't be recovered")
+	errClosed   = errors.New("mount closed")
+	errDialTime = errors.New("dial timed out")
+
+	// dialTimeout is the longest wait for a dial
+	dialTimeout = 10 * time.Second
+)
+
+func newRemote(addr, spec string, dial Dialer) *remote {
+	return &remote{addr: addr, spec: spec, dial: dial, users: 1}
+}
+
+// fid returns the root of the tree and the iounit of its connection,
+// dialing the server if needed
+func (r *remote) fid() (*client.Fid, uint32, error) {
+	r.mu.Lock()
+	for r.dialing != nil {
+		dialing := r.dialing
+		r.mu.Unlock()
+		<-dialing
+		r.mu.Lock()
+	}
+	if r.root != nil {
+		defer r.mu.Unlock()
+		return r.root, r.iounit, nil
+	}
+	if now := time.Now(); now.Before(r.retry) {
+		defer r.mu.Unlock()
+		return nil, 0, fmt.Errorf("%v: %v (retrying in %v)", r.addr, r.err, r.retry.Sub(now).Truncate(time.Millisecond))
+	}
+	dialing := make(chan struct{})
+	r.dialing = dialing
+	r.mu.Unlock()
+
+	root, conn, iounit, err := r.dialTimeout()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.dialing = nil
+	close(dialing)
+	if err == nil && r.users == 0 {
+		// the tree was unmounted during the dial
+		hangup(root, conn)
+		return nil, 0, fmt.Errorf("%v: %v", r.addr, errClosed)
+	}
+	if err != nil {
+		r.failures++
+		r.err = err
+		r.retry = time.Now().Add(backoff(r.failures))
+		log.WithFields(log.Fields{
+			"Module":   "namespace",
+			"Addr":     r.addr,
+			"Failures": r.failures,
+			"Err":      err,
+		}).Warnf("Dial failed")
+		return nil, 0, fmt.Errorf("%v: %v", r.addr, err)
+	}
+	r.root, r.conn, r.iounit, r.failures, r.err = root, conn, iounit, 0, nil
+	return root, iounit, nil
+}
+
+// dialTimeout dials the server, giving up after dialTimeout. The
+// connection made after that is closed.
+func (r *remote) dialTimeout() (*client.Fid, io.Closer, uint32, error) {
+	type result struct {
+		root   *client.Fid
+		conn   io.Closer
+		iounit uint32
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		var res result
+		res.root, res.conn, res.iounit, res.err = r.dial(r.addr, r.spec)
+		done <- res
+	}()
+	timer := time.NewTimer(dialTimeout)
+	defer timer.Stop()
+	select {
+	case res := <-done:
+		return res.root, res.conn, res.iounit, res.err
+	case <-timer.C:
+		go func() {
+			if res := <-done; res.err == nil {
+				hangup(res.root, res.conn)
+			}
+		}()
+		return nil, nil, 0, errDialTime
+	}
+}
+
+// connected returns the root of the tree, nil if the server
+// isn't connected
+func (r *remote) connected() *client.Fid {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.root
+}
+
+// backoff returns how long to wait after n failed dials
+func backoff(n int) time.Duration {
+	d := minBackoff
+	for i := 1; i < n && d < maxBackoff; i++ {
+		d *= 2
+	}
+	if d > maxBackoff {
+		d = maxBackoff
+	}
+	return d
+}
+
+// lost drops root if it is still the root of r, the next walk dials
+// the server again
+func (r *remote) lost(root *client.Fid) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.root != root {
+		return
+	}
+	log.WithFields(log.Fields{
+		"Module": "namespace",
+		"Addr":   r.addr,
+	}).Warnf("Connection lost")
+	r.hangup()
+}
+
+// hold adds a user of r, a bind of the tree
+func (r *remote) hold() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.users++
+}
+
+// close releases a user of r, the last one closes the connection
+func (r *remote) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.users--; r.users == 0 {
+		r.hangup()
+	}
+}
+
+// hangup closes the root and the connection of r
+func (r *remote) hangup() {
+	hangup(r.root, r.conn)
+	r.root, r.conn = nil, nil
+}
+
+// hangup closes root and conn, any of them can be nil
+func hangup(root *client.Fid, conn io.Closer) {
+	if root != nil {
+		root.Close()
+	}
+	if conn != nil {
+		conn.Close()
+	}
+}
+
+// connLost returns true if err comes from the connection and not from
+// the server, the client returns io.EOF when the server hangs up
+func connLost(err error) bool {
+	switch err.(type) {
+	case nil, client.Error, plan9.ProtocolError:
+		return false
+	}
+	return true
+}
+
+// probe returns the error of the connection of fid, if any. A read
+// returns io.EOF at the end of the file and when the connection is
+// closed, probe tells them apart.
+func probe(fid *client.Fid) error {
+	clone, err := fid.Walk("")
+	if err == nil {
+		clone.Close()
+		return nil
+	}
+	if connLost(err) {
+		return err
+	}
+	return nil
+}
+
+// fid returns the fid of the tree mounted by m
+func (m *Member) fid() (*client.Fid, error) {
+	if m.remote != nil {
+		root, _, err := m.remote.fid()
+		return root, err
+	}
+	return m.Fid, nil
+}
+
+// dialed returns the fid of the tree mounted by m, nil if it is a
+// remote tree that isn't connected
+func (m *Member) dialed() *client.Fid {
+	if m.remote != nil {
+		return m.remote.connected()
+	}
+	return m.Fid
+}
+
+// walk walks elems from the tree mounted by m and returns the member
+// of the file, a remote tree is dialed again once if its connection
+// was lost
+func (m *Member) walk(elems []string) (*Member, error) {
+	if m.remote == nil {
+		fid, err := walkFrom(m.Fid, elems)
+		if err != nil {
+			return nil, err
+		}
+		return &Member{Fid: fid, Flag: m.Flag, iounit: m.iounit, conn: m.conn}, nil
+	}
+	for try := 0; ; try++ {
+		root, iounit, err := m.remote.fid()
+		if err != nil {
+			return nil, err
+		}
+		fid, err := walkFrom(root, elems)
+		if err == nil {
+			return &Member{Fid: fid, Flag: m.Flag, iounit: iounit, conn: m.remote}, nil
+		}
+		if try > 0 || !connLost(err) {
+			return nil, err
+		}
+		m.remote.lost(root)
+	}
+}
@@ -0,0 +1,283 @@
+package namespace
+
+import (
+	"9fans.net/go/plan9"
+	"9fans.net/go/plan9/client"
+	"amoraes.info/ded/ramfs"
+	"amoraes.info/ded/vfs"
+	"amoraes.info/ded/vfs/memlistener"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flakyServer serves a ramfs to a Dialer, the connections can be cut
+// and the server can refuse new ones
+type flakyServer struct {
+	t  *testing.T
+	fs vfs.RPC
+
+	mu    sync.Mutex
+	dials int
+	// closed counts the connections closed by the namespace
+	closed int
+	down   bool
+	conns  []net.Conn
+}
+
+// flakyConn counts the connections closed
+type flakyConn struct {
+	*vfs.Client
+	s *flakyServer
+}
+
+func (c flakyConn) Close() error {
+	c.s.mu.Lock()
+	c.s.closed++
+	c.s.mu.Unlock()
+	return c.Client.Close()
+}
+
+func (s *flakyServer) dial(addr, spec string) (*client.Fid, io.Closer, uint32, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dials++
+	if s.down {
+		return nil, nil, 0, errors.New("connection refused")
+	}
+	l := memlistener.New(addr)
+	srv, err := vfs.NewServer(s.fs, l)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	s.t.Cleanup(func() { srv.Close() })
+	conn, err := memlistener.Connect(l, "namespace")
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	s.conns = append(s.conns, conn)
+	cli, err := vfs.NewClient(conn)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	fsys, err := cli.Attach(nil, "glenda", spec)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	root, err := fsys.Open("/", plan9.OREAD)
+	return root, flakyConn{cli, s}, cli.Msize - plan9.IOHDRSZ, err
+}
+
+// open returns the connections dialed and not closed
+func (s *flakyServer) open() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dials - s.closed
+}
+
+// cut closes the connections, like a server that was restarted
+func (s *flakyServer) cut(down bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.conns {
+		c.Close()
+	}
+	s.conns = nil
+	s.down = down
+}
+
+func (s *flakyServer) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dials
+}
+
+func TestReconnect(t *testing.T) {
+	s := &flakyServer{t: t, fs: vfs.NewFileserver(ramfs.New(0))}
+	fid, err := dial(t, s.fs).Create("x", plan9.OWRITE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fid.Write([]byte("data"))
+	fid.Close()
+
+	ns := &Namespace{}
+	if err := ns.Run(&Command{Name: "mount", Args: []string{"tcp!flaky!5640", "/src"}}, s.dial); err != nil {
+		t.Fatal(err)
+	}
+	if n := s.count(); n != 0 {
+		t.Errorf("Mount should dial on the first walk, got %v dials", n)
+	}
+	if dirs := ns.mountPoints("/"); len(dirs) != 1 || dirs[0].Name != "src" || s.count() != 0 {
+		t.Errorf("Listing the mount point shouldn't dial: %v after %v dials", dirs, s.count())
+	}
+
+	fsys := dial(t, vfs.NewFileserver(NewExport(ns)))
+	fid, err = fsys.Open("src/x", plan9.OREAD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fid.Close()
+	read := func() (string, error) {
+		buf := make([]byte, 100)
+		n, err := fid.ReadAt(buf, 0)
+		if err == io.EOF {
+			err = nil
+		}
+		return string(buf[:n]), err
+	}
+	if data, err := read(); err != nil || data != "data" || s.count() != 1 {
+		t.Fatalf("Unexpected read %q / %v after %v dials", data, err, s.count())
+	}
+
+	// the open fids are walked and opened again
+	s.cut(false)
+	if data, err := read(); err != nil || data != "data" || s.count() != 2 {
+		t.Errorf("Expecting a new connection, got %q / %v after %v dials", data, err, s.count())
+	}
+
+	// the dials wait after a failure
+	s.cut(true)
+	if _, err := ns.Walk("src/x"); err == nil || s.count() != 3 {
+		t.Errorf("Expecting a failed dial, got %v after %v dials", err, s.count())
+	}
+	if _, err := ns.Walk("src/x"); err == nil || !strings.Contains(err.Error(), "retrying") || s.count() != 3 {
+		t.Errorf("Expecting to wait before dialing, got %v after %v dials", err, s.count())
+	}
+	if _, err := read(); err == nil || !strings.Contains(err.Error(), errLost.Error()) {
+		t.Errorf("Expecting %v got %v", errLost, err)
+	}
+
+	s.cut(false)
+	time.Sleep(2 * minBackoff)
+	if data, err := read(); err != nil || data != "data" || s.count() != 4 {
+		t.Errorf("Expecting a new connection, got %q / %v after %v dials", data, err, s.count())
+	}
+}
+
+func TestCloseConnections(t *testing.T) {
+	s := &flakyServer{t: t, fs: vfs.NewFileserver(ramfs.New(0))}
+	fid, err := dial(t, s.fs).Create("x", plan9.OWRITE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fid.Close()
+	ns := &Namespace{}
+	if err := ns.Run(&Command{Name: "mount", Args: []string{"tcp!flaky!5640", "/src"}}, s.dial); err != nil {
+		t.Fatal(err)
+	}
+	walk := func(p string) {
+		t.Helper()
+		fid, err := ns.Walk(p)
+		if err != nil {
+			t.Fatalf("Walk of %v failed: %v", p, err)
+		}
+		fid.Close()
+	}
+	walk("src/x")
+
+	// the lost connection is closed
+	s.cut(false)
+	walk("src/x")
+	if s.count() != 2 || s.open() != 1 {
+		t.Errorf("Expecting 1 connection open, got %v of %v dials", s.open(), s.count())
+	}
+
+	// the binds keep the connection after the unmount
+	if err := ns.Bind("src", "b", MREPL); err != nil {
+		t.Fatal(err)
+	}
+	if err := ns.Unmount("src", nil); err != nil {
+		t.Fatal(err)
+	}
+	walk("b/x")
+	if s.open() != 1 {
+		t.Errorf("The bind should keep the connection open")
+	}
+	if err := ns.Unmount("b", nil); err != nil {
+		t.Fatal(err)
+	}
+	if s.open() != 0 {
+		t.Errorf("The connection should be closed, %v open", s.open())
+	}
+}
+
+func TestDialOnce(t *testing.T) {
+	s := &flakyServer{t: t, fs: vfs.NewFileserver(ramfs.New(0))}
+	release := make(chan struct{})
+	slow := func(addr, spec string) (*client.Fid, io.Closer, uint32, error) {
+		<-release
+		return s.dial(addr, spec)
+	}
+	r := newRemote("tcp!flaky!5640", "", slow)
+	defer r.close()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 3)
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _, err := r.fid()
+			errs <- err
+		}()
+	}
+	// the dial doesn't hold the lock
+	time.Sleep(10 * time.Millisecond)
+	if fid := r.connected(); fid != nil {
+		t.Errorf("Unexpected root %v", fid)
+	}
+	close(release)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	if s.count() != 1 {
+		t.Errorf("Expecting 1 dial, got %v", s.count())
+	}
+}
+
+func TestDialTimeout(t *testing.T) {
+	defer func(d time.Duration) { dialTimeout = d }(dialTimeout)
+	dialTimeout = 10 * time.Millisecond
+
+	s := &flakyServer{t: t, fs: vfs.NewFileserver(ramfs.New(0))}
+	release := make(chan struct{})
+	slow := func(addr, spec string) (*client.Fid, io.Closer, uint32, error) {
+		<-release
+		return s.dial(addr, spec)
+	}
+	r := newRemote("tcp!flaky!5640", "", slow)
+	defer r.close()
+	if _, _, err := r.fid(); err == nil || !strings.Contains(err.Error(), errDialTime.Error()) {
+		t.Errorf("Expecting %v got %v", errDialTime, err)
+	}
+	close(release)
+	// the late connection is closed
+	for i := 0; i < 100 && (s.count() == 0 || s.open() != 0); i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if s.count() != 1 || s.open() != 0 {
+		t.Errorf("Expecting the late connection closed, %v open of %v dials", s.open(), s.count())
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	for n, expected := range map[int]time.Duration{
+		1:  minBackoff,
+		2:  2 * minBackoff,
+		4:  8 * minBackoff,
+		30: maxBackoff,
+	} {
+		if d := backoff(n); d != expected {
+			t.Errorf("backoff(%v): expecting %v got %v", n, expected, d)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package namespace
+
+type (
+	// snapshot is a version of the mount tree, it never changes
+	// after it is published. The walks use the current snapshot,
+	// the changes publish a new one.
+	snapshot struct {
+		mounts *Tree
+		// walks counts the users of the snapshot
+		walks int
+		// retired has the members removed by the next snapshot,
+		// they are released when no walk can reach them
+		retired []*Member
+		next    *snapshot
+	}
+)
+
+// acquire returns the current mounts of ns, they are valid until
+// done is called
+func (ns *Namespace) acquire() *snapshot {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	ns.init()
+	ns.cur.walks++
+	return ns.cur
+}
+
+// done ends the use of s
+func (ns *Namespace) done(s *snapshot) {
+	ns.mu.Lock()
+	s.walks--
+	retired := ns.collect()
+	ns.mu.Unlock()
+	for _, m := range retired {
+		m.release()
+	}
+}
+
+// init creates the first snapshot, the zero Namespace has no mounts
+func (ns *Namespace) init() {
+	if ns.cur == nil {
+		ns.cur = &snapshot{mounts: &Tree{}}
+		ns.oldest = ns.cur
+	}
+}
+
+// collect drops the oldest snapshots without walks and returns the
+// members retired by them. A member retired by a snapshot can be
+// in the older ones, so a snapshot is only dropped after them.
+func (ns *Namespace) collect() []*Member {
+	var retired []*Member
+	for ns.oldest != ns.cur && ns.oldest.walks == 0 {
+		retired = append(retired, ns.oldest.retired...)
+		ns.oldest = ns.oldest.next
+	}
+	return retired
+}
+
+// change runs fn with a copy of the mount tree and publishes it as
+// the current snapshot. fn returns the members it removed, they are
+// released once the walks using the older snapshots end. The changes
+// are applied one at a time, the walks don't wait for them.
+func (ns *Namespace) change(fn func(mounts *Tree) ([]*Member, error)) error {
+	ns.wmu.Lock()
+	defer ns.wmu.Unlock()
+	s := ns.acquire()
+	mounts := s.mounts.copy()
+	retired, err := fn(mounts)
+	ns.done(s)
+	if err != nil {
+		return err
+	}
+
+	ns.mu.Lock()
+	ns.cur.retired = retired
+	ns.cur.next = &snapshot{mounts: mounts}
+	ns.cur = ns.cur.next
+	retired = ns.collect()
+	ns.mu.Unlock()
+	for _, m := range retired {
+		m.release()
+	}
+	return nil
+}
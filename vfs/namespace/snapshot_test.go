@@ -0,0 +1,117 @@
+package namespace
+
+import (
+	"9fans.net/go/plan9"
+	"amoraes.info/ded/vfs"
+	"io/ioutil"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestConcurrentWalks(t *testing.T) {
+	ns := &Namespace{}
+	if err := ns.Mount("a", "", newTree(t, "a", "x")); err != nil {
+		t.Fatal(err)
+	}
+	fsys := dial(t, vfs.NewFileserver(NewExport(ns)))
+
+	const walkers = 16
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < walkers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				// a doesn't change, the other paths come and go
+				if fid, err := ns.Walk("a/x"); err != nil {
+					t.Errorf("Walk of a/x failed: %v", err)
+					return
+				} else {
+					fid.Close()
+				}
+				if fid, err := ns.Walk("b/c/x"); err == nil {
+					fid.Close()
+				}
+				if i%2 == 0 {
+					fork := ns.Fork()
+					if err := fork.Bind("a", "d", MAFTER); err != nil {
+						t.Errorf("Bind in a fork failed: %v", err)
+					} else if fid, err := fork.Walk("d/x"); err != nil {
+						t.Errorf("Walk of d/x in a fork failed: %v", err)
+					} else {
+						fid.Close()
+					}
+					fork.Close()
+				}
+				fid, err := fsys.Open("a/x", plan9.OREAD)
+				if err != nil {
+					t.Errorf("Open of a/x failed: %v", err)
+					return
+				}
+				if data, _ := ioutil.ReadAll(fid); string(data) != "a" {
+					t.Errorf("Unexpected a/x %q", data)
+				}
+				fid.Close()
+				if fid, err := fsys.Open("/", plan9.OREAD); err == nil {
+					fid.Dirreadall()
+					fid.Close()
+				}
+			}
+		}(i)
+	}
+
+	for i := 0; i < 100; i++ {
+		if err := ns.Bind("a", "b/c", MREPL); err != nil {
+			t.Fatal(err)
+		}
+		if err := ns.MountFlag("e", "", newTree(t, "e", "y"), MBEFORE); err != nil {
+			t.Fatal(err)
+		}
+		if err := ns.Unmount("b/c", nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := ns.Unmount("e", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+	if s := ns.String(); s != "# mount -c fid /a\n" {
+		t.Errorf("Unexpected mounts %q", s)
+	}
+}
+
+func TestRetiredMembers(t *testing.T) {
+	ns := &Namespace{}
+	if err := ns.Mount("a", "", newTree(t, "a", "x")); err != nil {
+		t.Fatal(err)
+	}
+	s := ns.acquire()
+	m := s.mounts.find([]string{"a"}).Members[0]
+	if err := ns.Unmount("a", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ns.Walk("a/x"); err == nil {
+		t.Errorf("The new walks shouldn't see a")
+	}
+	// the walks of the old snapshot can still use a
+	if tg, err := s.mounts.resolve("a/x"); err != nil {
+		t.Errorf("The old snapshot should still have a: %v", err)
+	} else {
+		tg.members[0].Fid.Close()
+	}
+	if refs := atomic.LoadInt32(m.refs); refs != 1 {
+		t.Errorf("a shouldn't be released while it is walked: %v refs", refs)
+	}
+	ns.done(s)
+	if refs := atomic.LoadInt32(m.refs); refs != 0 {
+		t.Errorf("a should be released after the walk: %v refs", refs)
+	}
+}
@@ -0,0 +1,88 @@
+package namespace
+
+import (
+	"9fans.net/go/plan9"
+	"errors"
+	"hash/fnv"
+	"path"
+)
+
+type (
+	// target is a path resolved in the namespace
+	target struct {
+		// path is the path of the file in the namespace
+		path string
+		// members has the fids of the path, in the union order
+		members []*Member
+		// node is true if the path is a node of the mount tree, it
+		// is a directory holding the mount points below it even
+		// when there are no members
+		node bool
+		// ctl is true for the ctl file of a forked namespace
+		ctl bool
+	}
+)
+
+var (
+	errSynthetic = errors.New("directory of mount points")
+)
+
+// synthQidBit marks the Qids of the synthetic directories
+const synthQidBit = 1 << 61
+
+// resolve finds the fids of p. The nodes of the mount tree without
+// mounts are synthetic directories, they use the directory at the
+// same path of a tree mounted above them, if there is one.
+func (ns *Namespace) resolve(p string) (*target, error) {
+	s := ns.acquire()
+	defer ns.done(s)
+	return s.mounts.resolve(p)
+}
+
+// mountPoints returns the entries of the mount points in the
+// directory p, the mount points without mounts or with a remote
+// mount that isn't connected are synthetic directories
+func (ns *Namespace) mountPoints(p string) []plan9.Dir {
+	s := ns.acquire()
+	defer ns.done(s)
+	node := s.mounts.find(split(p))
+	if node == nil {
+		return nil
+	}
+	var dirs []plan9.Dir
+	for _, c := range node.Childs {
+		var d *plan9.Dir
+		var err error
+		if len(c.Members) > 0 {
+			// listing a directory doesn't dial its remote mounts
+			if fid := c.Members[0].dialed(); fid != nil {
+				d, err = fid.Stat()
+			}
+		}
+		if d == nil || err != nil {
+			d = synthDir(path.Join(p, c.Name))
+		}
+		d.Name = c.Name
+		dirs = append(dirs, *d)
+	}
+	return dirs
+}
+
+// synthQid returns the Qid of the synthetic directory p
+func synthQid(p string) plan9.Qid {
+	h := fnv.New64a()
+	h.Write([]byte(path.Join("/", p)))
+	return plan9.Qid{Type: plan9.QTDIR, Path: h.Sum64()&(synthQidBit-1) | synthQidBit}
+}
+
+// synthDir returns the entry of the synthetic directory p
+func synthDir(p string) *plan9.Dir {
+	return &plan9.Dir{
+		Qid:  synthQid(p),
+		Mode: plan9.DMDIR | 0555,
+		Name: path.Base(path.Join("/", p)),
+		Uid:  "none",
+		Gid:  "none",
+		Muid: "none",
+	}
+}
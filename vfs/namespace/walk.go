@@ -0,0 +1,275 @@
+package namespace
+
+import (
+	"9fans.net/go/plan9"
+	"errors"
+	"path"
+	"strings"
+)
+
+type (
+	// walker is a walk in progress in the namespace, it moves one
+	// name at a time and crosses the mount points it finds
+	walker struct {
+		mounts *Tree
+		// withCtl makes CtlName at the root the ctl file
+		withCtl bool
+		// exact walks one name per message, the servers only return
+		// the Qid of the last name of a message
+		exact bool
+
+		path string
+		// members are the fids at path. They belong to the walker
+		// when owned is true, otherwise they are the members of a
+		// mount point or of the fid the walk started from, and
+		// they are cloned when the walk ends.
+		members []*Member
+		owned   bool
+		node    bool
+		ctl     bool
+	}
+)
+
+var (
+	errNotFound = errors.New("file not found")
+	errNotDir   = errors.New("not a directory")
+	errBadName  = errors.New("invalid file name")
+)
+
+// walk walks names from t like a 9P walk. qids has the Qids of the
+// names walked, when the walk stops before the last name nt is nil
+// and err tells why. withCtl makes CtlName at the root the ctl file.
+// The fids of t are still owned by the caller.
+func (ns *Namespace) walk(t *target, names []string, withCtl bool) (qids []plan9.Qid, nt *target, err error) {
+	s := ns.acquire()
+	defer ns.done(s)
+	w := &walker{
+		mounts:  s.mounts,
+		withCtl: withCtl,
+		exact:   true,
+		path:    t.path,
+		members: t.members,
+		node:    t.node,
+		ctl:     t.ctl,
+	}
+	if s.mounts.find(split(t.path)) != nil {
+		// the mounts at a node may have changed since t was
+		// resolved, the walk starts from the current ones
+		rw := s.mounts.walkRoot()
+		rw.withCtl, rw.exact = withCtl, true
+		if _, err := rw.walk(split(t.path)); err == nil {
+			w = rw
+		} else {
+			rw.release()
+		}
+	}
+	if qids, err = w.walk(names); err != nil {
+		w.release()
+		return qids, nil, err
+	}
+	if nt, err = w.target(); err != nil {
+		return nil, nil, err
+	}
+	return qids, nt, nil
+}
+
+// resolve finds the fids of p in t. The path is clean, so .. is taken
+// from the names before it.
+func (t *Tree) resolve(p string) (*target, error) {
+	w := t.walkRoot()
+	if _, err := w.walk(split(p)); err != nil {
+		w.release()
+		return nil, err
+	}
+	return w.target()
+}
+
+// walkRoot returns a walker at the root of t
+func (t *Tree) walkRoot() *walker {
+	return &walker{mounts: t, path: "/", members: t.Members, node: true}
+}
+
+// walk moves w along names and returns the Qids of the names walked,
+// it stops at the first name that can't be walked
+func (w *walker) walk(names []string) ([]plan9.Qid, error) {
+	var qids []plan9.Qid
+	// single is set when a run of names failed, the names are
+	// walked one at a time to find the one missing
+	single := false
+	for i := 0; i < len(names); {
+		if dir, err := w.isDir(); err != nil {
+			return qids, err
+		} else if !dir {
+			return qids, errNotDir
+		}
+		n := 1
+		var err error
+		switch name := names[i]; {
+		case name == "..":
+			err = w.parent()
+		case w.withCtl && w.path == "/" && name == CtlName:
+			w.release()
+			w.path, w.members, w.owned, w.node, w.ctl = "/"+CtlName, nil, true, false, true
+		case !validName(name):
+			err = errBadName
+		default:
+			if !single && !w.exact {
+				n = w.span(names[i:])
+			}
+			if err = w.down(names[i : i+n]); err != nil && n > 1 {
+				single = true
+				continue
+			}
+		}
+		if err != nil {
+			return qids, err
+		}
+		q, err := w.qid()
+		if err != nil {
+			return qids, err
+		}
+		// the Qids in the middle of a run aren't known, the
+		// exact walks have runs of one name
+		for j := 1; j < n; j++ {
+			qids = append(qids, plan9.Qid{})
+		}
+		qids = append(qids, q)
+		i += n
+	}
+	return qids, nil
+}
+
+// span returns how many of names can be walked at once: the names
+// below a single member that don't reach a node of the mount tree,
+// at most MAXWELEM of them, so the server walks them in one message
+func (w *walker) span(names []string) int {
+	if len(w.members) != 1 {
+		return 1
+	}
+	for n := 0; n < len(names) && n < plan9.MAXWELEM; n++ {
+		if !validName(names[n]) || w.mounts.find(split(path.Join(w.path, path.Join(names[:n+1]...)))) != nil {
+			if n == 0 {
+				return 1
+			}
+			return n
+		}
+	}
+	if len(names) < plan9.MAXWELEM {
+		return len(names)
+	}
+	return plan9.MAXWELEM
+}
+
+// down walks names from w. A name that is a mount point moves w to
+// the members mounted there, the others are walked in the first
+// member that has them. A node of the mount tree that no member has
+// is a synthetic directory.
+func (w *walker) down(names []string) error {
+	p := path.Join(w.path, path.Join(names...))
+	node := w.mounts.find(split(p))
+	if node != nil && len(node.Members) > 0 {
+		w.release()
+		w.path, w.members, w.owned, w.node = p, node.Members, false, true
+		return nil
+	}
+	err := errNotFound
+	for _, m := range w.members {
+		nm, werr := w.walkMember(m, names)
+		if werr != nil {
+			err = werr
+			continue
+		}
+		w.release()
+		// files can be created anywhere below the mount point
+		nm.Flag = MCREATE
+		w.path, w.members, w.owned, w.node = p, []*Member{nm}, true, node != nil
+		return nil
+	}
+	if node == nil {
+		return err
+	}
+	w.release()
+	w.path, w.members, w.owned, w.node = p, nil, true, true
+	return nil
+}
+
+// walkMember walks names from m, the fids owned by w aren't open so
+// they are walked without a clone
+func (w *walker) walkMember(m *Member, names []string) (*Member, error) {
+	if !w.owned {
+		return m.walk(names)
+	}
+	fid, err := m.Fid.Walk(strings.Join(names, "/"))
+	if err != nil {
+		return nil, err
+	}
+	return &Member{Fid: fid, Flag: m.Flag, iounit: m.iounit, conn: m.conn}, nil
+}
+
+// parent moves w to the parent of its path, crossing back the mount
+// points like Plan 9 does
+func (w *walker) parent() error {
+	pw := w.mounts.walkRoot()
+	pw.withCtl = w.withCtl
+	if _, err := pw.walk(split(path.Dir(w.path))); err != nil {
+		pw.release()
+		return err
+	}
+	w.release()
+	*w = *pw
+	return nil
+}
+
+func (w *walker) qid() (plan9.Qid, error) {
+	switch {
+	case w.ctl:
+		return plan9.Qid{Path: ctlQid}, nil
+	case len(w.members) == 0:
+		return synthQid(w.path), nil
+	}
+	fid, err := w.members[0].fid()
+	if err != nil {
+		return plan9.Qid{}, err
+	}
+	return fid.Qid(), nil
+}
+
+func (w *walker) isDir() (bool, error) {
+	q, err := w.qid()
+	return q.Type&plan9.QTDIR != 0, err
+}
+
+// release closes the fids owned by w
+func (w *walker) release() {
+	if w.owned {
+		for _, m := range w.members {
+			m.Fid.Close()
+		}
+	}
+	w.members = nil
+}
+
+// target returns the file reached by w, the members not owned by w
+// are cloned
+func (w *walker) target() (*target, error) {
+	t := &target{path: w.path, node: w.node, ctl: w.ctl}
+	if w.owned {
+		t.members = w.members
+		return t, nil
+	}
+	for _, m := range w.members {
+		nm, err := m.walk(nil)
+		if err != nil {
+			for _, m := range t.members {
+				m.Fid.Close()
+			}
+			return nil, err
+		}
+		t.members = append(t.members, nm)
+	}
+	return t, nil
+}
+
+func validName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.Contains(name, "/")
+}
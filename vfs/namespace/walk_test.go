@@ -0,0 +1,154 @@
+package namespace
+
+import (
+	"9fans.net/go/plan9"
+	"amoraes.info/ded/vfs"
+	"amoraes.info/ded/vfs/memlistener"
+	"net"
+	"strings"
+	"testing"
+)
+
+// rawConn speaks 9P to an Export without the client package, which
+// hides the partial walks
+type rawConn struct {
+	t    *testing.T
+	conn net.Conn
+	tag  uint16
+}
+
+func rawAttach(t *testing.T, fs *Export) *rawConn {
+	l := memlistener.New("walk")
+	srv, err := vfs.NewServer(vfs.NewFileserver(fs), l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { srv.Close() })
+	conn, err := memlistener.Connect(l, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	c := &rawConn{t: t, conn: conn}
+	c.rpc(&plan9.Fcall{Type: plan9.Tversion, Tag: plan9.NOTAG, Msize: 8192, Version: "9P2000"})
+	if rx := c.rpc(&plan9.Fcall{Type: plan9.Tattach, Fid: 0, Afid: plan9.NOFID, Uname: "glenda"}); rx.Type == plan9.Rerror {
+		t.Fatal(rx.Ename)
+	}
+	return c
+}
+
+func (c *rawConn) rpc(tx *plan9.Fcall) *plan9.Fcall {
+	c.t.Helper()
+	if tx.Type != plan9.Tversion {
+		c.tag++
+		tx.Tag = c.tag
+	}
+	if err := plan9.WriteFcall(c.conn, tx); err != nil {
+		c.t.Fatal(err)
+	}
+	rx, err := plan9.ReadFcall(c.conn)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return rx
+}
+
+func TestWalkNames(t *testing.T) {
+	// deep has MAXWELEM-1 nested directories named d
+	var deep, dirs []string
+	for i := 0; i < plan9.MAXWELEM; i++ {
+		deep = append(deep, "d")
+		if i > 0 {
+			dirs = append(dirs, strings.Join(deep[:i], "/")+"/")
+		}
+	}
+	ns := &Namespace{}
+	if err := ns.Mount("b", "a", newTree(t, "b", "x/", "x/f")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ns.Mount("c", "", newTree(t, "c", "y")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ns.Mount("deep", "", newTree(t, "deep", dirs...)); err != nil {
+		t.Fatal(err)
+	}
+	c := rawAttach(t, NewExport(ns))
+
+	newfid := uint32(0)
+	walk := func(names ...string) *plan9.Fcall {
+		t.Helper()
+		newfid++
+		return c.rpc(&plan9.Fcall{Type: plan9.Twalk, Fid: 0, Newfid: newfid, Wname: names})
+	}
+	exists := func(fid uint32) bool {
+		rx := c.rpc(&plan9.Fcall{Type: plan9.Tclunk, Fid: fid})
+		return rx.Type == plan9.Rclunk
+	}
+
+	// .. goes back through the mount points
+	rx := walk("a", "b", "x", "..", "..", "..", "c", "y")
+	if rx.Type != plan9.Rwalk || len(rx.Wqid) != 8 || rx.Wqid[7].Type&plan9.QTDIR != 0 {
+		t.Errorf("Unexpected walk %v", rx)
+	}
+	if !exists(newfid) {
+		t.Errorf("The walk should create newfid")
+	}
+	if rx := walk("c", "..", "a"); rx.Type != plan9.Rwalk || len(rx.Wqid) != 3 || rx.Wqid[2] != synthQid("/a") {
+		t.Errorf("Unexpected walk %v", rx)
+	}
+
+	// partial walks list the names walked and don't create newfid
+	for _, w := range []struct {
+		names []string
+		qids  int
+	}{
+		{[]string{"a", "b", "missing", "x"}, 2},
+		{[]string{"a", "b", "x", "f", ".."}, 4},
+		{[]string{"a", "b", "x", "f", "g"}, 4},
+		{[]string{"deep", "d", "d", "d", "d", "d", "missing", "d"}, 6},
+	} {
+		rx := walk(w.names...)
+		if rx.Type != plan9.Rwalk || len(rx.Wqid) != w.qids {
+			t.Errorf("%v: expecting %v qids got %v", w.names, w.qids, rx)
+		}
+		if exists(newfid) {
+			t.Errorf("%v: partial walks shouldn't create newfid", w.names)
+		}
+	}
+	if rx := walk("missing"); rx.Type != plan9.Rerror {
+		t.Errorf("Expecting an error got %v", rx)
+	}
+	if rx := walk("a", "."); rx.Type != plan9.Rwalk || len(rx.Wqid) != 1 {
+		t.Errorf("Expecting the walk to stop at the invalid name got %v", rx)
+	}
+
+	// the names below a mount point are walked together
+	rx = walk(append([]string{"deep"}, deep[:plan9.MAXWELEM-1]...)...)
+	if rx.Type != plan9.Rwalk || len(rx.Wqid) != plan9.MAXWELEM || rx.Wqid[plan9.MAXWELEM-1].Type&plan9.QTDIR == 0 {
+		t.Errorf("Unexpected long walk %v", rx)
+	}
+	if fid, err := ns.Walk("deep/" + strings.Repeat("d/", plan9.MAXWELEM-1) + "../d"); err != nil {
+		t.Errorf("Namespace.Walk should walk long paths: %v", err)
+	} else {
+		fid.Close()
+	}
+}
+
+func TestWalkSameFid(t *testing.T) {
+	ns := &Namespace{}
+	if err := ns.Mount("a", "", newTree(t, "a", "x")); err != nil {
+		t.Fatal(err)
+	}
+	c := rawAttach(t, NewExport(ns))
+	c.rpc(&plan9.Fcall{Type: plan9.Twalk, Fid: 0, Newfid: 1, Wname: []string{"a", "x"}})
+	if rx := c.rpc(&plan9.Fcall{Type: plan9.Topen, Fid: 1, Mode: plan9.OREAD}); rx.Type != plan9.Ropen {
+		t.Fatalf("Unexpected open %v", rx)
+	}
+	// a walk without names to the same fid leaves it open
+	if rx := c.rpc(&plan9.Fcall{Type: plan9.Twalk, Fid: 1, Newfid: 1}); rx.Type != plan9.Rwalk {
+		t.Errorf("Unexpected walk %v", rx)
+	}
+	if rx := c.rpc(&plan9.Fcall{Type: plan9.Tread, Fid: 1, Count: 10}); rx.Type != plan9.Rread || string(rx.Data) != "a" {
+		t.Errorf("Unexpected read %v", rx)
+	}
+}
@@ -2,10 +2,13 @@ package vfs
 
 import (
 	"9fans.net/go/plan9"
+	"crypto/tls"
+	"errors"
 	log "github.com/Sirupsen/logrus"
 	"io"
 	"net"
 	"runtime"
+	"sync"
 )
 
 type (
@@ -20,10 +23,10 @@ type (
 		closeCh chan signal
 		newconn chan net.Conn
 		errors  chan error
-	}
+		done    chan signal
 
-	Context struct {
-		data map[interface{}]interface{}
+		recMu    sync.Mutex
+		recorder *Recorder
 	}
 
 	RPC interface {
@@ -33,6 +36,9 @@ type (
 
 	Fileserver struct {
 		ServerFS
+
+		// handler is the middleware chain built by NewFileserver
+		handler Handler
 	}
 
 	ServerFS interface {
@@ -50,7 +56,13 @@ type (
 		Wstat(*plan9.Fcall, *Context) *plan9.Fcall
 		Walk(*plan9.Fcall, *Context) *plan9.Fcall
 
-		ValidFid(*plan9.Fcall, *Context) bool
+		// ValidFid checks if the fids used by the request are valid,
+		// requests with invalid fids are answered with the error
+		// without calling the handler.
+		ValidFid(*plan9.Fcall, *Context) error
+		// UpdateFid is called after the request is answered to
+		// track the state of the fids.
+		UpdateFid(tx, rx *plan9.Fcall, ctx *Context)
 		ReleaseContext(*Context) error
 	}
 )
@@ -70,15 +82,42 @@ func NewTCPServer(fs RPC, bindAddr string) (*Server, error) {
 	s := &Server{
 		listener: lst,
 		fs:       fs,
-		closeCh:  make(chan signal, 1),
+		closeCh:  make(chan signal),
 		newconn:  make(chan net.Conn, 0),
 		errors:   make(chan error, 1),
+		done:     make(chan signal),
 	}
 	go s.serve()
 	return s, nil
 }
 
+// NewTLSServer works like NewTCPServer but every connection is protected
+// by TLS using cfg.
+//
+// When cfg requires client certificates, the CommonName of the certificate
+// is used as the uname of the connection, overriding the one sent by the client.
+func NewTLSServer(fs RPC, bindAddr string, cfg *tls.Config) (*Server, error) {
+	log.WithFields(log.Fields{
+		"addr": bindAddr,
+		"fs":   fs,
+	}).Infof("Starting TLS server")
+	lst, err := tls.Listen("tcp", bindAddr, cfg)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Errorf("Unable to start TLS server")
+		return nil, err
+	}
+	return NewServer(fs, lst)
+}
+
 func NewServer(fs RPC, listener net.Listener) (*Server, error) {
+	return NewRecordedServer(fs, listener, nil)
+}
+
+// NewRecordedServer works like NewServer but the messages of every
+// connection are written to rec, starting with the first one.
+func NewRecordedServer(fs RPC, listener net.Listener, rec *Recorder) (*Server, error) {
 	log.WithFields(log.Fields{
 		"listener": listener,
 		"fs":       fs,
@@ -86,9 +125,11 @@ func NewServer(fs RPC, listener net.Listener) (*Server, error) {
 	s := &Server{
 		listener: listener,
 		fs:       fs,
-		closeCh:  make(chan signal, 1),
+		closeCh:  make(chan signal),
 		newconn:  make(chan net.Conn, 0),
 		errors:   make(chan error, 1),
+		done:     make(chan signal),
+		recorder: rec,
 	}
 	go s.serve()
 	return s, nil
@@ -98,9 +139,27 @@ func (s *Server) accept() {
 	for {
 		conn, err := s.listener.Accept()
 		if err != nil {
-			s.errors <- err
+			s.report(err)
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return
 		}
-		s.newconn <- conn
+		select {
+		case s.newconn <- conn:
+		case <-s.done:
+			conn.Close()
+			return
+		}
+	}
+}
+
+// report sends err to the server loop, errors after the server
+// is closed are discarded.
+func (s *Server) report(err error) {
+	select {
+	case s.errors <- err:
+	case <-s.done:
 	}
 }
 
@@ -111,11 +170,9 @@ LOOP:
 		select {
 		case sig := <-s.closeCh:
 			// TODO(andre): cleanup stuff before returning
+			close(s.done)
 			sig.err <- s.listener.Close()
 			close(sig.err)
-			s.closeCh = nil
-			s.newconn = nil
-			s.errors = nil
 			break LOOP
 		case conn := <-s.newconn:
 			go s.serveConn(conn)
@@ -137,65 +194,171 @@ func (s *Server) serveConn(conn net.Conn) {
 		"module": "vfs.Server",
 	}).Infof("New client connected")
 	runtime.LockOSThread()
-	ctx := NewContext()
+	addr := conn.RemoteAddr()
+	ctx := newContext(addr)
+	rec := s.Recorder()
+	var connID uint64
+	if rec != nil {
+		connID = rec.newConn(addr.String())
+		defer rec.endConn(connID)
+	}
+	var certName string
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if err := tlsConn.Handshake(); err != nil {
+			log.WithFields(log.Fields{
+				"client": addr,
+				"module": "vfs.Server",
+				"err":    err,
+			}).Errorf("TLS handshake failed")
+			s.report(conn.Close())
+			return
+		}
+		certName = peerName(tlsConn)
+		ctx.setCertUname(certName)
+	}
+
+	// requests are handled concurrently, so a blocking request
+	// doesn't prevent the client from sending a Tflush.
+	var wlock sync.Mutex
+	var pending sync.WaitGroup
+	reply := func(fc *plan9.Fcall) {
+		log.WithFields(log.Fields{
+			"client": addr.String(),
+		}).Debugf("<< %v", fc)
+
+		if fc == nil {
+			return
+		}
+		wlock.Lock()
+		if rec != nil {
+			// recorded with the lock to keep the order of the wire
+			rec.message(connID, EventReply, fc)
+		}
+		defer wlock.Unlock()
+		if err := plan9.WriteFcall(conn, fc); err != nil {
+			log.WithFields(log.Fields{
+				"client": addr.String(),
+				"err":    err,
+			}).Debugf("Unable to send reply")
+		}
+	}
+
 	for {
-		addr := conn.RemoteAddr()
 		fc, err := plan9.ReadFcall(conn)
 		if err != nil {
 			if err != io.EOF {
-				s.errors <- err
+				s.report(err)
 			} else {
 				log.WithFields(log.Fields{
 					"client": addr,
 				}).Infof("Connection closed")
 			}
+			// abort everything that is still running before
+			// releasing the fids
+			ctx.close()
+			pending.Wait()
 			if err := s.fs.ReleaseContext(ctx); err != nil {
-				s.errors <- err
+				s.report(err)
 			}
 
-			s.errors <- conn.Close()
+			s.report(conn.Close())
 			break
 		}
 		log.WithFields(log.Fields{
 			"client": addr.String(),
 		}).Debugf(">> %v", fc)
+		if (fc.Type == plan9.Tauth || fc.Type == plan9.Tattach) && certName != "" {
+			// the certificate identifies the user, not the client
+			fc.Uname = certName
+		}
+		if rec != nil {
+			// recorded as served, a replay needs no certificate
+			rec.message(connID, EventRequest, fc)
+		}
 
-		fc = s.fs.Call(fc, ctx)
-
-		log.WithFields(log.Fields{
-			"client": addr.String(),
-		}).Debugf("<< %v", fc)
-
-		if fc == nil {
+		switch fc.Type {
+		case plan9.Tversion:
+			// a new session aborts all outstanding requests
+			ctx.flushAll()
+			pending.Wait()
+			reply(s.fs.Call(fc, ctx))
+			continue
+		case plan9.Tflush:
+			// answer only after the flushed request is answered
+			done := ctx.flush(fc.Oldtag)
+			pending.Add(1)
+			go func(fc *plan9.Fcall) {
+				defer pending.Done()
+				<-done
+				reply(s.fs.Call(fc, ctx))
+			}(fc)
 			continue
 		}
-		plan9.WriteFcall(conn, fc)
 
+		req, done := ctx.request(fc.Tag)
+		pending.Add(1)
+		go func(fc *plan9.Fcall) {
+			defer pending.Done()
+			defer done()
+			reply(s.fs.Call(fc, req))
+		}(fc)
 	}
 }
 
+// SetRecorder makes the server write every message of new connections
+// to rec, a nil rec stops the recording.
+func (s *Server) SetRecorder(rec *Recorder) {
+	s.recMu.Lock()
+	defer s.recMu.Unlock()
+	s.recorder = rec
+}
+
+// Recorder returns the recorder used by new connections
+func (s *Server) Recorder() *Recorder {
+	s.recMu.Lock()
+	defer s.recMu.Unlock()
+	return s.recorder
+}
+
 func (s *Server) Close() error {
-	err := make(chan error)
+	err := make(chan error, 1)
 	select {
 	case s.closeCh <- signal{err: err}:
-	default:
+		return <-err
+	case <-s.done:
+		return errors.New("server already closed")
 	}
-	return <-err
 }
 
 func (fs *Fileserver) Call(fc *plan9.Fcall, ctx *Context) *plan9.Fcall {
-	switch fc.Type {
-	case plan9.Tclunk, plan9.Tflush, plan9.Twrite, plan9.Tremove,
-		plan9.Tread, plan9.Tstat, plan9.Twstat, plan9.Twalk:
-		if !fs.ValidFid(fc, ctx) {
-			PackError(fc, ErrInvalidFid)
-		}
+	if fs.handler != nil {
+		return fs.handler(fc, ctx)
+	}
+	return fs.dispatch(fc, ctx)
+}
+
+// dispatch sends fc to the ServerFS method that handles it
+func (fs *Fileserver) dispatch(fc *plan9.Fcall, ctx *Context) *plan9.Fcall {
+	if err := fs.ValidFid(fc, ctx); err != nil {
+		ret := *fc
+		return PackError(&ret, err)
 	}
+	tx, replied := fc, false
+	defer func() {
+		if !replied {
+			// the handler panicked, there is no reply
+			fc = nil
+		}
+		fs.UpdateFid(tx, fc, ctx)
+	}()
 	switch fc.Type {
 	case plan9.Tversion:
 		fc = fs.Version(fc, ctx)
 	case plan9.Tattach:
 		fc = fs.Attach(fc, ctx)
+		if fc != nil && fc.Type == plan9.Rattach {
+			ctx.setAttach(tx.Uname, tx.Aname)
+		}
 	case plan9.Tclunk:
 		fc = fs.Clunk(fc, ctx)
 	case plan9.Tflush:
@@ -214,15 +377,15 @@ func (fs *Fileserver) Call(fc *plan9.Fcall, ctx *Context) *plan9.Fcall {
 		fc = fs.Stat(fc, ctx)
 	case plan9.Twstat:
 		fc = fs.Wstat(fc, ctx)
+	case plan9.Tauth:
+		fc = fs.Auth(fc, ctx)
 	case plan9.Twalk:
 		fc = fs.Walk(fc, ctx)
+	default:
+		ret := *fc
+		fc = PackError(&ret, ErrInvalidMessage)
 	}
 
+	replied = true
 	return fc
 }
-
-func NewContext() *Context {
-	return &Context{
-		data: make(map[interface{}]interface{}),
-	}
-}
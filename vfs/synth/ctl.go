@@ -0,0 +1,124 @@
+// Package synth has the kinds of files used by synthetic servers,
+// like the ctl and event files of acme.
+//
+// Every kind is a vfs.HasContent, so they can be served by
+// filetree.FS or used by any other vfs.ServerFS.
+package synth
+
+import (
+	"amoraes.info/ded/vfs"
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/flynn/go-shlex"
+	"sort"
+	"strings"
+	"sync"
+)
+
+type (
+	// Ctl is a file that runs a command for every line written to it,
+	// reading it returns the name of the commands.
+	Ctl struct {
+		mu       sync.Mutex
+		handlers map[string]CtlHandler
+	}
+
+	// CtlHandler runs a command, args holds the arguments after the
+	// name of the command.
+	CtlHandler func(args []string) error
+
+	ctlFd struct {
+		ctl  *Ctl
+		help *bytes.Reader
+	}
+)
+
+var (
+	ErrUnknownCommand = errors.New("unknown command")
+)
+
+func NewCtl() *Ctl {
+	return &Ctl{handlers: make(map[string]CtlHandler)}
+}
+
+// Handle makes c run h for the lines starting with name
+func (c *Ctl) Handle(name string, h CtlHandler) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.handlers[name] = h
+}
+
+// Run parses line like a shell would and runs the command,
+// empty lines are ignored.
+func (c *Ctl) Run(line string) error {
+	args, err := shlex.Split(line)
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		return nil
+	}
+	c.mu.Lock()
+	h, ok := c.handlers[args[0]]
+	c.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("%v: %v", ErrUnknownCommand, args[0])
+	}
+	return h(args[1:])
+}
+
+// commands returns the name of the commands, one per line
+func (c *Ctl) commands() []byte {
+	c.mu.Lock()
+	var names []string
+	for k := range c.handlers {
+		names = append(names, k)
+	}
+	c.mu.Unlock()
+	sort.Strings(names)
+	var buf bytes.Buffer
+	for _, n := range names {
+		fmt.Fprintln(&buf, n)
+	}
+	return buf.Bytes()
+}
+
+func (c *Ctl) Open(mode int, perm int) (vfs.FileContents, error) {
+	return &ctlFd{ctl: c, help: bytes.NewReader(c.commands())}, nil
+}
+
+func (c *Ctl) Size() (uint64, error) {
+	return 0, nil
+}
+
+func (c *Ctl) Close() error {
+	return nil
+}
+
+func (fd *ctlFd) Read(b []byte) (int, error) {
+	return fd.help.Read(b)
+}
+
+// Write runs every line of b, a write must hold complete lines.
+// The commands after the first failure aren't executed.
+func (fd *ctlFd) Write(b []byte) (int, error) {
+	for _, line := range strings.Split(string(b), "\n") {
+		if err := fd.ctl.Run(line); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+func (fd *ctlFd) Seek(off int64, sp vfs.SeekPoint) (int64, error) {
+	return fd.help.Seek(off, int(sp))
+}
+
+func (fd *ctlFd) Sync() error {
+	return nil
+}
+
+func (fd *ctlFd) Close() error {
+	return nil
+}
@@ -0,0 +1,217 @@
+package synth
+
+import (
+	"amoraes.info/ded/vfs"
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+type (
+	// Log is an append-only file, writes are added to the end
+	// whatever the offset and reads at the end wait for more data,
+	// like tail -f.
+	//
+	// Every open reads the log from the oldest data kept. The file
+	// serving a Log should have the plan9.DMAPPEND bit in its mode.
+	Log struct {
+		mu sync.Mutex
+		// chunks holds the data kept, one chunk per write
+		chunks []logChunk
+		// base is the position of the first byte kept, counting
+		// from the first write
+		base uint64
+		size uint64
+
+		// maxSize and maxAge are the retention limits, 0 means no limit
+		maxSize uint64
+		maxAge  time.Duration
+
+		// wake is closed when data is written
+		wake   chan struct{}
+		closed bool
+	}
+
+	logChunk struct {
+		at   time.Time
+		data []byte
+	}
+
+	logFd struct {
+		l *Log
+		// pos is the position of the next byte read
+		pos    uint64
+		closed bool
+	}
+)
+
+var (
+	ErrLogClosed = errors.New("log closed")
+)
+
+// NewLog returns a Log that keeps at most maxSize bytes written in
+// the last maxAge, a zero limit isn't enforced.
+func NewLog(maxSize uint64, maxAge time.Duration) *Log {
+	return &Log{
+		maxSize: maxSize,
+		maxAge:  maxAge,
+		wake:    make(chan struct{}),
+	}
+}
+
+// Append adds data to the end of l
+func (l *Log) Append(data []byte) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return ErrLogClosed
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	l.chunks = append(l.chunks, logChunk{at: time.Now(), data: append([]byte(nil), data...)})
+	l.size += uint64(len(data))
+	l.trim()
+	l.broadcast()
+	return nil
+}
+
+// broadcast wakes every pending read, l.mu must be held
+func (l *Log) broadcast() {
+	close(l.wake)
+	l.wake = make(chan struct{})
+}
+
+// trim drops the data outside the retention limits, l.mu must be held
+func (l *Log) trim() {
+	for len(l.chunks) > 0 {
+		c := &l.chunks[0]
+		switch {
+		case l.maxAge > 0 && time.Since(c.at) > l.maxAge:
+		case l.maxSize > 0 && l.size-uint64(len(c.data)) >= l.maxSize:
+		case l.maxSize > 0 && l.size > l.maxSize:
+			// keep only the end of the oldest chunk
+			cut := l.size - l.maxSize
+			c.data = c.data[cut:]
+			l.size -= cut
+			l.base += cut
+			return
+		default:
+			return
+		}
+		l.size -= uint64(len(c.data))
+		l.base += uint64(len(c.data))
+		l.chunks = l.chunks[1:]
+	}
+}
+
+func (l *Log) Open(mode int, perm int) (vfs.FileContents, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.trim()
+	return &logFd{l: l, pos: l.base}, nil
+}
+
+// Size returns the number of bytes kept
+func (l *Log) Size() (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.trim()
+	return l.size, nil
+}
+
+// Close ends the log, pending and future reads return io.EOF after
+// reading the data kept.
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.closed {
+		l.closed = true
+		close(l.wake)
+	}
+	return nil
+}
+
+func (fd *logFd) Read(b []byte) (int, error) {
+	return fd.ReadContext(context.Background(), b)
+}
+
+// ReadContext copies the data after the last read to b, if there
+// is no data it waits for a write.
+func (fd *logFd) ReadContext(ctx context.Context, b []byte) (int, error) {
+	l := fd.l
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for {
+		l.trim()
+		if fd.pos < l.base {
+			// the data was dropped before this reader got it
+			fd.pos = l.base
+		}
+		if fd.closed {
+			return 0, io.EOF
+		}
+		if fd.pos < l.base+l.size {
+			break
+		}
+		if l.closed {
+			return 0, io.EOF
+		}
+		wake := l.wake
+		l.mu.Unlock()
+		select {
+		case <-wake:
+		case <-ctx.Done():
+			l.mu.Lock()
+			return 0, ctx.Err()
+		}
+		l.mu.Lock()
+	}
+
+	n := 0
+	start := l.base
+	for _, c := range l.chunks {
+		end := start + uint64(len(c.data))
+		if fd.pos < end && n < len(b) {
+			m := copy(b[n:], c.data[fd.pos-start:])
+			n += m
+			fd.pos += uint64(m)
+		}
+		start = end
+	}
+	return n, nil
+}
+
+// Write appends b to the log, the offset is ignored
+func (fd *logFd) Write(b []byte) (int, error) {
+	if err := fd.l.Append(b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Seek is a no-op, reads continue from the previous read
+func (fd *logFd) Seek(off int64, sp vfs.SeekPoint) (int64, error) {
+	return 0, nil
+}
+
+func (fd *logFd) Sync() error {
+	return nil
+}
+
+// Close ends the pending read of fd
+func (fd *logFd) Close() error {
+	l := fd.l
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if fd.closed {
+		return nil
+	}
+	fd.closed = true
+	if !l.closed {
+		l.broadcast()
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+package synth
+
+import (
+	"amoraes.info/ded/vfs"
+	"context"
+	"io"
+	"sync"
+)
+
+type (
+	// Queue is a read-only file that sends events to its readers.
+	//
+	// Every open has its own cursor and receives the events posted
+	// after the open. Reads wait until an event is posted, the open
+	// is closed or the request is flushed.
+	Queue struct {
+		mu sync.Mutex
+		// events holds the events not read by every reader, the
+		// first one has the sequence number first
+		events [][]byte
+		first  uint64
+		// max is the number of events kept for slow readers
+		max     int
+		readers map[*queueFd]struct{}
+		// wake is closed when an event is posted
+		wake   chan struct{}
+		closed bool
+	}
+
+	queueFd struct {
+		q *Queue
+		// next is the sequence number of the event being read,
+		// and off the number of bytes of it already read
+		next   uint64
+		off    int
+		closed bool
+	}
+)
+
+// NewQueue returns a Queue that keeps at most max events for
+// readers that fall behind, the older events are dropped.
+func NewQueue(max int) *Queue {
+	if max < 1 {
+		max = 1
+	}
+	return &Queue{
+		max:     max,
+		readers: make(map[*queueFd]struct{}),
+		wake:    make(chan struct{}),
+	}
+}
+
+// Post sends a copy of ev to every reader
+func (q *Queue) Post(ev []byte) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed || len(q.readers) == 0 {
+		return
+	}
+	q.events = append(q.events, append([]byte(nil), ev...))
+	if len(q.events) > q.max {
+		q.first += uint64(len(q.events) - q.max)
+		q.events = q.events[len(q.events)-q.max:]
+	}
+	close(q.wake)
+	q.wake = make(chan struct{})
+}
+
+// trim drops the events already read by every reader
+func (q *Queue) trim() {
+	min := q.first + uint64(len(q.events))
+	for r := range q.readers {
+		if r.next < min {
+			min = r.next
+		}
+	}
+	if n := int(min - q.first); n > 0 {
+		q.events = q.events[n:]
+		q.first = min
+	}
+}
+
+func (q *Queue) Open(mode int, perm int) (vfs.FileContents, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	fd := &queueFd{q: q, next: q.first + uint64(len(q.events)), closed: q.closed}
+	q.readers[fd] = struct{}{}
+	return fd, nil
+}
+
+func (q *Queue) Size() (uint64, error) {
+	return 0, nil
+}
+
+// Close ends the queue, pending and future reads return io.EOF
+func (q *Queue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.closed {
+		q.closed = true
+		close(q.wake)
+	}
+	return nil
+}
+
+func (fd *queueFd) Read(b []byte) (int, error) {
+	return fd.ReadContext(context.Background(), b)
+}
+
+// ReadContext waits for an event and copies as many events as fit
+// in b, an event bigger than b is returned by many reads.
+func (fd *queueFd) ReadContext(ctx context.Context, b []byte) (int, error) {
+	q := fd.q
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for {
+		if fd.closed || q.closed {
+			return 0, io.EOF
+		}
+		if fd.next < q.first {
+			// the events were dropped before this reader got them
+			fd.next = q.first
+			fd.off = 0
+		}
+		if fd.next < q.first+uint64(len(q.events)) {
+			break
+		}
+		wake := q.wake
+		q.mu.Unlock()
+		select {
+		case <-wake:
+		case <-ctx.Done():
+			q.mu.Lock()
+			return 0, ctx.Err()
+		}
+		q.mu.Lock()
+	}
+
+	n := 0
+	for n < len(b) && fd.next < q.first+uint64(len(q.events)) {
+		ev := q.events[fd.next-q.first]
+		c := copy(b[n:], ev[fd.off:])
+		n += c
+		fd.off += c
+		if fd.off == len(ev) {
+			fd.next++
+			fd.off = 0
+		}
+	}
+	q.trim()
+	return n, nil
+}
+
+func (fd *queueFd) Write(b []byte) (int, error) {
+	return 0, vfs.ErrReadOnly
+}
+
+// Seek is a no-op, reads always return the next event
+func (fd *queueFd) Seek(off int64, sp vfs.SeekPoint) (int64, error) {
+	return 0, nil
+}
+
+func (fd *queueFd) Sync() error {
+	return nil
+}
+
+// Close removes the reader from the queue, a pending read returns io.EOF
+func (fd *queueFd) Close() error {
+	q := fd.q
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if fd.closed {
+		return nil
+	}
+	fd.closed = true
+	delete(q.readers, fd)
+	q.trim()
+	if !q.closed {
+		// wake the pending reads of fd, the other readers go back to sleep
+		close(q.wake)
+		q.wake = make(chan struct{})
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package synth
+
+import (
+	"amoraes.info/ded/vfs"
+	"io"
+)
+
+type (
+	// Snapshot is a read-only file with contents generated by a
+	// function. The contents are generated by the first read of
+	// each open and by every read at offset 0, so a client reading
+	// the file sequentially sees a consistent copy.
+	Snapshot struct {
+		gen func() ([]byte, error)
+	}
+
+	snapshotFd struct {
+		s    *Snapshot
+		data []byte
+		cur  int64
+		// fresh is false until the contents are generated
+		fresh bool
+	}
+)
+
+func NewSnapshot(gen func() ([]byte, error)) *Snapshot {
+	return &Snapshot{gen: gen}
+}
+
+func (s *Snapshot) Open(mode int, perm int) (vfs.FileContents, error) {
+	return &snapshotFd{s: s}, nil
+}
+
+// Size returns 0, the size is only known after the contents are generated
+func (s *Snapshot) Size() (uint64, error) {
+	return 0, nil
+}
+
+func (s *Snapshot) Close() error {
+	return nil
+}
+
+func (fd *snapshotFd) Read(b []byte) (int, error) {
+	if !fd.fresh || fd.cur == 0 {
+		data, err := fd.s.gen()
+		if err != nil {
+			return 0, err
+		}
+		fd.data = data
+		fd.fresh = true
+	}
+	if fd.cur >= int64(len(fd.data)) {
+		return 0, io.EOF
+	}
+	n := copy(b, fd.data[fd.cur:])
+	fd.cur += int64(n)
+	return n, nil
+}
+
+func (fd *snapshotFd) Write(b []byte) (int, error) {
+	return 0, vfs.ErrReadOnly
+}
+
+func (fd *snapshotFd) Seek(off int64, sp vfs.SeekPoint) (int64, error) {
+	cur := fd.cur
+	switch sp {
+	case vfs.SeekStart:
+		cur = off
+	case vfs.SeekCurrent:
+		cur += off
+	case vfs.SeekEnd:
+		cur = int64(len(fd.data)) - off
+	}
+	if cur < 0 {
+		return fd.cur, vfs.ErrSeek
+	}
+	fd.cur = cur
+	return cur, nil
+}
+
+func (fd *snapshotFd) Sync() error {
+	return nil
+}
+
+func (fd *snapshotFd) Close() error {
+	fd.data = nil
+	return nil
+}
@@ -0,0 +1,225 @@
+package synth
+
+import (
+	"9fans.net/go/plan9"
+	"amoraes.info/ded/vfs"
+	"amoraes.info/ded/vfs/filetree"
+	"amoraes.info/ded/vfs/fstest"
+	"amoraes.info/ded/vfs/memlistener"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// serve exports files over a memlistener and returns a connection
+// that already negotiated the version and attached fid 1
+func serve(t *testing.T, files ...*vfs.File) net.Conn {
+	l := memlistener.New("synth")
+	srv, err := vfs.NewServer(vfs.NewFileserver(filetree.New(vfs.NewDir("", files...))), l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { srv.Close() })
+	conn, err := memlistener.Connect(l, "client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	rpc(t, conn, &plan9.Fcall{Type: plan9.Tversion, Tag: plan9.NOTAG, Msize: 8192, Version: "9P2000"})
+	rpc(t, conn, &plan9.Fcall{Type: plan9.Tattach, Tag: 1, Fid: 1, Afid: plan9.NOFID, Uname: "glenda"})
+	return conn
+}
+
+// rpc sends tx and returns the reply
+func rpc(t *testing.T, conn net.Conn, tx *plan9.Fcall) *plan9.Fcall {
+	t.Helper()
+	if err := plan9.WriteFcall(conn, tx); err != nil {
+		t.Fatal(err)
+	}
+	rx, err := plan9.ReadFcall(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rx
+}
+
+// open walks from the attach fid to name and opens it as fid
+func open(t *testing.T, conn net.Conn, fid uint32, name string, mode uint8) {
+	t.Helper()
+	if rx := rpc(t, conn, &plan9.Fcall{Type: plan9.Twalk, Tag: 1, Fid: 1, Newfid: fid, Wname: []string{name}}); rx.Type != plan9.Rwalk {
+		t.Fatalf("walk %v: %v", name, rx)
+	}
+	if rx := rpc(t, conn, &plan9.Fcall{Type: plan9.Topen, Tag: 1, Fid: fid, Mode: mode}); rx.Type != plan9.Ropen {
+		t.Fatalf("open %v: %v", name, rx)
+	}
+}
+
+func TestCtl(t *testing.T) {
+	ctl := NewCtl()
+	var got []string
+	ctl.Handle("name", func(args []string) error {
+		got = append(got, args...)
+		return nil
+	})
+	ctl.Handle("fail", func(args []string) error {
+		return errors.New("failed")
+	})
+	conn := serve(t, vfs.NewFile("ctl", ctl))
+	open(t, conn, 2, "ctl", plan9.ORDWR)
+
+	if rx := rpc(t, conn, &plan9.Fcall{Type: plan9.Twrite, Tag: 1, Fid: 2, Data: []byte("name 'a b'\n\nname c\n")}); rx.Type != plan9.Rwrite {
+		t.Errorf("Unexpected reply %v", rx)
+	}
+	if fmt.Sprint(got) != "[a b c]" {
+		t.Errorf("Unexpected arguments %q", got)
+	}
+	if rx := rpc(t, conn, &plan9.Fcall{Type: plan9.Twrite, Tag: 1, Fid: 2, Data: []byte("fail")}); rx.Type != plan9.Rerror || rx.Ename != "failed" {
+		t.Errorf("Handler error should be returned: %v", rx)
+	}
+	if rx := rpc(t, conn, &plan9.Fcall{Type: plan9.Twrite, Tag: 1, Fid: 2, Data: []byte("other")}); rx.Type != plan9.Rerror {
+		t.Errorf("Unknown commands should fail: %v", rx)
+	}
+	if rx := rpc(t, conn, &plan9.Fcall{Type: plan9.Tread, Tag: 1, Fid: 2, Count: 100}); string(rx.Data) != "fail\nname\n" {
+		t.Errorf("Read should list the commands: %v", rx)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	n := 0
+	snap := NewSnapshot(func() ([]byte, error) {
+		n++
+		return []byte(fmt.Sprintf("snapshot %v", n)), nil
+	})
+	conn := serve(t, vfs.NewFile("snap", snap))
+	open(t, conn, 2, "snap", plan9.OREAD)
+
+	reads := []struct {
+		offset uint64
+		expect string
+	}{{0, "snap"}, {4, "shot 1"}, {0, "snap"}, {9, "2"}}
+	for _, r := range reads {
+		rx := rpc(t, conn, &plan9.Fcall{Type: plan9.Tread, Tag: 1, Fid: 2, Offset: r.offset, Count: uint32(len(r.expect))})
+		if string(rx.Data) != r.expect {
+			t.Errorf("read at %v: expecting %q got %v", r.offset, r.expect, rx)
+		}
+	}
+}
+
+func TestQueue(t *testing.T) {
+	q := NewQueue(2)
+	q.Post([]byte("lost"))
+	conn := serve(t, vfs.NewFile("event", q))
+	open(t, conn, 2, "event", plan9.OREAD)
+	open(t, conn, 3, "event", plan9.OREAD)
+
+	// a read blocks until an event is posted
+	plan9.WriteFcall(conn, &plan9.Fcall{Type: plan9.Tread, Tag: 2, Fid: 2, Count: 100})
+	time.Sleep(10 * time.Millisecond)
+	q.Post([]byte("one\n"))
+	if rx, err := plan9.ReadFcall(conn); err != nil || string(rx.Data) != "one\n" {
+		t.Fatalf("Unexpected event %v / %v", rx, err)
+	}
+
+	// every reader has its own cursor, and slow readers lose
+	// the older events
+	q.Post([]byte("two\n"))
+	q.Post([]byte("three\n"))
+	if rx := rpc(t, conn, &plan9.Fcall{Type: plan9.Tread, Tag: 1, Fid: 2, Count: 100}); string(rx.Data) != "two\nthree\n" {
+		t.Errorf("Unexpected events %v", rx)
+	}
+	if rx := rpc(t, conn, &plan9.Fcall{Type: plan9.Tread, Tag: 1, Fid: 3, Count: 4}); string(rx.Data) != "two\n" {
+		t.Errorf("Unexpected events %v", rx)
+	}
+
+	// flush aborts a blocked read
+	plan9.WriteFcall(conn, &plan9.Fcall{Type: plan9.Tread, Tag: 2, Fid: 2, Count: 100})
+	time.Sleep(10 * time.Millisecond)
+	plan9.WriteFcall(conn, &plan9.Fcall{Type: plan9.Tflush, Tag: 3, Oldtag: 2})
+	if rx, err := plan9.ReadFcall(conn); err != nil || rx.Tag != 2 || rx.Type != plan9.Rerror {
+		t.Fatalf("Flushed read should fail %v / %v", rx, err)
+	}
+	if rx, err := plan9.ReadFcall(conn); err != nil || rx.Type != plan9.Rflush {
+		t.Fatalf("Expecting Rflush %v / %v", rx, err)
+	}
+
+	// closing the queue ends the pending reads
+	plan9.WriteFcall(conn, &plan9.Fcall{Type: plan9.Tread, Tag: 2, Fid: 2, Count: 100})
+	time.Sleep(10 * time.Millisecond)
+	q.Close()
+	if rx, err := plan9.ReadFcall(conn); err != nil || rx.Type != plan9.Rread || len(rx.Data) != 0 {
+		t.Fatalf("Expecting EOF %v / %v", rx, err)
+	}
+}
+
+func TestProtocol(t *testing.T) {
+	q := NewQueue(1)
+	defer q.Close()
+	root := vfs.NewDir("", vfs.NewFile("file", vfs.NewInMemory([]byte("data"))), vfs.NewFile("event", q))
+	fstest.Run(t, filetree.New(root), fstest.Config{
+		File:     "file",
+		Contents: []byte("data"),
+		Blocking: "event",
+	})
+}
+
+func TestLog(t *testing.T) {
+	l := NewLog(8, 0)
+	f := vfs.NewFile("log", l)
+	f.Mode = plan9.DMAPPEND | 0666
+	conn := serve(t, f)
+	open(t, conn, 2, "log", plan9.OWRITE)
+	open(t, conn, 3, "log", plan9.OREAD)
+	open(t, conn, 4, "log", plan9.OREAD)
+
+	// followers at the end wait for a write, the offset of
+	// the write is ignored
+	plan9.WriteFcall(conn, &plan9.Fcall{Type: plan9.Tread, Tag: 2, Fid: 3, Count: 100})
+	time.Sleep(10 * time.Millisecond)
+	if rx := rpc(t, conn, &plan9.Fcall{Type: plan9.Twrite, Tag: 1, Fid: 2, Offset: 100, Data: []byte("abc")}); rx.Type != plan9.Rwrite {
+		t.Fatalf("Unexpected reply %v", rx)
+	}
+	if rx, err := plan9.ReadFcall(conn); err != nil || rx.Tag != 2 || string(rx.Data) != "abc" {
+		t.Fatalf("Unexpected read %v / %v", rx, err)
+	}
+
+	// the oldest data is dropped after maxSize bytes
+	rpc(t, conn, &plan9.Fcall{Type: plan9.Twrite, Tag: 1, Fid: 2, Data: []byte("defghi")})
+	if rx := rpc(t, conn, &plan9.Fcall{Type: plan9.Tread, Tag: 1, Fid: 4, Count: 100}); string(rx.Data) != "bcdefghi" {
+		t.Errorf("Unexpected read %v", rx)
+	}
+	if rx := rpc(t, conn, &plan9.Fcall{Type: plan9.Tread, Tag: 1, Fid: 3, Count: 3}); string(rx.Data) != "def" {
+		t.Errorf("Unexpected read %v", rx)
+	}
+
+	plan9.WriteFcall(conn, &plan9.Fcall{Type: plan9.Tread, Tag: 2, Fid: 4, Count: 100})
+	time.Sleep(10 * time.Millisecond)
+	plan9.WriteFcall(conn, &plan9.Fcall{Type: plan9.Tflush, Tag: 3, Oldtag: 2})
+	if rx, err := plan9.ReadFcall(conn); err != nil || rx.Tag != 2 || rx.Type != plan9.Rerror {
+		t.Fatalf("Flushed read should fail %v / %v", rx, err)
+	}
+	if rx, err := plan9.ReadFcall(conn); err != nil || rx.Type != plan9.Rflush {
+		t.Fatalf("Expecting Rflush %v / %v", rx, err)
+	}
+}
+
+func TestLogAge(t *testing.T) {
+	l := NewLog(0, 20*time.Millisecond)
+	l.Append([]byte("old"))
+	time.Sleep(30 * time.Millisecond)
+	l.Append([]byte("new"))
+	fd, _ := l.Open(plan9.OREAD, 0)
+	buf := make([]byte, 10)
+	if n, err := fd.Read(buf); err != nil || string(buf[:n]) != "new" {
+		t.Errorf("Unexpected read %q / %v", buf[:n], err)
+	}
+	l.Close()
+	if _, err := fd.Read(buf); err != io.EOF {
+		t.Errorf("Read of a closed log should return EOF: %v", err)
+	}
+	if _, err := fd.Write(buf); err != ErrLogClosed {
+		t.Errorf("Write to a closed log should fail: %v", err)
+	}
+}
@@ -0,0 +1,121 @@
+package vfs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+)
+
+type (
+	// TLSConfig describes the certificates used to protect 9P connections.
+	//
+	// The same description is used by servers and clients, servers
+	// require CertFile and KeyFile while clients only need them when
+	// the server verifies client certificates.
+	TLSConfig struct {
+		CertFile string
+		KeyFile  string
+
+		// CAFile pins the certificate authority used to verify the
+		// other side of the connection. When empty the system pool is used.
+		CAFile string
+
+		// VerifyClients makes the server require a client certificate
+		// signed by CAFile. The certificate CommonName is used as the
+		// 9P uname of the connection.
+		VerifyClients bool
+
+		// ServerName is used by clients to verify the server certificate,
+		// when empty the host part of the dialed address is used.
+		ServerName string
+	}
+)
+
+// TLSFlags register the flags used to configure TLS on fs and returns
+// the TLSConfig that will hold the parsed values.
+func TLSFlags(fs *flag.FlagSet) *TLSConfig {
+	cfg := &TLSConfig{}
+	fs.StringVar(&cfg.CertFile, "tlscert", "", "TLS certificate file (enables TLS)")
+	fs.StringVar(&cfg.KeyFile, "tlskey", "", "TLS private key file")
+	fs.StringVar(&cfg.CAFile, "tlsca", "", "TLS CA file used to verify the other side of the connection")
+	fs.BoolVar(&cfg.VerifyClients, "tlsverify", false, "Require client certificates signed by -tlsca")
+	fs.StringVar(&cfg.ServerName, "tlsname", "", "Name expected in the server certificate, by default the host of the dialed address")
+	return cfg
+}
+
+// Enabled returns true if any TLS option was configured
+func (c *TLSConfig) Enabled() bool {
+	return c != nil && (c.CertFile != "" || c.KeyFile != "" || c.CAFile != "")
+}
+
+// Server returns the tls.Config that should be used by NewTLSServer
+func (c *TLSConfig) Server() (*tls.Config, error) {
+	if c.CertFile == "" || c.KeyFile == "" {
+		return nil, errors.New("tls server requires a certificate and a key")
+	}
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}
+	if c.VerifyClients {
+		if c.CAFile == "" {
+			return nil, errors.New("client verification requires a CA file")
+		}
+		cfg.ClientCAs, err = loadCertPool(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+// Client returns the tls.Config that should be used by Dial
+func (c *TLSConfig) Client() (*tls.Config, error) {
+	cfg := &tls.Config{
+		ServerName: c.ServerName,
+	}
+	if c.CertFile != "" || c.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	if c.CAFile != "" {
+		var err error
+		cfg.RootCAs, err = loadCertPool(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return cfg, nil
+}
+
+func loadCertPool(file string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificate found at %v", file)
+	}
+	return pool, nil
+}
+
+// peerName returns the CommonName of the certificate presented by the
+// client, or an empty string if the client didn't present one.
+func peerName(conn *tls.Conn) string {
+	state := conn.ConnectionState()
+	if len(state.PeerCertificates) == 0 {
+		return ""
+	}
+	return state.PeerCertificates[0].Subject.CommonName
+}
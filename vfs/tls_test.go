@@ -0,0 +1,150 @@
+package vfs
+
+import (
+	"9fans.net/go/plan9"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"flag"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type (
+	attachRecorder struct {
+		unames chan string
+	}
+)
+
+func (ar *attachRecorder) Call(fc *plan9.Fcall, ctx *Context) *plan9.Fcall {
+	ret := *fc
+	ret.Type++
+	switch fc.Type {
+	case plan9.Tversion:
+		ret.Msize = 8 * 1024
+		ret.Version = "9P2000"
+	case plan9.Tattach:
+		ar.unames <- fc.Uname
+	}
+	return &ret
+}
+
+func (ar *attachRecorder) ReleaseContext(ctx *Context) error {
+	return nil
+}
+
+func writeCert(t *testing.T, dir, name string, tmpl, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating key: %v", err)
+	}
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatalf("Error creating certificate: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	ioutil.WriteFile(filepath.Join(dir, name+".crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	ioutil.WriteFile(filepath.Join(dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return cert, key
+}
+
+func certTemplate(serial int64, cn string, ca bool) *x509.Certificate {
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		BasicConstraintsValid: true,
+		IsCA:                  ca,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+	}
+	if !ca {
+		tmpl.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+	}
+	return tmpl
+}
+
+func TestTLSClientCertificateUname(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vfs-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca, caKey := writeCert(t, dir, "ca", certTemplate(1, "ca", true), nil, nil)
+	writeCert(t, dir, "server", certTemplate(2, "server", false), ca, caKey)
+	writeCert(t, dir, "client", certTemplate(3, "glenda", false), ca, caKey)
+
+	srvConfig, err := (&TLSConfig{
+		CertFile:      filepath.Join(dir, "server.crt"),
+		KeyFile:       filepath.Join(dir, "server.key"),
+		CAFile:        filepath.Join(dir, "ca.crt"),
+		VerifyClients: true,
+	}).Server()
+	if err != nil {
+		t.Fatalf("Invalid server config: %v", err)
+	}
+
+	rpc := &attachRecorder{unames: make(chan string, 1)}
+	srv, err := NewTLSServer(rpc, "127.0.0.1:0", srvConfig)
+	if err != nil {
+		t.Fatalf("Unable to start server: %v", err)
+	}
+	defer srv.Close()
+
+	cliConfig, err := (&TLSConfig{
+		CertFile: filepath.Join(dir, "client.crt"),
+		KeyFile:  filepath.Join(dir, "client.key"),
+		CAFile:   filepath.Join(dir, "ca.crt"),
+	}).Client()
+	if err != nil {
+		t.Fatalf("Invalid client config: %v", err)
+	}
+
+	cli, err := Connect(srv.listener.Addr().String(), cliConfig)
+	if err != nil {
+		t.Fatalf("Unable to connect: %v", err)
+	}
+	defer cli.Close()
+	if _, err := cli.Attach(nil, "someoneelse", ""); err != nil {
+		t.Fatalf("Unable to attach: %v", err)
+	}
+	if uname := <-rpc.unames; uname != "glenda" {
+		t.Errorf("Uname should come from the certificate, got %v", uname)
+	}
+
+	// without a client certificate the handshake must fail
+	cliConfig.Certificates = nil
+	if cli, err := Connect(srv.listener.Addr().String(), cliConfig); err == nil {
+		cli.Close()
+		t.Errorf("Connection without client certificate should fail")
+	}
+}
+
+func TestTLSFlags(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	cfg := TLSFlags(fs)
+	if err := fs.Parse([]string{"-tlsname", "srv.local"}); err != nil {
+		t.Fatal(err)
+	}
+	client, err := cfg.Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.ServerName != "srv.local" {
+		t.Errorf("Unexpected server name %q", client.ServerName)
+	}
+}
@@ -0,0 +1,394 @@
+package vfs
+
+import (
+	"9fans.net/go/plan9"
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A transcript is a text file with one event per line:
+//
+//	<time> <conn> + <remote address>
+//	<time> <conn> > <hex encoded T-message> [description]
+//	<time> <conn> < <hex encoded R-message> [description]
+//	<time> <conn> -
+//
+// time uses RFC3339 with nanoseconds, conn is the id of the connection
+// and the description is fc.String(), it is ignored when the
+// transcript is read. Lines starting with # are comments.
+
+type (
+	// Recorder writes the messages handled by a Server to a transcript
+	Recorder struct {
+		sync.Mutex
+		w      io.Writer
+		nextID uint64
+		failed bool
+	}
+
+	// EventKind identifies the lines of a transcript
+	EventKind byte
+
+	// Event is a line of a transcript
+	Event struct {
+		Line int
+		Time time.Time
+		Conn uint64
+		Kind EventKind
+		// Remote is the address of the client, only valid for EventConnect
+		Remote string
+		// Fcall is the message, only valid for EventRequest and EventReply
+		Fcall *plan9.Fcall
+	}
+
+	// Replay feeds the requests of a transcript to FS and compares the
+	// replies with the recorded ones.
+	Replay struct {
+		FS RPC
+		// Equal compares the recorded reply with the one returned by FS,
+		// when nil the encoded messages must be identical.
+		Equal func(want, got *plan9.Fcall) bool
+	}
+
+	// Mismatch is a reply that differs from the recorded one
+	Mismatch struct {
+		Line    int
+		Conn    uint64
+		Request *plan9.Fcall
+		Want    *plan9.Fcall
+		Got     *plan9.Fcall
+	}
+
+	replayConn struct {
+		ctx     *Context
+		pending map[uint16]*replayCall
+		// running counts the requests not answered yet
+		running sync.WaitGroup
+	}
+
+	replayCall struct {
+		req   *plan9.Fcall
+		reply *plan9.Fcall
+		// done is closed when reply is set
+		done chan struct{}
+	}
+)
+
+const (
+	EventConnect    = EventKind('+')
+	EventDisconnect = EventKind('-')
+	EventRequest    = EventKind('>')
+	EventReply      = EventKind('<')
+
+	transcriptHeader = "# 9P2000 transcript v1"
+	// maxTranscriptLine fits a hex encoded message of 1MB and its description
+	maxTranscriptLine = 4 * 1024 * 1024
+)
+
+// NewRecorder returns a recorder that writes a transcript to w
+func NewRecorder(w io.Writer) *Recorder {
+	return &Recorder{w: w}
+}
+
+// newConn writes the connection event and returns the connection id
+func (r *Recorder) newConn(remote string) uint64 {
+	r.Lock()
+	defer r.Unlock()
+	if r.nextID == 0 {
+		r.write(transcriptHeader + "\n")
+	}
+	r.nextID++
+	r.writeEvent(r.nextID, EventConnect, remote)
+	return r.nextID
+}
+
+func (r *Recorder) endConn(id uint64) {
+	r.Lock()
+	defer r.Unlock()
+	r.writeEvent(id, EventDisconnect, "")
+}
+
+// message writes fc, kind must be EventRequest or EventReply
+func (r *Recorder) message(id uint64, kind EventKind, fc *plan9.Fcall) {
+	buf, err := fc.Bytes()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"module": "vfs.Recorder",
+			"fcall":  fc.String(),
+			"err":    err,
+		}).Errorf("Unable to encode message")
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+	r.writeEvent(id, kind, hex.EncodeToString(buf)+" "+fc.String())
+}
+
+func (r *Recorder) writeEvent(id uint64, kind EventKind, rest string) {
+	line := fmt.Sprintf("%v %v %c", time.Now().UTC().Format(time.RFC3339Nano), id, kind)
+	if rest != "" {
+		// descriptions can't break the line
+		line += " " + strings.Replace(rest, "\n", "\\n", -1)
+	}
+	r.write(line + "\n")
+}
+
+func (r *Recorder) write(s string) {
+	_, err := io.WriteString(r.w, s)
+	if err != nil && !r.failed {
+		// report only the first error
+		r.failed = true
+		log.WithFields(log.Fields{
+			"module": "vfs.Recorder",
+			"err":    err,
+		}).Errorf("Unable to write transcript")
+	}
+}
+
+// ReadTranscript parses all the events of a transcript
+func ReadTranscript(in io.Reader) ([]Event, error) {
+	var events []Event
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(nil, maxTranscriptLine)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		ev, err := parseEvent(text)
+		if err != nil {
+			return nil, fmt.Errorf("line %v: %v", line, err)
+		}
+		ev.Line = line
+		events = append(events, ev)
+	}
+	return events, scanner.Err()
+}
+
+func parseEvent(text string) (ev Event, err error) {
+	fields := strings.SplitN(text, " ", 5)
+	if len(fields) < 3 || len(fields[2]) != 1 {
+		return ev, fmt.Errorf("malformed event %q", text)
+	}
+	if ev.Time, err = time.Parse(time.RFC3339Nano, fields[0]); err != nil {
+		return ev, err
+	}
+	if ev.Conn, err = strconv.ParseUint(fields[1], 10, 64); err != nil {
+		return ev, err
+	}
+	ev.Kind = EventKind(fields[2][0])
+	switch ev.Kind {
+	case EventConnect:
+		ev.Remote = strings.Join(fields[3:], " ")
+	case EventDisconnect:
+	case EventRequest, EventReply:
+		if len(fields) < 4 {
+			return ev, fmt.Errorf("missing message in %q", text)
+		}
+		buf, err := hex.DecodeString(fields[3])
+		if err != nil {
+			return ev, err
+		}
+		if ev.Fcall, err = plan9.UnmarshalFcall(buf); err != nil {
+			return ev, err
+		}
+	default:
+		return ev, fmt.Errorf("unknown event %q", fields[2])
+	}
+	return ev, nil
+}
+
+// Run replays the transcript read from in. Like in the server every
+// request runs on its own goroutine and a Tflush cancels the request
+// it flushes, the replies are compared in the order they were sent.
+func (r *Replay) Run(in io.Reader) ([]Mismatch, error) {
+	events, err := ReadTranscript(in)
+	if err != nil {
+		return nil, err
+	}
+	equal := r.Equal
+	if equal == nil {
+		equal = sameBytes
+	}
+	conns := make(map[uint64]*replayConn)
+	getConn := func(id uint64) *replayConn {
+		c, ok := conns[id]
+		if !ok {
+			// transcripts might start after the connection
+			c = &replayConn{ctx: NewContext(), pending: make(map[uint16]*replayCall)}
+			conns[id] = c
+		}
+		return c
+	}
+
+	var mismatches []Mismatch
+	for _, ev := range events {
+		switch ev.Kind {
+		case EventConnect:
+			getConn(ev.Conn)
+		case EventDisconnect:
+			r.release(getConn(ev.Conn))
+			delete(conns, ev.Conn)
+		case EventRequest:
+			c := getConn(ev.Conn)
+			c.pending[ev.Fcall.Tag] = r.start(c, ev.Fcall)
+		case EventReply:
+			c := getConn(ev.Conn)
+			call, ok := c.pending[ev.Fcall.Tag]
+			if !ok {
+				for _, c := range conns {
+					r.release(c)
+				}
+				return mismatches, fmt.Errorf("line %v: reply without request: %v", ev.Line, ev.Fcall)
+			}
+			delete(c.pending, ev.Fcall.Tag)
+			<-call.done
+			if call.reply == nil || !equal(ev.Fcall, call.reply) {
+				mismatches = append(mismatches, Mismatch{
+					Line:    ev.Line,
+					Conn:    ev.Conn,
+					Request: call.req,
+					Want:    ev.Fcall,
+					Got:     call.reply,
+				})
+			}
+		}
+	}
+	for _, c := range conns {
+		r.release(c)
+	}
+	return mismatches, nil
+}
+
+// start sends fc to r.FS the way the server does
+func (r *Replay) start(c *replayConn, fc *plan9.Fcall) *replayCall {
+	call := &replayCall{req: fc, done: make(chan struct{})}
+	req := *fc
+	switch fc.Type {
+	case plan9.Tversion:
+		c.ctx.flushAll()
+		c.running.Wait()
+		call.reply = r.FS.Call(&req, c.ctx)
+		close(call.done)
+		return call
+	case plan9.Tflush:
+		flushed := c.ctx.flush(fc.Oldtag)
+		c.running.Add(1)
+		go func() {
+			defer c.running.Done()
+			<-flushed
+			call.reply = r.FS.Call(&req, c.ctx)
+			close(call.done)
+		}()
+		return call
+	}
+	ctx, done := c.ctx.request(fc.Tag)
+	c.running.Add(1)
+	go func() {
+		defer c.running.Done()
+		call.reply = r.FS.Call(&req, ctx)
+		done()
+		close(call.done)
+	}()
+	return call
+}
+
+// release aborts the requests of c and releases its fids
+func (r *Replay) release(c *replayConn) {
+	c.ctx.close()
+	c.running.Wait()
+	r.FS.ReleaseContext(c.ctx)
+}
+
+func sameBytes(want, got *plan9.Fcall) bool {
+	wb, err := want.Bytes()
+	if err != nil {
+		return false
+	}
+	gb, err := got.Bytes()
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(wb, gb)
+}
+
+// LooseEqual compares only the parts of the replies that don't depend
+// on where the tree is stored: qid paths, versions and stat
+// times are ignored.
+func LooseEqual(want, got *plan9.Fcall) bool {
+	if want.Type != got.Type || want.Tag != got.Tag {
+		return false
+	}
+	switch want.Type {
+	case plan9.Rerror:
+		return want.Ename == got.Ename
+	case plan9.Rversion:
+		return want.Version == got.Version && want.Msize == got.Msize
+	case plan9.Rattach, plan9.Ropen, plan9.Rcreate:
+		return want.Qid.Type == got.Qid.Type
+	case plan9.Rwalk:
+		if len(want.Wqid) != len(got.Wqid) {
+			return false
+		}
+		for i := range want.Wqid {
+			if want.Wqid[i].Type != got.Wqid[i].Type {
+				return false
+			}
+		}
+	case plan9.Rread:
+		if bytes.Equal(want.Data, got.Data) {
+			return true
+		}
+		wd, wok := looseDirs(want.Data)
+		gd, gok := looseDirs(got.Data)
+		return wok && gok && strings.Join(wd, "\n") == strings.Join(gd, "\n")
+	case plan9.Rwrite:
+		return want.Count == got.Count
+	case plan9.Rstat:
+		wd, werr := plan9.UnmarshalDir(want.Stat)
+		gd, gerr := plan9.UnmarshalDir(got.Stat)
+		if werr != nil || gerr != nil {
+			return werr != nil && gerr != nil
+		}
+		return wd.Name == gd.Name && wd.Length == gd.Length && wd.Mode == gd.Mode
+	}
+	return true
+}
+
+// looseDirs describes the directory entries in buf without the fields
+// ignored by LooseEqual, ok is false if buf isn't a directory read.
+func looseDirs(buf []byte) (dirs []string, ok bool) {
+	if len(buf) == 0 {
+		return nil, false
+	}
+	for len(buf) > 0 {
+		if len(buf) < 2 {
+			return nil, false
+		}
+		n := int(buf[0]) | int(buf[1])<<8
+		if len(buf) < n+2 {
+			return nil, false
+		}
+		d, err := plan9.UnmarshalDir(buf[:n+2])
+		if err != nil {
+			return nil, false
+		}
+		dirs = append(dirs, fmt.Sprintf("%v %v %v", d.Name, d.Mode, d.Length))
+		buf = buf[n+2:]
+	}
+	return dirs, true
+}
+
+func (m Mismatch) String() string {
+	return fmt.Sprintf("line %v: conn %v: %v\n\twant: %v\n\tgot:  %v", m.Line, m.Conn, m.Request, m.Want, m.Got)
+}
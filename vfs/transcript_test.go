@@ -0,0 +1,225 @@
+package vfs_test
+
+import (
+	"9fans.net/go/plan9"
+	"9fans.net/go/plan9/client"
+	"amoraes.info/ded/ufs"
+	"amoraes.info/ded/vfs"
+	"amoraes.info/ded/vfs/memlistener"
+	"amoraes.info/ded/vfs/mixin"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type (
+	syncBuffer struct {
+		sync.Mutex
+		buf bytes.Buffer
+	}
+
+	// blockFS serves a single file whose reads wait until they
+	// are flushed
+	blockFS struct {
+		mixin.FS
+	}
+)
+
+func (sb *syncBuffer) Write(p []byte) (int, error) {
+	sb.Lock()
+	defer sb.Unlock()
+	return sb.buf.Write(p)
+}
+
+func (sb *syncBuffer) String() string {
+	sb.Lock()
+	defer sb.Unlock()
+	return sb.buf.String()
+}
+
+func (fs *blockFS) Walk(fc *plan9.Fcall, ctx *vfs.Context) *plan9.Fcall {
+	ret := *fc
+	ret.Type++
+	// only clones, the tree has no names
+	fs.SetFid(ctx, fc.Newfid, struct{}{})
+	return &ret
+}
+
+func (fs *blockFS) Open(fc *plan9.Fcall, ctx *vfs.Context) *plan9.Fcall {
+	ret := *fc
+	ret.Type++
+	return &ret
+}
+
+func (fs *blockFS) Read(fc *plan9.Fcall, ctx *vfs.Context) *plan9.Fcall {
+	ret := *fc
+	<-ctx.Done()
+	return vfs.PackError(&ret, ctx.Err())
+}
+
+func TestRecordReplay(t *testing.T) {
+	root, err := ioutil.TempDir("", "transcript")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	file := filepath.Join(root, "a.txt")
+	if err := ioutil.WriteFile(file, []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	l := memlistener.New("server")
+	srv, err := vfs.NewServer(vfs.NewFileserver(&ufs.Ufs{Root: root}), l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	transcript := &syncBuffer{}
+	srv.SetRecorder(vfs.NewRecorder(transcript))
+
+	conn, err := memlistener.Connect(l, "client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli, err := client.NewConn(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsys, err := cli.Attach(nil, "glenda", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fid, err := fsys.Open("a.txt", plan9.OREAD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadAll(fid); err != nil || string(data) != "hello" {
+		t.Fatalf("Unexpected read %q / %v", data, err)
+	}
+	if _, err := fid.Stat(); err != nil {
+		t.Fatal(err)
+	}
+	fid.Close()
+	conn.Close()
+
+	deadline := time.Now().Add(time.Second)
+	for !strings.HasSuffix(transcript.String(), " 1 -\n") {
+		if time.Now().After(deadline) {
+			t.Fatalf("Disconnect not recorded:\n%v", transcript)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	events, err := vfs.ReadTranscript(strings.NewReader(transcript.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := make(map[vfs.EventKind]int)
+	for _, ev := range events {
+		counts[ev.Kind]++
+	}
+	if counts[vfs.EventConnect] != 1 || counts[vfs.EventDisconnect] != 1 || counts[vfs.EventRequest] != counts[vfs.EventReply] {
+		t.Errorf("Unexpected events %v in:\n%v", counts, transcript)
+	}
+	if events[0].Kind != vfs.EventConnect || events[0].Remote != "client" {
+		t.Errorf("Transcript should start with the connection: %v", events[0])
+	}
+
+	replay := &vfs.Replay{FS: vfs.NewFileserver(&ufs.Ufs{Root: root})}
+	if mismatches, err := replay.Run(strings.NewReader(transcript.String())); err != nil {
+		t.Fatal(err)
+	} else if len(mismatches) != 0 {
+		t.Errorf("Replay of the same tree should match: %v", mismatches)
+	}
+
+	if err := ioutil.WriteFile(file, []byte("HELLO"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	replay.Equal = vfs.LooseEqual
+	mismatches, err := replay.Run(strings.NewReader(transcript.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mismatches) != 1 || mismatches[0].Want.Type != plan9.Rread {
+		t.Errorf("Replay should report only the changed read: %v", mismatches)
+	}
+}
+
+func TestReplayFlush(t *testing.T) {
+	l := memlistener.New("block")
+	srv, err := vfs.NewServer(vfs.NewFileserver(&blockFS{}), l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	transcript := &syncBuffer{}
+	srv.SetRecorder(vfs.NewRecorder(transcript))
+
+	conn, err := memlistener.Connect(l, "client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	send := func(fc *plan9.Fcall) {
+		t.Helper()
+		if err := plan9.WriteFcall(conn, fc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	recv := func() *plan9.Fcall {
+		t.Helper()
+		rx, err := plan9.ReadFcall(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rx
+	}
+	for _, fc := range []*plan9.Fcall{
+		{Type: plan9.Tversion, Tag: plan9.NOTAG, Msize: 8192, Version: "9P2000"},
+		{Type: plan9.Tattach, Tag: 1, Fid: 0, Afid: plan9.NOFID, Uname: "glenda"},
+		{Type: plan9.Twalk, Tag: 1, Fid: 0, Newfid: 2},
+		{Type: plan9.Topen, Tag: 1, Fid: 2, Mode: plan9.OREAD},
+	} {
+		send(fc)
+		if rx := recv(); rx.Type != fc.Type+1 {
+			t.Fatalf("Unexpected reply to %v: %v", fc, rx)
+		}
+	}
+	// the read waits until it is flushed
+	send(&plan9.Fcall{Type: plan9.Tread, Tag: 2, Fid: 2, Count: 100})
+	send(&plan9.Fcall{Type: plan9.Tflush, Tag: 3, Oldtag: 2})
+	for recv().Type != plan9.Rflush {
+	}
+	conn.Close()
+
+	deadline := time.Now().Add(time.Second)
+	for !strings.HasSuffix(transcript.String(), " 1 -\n") {
+		if time.Now().After(deadline) {
+			t.Fatalf("Disconnect not recorded:\n%v", transcript)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	replay := &vfs.Replay{FS: vfs.NewFileserver(&blockFS{}), Equal: vfs.LooseEqual}
+	type result struct {
+		mismatches []vfs.Mismatch
+		err        error
+	}
+	done := make(chan result, 1)
+	go func() {
+		mismatches, err := replay.Run(strings.NewReader(transcript.String()))
+		done <- result{mismatches, err}
+	}()
+	select {
+	case res := <-done:
+		if res.err != nil || len(res.mismatches) != 0 {
+			t.Errorf("Unexpected replay %v / %v", res.mismatches, res.err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("The flush of the read wasn't replayed")
+	}
+}